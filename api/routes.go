@@ -97,7 +97,7 @@ func ApplyPermissionAgent(logger *logrus.Logger, conf *foodme.Configuration, htt
 
 		oidcClient := foodme.NewOIDCClient(httpClient, cspec.ClientID, cspec.ClientSecret, conf.OIDCTokenURL, conf.OIDCUserInfoURL, at, rt)
 		if !oidcClient.IsAccessTokenValid() {
-			err = oidcClient.RefreshAccessToken()
+			err = oidcClient.RefreshAccessToken(r.Context())
 			if err != nil {
 				logger.WithFields(logrus.Fields{"component": "api"}).Errorf("[%p] %s", r, err)
 				HandleErrorResponse(logger, w, http.StatusUnauthorized, "Failed to refresh access token: "+err.Error())
@@ -105,7 +105,7 @@ func ApplyPermissionAgent(logger *logrus.Logger, conf *foodme.Configuration, htt
 			}
 		}
 
-		uinfo, err := oidcClient.GetUserInfo()
+		uinfo, err := oidcClient.GetUserInfo(r.Context())
 		if err != nil {
 			logger.WithFields(logrus.Fields{"component": "api"}).Errorf("[%p] %s", r, err)
 			HandleErrorResponse(logger, w, http.StatusUnauthorized, "Failed to get user info: "+err.Error())
@@ -127,14 +127,14 @@ func ApplyPermissionAgent(logger *logrus.Logger, conf *foodme.Configuration, htt
 			return
 		}
 
-		err = sqlHandler.SetDDL(uinfo)
+		err = sqlHandler.SetDDL(r.Context(), uinfo)
 		if err != nil {
 			logger.WithFields(logrus.Fields{"component": "api"}).Errorf("[%p] %s", r, err)
 			HandleErrorResponse(logger, w, http.StatusInternalServerError, "Failed to set DDL: "+err.Error())
 			return
 		}
 
-		newSQL, err := sqlHandler.Handle(data.SQL, uinfo)
+		newSQL, err := sqlHandler.Handle(r.Context(), data.SQL, uinfo)
 		if err != nil {
 			logger.WithFields(logrus.Fields{"component": "api"}).Errorf("[%p] %s", r, err)
 			HandleErrorResponse(logger, w, http.StatusInternalServerError, "Failed to handle SQL: "+err.Error())
@@ -149,3 +149,28 @@ func ApplyPermissionAgent(logger *logrus.Logger, conf *foodme.Configuration, htt
 		}
 	}
 }
+
+func Health(logger *logrus.Logger, checker *foodme.HealthChecker, readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.WithFields(logrus.Fields{"component": "api"}).Debugf("[%p] %s %s %s", r, r.Method, r.URL, r.RemoteAddr)
+
+		var report *foodme.HealthReport
+		if readiness {
+			report = checker.Readiness()
+		} else {
+			report = checker.Health()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if report.Status == foodme.HealthStatusOK {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			logger.WithFields(logrus.Fields{"component": "api"}).Warnf("[%p] Health checks failed: %+v", r, report.Checks)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"component": "api"}).Errorf("[%p] %s", r, err)
+		}
+	}
+}
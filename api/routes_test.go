@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	foodme "github.com/ryshoooo/food-me/internal"
@@ -337,3 +338,36 @@ func TestApplyPermissionAgent(t *testing.T) {
 	r = &http.Request{Body: &MockBody{Body: "{\"username\":\"test\", \"sql\":\"select * from pets p\"}"}}
 	handler(w, r)
 }
+
+func TestHealth(t *testing.T) {
+	log := logrus.StandardLogger()
+	conf := &foodme.Configuration{DestinationHost: "127.0.0.1", DestinationPort: 1, DestinationDatabaseType: "postgres", HealthCheckTimeout: 1}
+	checker := foodme.NewHealthChecker(conf, log)
+
+	// Unreachable destination
+	w := MockResponseWriter{buffer: &MockBuffer{buffer: []byte{}}, headers: &MockHeaders{headers: []int{}}}
+	r := &http.Request{}
+	Health(log, checker, false)(w, r)
+	assert.DeepEqual(t, w.headers.headers, []int{503})
+	report := &foodme.HealthReport{}
+	err := json.Unmarshal(w.buffer.buffer, report)
+	assert.NilError(t, err)
+	assert.Equal(t, report.Status, foodme.HealthStatusFailed)
+	assert.Equal(t, len(report.Checks), 1)
+	assert.Equal(t, report.Checks[0].Name, "destination")
+	assert.Equal(t, report.Checks[0].Status, foodme.HealthStatusFailed)
+
+	// Shutting down
+	checker.SetShuttingDown()
+	w = MockResponseWriter{buffer: &MockBuffer{buffer: []byte{}}, headers: &MockHeaders{headers: []int{}}}
+	Health(log, checker, true)(w, r)
+	assert.DeepEqual(t, w.headers.headers, []int{503})
+	assert.DeepEqual(t, w.buffer.buffer, []byte("{\"status\":\"failed\",\"checks\":[{\"name\":\"shutdown\",\"status\":\"failed\",\"error\":\"server is shutting down\",\"durationSeconds\":0}]}\n"))
+
+	recorder := httptest.NewRecorder()
+	Health(log, checker, true)(recorder, r)
+	assert.Equal(t, recorder.Header().Get("Content-Type"), "application/json")
+
+	w = MockResponseWriter{buffer: &MockBuffer{buffer: []byte{}}, headers: &MockHeaders{headers: []int{}}, failWrite: true}
+	Health(log, checker, true)(w, r)
+}
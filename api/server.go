@@ -1,10 +1,12 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	foodme "github.com/ryshoooo/food-me/internal"
 	"github.com/sirupsen/logrus"
 )
@@ -25,18 +27,30 @@ func StartCleaner(logger *logrus.Logger, period int) {
 	}()
 }
 
-func Start(logger *logrus.Logger, conf *foodme.Configuration) {
+func Start(logger *logrus.Logger, conf *foodme.Configuration, checker *foodme.HealthChecker, certificates *foodme.CertificateManager) *http.Server {
 	logger.WithFields(logrus.Fields{"component": "api"}).Infof("Starting the API")
 
 	StartCleaner(logger, conf.ApiGarbageCollectionPeriod)
-	server := http.NewServeMux()
+	mux := http.NewServeMux()
 	httpClient := &http.Client{}
-	server.HandleFunc("POST /connection", CreateNewConnection(logger, conf.ApiUsernameLifetime))
-	server.HandleFunc("POST /permissionapply", ApplyPermissionAgent(logger, conf, httpClient))
-	if conf.APITLSEnabled {
-		logger.Fatal(http.ListenAndServeTLS(fmt.Sprintf(":%v", conf.ApiPort), conf.ServerTLSCertificateFile, conf.ServerTLSCertificateKeyFile, server))
-	} else {
-		logger.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", conf.ApiPort), server))
-	}
+	mux.HandleFunc("POST /connection", CreateNewConnection(logger, conf.ApiUsernameLifetime))
+	mux.HandleFunc("POST /permissionapply", ApplyPermissionAgent(logger, conf, httpClient))
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", Health(logger, checker, false))
+	mux.HandleFunc("GET /readyz", Health(logger, checker, true))
 
+	server := &http.Server{Addr: fmt.Sprintf(":%v", conf.ApiPort), Handler: mux}
+	go func() {
+		var err error
+		if conf.APITLSEnabled {
+			server.TLSConfig = certificates.TLSConfig("h2", "http/1.1")
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatal(err)
+		}
+	}()
+	return server
 }
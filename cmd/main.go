@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ryshoooo/food-me/api"
 	foodme "github.com/ryshoooo/food-me/internal"
@@ -16,7 +20,68 @@ func main() {
 	}
 	logger := foodme.NewLogger(conf)
 
+	if conf.TracingEnabled {
+		provider, err := foodme.NewTracerProvider(conf)
+		if err != nil {
+			logger.Fatalf("Error setting up tracing: %v", err)
+		}
+		defer provider.Shutdown(context.Background())
+	}
+
+	upstream, err := foodme.GetUpstreamHandler(conf, logger)
+	if err != nil {
+		logger.Fatalf("Error setting up the destination: %v", err)
+	}
+
+	// The proxy and the API share the certificates
+	var certificates *foodme.CertificateManager
+	if conf.ServerTLSEnabled || conf.APITLSEnabled {
+		certificates, err = foodme.NewCertificateManager(conf, logger)
+		if err != nil {
+			logger.Fatalf("Error loading the TLS certificates: %v", err)
+		}
+		certificates.Start()
+		defer certificates.Close()
+	}
+
 	server := foodme.NewServer(conf, logger)
-	go api.Start(logger, conf)
-	logger.Fatal(server.Start())
+	server.Upstream = upstream
+	server.Certificates = certificates
+	checker := foodme.NewHealthChecker(conf, logger)
+	checker.Upstream = upstream
+	apiServer := api.Start(logger, conf, checker, certificates)
+
+	serverErr := make(chan error, 1)
+	go func() { serverErr <- server.Start() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serverErr:
+		logger.Fatal(err)
+	case sig := <-signals:
+		logger.Infof("Received %v, shutting down", sig)
+	}
+
+	// Readiness goes down first, the API keeps serving until the sessions are drained
+	checker.SetShuttingDown()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(conf.ServerShutdownTimeout)*time.Second)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != nil {
+		logger.Warnf("Sessions terminated before finishing: %v", err)
+	}
+	err = <-serverErr
+	if err != nil {
+		logger.Errorf("Error stopping the server: %v", err)
+	}
+
+	apiCtx, apiCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer apiCancel()
+	err = apiServer.Shutdown(apiCtx)
+	if err != nil {
+		logger.Errorf("Error stopping the API: %v", err)
+	}
+	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,294 @@
+package foodme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auxten/postgresql-parser/pkg/sql/parser"
+	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeError   = "error"
+	AuditOutcomeDenied  = "denied"
+)
+
+var literalPattern = regexp.MustCompile(`'(?:[^']|'')*'|\b\d+(?:\.\d+)?\b`)
+
+type PermissionDecision struct {
+	Table     string   `json:"table,omitempty"`
+	Operation string   `json:"operation"`
+	Allowed   bool     `json:"allowed"`
+	Filters   []string `json:"filters,omitempty"`
+}
+
+type AuditEvent struct {
+	Time          time.Time             `json:"time"`
+	Subject       string                `json:"subject,omitempty"`
+	Username      string                `json:"username,omitempty"`
+	Database      string                `json:"database,omitempty"`
+	ClientAddress string                `json:"clientAddress,omitempty"`
+	SQL           string                `json:"sql"`
+	RewrittenSQL  string                `json:"rewrittenSql,omitempty"`
+	Decisions     []*PermissionDecision `json:"decisions,omitempty"`
+	Outcome       string                `json:"outcome"`
+	Error         string                `json:"error,omitempty"`
+	CommandTag    string                `json:"commandTag,omitempty"`
+	Rows          int64                 `json:"rows"`
+}
+
+// Complete records the CommandComplete tag sent by the upstream for the statement.
+// Multi-statement queries complete several times, the rows are summed up.
+func (e *AuditEvent) Complete(tag string) {
+	e.CommandTag = tag
+	parts := strings.Split(tag, " ")
+	if len(parts) < 2 {
+		return
+	}
+	rows, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if err != nil {
+		return
+	}
+	e.Rows += rows
+}
+
+func (e *AuditEvent) Fail(outcome string, err error) {
+	e.Outcome = outcome
+	e.Error = err.Error()
+}
+
+type Auditor struct {
+	Sink           IAuditSink
+	RedactLiterals bool
+	Logger         *logrus.Logger
+}
+
+func NewAuditor(conf *Configuration, logger *logrus.Logger, httpClient IHttpClient) (*Auditor, error) {
+	var sink IAuditSink
+	var err error
+	switch conf.AuditSink {
+	case "file":
+		sink, err = NewFileAuditSink(conf.AuditFile)
+	case "syslog":
+		sink, err = NewSyslogAuditSink(conf.AuditSyslogNetwork, conf.AuditSyslogAddress, conf.AuditSyslogTag)
+	case "http":
+		sink = NewHTTPAuditSink(conf.AuditHTTPEndpoint, httpClient, time.Duration(conf.AuditHTTPTimeout)*time.Second, conf.AuditHTTPQueueSize, logger)
+	default:
+		return nil, fmt.Errorf("unknown audit sink: %s", conf.AuditSink)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit sink: %w", err)
+	}
+
+	return &Auditor{Sink: sink, RedactLiterals: conf.AuditRedactLiterals, Logger: logger}, nil
+}
+
+func (a *Auditor) Record(event *AuditEvent) {
+	if a.RedactLiterals {
+		event.SQL = redactLiterals(event.SQL)
+		event.RewrittenSQL = redactLiterals(event.RewrittenSQL)
+	}
+	if event.Outcome == "" {
+		event.Outcome = AuditOutcomeSuccess
+	}
+
+	err := a.Sink.Write(event)
+	if err != nil {
+		a.Logger.WithField("component", "audit").Errorf("Failed to write audit event: %v", err)
+	}
+}
+
+func (a *Auditor) Close() error {
+	return a.Sink.Close()
+}
+
+func redactLiterals(sql string) string {
+	if sql == "" {
+		return sql
+	}
+
+	statements, err := parser.Parse(sql)
+	if err != nil {
+		return literalPattern.ReplaceAllString(sql, "_")
+	}
+
+	redacted := make([]string, len(statements))
+	for idx, stmt := range statements {
+		redacted[idx] = tree.AsStringWithFlags(stmt.AST, tree.FmtHideConstants)
+	}
+	return strings.Join(redacted, "; ")
+}
+
+type FileAuditSink struct {
+	Path string
+
+	mutex sync.Mutex
+	file  io.WriteCloser
+}
+
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileAuditSink{Path: path, file: file}, nil
+}
+
+func (s *FileAuditSink) Write(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+type SyslogAuditSink struct {
+	writer io.WriteCloser
+}
+
+func NewSyslogAuditSink(network, address, tag string) (*SyslogAuditSink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+func (s *SyslogAuditSink) Write(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+	_, err = s.writer.Write(line)
+	return err
+}
+
+func (s *SyslogAuditSink) Close() error {
+	return s.writer.Close()
+}
+
+// HTTPAuditSink posts the events to the endpoint in the background, so that
+// a slow endpoint does not hold the sessions up. The events finding the queue
+// full and the events failing to be posted are dropped and counted.
+type HTTPAuditSink struct {
+	Endpoint string
+	Timeout  time.Duration
+
+	client IHttpClient
+	logger *logrus.Logger
+	mutex  sync.RWMutex
+	queue  chan *AuditEvent
+	done   chan struct{}
+	closed bool
+}
+
+func NewHTTPAuditSink(endpoint string, httpClient IHttpClient, timeout time.Duration, queueSize int, logger *logrus.Logger) *HTTPAuditSink {
+	s := &HTTPAuditSink{
+		Endpoint: endpoint,
+		Timeout:  timeout,
+		client:   httpClient,
+		logger:   logger,
+		queue:    make(chan *AuditEvent, queueSize),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *HTTPAuditSink) Write(event *AuditEvent) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return fmt.Errorf("audit sink is closed")
+	}
+
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		auditEventsDroppedTotal.WithLabelValues("queue_full").Inc()
+		return fmt.Errorf("audit queue is full, event dropped")
+	}
+}
+
+func (s *HTTPAuditSink) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		err := s.post(event)
+		if err != nil {
+			auditEventsDroppedTotal.WithLabelValues("failed").Inc()
+			s.logger.WithField("component", "audit").Errorf("Failed to post audit event: %v", err)
+		}
+	}
+}
+
+func (s *HTTPAuditSink) post(event *AuditEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close stops taking events and waits up to the timeout for the queued ones
+// to be posted.
+func (s *HTTPAuditSink) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mutex.Unlock()
+
+	timer := time.NewTimer(s.Timeout)
+	defer timer.Stop()
+	select {
+	case <-s.done:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("timed out posting the queued audit events")
+	}
+}
@@ -0,0 +1,227 @@
+package foodme
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+)
+
+type MockAuditSink struct {
+	FailWrite bool
+	Events    []*AuditEvent
+	Closed    bool
+}
+
+func (m *MockAuditSink) Write(event *AuditEvent) error {
+	if m.FailWrite {
+		return fmt.Errorf("write failed")
+	}
+	m.Events = append(m.Events, event)
+	return nil
+}
+
+func (m *MockAuditSink) Close() error {
+	m.Closed = true
+	return nil
+}
+
+func TestNewAuditor(t *testing.T) {
+	logger := logrus.StandardLogger()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	a, err := NewAuditor(&Configuration{AuditSink: "file", AuditFile: path, AuditRedactLiterals: true}, logger, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, a.RedactLiterals)
+	switch a.Sink.(type) {
+	case *FileAuditSink:
+		assert.Assert(t, true)
+	default:
+		t.Fatalf("unexpected sink type: %T", a.Sink)
+	}
+	assert.NilError(t, a.Close())
+
+	a, err = NewAuditor(&Configuration{AuditSink: "http", AuditHTTPEndpoint: "http://audit", AuditHTTPTimeout: 1, AuditHTTPQueueSize: 10}, logger, &MockHttpClient{})
+	assert.NilError(t, err)
+	switch a.Sink.(type) {
+	case *HTTPAuditSink:
+		assert.Assert(t, true)
+	default:
+		t.Fatalf("unexpected sink type: %T", a.Sink)
+	}
+
+	_, err = NewAuditor(&Configuration{AuditSink: "file", AuditFile: filepath.Join(t.TempDir(), "missing", "audit.jsonl")}, logger, nil)
+	assert.ErrorContains(t, err, "failed to create audit sink")
+
+	_, err = NewAuditor(&Configuration{AuditSink: "blah"}, logger, nil)
+	assert.Error(t, err, "unknown audit sink: blah")
+}
+
+func TestAuditorRecord(t *testing.T) {
+	logger := logrus.StandardLogger()
+	sink := &MockAuditSink{}
+	a := &Auditor{Sink: sink, Logger: logger}
+
+	a.Record(&AuditEvent{SQL: "select * from pets where name = 'bob'"})
+	assert.Equal(t, len(sink.Events), 1)
+	assert.Equal(t, sink.Events[0].SQL, "select * from pets where name = 'bob'")
+	assert.Equal(t, sink.Events[0].Outcome, AuditOutcomeSuccess)
+
+	a.RedactLiterals = true
+	a.Record(&AuditEvent{SQL: "select * from pets where name = 'bob'", RewrittenSQL: "SELECT * FROM pets WHERE (owner = 'alice') AND (name = 'bob')", Outcome: AuditOutcomeError})
+	assert.Equal(t, len(sink.Events), 2)
+	assert.Equal(t, sink.Events[1].SQL, "SELECT * FROM pets WHERE name = _")
+	assert.Equal(t, sink.Events[1].RewrittenSQL, "SELECT * FROM pets WHERE (owner = _) AND (name = _)")
+	assert.Equal(t, sink.Events[1].Outcome, AuditOutcomeError)
+
+	// Sink failures are only logged
+	sink.FailWrite = true
+	a.Record(&AuditEvent{SQL: "select 1"})
+	assert.Equal(t, len(sink.Events), 2)
+
+	assert.NilError(t, a.Close())
+	assert.Assert(t, sink.Closed)
+}
+
+func TestRedactLiterals(t *testing.T) {
+	assert.Equal(t, redactLiterals(""), "")
+	assert.Equal(t, redactLiterals("select 1; insert into pets values ('bob', 3)"), "SELECT _; INSERT INTO pets VALUES (_, _)")
+	assert.Equal(t, redactLiterals("selec * from pets where name = 'it''s' and age > 3.5 and t1 = 2"), "selec * from pets where name = _ and age > _ and t1 = _")
+}
+
+func TestAuditEventComplete(t *testing.T) {
+	e := &AuditEvent{}
+	e.Complete("BEGIN")
+	assert.Equal(t, e.CommandTag, "BEGIN")
+	assert.Equal(t, e.Rows, int64(0))
+
+	e.Complete("SELECT 5")
+	assert.Equal(t, e.CommandTag, "SELECT 5")
+	assert.Equal(t, e.Rows, int64(5))
+
+	e.Complete("INSERT 0 3")
+	assert.Equal(t, e.CommandTag, "INSERT 0 3")
+	assert.Equal(t, e.Rows, int64(8))
+
+	e.Complete("SET blah")
+	assert.Equal(t, e.Rows, int64(8))
+
+	e.Fail(AuditOutcomeDenied, fmt.Errorf("nope"))
+	assert.Equal(t, e.Outcome, AuditOutcomeDenied)
+	assert.Equal(t, e.Error, "nope")
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileAuditSink(path)
+	assert.NilError(t, err)
+
+	assert.NilError(t, sink.Write(&AuditEvent{SQL: "select 1", Outcome: AuditOutcomeSuccess, Rows: 1}))
+	assert.NilError(t, sink.Write(&AuditEvent{SQL: "select 2", Outcome: AuditOutcomeError, Error: "boom"}))
+	assert.NilError(t, sink.Close())
+
+	b, err := os.ReadFile(path)
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Equal(t, len(lines), 2)
+
+	event := &AuditEvent{}
+	assert.NilError(t, json.Unmarshal([]byte(lines[1]), event))
+	assert.Equal(t, event.SQL, "select 2")
+	assert.Equal(t, event.Outcome, AuditOutcomeError)
+	assert.Equal(t, event.Error, "boom")
+
+	// Closed file
+	assert.ErrorContains(t, sink.Write(&AuditEvent{SQL: "select 3"}), "file already closed")
+}
+
+// BlockingHttpClient holds the requests until they are released or their
+// context is done.
+type BlockingHttpClient struct {
+	Started chan struct{}
+	Release chan struct{}
+}
+
+func (m *BlockingHttpClient) Do(req *http.Request) (*http.Response, error) {
+	m.Started <- struct{}{}
+	select {
+	case <-m.Release:
+		return &http.Response{StatusCode: 204, Body: io.NopCloser(strings.NewReader(""))}, nil
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+func TestHTTPAuditSink(t *testing.T) {
+	httpClient := &MockHttpClient{DoSucceed: true, StatusCode: 204}
+	sink := NewHTTPAuditSink("http://audit", httpClient, time.Second, 10, logrus.StandardLogger())
+
+	// The events are posted in the background
+	err := sink.Write(&AuditEvent{SQL: "select 1", Username: "bob", Decisions: []*PermissionDecision{{Table: "pets", Operation: "select", Allowed: true}}})
+	assert.NilError(t, err)
+	assert.NilError(t, sink.Close())
+	assert.Equal(t, httpClient.RequestHeader.Get("Content-Type"), "application/json")
+	event := &AuditEvent{}
+	assert.NilError(t, json.Unmarshal([]byte(httpClient.RequestBody), event))
+	assert.Equal(t, event.Username, "bob")
+	assert.DeepEqual(t, event.Decisions, []*PermissionDecision{{Table: "pets", Operation: "select", Allowed: true}})
+	assert.Error(t, sink.Write(&AuditEvent{SQL: "select 1"}), "audit sink is closed")
+	assert.NilError(t, sink.Close())
+
+	httpClient.StatusCode = 500
+	err = sink.post(&AuditEvent{SQL: "select 1"})
+	assert.Error(t, err, "unexpected status code: 500")
+
+	httpClient.DoSucceed = false
+	err = sink.post(&AuditEvent{SQL: "select 1"})
+	assert.Error(t, err, "failed to execute request: failed to do request")
+
+	sink.Endpoint = "http://bad\x00url"
+	err = sink.post(&AuditEvent{SQL: "select 1"})
+	assert.ErrorContains(t, err, "failed to create http request")
+
+	// The failed events are counted as dropped
+	failed := testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("failed"))
+	sink = NewHTTPAuditSink("http://audit", httpClient, time.Second, 10, logrus.StandardLogger())
+	assert.NilError(t, sink.Write(&AuditEvent{SQL: "select 1"}))
+	assert.NilError(t, sink.Close())
+	assert.Equal(t, testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("failed")), failed+1)
+}
+
+func TestHTTPAuditSinkQueue(t *testing.T) {
+	httpClient := &BlockingHttpClient{Started: make(chan struct{}, 10), Release: make(chan struct{})}
+	sink := NewHTTPAuditSink("http://audit", httpClient, time.Second, 1, logrus.StandardLogger())
+
+	// The event being posted leaves room for one more
+	assert.NilError(t, sink.Write(&AuditEvent{SQL: "select 1"}))
+	<-httpClient.Started
+	assert.NilError(t, sink.Write(&AuditEvent{SQL: "select 2"}))
+
+	// The full queue drops the events
+	dropped := testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("queue_full"))
+	assert.Error(t, sink.Write(&AuditEvent{SQL: "select 3"}), "audit queue is full, event dropped")
+	assert.Equal(t, testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("queue_full")), dropped+1)
+
+	close(httpClient.Release)
+	assert.NilError(t, sink.Close())
+
+	// The requests time out
+	httpClient = &BlockingHttpClient{Started: make(chan struct{}, 10), Release: make(chan struct{})}
+	sink = NewHTTPAuditSink("http://audit", httpClient, 10*time.Millisecond, 10, logrus.StandardLogger())
+	assert.Error(t, sink.post(&AuditEvent{SQL: "select 1"}), "failed to execute request: context deadline exceeded")
+
+	// Closing waits for the queued events up to the timeout
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, sink.Write(&AuditEvent{SQL: "select 1"}))
+	}
+	assert.Error(t, sink.Close(), "timed out posting the queued audit events")
+}
@@ -0,0 +1,89 @@
+package foodme
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+
+	"github.com/ryshoooo/food-me/internal/pgwire"
+)
+
+// BackendKey identifies a backend process in the CancelRequest of a client.
+type BackendKey struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+// CancelTarget is the destination backend running the statements of a
+// session. The host name is kept for the verification of its certificate.
+type CancelTarget struct {
+	Address string
+	Host    string
+	Key     BackendKey
+}
+
+// CancelRegistry issues the backend keys of the sessions. The keys of the
+// destination backends mean nothing to the clients of a pool or of many
+// destinations, so the clients get the keys of the proxy instead.
+type CancelRegistry struct {
+	mutex    sync.Mutex
+	sessions map[BackendKey]func() *CancelTarget
+}
+
+func NewCancelRegistry() *CancelRegistry {
+	return &CancelRegistry{sessions: make(map[BackendKey]func() *CancelTarget)}
+}
+
+// Register issues a random key for the session. The target is resolved only
+// once the client cancels, as the pooled sessions move between backends.
+func (r *CancelRegistry) Register(target func() *CancelTarget) BackendKey {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for {
+		buf := make([]byte, 8)
+		_, _ = rand.Read(buf)
+		key := BackendKey{ProcessID: binary.BigEndian.Uint32(buf[:4]), SecretKey: binary.BigEndian.Uint32(buf[4:])}
+		if _, ok := r.sessions[key]; !ok {
+			r.sessions[key] = target
+			return key
+		}
+	}
+}
+
+func (r *CancelRegistry) Unregister(key BackendKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.sessions, key)
+}
+
+// Target returns the backend of the session the key was issued for, nil when
+// the key is unknown or the session has no backend at the moment.
+func (r *CancelRegistry) Target(key BackendKey) *CancelTarget {
+	r.mutex.Lock()
+	target, ok := r.sessions[key]
+	r.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return target()
+}
+
+// parseBackendKey reads the key of a BackendKeyData message.
+func parseBackendKey(body []byte) (BackendKey, bool) {
+	msg := &pgwire.BackendKeyData{}
+	if msg.Decode(body) != nil {
+		return BackendKey{}, false
+	}
+	return BackendKey{ProcessID: msg.ProcessID, SecretKey: msg.SecretKey}, true
+}
+
+// backendKeyData is the BackendKeyData message of the key.
+func (k BackendKey) backendKeyData() []byte {
+	return pgwire.Encode(&pgwire.BackendKeyData{ProcessID: k.ProcessID, SecretKey: k.SecretKey})
+}
+
+// cancelRequest is the CancelRequest packet of the key.
+func (k BackendKey) cancelRequest() []byte {
+	return pgwire.Encode(&pgwire.CancelRequest{ProcessID: k.ProcessID, SecretKey: k.SecretKey})
+}
@@ -0,0 +1,40 @@
+package foodme
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCancelRegistry(t *testing.T) {
+	r := NewCancelRegistry()
+	target := &CancelTarget{Address: "127.0.0.1:5432", Host: "db", Key: BackendKey{ProcessID: 1, SecretKey: 2}}
+	var current *CancelTarget
+	key := r.Register(func() *CancelTarget { return current })
+	other := r.Register(func() *CancelTarget { return target })
+	assert.Assert(t, key != other)
+
+	// The session has no backend at the moment
+	assert.Assert(t, r.Target(key) == nil)
+	current = target
+	assert.Equal(t, r.Target(key), target)
+	assert.Equal(t, r.Target(other), target)
+
+	// Unknown keys
+	assert.Assert(t, r.Target(BackendKey{ProcessID: key.ProcessID, SecretKey: key.SecretKey + 1}) == nil)
+	r.Unregister(key)
+	assert.Assert(t, r.Target(key) == nil)
+}
+
+func TestBackendKeyMessages(t *testing.T) {
+	key := BackendKey{ProcessID: 0x01020304, SecretKey: 0x05060708}
+	assert.DeepEqual(t, key.backendKeyData(), []byte{'K', 0, 0, 0, 12, 1, 2, 3, 4, 5, 6, 7, 8})
+	assert.DeepEqual(t, key.cancelRequest(), []byte{0, 0, 0, 16, 4, 210, 22, 46, 1, 2, 3, 4, 5, 6, 7, 8})
+
+	parsed, ok := parseBackendKey(key.backendKeyData()[5:])
+	assert.Assert(t, ok)
+	assert.Equal(t, parsed, key)
+	_, ok = parseBackendKey([]byte{1, 2, 3})
+	assert.Assert(t, !ok)
+
+}
@@ -0,0 +1,221 @@
+package foodme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	TLSClientAuthNone    = "none"
+	TLSClientAuthRequest = "request"
+	TLSClientAuthRequire = "require"
+)
+
+// CertificateManager serves the TLS certificates of the proxy and the API.
+// The files are checked periodically, so the renewed certificates are picked
+// up without a restart.
+type CertificateManager struct {
+	Certificates []*CertificateSpec
+	ClientCAFile string
+	ClientAuth   tls.ClientAuthType
+	ReloadPeriod time.Duration
+	Logger       *logrus.Logger
+
+	current  atomic.Pointer[certificateSet]
+	stamp    string
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  sync.WaitGroup
+}
+
+// certificateSet is a single load of the files. The first certificate is the
+// default one for the clients without a matching SNI.
+type certificateSet struct {
+	fallback  *tls.Certificate
+	names     map[string]*tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func NewCertificateManager(conf *Configuration, logger *logrus.Logger) (*CertificateManager, error) {
+	m := &CertificateManager{
+		Certificates: conf.ServerTLSCertificates,
+		ClientCAFile: conf.ServerTLSClientCAFile,
+		ClientAuth:   clientAuthType(conf.ServerTLSClientAuth),
+		ReloadPeriod: time.Duration(conf.ServerTLSReloadPeriod) * time.Second,
+		Logger:       logger,
+		stop:         make(chan struct{}),
+	}
+
+	m.stamp = m.fileStamp()
+	err := m.Load()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func clientAuthType(mode string) tls.ClientAuthType {
+	switch mode {
+	case TLSClientAuthRequest:
+		return tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// Load reads all the files, the served certificates are replaced only when
+// every one of them is valid.
+func (m *CertificateManager) Load() error {
+	set := &certificateSet{names: make(map[string]*tls.Certificate)}
+	for _, spec := range m.Certificates {
+		cert, err := tls.LoadX509KeyPair(spec.CertificateFile, spec.CertificateKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate %s: %w", spec.CertificateFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS certificate %s: %w", spec.CertificateFile, err)
+		}
+		cert.Leaf = leaf
+
+		if set.fallback == nil {
+			set.fallback = &cert
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := set.names[name]; !ok {
+				set.names[name] = &cert
+			}
+		}
+	}
+
+	if m.ClientCAFile != "" {
+		data, err := os.ReadFile(m.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS client CA file: %w", err)
+		}
+		set.clientCAs = x509.NewCertPool()
+		if !set.clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in TLS client CA file: %s", m.ClientCAFile)
+		}
+	}
+
+	m.current.Store(set)
+	return nil
+}
+
+// Start checks the files for changes in the background until the manager is
+// closed.
+func (m *CertificateManager) Start() {
+	m.stopped.Add(1)
+	go func() {
+		defer m.stopped.Done()
+		ticker := time.NewTicker(m.ReloadPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.reloadChanged()
+			}
+		}
+	}()
+}
+
+func (m *CertificateManager) Close() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	m.stopped.Wait()
+	return nil
+}
+
+// reloadChanged loads the files again once any of them changed. A failed
+// load keeps the previous certificates and is retried with the next check,
+// the renewal may have been caught half-written.
+func (m *CertificateManager) reloadChanged() {
+	stamp := m.fileStamp()
+	if stamp == m.stamp {
+		return
+	}
+
+	err := m.Load()
+	if err != nil {
+		m.Logger.WithField("component", "certificates").Warnf("Failed to reload the TLS certificates, keeping the previous ones: %v", err)
+		return
+	}
+	m.stamp = stamp
+	m.Logger.WithField("component", "certificates").Info("Reloaded the TLS certificates")
+}
+
+func (m *CertificateManager) fileStamp() string {
+	files := []string{m.ClientCAFile}
+	for _, spec := range m.Certificates {
+		files = append(files, spec.CertificateFile, spec.CertificateKeyFile)
+	}
+	return fileStamp(files...)
+}
+
+// fileStamp summarizes the modification times and the sizes of the files,
+// the symbolic links are followed as the mounted secrets are swapped by them.
+func fileStamp(files ...string) string {
+	var stamp strings.Builder
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			fmt.Fprintf(&stamp, "%s:missing;", file)
+			continue
+		}
+		fmt.Fprintf(&stamp, "%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp.String()
+}
+
+// GetCertificate picks the certificate matching the SNI of the client, the
+// wildcard certificates cover a single label.
+func (m *CertificateManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := m.current.Load()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := set.names[name]; ok {
+		return cert, nil
+	}
+	if idx := strings.Index(name, "."); idx > 0 {
+		if cert, ok := set.names["*"+name[idx:]]; ok {
+			return cert, nil
+		}
+	}
+	return set.fallback, nil
+}
+
+// TLSConfig builds the server configuration offering the ALPN protocols, every
+// handshake uses the certificates loaded at that moment.
+func (m *CertificateManager) TLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				GetCertificate: m.GetCertificate,
+				NextProtos:     nextProtos,
+				ClientAuth:     m.ClientAuth,
+				ClientCAs:      m.current.Load().clientCAs,
+			}, nil
+		},
+	}
+}
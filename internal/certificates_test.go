@@ -0,0 +1,175 @@
+package foodme
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+)
+
+func newTestCertificateManager(t *testing.T, conf *Configuration) *CertificateManager {
+	if conf.ServerTLSReloadPeriod == 0 {
+		conf.ServerTLSReloadPeriod = 1
+	}
+	m, err := NewCertificateManager(conf, logrus.StandardLogger())
+	assert.NilError(t, err)
+	return m
+}
+
+func servedCertificateName(t *testing.T, m *CertificateManager, serverName string) string {
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	assert.NilError(t, err)
+	return cert.Leaf.Subject.CommonName
+}
+
+// replaceTestCertificate moves the files of the new certificate in place of
+// the old ones, the way a renewal does.
+func replaceTestCertificate(t *testing.T, old *testCertificate, renewed *testCertificate) {
+	for src, dst := range map[string]string{renewed.certFile: old.certFile, renewed.keyFile: old.keyFile} {
+		data, err := os.ReadFile(src)
+		assert.NilError(t, err)
+		assert.NilError(t, os.WriteFile(dst, data, 0600))
+		future := time.Now().Add(time.Minute)
+		assert.NilError(t, os.Chtimes(dst, future, future))
+	}
+}
+
+func TestCertificateManagerSNI(t *testing.T) {
+	ca := newTestCertificate(t, "ca", "", nil)
+	main := newTestCertificate(t, "main", "db.example.com", ca)
+	tenants := newTestCertificate(t, "tenants", "*.tenants.example.com", ca)
+
+	m := newTestCertificateManager(t, &Configuration{ServerTLSCertificates: []*CertificateSpec{
+		{CertificateFile: main.certFile, CertificateKeyFile: main.keyFile},
+		{CertificateFile: tenants.certFile, CertificateKeyFile: tenants.keyFile},
+	}})
+
+	assert.Equal(t, servedCertificateName(t, m, "db.example.com"), "main")
+	assert.Equal(t, servedCertificateName(t, m, "DB.example.com."), "main")
+	assert.Equal(t, servedCertificateName(t, m, "acme.tenants.example.com"), "tenants")
+	assert.Equal(t, servedCertificateName(t, m, "a.acme.tenants.example.com"), "main")
+	assert.Equal(t, servedCertificateName(t, m, "other.example.com"), "main")
+	assert.Equal(t, servedCertificateName(t, m, ""), "main")
+}
+
+func TestCertificateManagerReload(t *testing.T) {
+	ca := newTestCertificate(t, "ca", "", nil)
+	current := newTestCertificate(t, "current", "db.example.com", ca)
+	m := newTestCertificateManager(t, &Configuration{ServerTLSCertificates: []*CertificateSpec{
+		{CertificateFile: current.certFile, CertificateKeyFile: current.keyFile},
+	}})
+
+	// Nothing changed
+	m.reloadChanged()
+	assert.Equal(t, servedCertificateName(t, m, "db.example.com"), "current")
+
+	// A broken renewal keeps the previous certificate
+	assert.NilError(t, os.WriteFile(current.keyFile, []byte("broken"), 0600))
+	m.reloadChanged()
+	assert.Equal(t, servedCertificateName(t, m, "db.example.com"), "current")
+
+	// The renewal is picked up, the broken one is retried
+	replaceTestCertificate(t, current, newTestCertificate(t, "renewed", "db.example.com", ca))
+	m.reloadChanged()
+	assert.Equal(t, servedCertificateName(t, m, "db.example.com"), "renewed")
+
+	// In the background
+	m.Start()
+	defer m.Close()
+	replaceTestCertificate(t, current, newTestCertificate(t, "background", "db.example.com", ca))
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCertificateName(t, m, "db.example.com") != "background" {
+		assert.Assert(t, time.Now().Before(deadline), "certificate was not reloaded")
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// handshakeTestCertificateManager runs the handshake of the client against a
+// listener served by the manager.
+func handshakeTestCertificateManager(t *testing.T, m *CertificateManager, client *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", m.TLSConfig(postgresALPN))
+	assert.NilError(t, err)
+	defer listener.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	tlsConn := tls.Client(conn, client)
+	err = tlsConn.Handshake()
+	if err == nil {
+		// The client certificate is verified after the client finished
+		err = <-serverErr
+	}
+	return err
+}
+
+func TestCertificateManagerClientAuth(t *testing.T) {
+	ca := newTestCertificate(t, "ca", "", nil)
+	server := newTestCertificate(t, "server", "db.example.com", ca)
+	client := newTestCertificate(t, "bob", "", ca)
+	stranger := newTestCertificate(t, "stranger", "", newTestCertificate(t, "other-ca", "", nil))
+	clientCert, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+	assert.NilError(t, err)
+	strangerCert, err := tls.LoadX509KeyPair(stranger.certFile, stranger.keyFile)
+	assert.NilError(t, err)
+
+	for _, tc := range []struct {
+		auth string
+		cert *tls.Certificate
+		err  string
+	}{
+		{auth: TLSClientAuthNone},
+		{auth: TLSClientAuthRequest},
+		{auth: TLSClientAuthRequest, cert: &clientCert},
+		{auth: TLSClientAuthRequest, cert: &strangerCert, err: "certificate signed by unknown authority"},
+		{auth: TLSClientAuthRequire, err: "client didn't provide a certificate"},
+		{auth: TLSClientAuthRequire, cert: &clientCert},
+	} {
+		m := newTestCertificateManager(t, &Configuration{
+			ServerTLSCertificates: []*CertificateSpec{{CertificateFile: server.certFile, CertificateKeyFile: server.keyFile}},
+			ServerTLSClientAuth:   tc.auth,
+			ServerTLSClientCAFile: ca.certFile,
+		})
+		// The client sends the certificate even when the CA is not accepted
+		getClientCertificate := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if tc.cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return tc.cert, nil
+		}
+		err := handshakeTestCertificateManager(t, m, &tls.Config{InsecureSkipVerify: true, GetClientCertificate: getClientCertificate})
+		if tc.err == "" {
+			assert.NilError(t, err, tc)
+		} else {
+			assert.ErrorContains(t, err, tc.err, tc)
+		}
+	}
+}
+
+func TestCertificateManagerErrors(t *testing.T) {
+	_, err := NewCertificateManager(&Configuration{ServerTLSCertificates: []*CertificateSpec{
+		{CertificateFile: "../data/cert.pem", CertificateKeyFile: "../data/nonexistent.pem"},
+	}}, logrus.StandardLogger())
+	assert.ErrorContains(t, err, "failed to load TLS certificate ../data/cert.pem")
+
+	_, err = NewCertificateManager(&Configuration{
+		ServerTLSCertificates: []*CertificateSpec{{CertificateFile: "../data/cert.pem", CertificateKeyFile: "../data/key.pem"}},
+		ServerTLSClientCAFile: "../data/test_sql.sql",
+	}, logrus.StandardLogger())
+	assert.Error(t, err, "no certificates found in TLS client CA file: ../data/test_sql.sql")
+}
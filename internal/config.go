@@ -2,10 +2,14 @@ package foodme
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 
 	"github.com/jessevdk/go-flags"
+	"github.com/ryshoooo/food-me/internal/pgwire"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,6 +18,16 @@ type OIDCDatabaseClientSpec struct {
 	ClientSecret string
 }
 
+type DestinationTargetSpec struct {
+	Address string
+	Role    string
+}
+
+type CertificateSpec struct {
+	CertificateFile    string
+	CertificateKeyFile string
+}
+
 type Configuration struct {
 	// Log configuration
 	LogLevel  string `long:"log-level" env:"LOG_LEVEL" default:"warn" choice:"trace" choice:"debug" choice:"info" choice:"warn" choice:"error" choice:"fatal" choice:"panic" description:"Log level"`
@@ -28,22 +42,85 @@ type Configuration struct {
 	DestinationLogUpstream   bool   `long:"destination-log-upstream" env:"DESTINATION_LOG_UPSTREAM" description:"Log packets from the destination database"`
 	DestinationLogDownstream bool   `long:"destination-log-downstream" env:"DESTINATION_LOG_DOWNSTREAM" description:"Log packets from the source client"`
 
+	// Destination TLS
+	DestinationTLSMode               string `long:"destination-tls-mode" env:"DESTINATION_TLS_MODE" default:"prefer" choice:"disable" choice:"prefer" choice:"require" choice:"verify-ca" choice:"verify-full" description:"TLS mode of the connections to the destination database, same as the sslmode of libpq"`
+	DestinationTLSCAFile             string `long:"destination-tls-ca-file" env:"DESTINATION_TLS_CA_FILE" description:"CA bundle verifying the destination certificate, the system roots are used without it"`
+	DestinationTLSCertificateFile    string `long:"destination-tls-certificate-file" env:"DESTINATION_TLS_CERTIFICATE_FILE" description:"Client certificate file for the destination database"`
+	DestinationTLSCertificateKeyFile string `long:"destination-tls-certificate-key-file" env:"DESTINATION_TLS_CERTIFICATE_KEY_FILE" description:"Client certificate key file for the destination database"`
+	DestinationInsecurePasswordAuth  bool   `long:"destination-insecure-password-auth" env:"DESTINATION_INSECURE_PASSWORD_AUTH" description:"Send the cleartext and MD5 passwords to the destinations whose certificate is not verified"`
+	DestinationChannelBinding        string `long:"destination-channel-binding" env:"DESTINATION_CHANNEL_BINDING" default:"prefer" choice:"disable" choice:"prefer" choice:"require" description:"Channel binding of the SCRAM authentication to the destination database, same as the channel_binding of libpq"`
+
+	// Destination credentials
+	DestinationCredentialsProvider     string `long:"destination-credentials-provider" env:"DESTINATION_CREDENTIALS_PROVIDER" default:"disabled" choice:"disabled" choice:"file" choice:"exec" choice:"vault" description:"Provider of the credentials of the destination database per session, the configured user is the fallback"`
+	DestinationCredentialsFile         string `long:"destination-credentials-file" env:"DESTINATION_CREDENTIALS_FILE" description:"JSON file with the credentials of the destination database per database and per role of the user"`
+	DestinationCredentialsClaim        string `long:"destination-credentials-claim" env:"DESTINATION_CREDENTIALS_CLAIM" default:"roles" description:"UserInfo claim whose values pick the credentials per role"`
+	DestinationCredentialsReloadPeriod int    `long:"destination-credentials-reload-period" env:"DESTINATION_CREDENTIALS_RELOAD_PERIOD" default:"30" description:"Time in seconds between the checks of the credentials file for changes"`
+	DestinationCredentialsExec         string `long:"destination-credentials-exec" env:"DESTINATION_CREDENTIALS_EXEC" description:"Command of the plugin printing the credentials as JSON, it reads the database and the UserInfo as JSON"`
+	DestinationCredentialsTimeout      int    `long:"destination-credentials-timeout" env:"DESTINATION_CREDENTIALS_TIMEOUT" default:"10" description:"Time in seconds the credentials plugin and the Vault requests get"`
+	DestinationCredentialsVaultURL     string `long:"destination-credentials-vault-url" env:"DESTINATION_CREDENTIALS_VAULT_URL" description:"URL of the Vault server leasing the credentials"`
+	DestinationCredentialsVaultToken   string `long:"destination-credentials-vault-token" env:"DESTINATION_CREDENTIALS_VAULT_TOKEN" description:"Vault token allowed to read the credentials and to renew and revoke their leases"`
+	DestinationCredentialsVaultMount   string `long:"destination-credentials-vault-mount" env:"DESTINATION_CREDENTIALS_VAULT_MOUNT" default:"database" description:"Mount path of the Vault database secrets engine"`
+	DestinationCredentialsVaultRole    string `long:"destination-credentials-vault-role" env:"DESTINATION_CREDENTIALS_VAULT_ROLE" default:"{{ .Database }}" description:"Golang template of the Vault role of the session, given the Database and the UserInfo"`
+
+	// Destination cluster
+	EDestinationHosts          string `long:"destination-hosts" env:"DESTINATION_HOSTS" description:"Additional destination hosts as host:port=role, where the role is primary or replica"`
+	DestinationTargets         []*DestinationTargetSpec
+	DestinationCheckPeriod     int    `long:"destination-check-period" env:"DESTINATION_CHECK_PERIOD" default:"5" description:"Time in seconds between the role checks of the destination hosts"`
+	DestinationReadOnlyRouting bool   `long:"destination-read-only-routing" env:"DESTINATION_READ_ONLY_ROUTING" description:"Route the read-only sessions and transactions to the replicas"`
+	DestinationReadOnlyClaim   string `long:"destination-read-only-claim" env:"DESTINATION_READ_ONLY_CLAIM" description:"Boolean UserInfo claim marking the users whose sessions are routed to the replicas"`
+
 	// OIDC
-	OIDCEnabled      bool   `long:"oidc-enabled" env:"OIDC_ENABLED" description:"Enable OIDC authentication"`
-	OIDCClientID     string `long:"oidc-client-id" env:"OIDC_CLIENT_ID" description:"Global OIDC Client ID"`
-	OIDCClientSecret string `long:"oidc-client-secret" env:"OIDC_CLIENT_SECRET" description:"Global OIDC Client Secret"`
-	OIDCTokenURL     string `long:"oidc-token-url" env:"OIDC_TOKEN_URL" description:"OIDC Token URL"`
-	OIDCUserInfoURL  string `long:"oidc-user-info-url" env:"OIDC_USER_INFO_URL" description:"OIDC User Info URL"`
+	OIDCEnabled                bool   `long:"oidc-enabled" env:"OIDC_ENABLED" description:"Enable OIDC authentication"`
+	OIDCClientID               string `long:"oidc-client-id" env:"OIDC_CLIENT_ID" description:"Global OIDC Client ID"`
+	OIDCClientSecret           string `long:"oidc-client-secret" env:"OIDC_CLIENT_SECRET" description:"Global OIDC Client Secret"`
+	OIDCTokenURL               string `long:"oidc-token-url" env:"OIDC_TOKEN_URL" description:"OIDC Token URL"`
+	OIDCUserInfoURL            string `long:"oidc-user-info-url" env:"OIDC_USER_INFO_URL" description:"OIDC User Info URL"`
+	OIDCJWKSURL                string `long:"oidc-jwks-url" env:"OIDC_JWKS_URL" description:"OIDC JSON Web Key Set URL"`
+	OIDCPasswordLogin          string `long:"oidc-password-login" env:"OIDC_PASSWORD_LOGIN" default:"disabled" choice:"disabled" choice:"token" choice:"password" choice:"token-exchange" description:"Ask the clients without the tokens in the username for the password, used as the access or refresh token, the password of the user or the token to exchange"`
+	OIDCDeviceAuthorizationURL string `long:"oidc-device-authorization-url" env:"OIDC_DEVICE_AUTHORIZATION_URL" description:"OIDC Device Authorization URL, enables the device login"`
+	OIDCDeviceLoginUsername    string `long:"oidc-device-login-username" env:"OIDC_DEVICE_LOGIN_USERNAME" default:"device" description:"Username of the clients logging in by the device authorization"`
+	OIDCClientCredentialsLogin bool   `long:"oidc-client-credentials-login" env:"OIDC_CLIENT_CREDENTIALS_LOGIN" description:"Log in the clients with the username client_id=<client ID> and the client secret as the password by the client credentials grant"`
 
 	// OIDC-Database
-	EDatabaseClientID                  string `long:"oidc-database-client-id" env:"OIDC_DATABASE_CLIENT_ID" description:"OIDC Database Client ID mapping"`
-	EDatabaseClientSecret              string `long:"oidc-database-client-secret" env:"OIDC_DATABASE_CLIENT_SECRET" description:"OIDC Database Client Secret mapping"`
-	OIDCDatabaseClients                map[string]*OIDCDatabaseClientSpec
-	OIDCDatabaseFallBackToBaseClient   bool   `long:"oidc-database-fallback-to-base-client" env:"OIDC_DATABASE_FALLBACK_TO_BASE_CLIENT" description:"Fall back to the base client if the client ID is not found"`
-	OIDCAssumeUserSession              bool   `long:"oidc-assume-user-session" env:"OIDC_ASSUME_USER_SESSION" description:"Assume the user role upon successful authentication"`
-	OIDCAssumeUserSessionUsernameClaim string `long:"oidc-assume-user-session-username-claim" env:"OIDC_ASSUME_USER_SESSION_USERNAME_CLAIM" default:"preferred_username" description:"Username claim of the UserInfo response to use as the username for the connection session"`
-	OIDCAssumeUserSessionAllowEscape   bool   `long:"oidc-assume-user-session-allow-escape" env:"OIDC_ASSUME_USER_SESSION_ALLOW_ESCAPE" description:"Allow the user to escape the assumed session"`
-	OIDCPostAuthSQLTemplate            string `long:"oidc-post-auth-sql-template" env:"OIDC_POST_AUTH_SQL_TEMPLATE" description:"SQL template file to execute after a successful OIDC authentication"`
+	EDatabaseClientID                        string `long:"oidc-database-client-id" env:"OIDC_DATABASE_CLIENT_ID" description:"OIDC Database Client ID mapping"`
+	EDatabaseClientSecret                    string `long:"oidc-database-client-secret" env:"OIDC_DATABASE_CLIENT_SECRET" description:"OIDC Database Client Secret mapping"`
+	OIDCDatabaseClients                      map[string]*OIDCDatabaseClientSpec
+	OIDCDatabaseFallBackToBaseClient         bool   `long:"oidc-database-fallback-to-base-client" env:"OIDC_DATABASE_FALLBACK_TO_BASE_CLIENT" description:"Fall back to the base client if the client ID is not found"`
+	OIDCAssumeUserSession                    bool   `long:"oidc-assume-user-session" env:"OIDC_ASSUME_USER_SESSION" description:"Assume the user role upon successful authentication"`
+	OIDCAssumeUserSessionUsernameClaim       string `long:"oidc-assume-user-session-username-claim" env:"OIDC_ASSUME_USER_SESSION_USERNAME_CLAIM" default:"preferred_username" description:"Username claim of the UserInfo response to use as the username for the connection session"`
+	OIDCAssumeUserSessionAllowEscape         bool   `long:"oidc-assume-user-session-allow-escape" env:"OIDC_ASSUME_USER_SESSION_ALLOW_ESCAPE" description:"Allow the user to escape the assumed session"`
+	OIDCAssumeUserSessionMode                string `long:"oidc-assume-user-session-mode" env:"OIDC_ASSUME_USER_SESSION_MODE" default:"session-authorization" choice:"session-authorization" choice:"role" description:"Assume the user session by SET SESSION AUTHORIZATION, which needs a superuser, or by SET ROLE, which needs a membership of the role"`
+	OIDCAssumeUserSessionUsernameLowercase   bool   `long:"oidc-assume-user-session-username-lowercase" env:"OIDC_ASSUME_USER_SESSION_USERNAME_LOWERCASE" description:"Lowercase the username for the role of the session"`
+	OIDCAssumeUserSessionUsernameStripDomain bool   `long:"oidc-assume-user-session-username-strip-domain" env:"OIDC_ASSUME_USER_SESSION_USERNAME_STRIP_DOMAIN" description:"Strip the domain of an email username for the role of the session"`
+	OIDCAssumeUserSessionUsernamePrefix      string `long:"oidc-assume-user-session-username-prefix" env:"OIDC_ASSUME_USER_SESSION_USERNAME_PREFIX" description:"Prefix of the role of the session"`
+	OIDCAssumeUserSessionUsernamePattern     string `long:"oidc-assume-user-session-username-pattern" env:"OIDC_ASSUME_USER_SESSION_USERNAME_PATTERN" description:"Regular expression the role of the session has to match, any name when empty"`
+	OIDCAssumeUserSessionUsernameRegexp      *regexp.Regexp
+	OIDCPostAuthSQLTemplate                  string `long:"oidc-post-auth-sql-template" env:"OIDC_POST_AUTH_SQL_TEMPLATE" description:"SQL template file to execute after a successful OIDC authentication"`
+
+	// Role provisioning
+	RoleProvisioning            bool   `long:"role-provisioning" env:"ROLE_PROVISIONING" description:"Create the roles of the users and sync their memberships of the group roles mapped from their groups"`
+	RoleProvisioningGroupsClaim string `long:"role-provisioning-groups-claim" env:"ROLE_PROVISIONING_GROUPS_CLAIM" default:"groups" description:"UserInfo claim with the groups of the user"`
+	RoleProvisioningMappingFile string `long:"role-provisioning-mapping-file" env:"ROLE_PROVISIONING_MAPPING_FILE" description:"JSON file mapping the groups to the roles granted to their users"`
+	RoleProvisioningCacheTTL    int    `long:"role-provisioning-cache-ttl" env:"ROLE_PROVISIONING_CACHE_TTL" default:"300" description:"Time in seconds the provisioned roles are not provisioned again"`
+
+	// Certificate authentication
+	CertificateAuthEnabled        bool   `long:"certificate-auth-enabled" env:"CERTIFICATE_AUTH_ENABLED" description:"Authenticate the clients by their TLS certificates mapped to identities"`
+	CertificateAuthIdentitiesFile string `long:"certificate-auth-identities-file" env:"CERTIFICATE_AUTH_IDENTITIES_FILE" description:"JSON file mapping the certificate names to the UserInfo of their identities"`
+
+	// Local authentication
+	LocalAuth           string `long:"local-auth" env:"LOCAL_AUTH" default:"disabled" choice:"disabled" choice:"file" choice:"ldap" description:"Authenticate the clients without the tokens on the proxy by SCRAM-SHA-256 against the local users file or by an LDAP bind, the destination sees the service account"`
+	LocalAuthUsersFile  string `long:"local-auth-users-file" env:"LOCAL_AUTH_USERS_FILE" description:"JSON file mapping the usernames to their SCRAM-SHA-256 secret and the UserInfo claims"`
+	LocalAuthLDAPURL    string `long:"local-auth-ldap-url" env:"LOCAL_AUTH_LDAP_URL" description:"URL of the LDAP server binding the users, ldap:// or ldaps://"`
+	LocalAuthLDAPPrefix string `long:"local-auth-ldap-prefix" env:"LOCAL_AUTH_LDAP_PREFIX" default:"cn=" description:"Prefix of the username in the DN of the LDAP bind"`
+	LocalAuthLDAPSuffix string `long:"local-auth-ldap-suffix" env:"LOCAL_AUTH_LDAP_SUFFIX" description:"Suffix of the username in the DN of the LDAP bind"`
+
+	// Routing
+	RoutingEnabled         bool   `long:"routing-enabled" env:"ROUTING_ENABLED" description:"Pick the destination of the OIDC sessions from their userinfo"`
+	RoutingClaim           string `long:"routing-claim" env:"ROUTING_CLAIM" default:"tenant" description:"UserInfo claim whose value picks the destination"`
+	RoutingTableFile       string `long:"routing-table-file" env:"ROUTING_TABLE_FILE" description:"JSON file mapping the claim values to the destination address, credentials and database"`
+	RoutingAddressTemplate string `long:"routing-address-template" env:"ROUTING_ADDRESS_TEMPLATE" description:"Golang template of the destination address for the claim values missing in the routing table"`
+	RoutingHostPattern     string `long:"routing-host-pattern" env:"ROUTING_HOST_PATTERN" description:"Regular expression the whole host of the templated destination address has to match"`
+	RoutingHostRegexp      *regexp.Regexp
 
 	// Permission Agents
 	PermissionAgentEnabled bool   `long:"permission-agent-enabled" env:"PERMISSION_AGENT_ENABLED" description:"Enable permission agent for handling SQL queries"`
@@ -56,24 +133,70 @@ type Configuration struct {
 	PermissionAgentOPAUpdateQuery           string `long:"permission-agent-opa-update-query" env:"PERMISSION_AGENT_OPA_UPDATE_QUERY" description:"OPA query for UPDATE operations" default:"data.ddl_update.allow == true"`
 	PermissionAgentOPADeleteQuery           string `long:"permission-agent-opa-delete-query" env:"PERMISSION_AGENT_OPA_DELETE_QUERY" description:"OPA query for DELETE operations" default:"data.ddl_delete.allow == true"`
 	PermissionAgentOPAStringEscapeCharacter string `long:"permission-agent-opa-string-escape-character" env:"PERMISSION_AGENT_OPA_STRING_ESCAPE_CHARACTER" description:"Wrap the resulting OPA string fields with this characters" default:"'"`
+	PermissionAgentOPAClientPolicyPath      string `long:"permission-agent-opa-client-policy-path" env:"PERMISSION_AGENT_OPA_CLIENT_POLICY_PATH" description:"OPA path of the packages per client ID evaluated for the client credentials logins instead of the data root, empty for the same policies as the users" default:"data.clients"`
 
 	// HTTP Permission Agent Configuration
 	PermissionAgentHTTPDDLEndpoint    string `long:"permission-agent-http-ddl-endpoint" env:"PERMISSION_AGENT_HTTP_DDL_ENDPOINT" description:"HTTP endpoint for DDL operations"`
 	PermissionAgentHTTPSelectEndpoint string `long:"permission-agent-http-select-endpoint" env:"PERMISSION_AGENT_HTTP_SELECT_ENDPOINT" description:"HTTP endpoint for SELECT operations"`
 
+	// Audit
+	AuditEnabled        bool   `long:"audit-enabled" env:"AUDIT_ENABLED" description:"Enable the audit log of executed statements"`
+	AuditSink           string `long:"audit-sink" env:"AUDIT_SINK" default:"file" choice:"file" choice:"syslog" choice:"http" description:"Audit log sink"`
+	AuditFile           string `long:"audit-file" env:"AUDIT_FILE" description:"Path to the JSON lines audit log file"`
+	AuditSyslogNetwork  string `long:"audit-syslog-network" env:"AUDIT_SYSLOG_NETWORK" description:"Network of the syslog server, empty for the local syslog"`
+	AuditSyslogAddress  string `long:"audit-syslog-address" env:"AUDIT_SYSLOG_ADDRESS" description:"Address of the syslog server, empty for the local syslog"`
+	AuditSyslogTag      string `long:"audit-syslog-tag" env:"AUDIT_SYSLOG_TAG" default:"food-me" description:"Syslog tag of the audit events"`
+	AuditHTTPEndpoint   string `long:"audit-http-endpoint" env:"AUDIT_HTTP_ENDPOINT" description:"HTTP endpoint receiving the audit events"`
+	AuditHTTPTimeout    int    `long:"audit-http-timeout" env:"AUDIT_HTTP_TIMEOUT" default:"5" description:"Timeout in seconds of a request posting an audit event"`
+	AuditHTTPQueueSize  int    `long:"audit-http-queue-size" env:"AUDIT_HTTP_QUEUE_SIZE" default:"1000" description:"Number of audit events waiting to be posted, the events beyond it are dropped"`
+	AuditRedactLiterals bool   `long:"audit-redact-literals" env:"AUDIT_REDACT_LITERALS" description:"Replace literals in the audited SQL statements with placeholders"`
+
+	// Tracing
+	TracingEnabled             bool    `long:"tracing-enabled" env:"TRACING_ENABLED" description:"Enable OpenTelemetry tracing"`
+	TracingOTLPEndpoint        string  `long:"tracing-otlp-endpoint" env:"TRACING_OTLP_ENDPOINT" description:"Host and port of the OTLP HTTP trace collector"`
+	TracingOTLPInsecure        bool    `long:"tracing-otlp-insecure" env:"TRACING_OTLP_INSECURE" description:"Export traces to the collector without TLS"`
+	TracingServiceName         string  `long:"tracing-service-name" env:"TRACING_SERVICE_NAME" default:"food-me" description:"Service name of the exported traces"`
+	TracingSampleRatio         float64 `long:"tracing-sample-ratio" env:"TRACING_SAMPLE_RATIO" default:"1" description:"Ratio of the traces to sample"`
+	TracingFromApplicationName bool    `long:"tracing-from-application-name" env:"TRACING_FROM_APPLICATION_NAME" description:"Read the trace context from the traceparent in the client application_name"`
+	TracingFromSQLComment      bool    `long:"tracing-from-sql-comment" env:"TRACING_FROM_SQL_COMMENT" description:"Read the trace context from the traceparent in a SQL comment of the statement"`
+
+	// Pooling
+	PoolMode        string `long:"pool-mode" env:"POOL_MODE" default:"disabled" choice:"disabled" choice:"session" choice:"transaction" description:"Pool the connections to the destination database per client session or per transaction"`
+	PoolSize        int    `long:"pool-size" env:"POOL_SIZE" default:"10" description:"Maximum number of pooled connections per database"`
+	PoolWaitTimeout int    `long:"pool-wait-timeout" env:"POOL_WAIT_TIMEOUT" default:"30" description:"Time in seconds a client waits for a pooled connection"`
+	PoolResetQuery  string `long:"pool-reset-query" env:"POOL_RESET_QUERY" default:"DISCARD ALL" description:"Query resetting the pooled connections before they are returned to the pool"`
+
+	// Health checks
+	HealthCheckDatabase string `long:"health-check-database" env:"HEALTH_CHECK_DATABASE" default:"postgres" description:"Database to authenticate against in the health checks"`
+	HealthCheckTimeout  int    `long:"health-check-timeout" env:"HEALTH_CHECK_TIMEOUT" default:"5" description:"Timeout of each health check in seconds"`
+
 	// TLS
 	ServerTLSEnabled            bool   `long:"server-tls-enabled" env:"SERVER_TLS_ENABLED" description:"Enable TLS for the server"`
 	ServerTLSCertificateFile    string `long:"server-tls-certificate-file" env:"SERVER_TLS_CERTIFICATE_FILE" description:"TLS certificate file"`
 	ServerTLSCertificateKeyFile string `long:"server-tls-certificate-key-file" env:"SERVER_TLS_CERTIFICATE_KEY_FILE" description:"TLS certificate key file"`
+	ServerTLSRequired           bool   `long:"server-tls-required" env:"SERVER_TLS_REQUIRED" description:"Reject the clients connecting without TLS"`
+	EServerTLSCertificates      string `long:"server-tls-certificates" env:"SERVER_TLS_CERTIFICATES" description:"Additional certificates picked by the SNI as certificate-file=key-file"`
+	ServerTLSCertificates       []*CertificateSpec
+	ServerTLSReloadPeriod       int    `long:"server-tls-reload-period" env:"SERVER_TLS_RELOAD_PERIOD" default:"30" description:"Time in seconds between the checks of the TLS files for renewals"`
+	ServerTLSClientAuth         string `long:"server-tls-client-auth" env:"SERVER_TLS_CLIENT_AUTH" default:"none" choice:"none" choice:"request" choice:"require" description:"Request the client certificates, the given ones are verified"`
+	ServerTLSClientCAFile       string `long:"server-tls-client-ca-file" env:"SERVER_TLS_CLIENT_CA_FILE" description:"CA bundle verifying the client certificates"`
 
 	// Server
-	ServerPort int `long:"port" env:"PORT" default:"2099" description:"Server proxy port"`
+	ServerPort                int    `long:"port" env:"PORT" default:"2099" description:"Server proxy port"`
+	ServerShutdownTimeout     int    `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" default:"30" description:"Time in seconds the sessions get to finish their transactions on shutdown"`
+	EStartupParametersAllowed string `long:"startup-parameters-allowed" env:"STARTUP_PARAMETERS_ALLOWED" default:"application_name,client_encoding,DateStyle,IntervalStyle,TimeZone,extra_float_digits,search_path" description:"Startup parameters of the clients forwarded to the destination by the sessions of the proxy"`
+	StartupParametersAllowed  []string
+	EStartupParametersDenied  string `long:"startup-parameters-denied" env:"STARTUP_PARAMETERS_DENIED" default:"replication" description:"Startup parameters rejected in every session"`
+	StartupParametersDenied   []string
+	MaxMessageSize            int `long:"max-message-size" env:"MAX_MESSAGE_SIZE" default:"1073741823" description:"Size limit in bytes of the messages of the clients, the sessions sending larger messages are closed"`
 
 	// API
-	ApiPort                    int  `long:"api-port" env:"API_PORT" default:"10000" description:"API port"`
-	APITLSEnabled              bool `long:"api-tls-enabled" env:"API_TLS_ENABLED" description:"Enable TLS for the API"`
-	ApiUsernameLifetime        int  `long:"api-username-lifetime" env:"API_USERNAME_LIFETIME" default:"3600" description:"Username lifetime in seconds"`
-	ApiGarbageCollectionPeriod int  `long:"api-garbage-collection-period" env:"API_GARBAGE_COLLECTION_PERIOD" default:"60" description:"Garbage collection period in seconds"`
+	ApiPort                    int    `long:"api-port" env:"API_PORT" default:"10000" description:"API port"`
+	APITLSEnabled              bool   `long:"api-tls-enabled" env:"API_TLS_ENABLED" description:"Enable TLS for the API"`
+	ApiUsernameLifetime        int    `long:"api-username-lifetime" env:"API_USERNAME_LIFETIME" default:"3600" description:"Username lifetime in seconds"`
+	ApiGarbageCollectionPeriod int    `long:"api-garbage-collection-period" env:"API_GARBAGE_COLLECTION_PERIOD" default:"60" description:"Garbage collection period in seconds"`
+	EMetricsDatabases          string `long:"metrics-databases" env:"METRICS_DATABASES" description:"Databases labeled by their name in the metrics besides the ones of the OIDC database clients and the routing table"`
+	MetricsDatabases           []string
 }
 
 func NewConfiguration(args []string) (*Configuration, error) {
@@ -128,6 +251,41 @@ func NewConfiguration(args []string) (*Configuration, error) {
 		}
 	}
 
+	// parse the destination hosts, the main destination is the first primary
+	c.DestinationTargets = []*DestinationTargetSpec{{Address: net.JoinHostPort(c.DestinationHost, fmt.Sprint(c.DestinationPort)), Role: UpstreamRolePrimary}}
+	for _, key := range strings.Split(c.EDestinationHosts, ",") {
+		if key == "" {
+			continue
+		}
+		kv := strings.Split(key, "=")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid destination host: %s", key)
+		}
+		if _, _, err := net.SplitHostPort(kv[0]); err != nil {
+			return nil, fmt.Errorf("invalid destination host: %s", key)
+		}
+		if kv[1] != UpstreamRolePrimary && kv[1] != UpstreamRoleReplica {
+			return nil, fmt.Errorf("invalid destination host role: %s", key)
+		}
+		for _, target := range c.DestinationTargets {
+			if target.Address == kv[0] {
+				return nil, fmt.Errorf("destination hosts have a duplicate host: %s", kv[0])
+			}
+		}
+		c.DestinationTargets = append(c.DestinationTargets, &DestinationTargetSpec{Address: kv[0], Role: kv[1]})
+	}
+	if len(c.DestinationTargets) > 1 && c.DestinationCheckPeriod < 1 {
+		return nil, fmt.Errorf("destination check period must be at least 1: %v", c.DestinationCheckPeriod)
+	}
+
+	// Check assume user session
+	if c.OIDCAssumeUserSessionUsernamePattern != "" {
+		c.OIDCAssumeUserSessionUsernameRegexp, err = regexp.Compile(c.OIDCAssumeUserSessionUsernamePattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid assume user session username pattern: %w", err)
+		}
+	}
+
 	// Check whether the template file exists
 	if c.OIDCPostAuthSQLTemplate != "" {
 		if _, err := os.Stat(c.OIDCPostAuthSQLTemplate); os.IsNotExist(err) {
@@ -135,7 +293,210 @@ func NewConfiguration(args []string) (*Configuration, error) {
 		}
 	}
 
+	// Check role provisioning
+	if c.RoleProvisioning {
+		if c.RoleProvisioningMappingFile == "" {
+			return nil, fmt.Errorf("role mapping file is required for the role provisioning")
+		}
+		if _, err := os.Stat(c.RoleProvisioningMappingFile); os.IsNotExist(err) {
+			return nil, fmt.Errorf("role mapping file does not exist: %s", c.RoleProvisioningMappingFile)
+		}
+		if c.RoleProvisioningCacheTTL < 0 {
+			return nil, fmt.Errorf("role provisioning cache TTL must not be negative: %v", c.RoleProvisioningCacheTTL)
+		}
+	}
+
+	// Check password login
+	if c.OIDCPasswordLogin != PasswordLoginDisabled && !c.OIDCEnabled {
+		return nil, fmt.Errorf("OIDC must be enabled for the password login")
+	}
+
+	// Check device login
+	if c.OIDCDeviceAuthorizationURL != "" && !c.OIDCEnabled {
+		return nil, fmt.Errorf("OIDC must be enabled for the device login")
+	}
+
+	// Check client credentials login
+	if c.OIDCClientCredentialsLogin && !c.OIDCEnabled {
+		return nil, fmt.Errorf("OIDC must be enabled for the client credentials login")
+	}
+
+	// Check certificate authentication
+	if c.CertificateAuthEnabled {
+		if !c.ServerTLSEnabled || c.ServerTLSClientAuth == TLSClientAuthNone {
+			return nil, fmt.Errorf("TLS client certificates are required for the certificate authentication")
+		}
+		if c.CertificateAuthIdentitiesFile == "" {
+			return nil, fmt.Errorf("certificate identities file is required for the certificate authentication")
+		}
+		if _, err := os.Stat(c.CertificateAuthIdentitiesFile); os.IsNotExist(err) {
+			return nil, fmt.Errorf("certificate identities file does not exist: %s", c.CertificateAuthIdentitiesFile)
+		}
+	}
+
+	// Check local authentication
+	switch c.LocalAuth {
+	case LocalAuthFile:
+		if c.LocalAuthUsersFile == "" {
+			return nil, fmt.Errorf("local users file is required for the local authentication")
+		}
+		if _, err := os.Stat(c.LocalAuthUsersFile); os.IsNotExist(err) {
+			return nil, fmt.Errorf("local users file does not exist: %s", c.LocalAuthUsersFile)
+		}
+	case LocalAuthLDAP:
+		if c.LocalAuthLDAPURL == "" {
+			return nil, fmt.Errorf("LDAP URL is required for the local authentication")
+		}
+		if u, err := url.Parse(c.LocalAuthLDAPURL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return nil, fmt.Errorf("invalid LDAP URL: %s", c.LocalAuthLDAPURL)
+		}
+	}
+	if c.LocalAuth != LocalAuthDisabled && c.OIDCPasswordLogin != PasswordLoginDisabled {
+		return nil, fmt.Errorf("local authentication cannot be combined with the OIDC password login")
+	}
+
+	// Check routing
+	if c.RoutingEnabled {
+		if c.RoutingTableFile == "" && c.RoutingAddressTemplate == "" {
+			return nil, fmt.Errorf("routing table file or routing address template is required for routing")
+		}
+		if c.RoutingTableFile != "" {
+			if _, err := os.Stat(c.RoutingTableFile); os.IsNotExist(err) {
+				return nil, fmt.Errorf("routing table file does not exist: %s", c.RoutingTableFile)
+			}
+		}
+		if c.RoutingAddressTemplate != "" {
+			if c.RoutingHostPattern == "" {
+				return nil, fmt.Errorf("routing host pattern is required for the routing address template")
+			}
+			c.RoutingHostRegexp, err = regexp.Compile("^(?:" + c.RoutingHostPattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid routing host pattern: %w", err)
+			}
+		}
+	}
+
+	// Check audit sink
+	if c.AuditEnabled {
+		if c.AuditSink == "file" && c.AuditFile == "" {
+			return nil, fmt.Errorf("audit file is required for the file audit sink")
+		}
+		if c.AuditSink == "http" && c.AuditHTTPEndpoint == "" {
+			return nil, fmt.Errorf("audit HTTP endpoint is required for the http audit sink")
+		}
+		if c.AuditSink == "http" && c.AuditHTTPTimeout < 1 {
+			return nil, fmt.Errorf("audit HTTP timeout must be at least 1: %v", c.AuditHTTPTimeout)
+		}
+		if c.AuditSink == "http" && c.AuditHTTPQueueSize < 1 {
+			return nil, fmt.Errorf("audit HTTP queue size must be at least 1: %v", c.AuditHTTPQueueSize)
+		}
+	}
+
+	// Check pooling
+	if c.PoolMode != PoolModeDisabled && c.PoolSize < 1 {
+		return nil, fmt.Errorf("pool size must be at least 1: %v", c.PoolSize)
+	}
+
+	// Check message size
+	if c.MaxMessageSize < 1 || c.MaxMessageSize > pgwire.DefaultMaxMessageSize {
+		return nil, fmt.Errorf("max message size must be between 1 and %d: %v", pgwire.DefaultMaxMessageSize, c.MaxMessageSize)
+	}
+
+	// Check tracing
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio must be between 0 and 1: %v", c.TracingSampleRatio)
+	}
+
+	// Check destination TLS files
+	for _, file := range []string{c.DestinationTLSCAFile, c.DestinationTLSCertificateFile, c.DestinationTLSCertificateKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return nil, fmt.Errorf("destination TLS file does not exist: %s", file)
+		}
+	}
+	if (c.DestinationTLSCertificateFile == "") != (c.DestinationTLSCertificateKeyFile == "") {
+		return nil, fmt.Errorf("destination TLS certificate and key files are required together")
+	}
+	if c.DestinationChannelBinding == ChannelBindingRequire && c.DestinationTLSMode == TLSModeDisable {
+		return nil, fmt.Errorf("destination channel binding requires TLS")
+	}
+
+	// Check destination credentials, the credentials file alone picks the file provider
+	if c.DestinationCredentialsProvider == CredentialProviderDisabled && c.DestinationCredentialsFile != "" {
+		c.DestinationCredentialsProvider = CredentialProviderFile
+	}
+	switch c.DestinationCredentialsProvider {
+	case CredentialProviderFile:
+		if c.DestinationCredentialsFile == "" {
+			return nil, fmt.Errorf("destination credentials file is required for the file credentials provider")
+		}
+	case CredentialProviderExec:
+		if strings.TrimSpace(c.DestinationCredentialsExec) == "" {
+			return nil, fmt.Errorf("destination credentials command is required for the exec credentials provider")
+		}
+	case CredentialProviderVault:
+		if c.DestinationCredentialsVaultURL == "" {
+			return nil, fmt.Errorf("Vault URL is required for the vault credentials provider")
+		}
+		if c.DestinationCredentialsVaultToken == "" {
+			return nil, fmt.Errorf("Vault token is required for the vault credentials provider")
+		}
+		if _, err := parseVaultRole(c.DestinationCredentialsVaultRole); err != nil {
+			return nil, fmt.Errorf("invalid Vault role template: %w", err)
+		}
+	}
+	if c.DestinationCredentialsProvider != CredentialProviderDisabled && c.DestinationCredentialsTimeout < 1 {
+		return nil, fmt.Errorf("destination credentials timeout must be at least 1: %v", c.DestinationCredentialsTimeout)
+	}
+	if c.DestinationCredentialsFile != "" {
+		if _, err := os.Stat(c.DestinationCredentialsFile); os.IsNotExist(err) {
+			return nil, fmt.Errorf("destination credentials file does not exist: %s", c.DestinationCredentialsFile)
+		}
+		if c.DestinationCredentialsReloadPeriod < 1 {
+			return nil, fmt.Errorf("destination credentials reload period must be at least 1: %v", c.DestinationCredentialsReloadPeriod)
+		}
+	}
+
+	// parse the startup parameters, the user and the database are always handled by the proxy
+	for _, name := range strings.Split(c.EStartupParametersAllowed, ",") {
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(name, "user") || strings.EqualFold(name, "database") {
+			return nil, fmt.Errorf("startup parameter %s cannot be configured", name)
+		}
+		c.StartupParametersAllowed = append(c.StartupParametersAllowed, name)
+	}
+	// the pooled connections take the parameters by SET, which options is not
+	if c.PoolMode != PoolModeDisabled && containsFold(c.StartupParametersAllowed, "options") {
+		return nil, fmt.Errorf("startup parameter options cannot be forwarded by the pooled sessions")
+	}
+	for _, name := range strings.Split(c.EStartupParametersDenied, ",") {
+		if name == "" {
+			continue
+		}
+		if strings.EqualFold(name, "user") || strings.EqualFold(name, "database") {
+			return nil, fmt.Errorf("startup parameter %s cannot be configured", name)
+		}
+		if containsFold(c.StartupParametersAllowed, name) {
+			return nil, fmt.Errorf("startup parameter %s cannot be both allowed and denied", name)
+		}
+		c.StartupParametersDenied = append(c.StartupParametersDenied, name)
+	}
+
+	// parse the databases of the metrics
+	for _, name := range strings.Split(c.EMetricsDatabases, ",") {
+		if name != "" {
+			c.MetricsDatabases = append(c.MetricsDatabases, name)
+		}
+	}
+
 	// Check TLS files
+	if c.ServerTLSRequired && !c.ServerTLSEnabled {
+		return nil, fmt.Errorf("TLS must be enabled to be required")
+	}
 	if c.ServerTLSEnabled || c.APITLSEnabled {
 		if c.ServerTLSCertificateFile == "" {
 			return nil, fmt.Errorf("TLS certificate file is required")
@@ -149,6 +510,35 @@ func NewConfiguration(args []string) (*Configuration, error) {
 		if _, err := os.Stat(c.ServerTLSCertificateKeyFile); os.IsNotExist(err) {
 			return nil, fmt.Errorf("TLS certificate key file does not exist: %s", c.ServerTLSCertificateKeyFile)
 		}
+		if c.ServerTLSReloadPeriod < 1 {
+			return nil, fmt.Errorf("TLS reload period must be at least 1: %v", c.ServerTLSReloadPeriod)
+		}
+		if c.ServerTLSClientAuth != TLSClientAuthNone && c.ServerTLSClientCAFile == "" {
+			return nil, fmt.Errorf("TLS client CA file is required for the client certificates")
+		}
+		if c.ServerTLSClientCAFile != "" {
+			if _, err := os.Stat(c.ServerTLSClientCAFile); os.IsNotExist(err) {
+				return nil, fmt.Errorf("TLS client CA file does not exist: %s", c.ServerTLSClientCAFile)
+			}
+		}
+	}
+
+	// parse the TLS certificates, the configured one is the default
+	c.ServerTLSCertificates = []*CertificateSpec{{CertificateFile: c.ServerTLSCertificateFile, CertificateKeyFile: c.ServerTLSCertificateKeyFile}}
+	for _, key := range strings.Split(c.EServerTLSCertificates, ",") {
+		if key == "" {
+			continue
+		}
+		kv := strings.Split(key, "=")
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid TLS certificate: %s", key)
+		}
+		for _, file := range kv {
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				return nil, fmt.Errorf("TLS certificate file does not exist: %s", file)
+			}
+		}
+		c.ServerTLSCertificates = append(c.ServerTLSCertificates, &CertificateSpec{CertificateFile: kv[0], CertificateKeyFile: kv[1]})
 	}
 
 	return c, nil
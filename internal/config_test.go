@@ -25,11 +25,35 @@ func TestNewConfigurationDefaults(t *testing.T) {
 	assert.Equal(t, c.DestinationPassword, "")
 	assert.Equal(t, c.DestinationLogUpstream, false)
 	assert.Equal(t, c.DestinationLogDownstream, false)
+	assert.Equal(t, c.EDestinationHosts, "")
+	assert.DeepEqual(t, c.DestinationTargets, []*DestinationTargetSpec{{Address: "localhost:5432", Role: "primary"}})
+	assert.Equal(t, c.DestinationCheckPeriod, 5)
+	assert.Equal(t, c.DestinationReadOnlyRouting, false)
+	assert.Equal(t, c.DestinationReadOnlyClaim, "")
+	assert.Equal(t, c.DestinationTLSMode, "prefer")
+	assert.Equal(t, c.DestinationTLSCAFile, "")
+	assert.Equal(t, c.DestinationInsecurePasswordAuth, false)
+	assert.Equal(t, c.DestinationTLSCertificateFile, "")
+	assert.Equal(t, c.DestinationTLSCertificateKeyFile, "")
+	assert.Equal(t, c.DestinationChannelBinding, "prefer")
+	assert.Equal(t, c.CertificateAuthEnabled, false)
+	assert.Equal(t, c.CertificateAuthIdentitiesFile, "")
+	assert.Equal(t, c.RoutingEnabled, false)
+	assert.Equal(t, c.RoutingClaim, "tenant")
+	assert.Equal(t, c.RoutingTableFile, "")
+	assert.Equal(t, c.RoutingAddressTemplate, "")
+	assert.Equal(t, c.RoutingHostPattern, "")
+	assert.Assert(t, c.RoutingHostRegexp == nil)
 	assert.Equal(t, c.OIDCEnabled, false)
 	assert.Equal(t, c.OIDCClientID, "")
 	assert.Equal(t, c.OIDCClientSecret, "")
 	assert.Equal(t, c.OIDCTokenURL, "")
 	assert.Equal(t, c.OIDCUserInfoURL, "")
+	assert.Equal(t, c.OIDCJWKSURL, "")
+	assert.Equal(t, c.OIDCPasswordLogin, "disabled")
+	assert.Equal(t, c.OIDCDeviceAuthorizationURL, "")
+	assert.Equal(t, c.OIDCDeviceLoginUsername, "device")
+	assert.Equal(t, c.OIDCClientCredentialsLogin, false)
 	assert.Equal(t, c.EDatabaseClientID, "")
 	assert.Equal(t, c.EDatabaseClientSecret, "")
 	assert.Equal(t, c.OIDCDatabaseFallBackToBaseClient, false)
@@ -43,15 +67,49 @@ func TestNewConfigurationDefaults(t *testing.T) {
 	assert.Equal(t, c.PermissionAgentOPAUpdateQuery, "data.ddl_update.allow == true")
 	assert.Equal(t, c.PermissionAgentOPADeleteQuery, "data.ddl_delete.allow == true")
 	assert.Equal(t, c.PermissionAgentOPAStringEscapeCharacter, "'")
+	assert.Equal(t, c.PermissionAgentOPAClientPolicyPath, "data.clients")
 	assert.Equal(t, c.PermissionAgentHTTPDDLEndpoint, "")
 	assert.Equal(t, c.PermissionAgentHTTPSelectEndpoint, "")
+	assert.Equal(t, c.AuditEnabled, false)
+	assert.Equal(t, c.AuditSink, "file")
+	assert.Equal(t, c.AuditFile, "")
+	assert.Equal(t, c.AuditSyslogNetwork, "")
+	assert.Equal(t, c.AuditSyslogAddress, "")
+	assert.Equal(t, c.AuditSyslogTag, "food-me")
+	assert.Equal(t, c.AuditHTTPEndpoint, "")
+	assert.Equal(t, c.AuditHTTPTimeout, 5)
+	assert.Equal(t, c.AuditHTTPQueueSize, 1000)
+	assert.Equal(t, c.AuditRedactLiterals, false)
+	assert.Equal(t, c.TracingEnabled, false)
+	assert.Equal(t, c.TracingOTLPEndpoint, "")
+	assert.Equal(t, c.TracingOTLPInsecure, false)
+	assert.Equal(t, c.TracingServiceName, "food-me")
+	assert.Equal(t, c.TracingSampleRatio, 1.0)
+	assert.Equal(t, c.TracingFromApplicationName, false)
+	assert.Equal(t, c.TracingFromSQLComment, false)
+	assert.Equal(t, c.HealthCheckDatabase, "postgres")
+	assert.Equal(t, c.HealthCheckTimeout, 5)
 	assert.Equal(t, c.ServerTLSEnabled, false)
 	assert.Equal(t, c.ServerTLSCertificateFile, "")
 	assert.Equal(t, c.ServerTLSCertificateKeyFile, "")
+	assert.Equal(t, c.ServerTLSRequired, false)
+	assert.Equal(t, c.EServerTLSCertificates, "")
+	assert.DeepEqual(t, c.ServerTLSCertificates, []*CertificateSpec{{}})
+	assert.Equal(t, c.ServerTLSReloadPeriod, 30)
+	assert.Equal(t, c.ServerTLSClientAuth, "none")
+	assert.Equal(t, c.ServerTLSClientCAFile, "")
 	assert.Equal(t, c.OIDCAssumeUserSession, false)
 	assert.Equal(t, c.OIDCAssumeUserSessionUsernameClaim, "preferred_username")
 	assert.Equal(t, c.OIDCAssumeUserSessionAllowEscape, false)
 	assert.Equal(t, c.ServerPort, 2099)
+	assert.Equal(t, c.ServerShutdownTimeout, 30)
+	assert.DeepEqual(t, c.StartupParametersAllowed, []string{"application_name", "client_encoding", "DateStyle", "IntervalStyle", "TimeZone", "extra_float_digits", "search_path"})
+	assert.DeepEqual(t, c.StartupParametersDenied, []string{"replication"})
+	assert.Equal(t, c.MaxMessageSize, 1073741823)
+	assert.Equal(t, c.PoolMode, "disabled")
+	assert.Equal(t, c.PoolSize, 10)
+	assert.Equal(t, c.PoolWaitTimeout, 30)
+	assert.Equal(t, c.PoolResetQuery, "DISCARD ALL")
 	assert.Equal(t, c.ApiPort, 10000)
 	assert.Equal(t, c.APITLSEnabled, false)
 	assert.Equal(t, c.ApiUsernameLifetime, 3600)
@@ -69,11 +127,30 @@ func TestNewConfigurationFull(t *testing.T) {
 		"--destination-password", "password",
 		"--destination-log-upstream",
 		"--destination-log-downstream",
+		"--destination-hosts", "replica:7272=replica,standby:7273=primary",
+		"--destination-check-period", "10",
+		"--destination-read-only-routing",
+		"--destination-read-only-claim", "read_only",
+		"--destination-tls-mode", "verify-full",
+		"--destination-tls-ca-file", "../data/cert.pem",
+		"--destination-tls-certificate-file", "../data/cert.pem",
+		"--destination-tls-certificate-key-file", "../data/key.pem",
+		"--certificate-auth-enabled",
+		"--certificate-auth-identities-file", "../data/test_identities.json",
+		"--routing-enabled",
+		"--routing-claim", "org",
+		"--routing-table-file", "../data/test_routing.json",
+		"--routing-address-template", "{{ .org }}.db:5432",
+		"--routing-host-pattern", "[a-z0-9-]+\\.db",
 		"--oidc-enabled",
 		"--oidc-client-id", "client-id",
 		"--oidc-client-secret", "client-secret",
 		"--oidc-token-url", "http://token",
 		"--oidc-user-info-url", "http://info",
+		"--oidc-password-login", "token-exchange",
+		"--oidc-device-authorization-url", "http://device",
+		"--oidc-device-login-username", "me",
+		"--oidc-client-credentials-login",
 		"--oidc-database-client-id", "postgres=pg-client-id,stuff=stuff-client-id,secretstuff=secretstuff-client-id",
 		"--oidc-database-client-secret", "postgres=pg-secret,secretstuff=more-secret",
 		"--oidc-database-fallback-to-base-client",
@@ -86,14 +163,35 @@ func TestNewConfigurationFull(t *testing.T) {
 		"--permission-agent-opa-update-query", "update query",
 		"--permission-agent-opa-delete-query", "delete query",
 		"--permission-agent-opa-string-escape-character", "''",
+		"--permission-agent-opa-client-policy-path", "data.machines",
 		"--permission-agent-http-ddl-endpoint", "http://ddl",
 		"--permission-agent-http-select-endpoint", "http://select",
+		"--audit-enabled",
+		"--audit-sink", "http",
+		"--audit-file", "audit.jsonl",
+		"--audit-syslog-network", "udp",
+		"--audit-syslog-address", "localhost:514",
+		"--audit-syslog-tag", "foodme-audit",
+		"--audit-http-endpoint", "http://audit",
+		"--audit-redact-literals",
+		"--tracing-enabled",
+		"--tracing-otlp-endpoint", "otel:4318",
+		"--tracing-otlp-insecure",
+		"--tracing-service-name", "foodme-test",
+		"--tracing-sample-ratio", "0.25",
+		"--tracing-from-application-name",
+		"--tracing-from-sql-comment",
 		"--oidc-assume-user-session",
 		"--oidc-assume-user-session-username-claim", "db_role",
 		"--oidc-assume-user-session-allow-escape",
 		"--server-tls-enabled",
 		"--server-tls-certificate-file", "../data/cert.pem",
 		"--server-tls-certificate-key-file", "../data/key.pem",
+		"--server-tls-required",
+		"--server-tls-certificates", "../data/cert.pem=../data/key.pem",
+		"--server-tls-reload-period", "60",
+		"--server-tls-client-auth", "require",
+		"--server-tls-client-ca-file", "../data/cert.pem",
 		"--port", "9876",
 		"--api-port", "8888",
 		"--api-tls-enabled",
@@ -110,11 +208,37 @@ func TestNewConfigurationFull(t *testing.T) {
 	assert.Equal(t, c.DestinationPassword, "password")
 	assert.Equal(t, c.DestinationLogUpstream, true)
 	assert.Equal(t, c.DestinationLogDownstream, true)
+	assert.Equal(t, c.EDestinationHosts, "replica:7272=replica,standby:7273=primary")
+	assert.DeepEqual(t, c.DestinationTargets, []*DestinationTargetSpec{
+		{Address: "myhost:7272", Role: "primary"},
+		{Address: "replica:7272", Role: "replica"},
+		{Address: "standby:7273", Role: "primary"},
+	})
+	assert.Equal(t, c.DestinationCheckPeriod, 10)
+	assert.Equal(t, c.DestinationReadOnlyRouting, true)
+	assert.Equal(t, c.DestinationReadOnlyClaim, "read_only")
+	assert.Equal(t, c.DestinationTLSMode, "verify-full")
+	assert.Equal(t, c.DestinationTLSCAFile, "../data/cert.pem")
+	assert.Equal(t, c.DestinationTLSCertificateFile, "../data/cert.pem")
+	assert.Equal(t, c.DestinationTLSCertificateKeyFile, "../data/key.pem")
+	assert.Equal(t, c.CertificateAuthEnabled, true)
+	assert.Equal(t, c.CertificateAuthIdentitiesFile, "../data/test_identities.json")
+	assert.Equal(t, c.RoutingEnabled, true)
+	assert.Equal(t, c.RoutingClaim, "org")
+	assert.Equal(t, c.RoutingTableFile, "../data/test_routing.json")
+	assert.Equal(t, c.RoutingAddressTemplate, "{{ .org }}.db:5432")
+	assert.Equal(t, c.RoutingHostPattern, "[a-z0-9-]+\\.db")
+	assert.Assert(t, c.RoutingHostRegexp.MatchString("acme.db"))
+	assert.Assert(t, !c.RoutingHostRegexp.MatchString("acme.db.evil.com"))
 	assert.Equal(t, c.OIDCEnabled, true)
 	assert.Equal(t, c.OIDCClientID, "client-id")
 	assert.Equal(t, c.OIDCClientSecret, "client-secret")
 	assert.Equal(t, c.OIDCTokenURL, "http://token")
 	assert.Equal(t, c.OIDCUserInfoURL, "http://info")
+	assert.Equal(t, c.OIDCPasswordLogin, "token-exchange")
+	assert.Equal(t, c.OIDCDeviceAuthorizationURL, "http://device")
+	assert.Equal(t, c.OIDCDeviceLoginUsername, "me")
+	assert.Equal(t, c.OIDCClientCredentialsLogin, true)
 	assert.Equal(t, c.EDatabaseClientID, "postgres=pg-client-id,stuff=stuff-client-id,secretstuff=secretstuff-client-id")
 	assert.Equal(t, c.EDatabaseClientSecret, "postgres=pg-secret,secretstuff=more-secret")
 	assert.Equal(t, c.OIDCDatabaseFallBackToBaseClient, true)
@@ -132,14 +256,38 @@ func TestNewConfigurationFull(t *testing.T) {
 	assert.Equal(t, c.PermissionAgentOPAUpdateQuery, "update query")
 	assert.Equal(t, c.PermissionAgentOPADeleteQuery, "delete query")
 	assert.Equal(t, c.PermissionAgentOPAStringEscapeCharacter, "''")
+	assert.Equal(t, c.PermissionAgentOPAClientPolicyPath, "data.machines")
 	assert.Equal(t, c.PermissionAgentHTTPDDLEndpoint, "http://ddl")
 	assert.Equal(t, c.PermissionAgentHTTPSelectEndpoint, "http://select")
+	assert.Equal(t, c.AuditEnabled, true)
+	assert.Equal(t, c.AuditSink, "http")
+	assert.Equal(t, c.AuditFile, "audit.jsonl")
+	assert.Equal(t, c.AuditSyslogNetwork, "udp")
+	assert.Equal(t, c.AuditSyslogAddress, "localhost:514")
+	assert.Equal(t, c.AuditSyslogTag, "foodme-audit")
+	assert.Equal(t, c.AuditHTTPEndpoint, "http://audit")
+	assert.Equal(t, c.AuditRedactLiterals, true)
+	assert.Equal(t, c.TracingEnabled, true)
+	assert.Equal(t, c.TracingOTLPEndpoint, "otel:4318")
+	assert.Equal(t, c.TracingOTLPInsecure, true)
+	assert.Equal(t, c.TracingServiceName, "foodme-test")
+	assert.Equal(t, c.TracingSampleRatio, 0.25)
+	assert.Equal(t, c.TracingFromApplicationName, true)
+	assert.Equal(t, c.TracingFromSQLComment, true)
 	assert.Equal(t, c.OIDCAssumeUserSession, true)
 	assert.Equal(t, c.OIDCAssumeUserSessionUsernameClaim, "db_role")
 	assert.Equal(t, c.OIDCAssumeUserSessionAllowEscape, true)
 	assert.Equal(t, c.ServerTLSEnabled, true)
 	assert.Equal(t, c.ServerTLSCertificateFile, "../data/cert.pem")
 	assert.Equal(t, c.ServerTLSCertificateKeyFile, "../data/key.pem")
+	assert.Equal(t, c.ServerTLSRequired, true)
+	assert.DeepEqual(t, c.ServerTLSCertificates, []*CertificateSpec{
+		{CertificateFile: "../data/cert.pem", CertificateKeyFile: "../data/key.pem"},
+		{CertificateFile: "../data/cert.pem", CertificateKeyFile: "../data/key.pem"},
+	})
+	assert.Equal(t, c.ServerTLSReloadPeriod, 60)
+	assert.Equal(t, c.ServerTLSClientAuth, "require")
+	assert.Equal(t, c.ServerTLSClientCAFile, "../data/cert.pem")
 	assert.Equal(t, c.ServerPort, 9876)
 	assert.Equal(t, c.ApiPort, 8888)
 	assert.Equal(t, c.APITLSEnabled, true)
@@ -212,6 +360,326 @@ func TestMissingPostAuthTemplate(t *testing.T) {
 	assert.Error(t, err, "OIDC Post Auth SQL template file does not exist: missing-file.sql")
 }
 
+func TestBadAuditConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--audit-enabled",
+	})
+	assert.Error(t, err, "audit file is required for the file audit sink")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--audit-enabled",
+		"--audit-sink", "http",
+	})
+	assert.Error(t, err, "audit HTTP endpoint is required for the http audit sink")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--audit-enabled",
+		"--audit-sink", "http",
+		"--audit-http-endpoint", "http://audit",
+		"--audit-http-timeout", "0",
+	})
+	assert.Error(t, err, "audit HTTP timeout must be at least 1: 0")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--audit-enabled",
+		"--audit-sink", "http",
+		"--audit-http-endpoint", "http://audit",
+		"--audit-http-queue-size", "0",
+	})
+	assert.Error(t, err, "audit HTTP queue size must be at least 1: 0")
+
+	c, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--audit-enabled",
+		"--audit-sink", "syslog",
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, c.AuditSink, "syslog")
+}
+
+func TestBadTracingConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--tracing-sample-ratio", "1.5",
+	})
+	assert.Error(t, err, "tracing sample ratio must be between 0 and 1: 1.5")
+}
+
+func TestBadDestinationHosts(t *testing.T) {
+	for hosts, expected := range map[string]string{
+		"replica":                "invalid destination host: replica",
+		"replica=replica":        "invalid destination host: replica=replica",
+		"replica:5432=leader":    "invalid destination host role: replica:5432=leader",
+		"replica:5432=replica=1": "invalid destination host: replica:5432=replica=1",
+		"localhost:5432=replica": "destination hosts have a duplicate host: localhost:5432",
+	} {
+		_, err := NewConfiguration([]string{
+			"--destination-database-type", "postgres",
+			"--destination-host", "localhost",
+			"--destination-port", "5432",
+			"--destination-hosts", hosts,
+		})
+		assert.Error(t, err, expected)
+	}
+
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--destination-hosts", "replica:5432=replica",
+		"--destination-check-period", "0",
+	})
+	assert.Error(t, err, "destination check period must be at least 1: 0")
+}
+
+func TestBadRoutingConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--routing-enabled",
+	})
+	assert.Error(t, err, "routing table file or routing address template is required for routing")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--routing-enabled",
+		"--routing-table-file", "../data/nonexistent.json",
+	})
+	assert.Error(t, err, "routing table file does not exist: ../data/nonexistent.json")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--routing-enabled",
+		"--routing-address-template", "{{ .tenant }}.db:5432",
+	})
+	assert.Error(t, err, "routing host pattern is required for the routing address template")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--routing-enabled",
+		"--routing-address-template", "{{ .tenant }}.db:5432",
+		"--routing-host-pattern", "[a-z",
+	})
+	assert.ErrorContains(t, err, "invalid routing host pattern")
+}
+
+func TestStartupParametersConfiguration(t *testing.T) {
+	c, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--startup-parameters-allowed", "application_name,options",
+		"--startup-parameters-denied", "",
+	})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, c.StartupParametersAllowed, []string{"application_name", "options"})
+	assert.Equal(t, len(c.StartupParametersDenied), 0)
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--startup-parameters-denied", "replication,Database",
+	})
+	assert.Error(t, err, "startup parameter Database cannot be configured")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--startup-parameters-allowed", "application_name,options",
+		"--startup-parameters-denied", "OPTIONS",
+	})
+	assert.Error(t, err, "startup parameter OPTIONS cannot be both allowed and denied")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--pool-mode", "session",
+		"--startup-parameters-allowed", "application_name,Options",
+	})
+	assert.Error(t, err, "startup parameter options cannot be forwarded by the pooled sessions")
+}
+
+func TestBadPasswordLoginConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--oidc-password-login", "password",
+	})
+	assert.Error(t, err, "OIDC must be enabled for the password login")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--oidc-enabled",
+		"--oidc-password-login", "implicit",
+	})
+	assert.ErrorContains(t, err, "Invalid value `implicit' for option `--oidc-password-login'")
+}
+
+func TestBadDeviceLoginConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--oidc-device-authorization-url", "http://device",
+	})
+	assert.Error(t, err, "OIDC must be enabled for the device login")
+}
+
+func TestBadClientCredentialsLoginConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--oidc-client-credentials-login",
+	})
+	assert.Error(t, err, "OIDC must be enabled for the client credentials login")
+}
+
+func TestBadCertificateAuthConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--certificate-auth-enabled",
+	})
+	assert.Error(t, err, "TLS client certificates are required for the certificate authentication")
+
+	tlsArgs := []string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--server-tls-enabled",
+		"--server-tls-certificate-file", "../data/cert.pem",
+		"--server-tls-certificate-key-file", "../data/key.pem",
+		"--certificate-auth-enabled",
+	}
+	_, err = NewConfiguration(tlsArgs)
+	assert.Error(t, err, "TLS client certificates are required for the certificate authentication")
+
+	tlsArgs = append(tlsArgs, "--server-tls-client-auth", "request", "--server-tls-client-ca-file", "../data/cert.pem")
+	_, err = NewConfiguration(tlsArgs)
+	assert.Error(t, err, "certificate identities file is required for the certificate authentication")
+
+	_, err = NewConfiguration(append(tlsArgs, "--certificate-auth-identities-file", "../data/nonexistent.json"))
+	assert.Error(t, err, "certificate identities file does not exist: ../data/nonexistent.json")
+}
+
+func TestBadDestinationCredentialsConfiguration(t *testing.T) {
+	args := []string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+	}
+	_, err := NewConfiguration(append(args, "--destination-credentials-file", "../data/nonexistent.json"))
+	assert.Error(t, err, "destination credentials file does not exist: ../data/nonexistent.json")
+
+	_, err = NewConfiguration(append(args, "--destination-credentials-file", "../data/test_routing.json", "--destination-credentials-reload-period", "0"))
+	assert.Error(t, err, "destination credentials reload period must be at least 1: 0")
+
+	conf, err := NewConfiguration(append(args, "--destination-credentials-file", "../data/test_routing.json"))
+	assert.NilError(t, err)
+	assert.Equal(t, conf.DestinationCredentialsClaim, "roles")
+	assert.Equal(t, conf.DestinationCredentialsReloadPeriod, 30)
+	assert.Equal(t, conf.DestinationCredentialsProvider, CredentialProviderFile)
+
+	_, err = NewConfiguration(append(args, "--destination-credentials-provider", "file"))
+	assert.Error(t, err, "destination credentials file is required for the file credentials provider")
+
+	_, err = NewConfiguration(append(args, "--destination-credentials-provider", "exec", "--destination-credentials-exec", " "))
+	assert.Error(t, err, "destination credentials command is required for the exec credentials provider")
+
+	_, err = NewConfiguration(append(args, "--destination-credentials-provider", "exec", "--destination-credentials-exec", "/usr/local/bin/credentials", "--destination-credentials-timeout", "0"))
+	assert.Error(t, err, "destination credentials timeout must be at least 1: 0")
+
+	_, err = NewConfiguration(append(args, "--destination-credentials-provider", "vault"))
+	assert.Error(t, err, "Vault URL is required for the vault credentials provider")
+
+	vault := append(args, "--destination-credentials-provider", "vault", "--destination-credentials-vault-url", "http://127.0.0.1:8200")
+	_, err = NewConfiguration(vault)
+	assert.Error(t, err, "Vault token is required for the vault credentials provider")
+
+	_, err = NewConfiguration(append(vault, "--destination-credentials-vault-token", "root", "--destination-credentials-vault-role", "{{ .Database"))
+	assert.ErrorContains(t, err, "invalid Vault role template")
+
+	_, err = NewConfiguration(append(args, "--destination-credentials-provider", "kms"))
+	assert.ErrorContains(t, err, "Invalid value `kms' for option `--destination-credentials-provider'")
+
+	conf, err = NewConfiguration(append(vault, "--destination-credentials-vault-token", "root"))
+	assert.NilError(t, err)
+	assert.Equal(t, conf.DestinationCredentialsVaultMount, "database")
+	assert.Equal(t, conf.DestinationCredentialsVaultRole, "{{ .Database }}")
+	assert.Equal(t, conf.DestinationCredentialsTimeout, 10)
+}
+
+func TestBadLocalAuthConfiguration(t *testing.T) {
+	args := []string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+	}
+	_, err := NewConfiguration(append(args, "--local-auth", "file"))
+	assert.Error(t, err, "local users file is required for the local authentication")
+
+	_, err = NewConfiguration(append(args, "--local-auth", "file", "--local-auth-users-file", "../data/nonexistent.json"))
+	assert.Error(t, err, "local users file does not exist: ../data/nonexistent.json")
+
+	_, err = NewConfiguration(append(args, "--local-auth", "ldap"))
+	assert.Error(t, err, "LDAP URL is required for the local authentication")
+
+	_, err = NewConfiguration(append(args, "--local-auth", "ldap", "--local-auth-ldap-url", "http://ldap.example.com"))
+	assert.Error(t, err, "invalid LDAP URL: http://ldap.example.com")
+
+	_, err = NewConfiguration(append(args, "--local-auth", "kerberos"))
+	assert.ErrorContains(t, err, "Invalid value `kerberos' for option `--local-auth'")
+
+	_, err = NewConfiguration(append(args, "--local-auth", "file", "--local-auth-users-file", "../data/test_local_users.json", "--oidc-enabled", "--oidc-password-login", "password"))
+	assert.Error(t, err, "local authentication cannot be combined with the OIDC password login")
+
+	conf, err := NewConfiguration(append(args, "--local-auth", "ldap", "--local-auth-ldap-url", "ldaps://ldap.example.com", "--local-auth-ldap-suffix", ",ou=people,dc=example,dc=com"))
+	assert.NilError(t, err)
+	assert.Equal(t, conf.LocalAuthLDAPPrefix, "cn=")
+}
+
+func TestBadPoolConfiguration(t *testing.T) {
+	_, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--pool-mode", "transaction",
+		"--pool-size", "0",
+	})
+	assert.Error(t, err, "pool size must be at least 1: 0")
+}
+
 func TestBadTLSConfiguration(t *testing.T) {
 	_, err := NewConfiguration([]string{
 		"--destination-database-type", "postgres",
@@ -248,6 +716,70 @@ func TestBadTLSConfiguration(t *testing.T) {
 		"--server-tls-certificate-key-file", "missing-key.pem",
 	})
 	assert.Error(t, err, "TLS certificate key file does not exist: missing-key.pem")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--server-tls-required",
+	})
+	assert.Error(t, err, "TLS must be enabled to be required")
+
+	tlsArgs := []string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--server-tls-enabled",
+		"--server-tls-certificate-file", "../data/cert.pem",
+		"--server-tls-certificate-key-file", "../data/key.pem",
+	}
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{args: []string{"--server-tls-reload-period", "0"}, err: "TLS reload period must be at least 1: 0"},
+		{args: []string{"--server-tls-client-auth", "request"}, err: "TLS client CA file is required for the client certificates"},
+		{args: []string{"--server-tls-client-ca-file", "missing-ca.pem"}, err: "TLS client CA file does not exist: missing-ca.pem"},
+		{args: []string{"--server-tls-certificates", "../data/cert.pem"}, err: "invalid TLS certificate: ../data/cert.pem"},
+		{args: []string{"--server-tls-certificates", "../data/cert.pem="}, err: "invalid TLS certificate: ../data/cert.pem="},
+		{args: []string{"--server-tls-certificates", "../data/cert.pem=missing-key.pem"}, err: "TLS certificate file does not exist: missing-key.pem"},
+	} {
+		_, err = NewConfiguration(append(append([]string{}, tlsArgs...), tc.args...))
+		assert.Error(t, err, tc.err)
+	}
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--destination-tls-mode", "strict",
+	})
+	assert.ErrorContains(t, err, "Invalid value `strict' for option `--destination-tls-mode'")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--destination-tls-ca-file", "missing-ca.pem",
+	})
+	assert.Error(t, err, "destination TLS file does not exist: missing-ca.pem")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--destination-tls-certificate-file", "../data/cert.pem",
+	})
+	assert.Error(t, err, "destination TLS certificate and key files are required together")
+
+	_, err = NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--destination-tls-mode", "disable",
+		"--destination-channel-binding", "require",
+	})
+	assert.Error(t, err, "destination channel binding requires TLS")
 }
 
 func TestNewLoggerFormatters(t *testing.T) {
@@ -316,3 +848,74 @@ func TestNewLoggerLevels(t *testing.T) {
 	logger = NewLogger(c)
 	assert.Equal(t, logger.Level, logrus.WarnLevel)
 }
+
+func TestMaxMessageSizeConfiguration(t *testing.T) {
+	c, err := NewConfiguration([]string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+		"--max-message-size", "1048576",
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, c.MaxMessageSize, 1048576)
+
+	for _, size := range []string{"0", "1073741824"} {
+		_, err = NewConfiguration([]string{
+			"--destination-database-type", "postgres",
+			"--destination-host", "localhost",
+			"--destination-port", "5432",
+			"--max-message-size", size,
+		})
+		assert.Error(t, err, "max message size must be between 1 and 1073741823: "+size)
+	}
+}
+
+func TestBadRoleProvisioningConfiguration(t *testing.T) {
+	args := []string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+	}
+	_, err := NewConfiguration(append(args, "--role-provisioning"))
+	assert.Error(t, err, "role mapping file is required for the role provisioning")
+
+	_, err = NewConfiguration(append(args, "--role-provisioning", "--role-provisioning-mapping-file", "../data/nonexistent.json"))
+	assert.Error(t, err, "role mapping file does not exist: ../data/nonexistent.json")
+
+	_, err = NewConfiguration(append(args, "--role-provisioning", "--role-provisioning-mapping-file", "../data/test_role_mapping.json", "--role-provisioning-cache-ttl", "-1"))
+	assert.Error(t, err, "role provisioning cache TTL must not be negative: -1")
+
+	conf, err := NewConfiguration(append(args, "--role-provisioning", "--role-provisioning-mapping-file", "../data/test_role_mapping.json"))
+	assert.NilError(t, err)
+	assert.Equal(t, conf.RoleProvisioningGroupsClaim, "groups")
+	assert.Equal(t, conf.RoleProvisioningCacheTTL, 300)
+}
+
+func TestAssumeUserSessionConfiguration(t *testing.T) {
+	args := []string{
+		"--destination-database-type", "postgres",
+		"--destination-host", "localhost",
+		"--destination-port", "5432",
+	}
+	conf, err := NewConfiguration(args)
+	assert.NilError(t, err)
+	assert.Equal(t, conf.OIDCAssumeUserSessionMode, AssumeSessionAuthorization)
+	assert.Equal(t, conf.OIDCAssumeUserSessionUsernamePattern, "")
+	assert.Assert(t, conf.OIDCAssumeUserSessionUsernameRegexp == nil)
+
+	conf, err = NewConfiguration(append(args, "--oidc-assume-user-session-username-pattern", "^[A-Za-z0-9_][A-Za-z0-9_.@$-]*$"))
+	assert.NilError(t, err)
+	assert.Assert(t, conf.OIDCAssumeUserSessionUsernameRegexp.MatchString("bob.smith@example.com"))
+	assert.Assert(t, !conf.OIDCAssumeUserSessionUsernameRegexp.MatchString("bob; DROP TABLE x"))
+
+	conf, err = NewConfiguration(append(args, "--oidc-assume-user-session-mode", "role", "--oidc-assume-user-session-username-lowercase", "--oidc-assume-user-session-username-strip-domain", "--oidc-assume-user-session-username-prefix", "app_", "--oidc-assume-user-session-username-pattern", ""))
+	assert.NilError(t, err)
+	assert.Equal(t, conf.OIDCAssumeUserSessionMode, AssumeSessionRole)
+	assert.DeepEqual(t, NewRoleNameRules(conf), &RoleNameRules{Lowercase: true, StripDomain: true, Prefix: "app_"})
+
+	_, err = NewConfiguration(append(args, "--oidc-assume-user-session-username-pattern", "^[a-z"))
+	assert.ErrorContains(t, err, "invalid assume user session username pattern")
+
+	_, err = NewConfiguration(append(args, "--oidc-assume-user-session-mode", "set"))
+	assert.ErrorContains(t, err, "Invalid value `set' for option `--oidc-assume-user-session-mode'")
+}
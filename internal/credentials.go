@@ -0,0 +1,228 @@
+package foodme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CredentialProviderDisabled = "disabled"
+	CredentialProviderFile     = "file"
+	CredentialProviderExec     = "exec"
+	CredentialProviderVault    = "vault"
+)
+
+// UpstreamCredential is a service account of the destination. The password
+// is given as it is or by the name of the environment variable holding it.
+type UpstreamCredential struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	PasswordEnv string `json:"password_env"`
+}
+
+// CredentialLease is the credential a session logs in upstream with. The
+// credentials without an expiration are valid until the provider changes
+// them, the others are renewed while the session lasts.
+type CredentialLease struct {
+	Credential *UpstreamCredential
+	ID         string
+	Expires    time.Time
+	Renewable  bool
+}
+
+// NewCredentialProvider creates the provider of the destination credentials
+// and starts its background work.
+func NewCredentialProvider(conf *Configuration, logger *logrus.Logger, httpClient IHttpClient) (ICredentialProvider, error) {
+	switch conf.DestinationCredentialsProvider {
+	case CredentialProviderFile:
+		store, err := NewCredentialStore(conf, logger)
+		if err != nil {
+			return nil, err
+		}
+		store.Start()
+		return store, nil
+	case CredentialProviderExec:
+		return NewExecCredentialProvider(conf), nil
+	case CredentialProviderVault:
+		return NewVaultCredentialProvider(conf, httpClient)
+	default:
+		return nil, fmt.Errorf("unknown destination credentials provider: %s", conf.DestinationCredentialsProvider)
+	}
+}
+
+// observeLease counts the operation of the provider on the credentials.
+func observeLease(provider, operation string, err error) {
+	credentialLeasesTotal.WithLabelValues(provider, operation, observeOutcome(err)).Inc()
+}
+
+// credentialSet is a single load of the credentials file.
+type credentialSet struct {
+	Databases map[string]*UpstreamCredential `json:"databases"`
+	Roles     map[string]*UpstreamCredential `json:"roles"`
+}
+
+// CredentialStore picks the service account a session logs in upstream as,
+// by the roles of the user or by the database. The file is checked
+// periodically, so the rotated credentials are picked up without a restart.
+type CredentialStore struct {
+	File         string
+	RoleClaim    string
+	ReloadPeriod time.Duration
+	Logger       *logrus.Logger
+
+	current  atomic.Pointer[credentialSet]
+	stamp    string
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  sync.WaitGroup
+}
+
+func NewCredentialStore(conf *Configuration, logger *logrus.Logger) (*CredentialStore, error) {
+	s := &CredentialStore{
+		File:         conf.DestinationCredentialsFile,
+		RoleClaim:    conf.DestinationCredentialsClaim,
+		ReloadPeriod: time.Duration(conf.DestinationCredentialsReloadPeriod) * time.Second,
+		Logger:       logger,
+		stop:         make(chan struct{}),
+	}
+
+	s.stamp = fileStamp(s.File)
+	err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads the file and resolves the passwords, the credentials are
+// replaced only when every one of them is valid.
+func (s *CredentialStore) Load() error {
+	data, err := os.ReadFile(s.File)
+	if err != nil {
+		return fmt.Errorf("failed to read destination credentials: %w", err)
+	}
+	set := &credentialSet{}
+	err = json.Unmarshal(data, set)
+	if err != nil {
+		return fmt.Errorf("failed to parse destination credentials: %w", err)
+	}
+
+	for kind, credentials := range map[string]map[string]*UpstreamCredential{"database": set.Databases, "role": set.Roles} {
+		for name, credential := range credentials {
+			if credential == nil || credential.Username == "" {
+				return fmt.Errorf("destination credentials of the %s %s have no username", kind, name)
+			}
+			if credential.PasswordEnv == "" {
+				continue
+			}
+			password, ok := os.LookupEnv(credential.PasswordEnv)
+			if !ok {
+				return fmt.Errorf("environment variable %s of the destination credentials of the %s %s is not set", credential.PasswordEnv, kind, name)
+			}
+			credential.Password = password
+		}
+	}
+
+	s.current.Store(set)
+	return nil
+}
+
+// Start checks the file for changes in the background until the store is
+// closed.
+func (s *CredentialStore) Start() {
+	s.stopped.Add(1)
+	go func() {
+		defer s.stopped.Done()
+		ticker := time.NewTicker(s.ReloadPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.reloadChanged()
+			}
+		}
+	}()
+}
+
+func (s *CredentialStore) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.stopped.Wait()
+	return nil
+}
+
+// reloadChanged loads the file again once it changed. A failed load keeps
+// the previous credentials and is retried with the next check.
+func (s *CredentialStore) reloadChanged() {
+	stamp := fileStamp(s.File)
+	if stamp == s.stamp {
+		return
+	}
+
+	err := s.Load()
+	if err != nil {
+		s.Logger.WithField("component", "credentials").Warnf("Failed to reload the destination credentials, keeping the previous ones: %v", err)
+		return
+	}
+	s.stamp = stamp
+	s.Logger.WithField("component", "credentials").Info("Reloaded the destination credentials")
+}
+
+// Lookup returns the credentials of the first role of the user found in the
+// file, then the ones of the database.
+func (s *CredentialStore) Lookup(database string, userinfo map[string]interface{}) (*UpstreamCredential, bool) {
+	set := s.current.Load()
+	for _, role := range claimValues(userinfo[s.RoleClaim]) {
+		if credential, ok := set.Roles[role]; ok {
+			return credential, true
+		}
+	}
+	credential, ok := set.Databases[database]
+	return credential, ok
+}
+
+// Lease returns the credentials of the file picked for the session, nil when
+// none of them matches.
+func (s *CredentialStore) Lease(ctx context.Context, database string, userinfo map[string]interface{}) (*CredentialLease, error) {
+	credential, ok := s.Lookup(database, userinfo)
+	if !ok {
+		return nil, nil
+	}
+	observeLease(CredentialProviderFile, "lease", nil)
+	return &CredentialLease{Credential: credential}, nil
+}
+
+// Renew fails, the credentials of the file do not expire.
+func (s *CredentialStore) Renew(lease *CredentialLease) error {
+	return fmt.Errorf("destination credentials of the file are not renewable")
+}
+
+func (s *CredentialStore) Release(lease *CredentialLease) error {
+	return nil
+}
+
+// claimValues lists the values of a string or a list claim.
+func claimValues(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
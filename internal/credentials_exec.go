@@ -0,0 +1,94 @@
+package foodme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ExecCredentialProvider runs a plugin for the credentials of every session.
+// The plugin gets the database and the userinfo as JSON on its standard input
+// and prints the credentials as JSON, an empty username leaves the session
+// to the configured destination user.
+type ExecCredentialProvider struct {
+	Command []string
+	Timeout time.Duration
+}
+
+type execCredentialRequest struct {
+	Database string                 `json:"database"`
+	UserInfo map[string]interface{} `json:"userinfo"`
+}
+
+type execCredentialResponse struct {
+	Username  string     `json:"username"`
+	Password  string     `json:"password"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func NewExecCredentialProvider(conf *Configuration) *ExecCredentialProvider {
+	return &ExecCredentialProvider{
+		Command: strings.Fields(conf.DestinationCredentialsExec),
+		Timeout: time.Duration(conf.DestinationCredentialsTimeout) * time.Second,
+	}
+}
+
+func (p *ExecCredentialProvider) Lease(ctx context.Context, database string, userinfo map[string]interface{}) (*CredentialLease, error) {
+	lease, err := p.run(ctx, database, userinfo)
+	observeLease(CredentialProviderExec, "lease", err)
+	return lease, err
+}
+
+func (p *ExecCredentialProvider) run(ctx context.Context, database string, userinfo map[string]interface{}) (*CredentialLease, error) {
+	input, err := json.Marshal(&execCredentialRequest{Database: database, UserInfo: userinfo})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal credentials plugin input: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return nil, fmt.Errorf("credentials plugin failed: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("credentials plugin failed: %w", err)
+	}
+
+	response := &execCredentialResponse{}
+	err = json.Unmarshal(output, response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output of the credentials plugin: %w", err)
+	}
+	if response.Username == "" {
+		return nil, nil
+	}
+
+	lease := &CredentialLease{Credential: &UpstreamCredential{Username: response.Username, Password: response.Password}}
+	if response.ExpiresAt != nil {
+		lease.Expires = *response.ExpiresAt
+	}
+	return lease, nil
+}
+
+// Renew fails, running the plugin again gives new credentials rather than
+// extending the old ones.
+func (p *ExecCredentialProvider) Renew(lease *CredentialLease) error {
+	return fmt.Errorf("destination credentials of the plugin are not renewable")
+}
+
+func (p *ExecCredentialProvider) Release(lease *CredentialLease) error {
+	return nil
+}
+
+func (p *ExecCredentialProvider) Close() error {
+	return nil
+}
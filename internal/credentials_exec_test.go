@@ -0,0 +1,68 @@
+package foodme
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func writeTestPlugin(t *testing.T, script string) string {
+	file := filepath.Join(t.TempDir(), "plugin.sh")
+	assert.NilError(t, os.WriteFile(file, []byte("#!/bin/sh\n"+script), 0700))
+	return file
+}
+
+func TestExecCredentialProvider(t *testing.T) {
+	// The plugin answers by the database and the roles of the input
+	plugin := writeTestPlugin(t, `
+input=$(cat)
+case "$input" in
+  *'"database":"analytics"'*'"roles":["admin"]'*) echo '{"username": "analytics_admin", "password": "secret", "expires_at": "2030-01-02T03:04:05Z"}' ;;
+  *'"database":"analytics"'*) echo '{"username": "analytics_ro", "password": "secret"}' ;;
+  *'"database":"broken"'*) echo "no credentials for $1" >&2; exit 3 ;;
+  *'"database":"garbage"'*) echo 'garbage' ;;
+  *) echo '{}' ;;
+esac
+`)
+	provider := NewExecCredentialProvider(&Configuration{DestinationCredentialsExec: plugin + " broken", DestinationCredentialsTimeout: 5})
+	assert.DeepEqual(t, provider.Command, []string{plugin, "broken"})
+
+	lease, err := provider.Lease(context.Background(), "analytics", map[string]interface{}{"roles": []interface{}{"admin"}})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, lease.Credential, &UpstreamCredential{Username: "analytics_admin", Password: "secret"})
+	assert.Equal(t, lease.Expires, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	lease, err = provider.Lease(context.Background(), "analytics", nil)
+	assert.NilError(t, err)
+	assert.Equal(t, lease.Credential.Username, "analytics_ro")
+	assert.Assert(t, lease.Expires.IsZero())
+	assert.ErrorContains(t, provider.Renew(lease), "destination credentials of the plugin are not renewable")
+	assert.NilError(t, provider.Release(lease))
+
+	// An empty username leaves the session to the configured destination user
+	lease, err = provider.Lease(context.Background(), "postgres", nil)
+	assert.NilError(t, err)
+	assert.Assert(t, lease == nil)
+
+	_, err = provider.Lease(context.Background(), "broken", nil)
+	assert.ErrorContains(t, err, "credentials plugin failed: exit status 3: no credentials for broken")
+	_, err = provider.Lease(context.Background(), "garbage", nil)
+	assert.ErrorContains(t, err, "invalid output of the credentials plugin")
+
+	provider.Command = []string{filepath.Join(t.TempDir(), "missing")}
+	_, err = provider.Lease(context.Background(), "analytics", nil)
+	assert.ErrorContains(t, err, "credentials plugin failed")
+}
+
+func TestExecCredentialProviderTimeout(t *testing.T) {
+	provider := NewExecCredentialProvider(&Configuration{DestinationCredentialsExec: writeTestPlugin(t, "exec sleep 5\n"), DestinationCredentialsTimeout: 1})
+	provider.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := provider.Lease(context.Background(), "analytics", nil)
+	assert.ErrorContains(t, err, "credentials plugin failed")
+	assert.Assert(t, time.Since(start) < 2*time.Second)
+}
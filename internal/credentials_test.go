@@ -0,0 +1,78 @@
+package foodme
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+)
+
+func TestNewCredentialStore(t *testing.T) {
+	t.Setenv("FOODME_TEST_ANALYTICS_PASSWORD", "analytics-secret")
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	err := os.WriteFile(file, []byte(`{
+		"databases": {
+			"analytics": {"username": "analytics_ro", "password_env": "FOODME_TEST_ANALYTICS_PASSWORD"},
+			"app": {"username": "app_svc", "password": "app-secret"}
+		},
+		"roles": {"admin": {"username": "admin_svc", "password": "admin-secret"}}
+	}`), 0600)
+	assert.NilError(t, err)
+
+	store, err := NewCredentialStore(&Configuration{DestinationCredentialsFile: file, DestinationCredentialsClaim: "roles", DestinationCredentialsReloadPeriod: 1}, logrus.StandardLogger())
+	assert.NilError(t, err)
+
+	credential, ok := store.Lookup("analytics", map[string]interface{}{"roles": []interface{}{"viewer"}})
+	assert.Assert(t, ok)
+	assert.Equal(t, credential.Username, "analytics_ro")
+	assert.Equal(t, credential.Password, "analytics-secret")
+
+	// The first role found wins over the database
+	credential, ok = store.Lookup("app", map[string]interface{}{"roles": []interface{}{"viewer", "admin"}})
+	assert.Assert(t, ok)
+	assert.Equal(t, credential.Username, "admin_svc")
+	credential, ok = store.Lookup("app", map[string]interface{}{"roles": "admin"})
+	assert.Assert(t, ok)
+	assert.Equal(t, credential.Username, "admin_svc")
+
+	_, ok = store.Lookup("postgres", map[string]interface{}{"roles": 1})
+	assert.Assert(t, !ok)
+}
+
+func TestBadCredentialStore(t *testing.T) {
+	dir := t.TempDir()
+	conf := &Configuration{DestinationCredentialsFile: filepath.Join(dir, "credentials.json"), DestinationCredentialsClaim: "roles", DestinationCredentialsReloadPeriod: 1}
+	_, err := NewCredentialStore(conf, logrus.StandardLogger())
+	assert.ErrorContains(t, err, "failed to read destination credentials")
+
+	for content, expected := range map[string]string{
+		`{"databases": []}`: "failed to parse destination credentials",
+		`{"databases": {"app": {"password": "secret"}}}`:                       "destination credentials of the database app have no username",
+		`{"roles": {"admin": null}}`:                                           "destination credentials of the role admin have no username",
+		`{"roles": {"admin": {"username": "admin", "password_env": "UNSET"}}}`: "environment variable UNSET of the destination credentials of the role admin is not set",
+	} {
+		assert.NilError(t, os.WriteFile(conf.DestinationCredentialsFile, []byte(content), 0600))
+		_, err = NewCredentialStore(conf, logrus.StandardLogger())
+		assert.ErrorContains(t, err, expected)
+	}
+}
+
+func TestCredentialStoreReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	assert.NilError(t, os.WriteFile(file, []byte(`{"databases": {"app": {"username": "app_v1"}}}`), 0600))
+	store, err := NewCredentialStore(&Configuration{DestinationCredentialsFile: file, DestinationCredentialsReloadPeriod: 1}, logrus.StandardLogger())
+	assert.NilError(t, err)
+
+	// A broken file keeps the previous credentials
+	assert.NilError(t, os.WriteFile(file, []byte(`{"databases": {"app": {}}}`), 0600))
+	store.reloadChanged()
+	credential, _ := store.Lookup("app", nil)
+	assert.Equal(t, credential.Username, "app_v1")
+
+	assert.NilError(t, os.WriteFile(file, []byte(`{"databases": {"app": {"username": "app_v2"}}}`), 0600))
+	store.reloadChanged()
+	credential, _ = store.Lookup("app", nil)
+	assert.Equal(t, credential.Username, "app_v2")
+}
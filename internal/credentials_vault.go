@@ -0,0 +1,190 @@
+package foodme
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// VaultCredentialProvider leases the dynamic credentials of a Vault database
+// secrets engine for every session. The role is picked by a template of the
+// database and the userinfo of the session.
+type VaultCredentialProvider struct {
+	URL     string
+	Token   string
+	Mount   string
+	Role    *template.Template
+	Timeout time.Duration
+
+	client IHttpClient
+}
+
+// vaultRoleData is the data of the role template.
+type vaultRoleData struct {
+	Database string
+	UserInfo map[string]interface{}
+}
+
+type vaultSecret struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+	Data          struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"data"`
+}
+
+type vaultErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// parseVaultRole parses the role template, the missing keys fail the
+// execution instead of rendering "<no value>".
+func parseVaultRole(text string) (*template.Template, error) {
+	return template.New("vault-role").Option("missingkey=error").Parse(text)
+}
+
+func NewVaultCredentialProvider(conf *Configuration, httpClient IHttpClient) (*VaultCredentialProvider, error) {
+	role, err := parseVaultRole(conf.DestinationCredentialsVaultRole)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Vault role template: %w", err)
+	}
+	return &VaultCredentialProvider{
+		URL:     strings.TrimSuffix(conf.DestinationCredentialsVaultURL, "/"),
+		Token:   conf.DestinationCredentialsVaultToken,
+		Mount:   strings.Trim(conf.DestinationCredentialsVaultMount, "/"),
+		Role:    role,
+		Timeout: time.Duration(conf.DestinationCredentialsTimeout) * time.Second,
+		client:  httpClient,
+	}, nil
+}
+
+// Lease reads new credentials of the role of the session, an empty role
+// leaves the session to the configured destination user.
+func (p *VaultCredentialProvider) Lease(ctx context.Context, database string, userinfo map[string]interface{}) (*CredentialLease, error) {
+	var role bytes.Buffer
+	err := p.Role.Execute(&role, &vaultRoleData{Database: database, UserInfo: userinfo})
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute Vault role template: %w", err)
+	}
+	if role.Len() == 0 {
+		return nil, nil
+	}
+	// The role may come from the claims, it must stay a single segment of the path
+	if strings.Contains(role.String(), "/") || role.String() == "." || role.String() == ".." {
+		return nil, fmt.Errorf("invalid Vault role: %q", role.String())
+	}
+
+	secret := &vaultSecret{}
+	err = p.query(ctx, http.MethodGet, "/v1/"+p.Mount+"/creds/"+url.PathEscape(role.String()), nil, secret)
+	observeLease(CredentialProviderVault, "lease", err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease the credentials of the Vault role %s: %w", role.String(), err)
+	}
+	if secret.Data.Username == "" {
+		return nil, fmt.Errorf("Vault role %s returned no username", role.String())
+	}
+
+	return &CredentialLease{
+		Credential: &UpstreamCredential{Username: secret.Data.Username, Password: secret.Data.Password},
+		ID:         secret.LeaseID,
+		Expires:    leaseExpiration(secret.LeaseDuration),
+		Renewable:  secret.Renewable,
+	}, nil
+}
+
+// Renew extends the lease, Vault shortens the extension once the lease
+// approaches its maximum TTL.
+func (p *VaultCredentialProvider) Renew(lease *CredentialLease) error {
+	secret := &vaultSecret{}
+	err := p.query(context.Background(), http.MethodPut, "/v1/sys/leases/renew", map[string]string{"lease_id": lease.ID}, secret)
+	observeLease(CredentialProviderVault, "renew", err)
+	if err != nil {
+		return fmt.Errorf("failed to renew the Vault lease: %w", err)
+	}
+	if secret.LeaseDuration <= 0 {
+		return fmt.Errorf("Vault lease has expired: %s", lease.ID)
+	}
+	lease.Expires = leaseExpiration(secret.LeaseDuration)
+	lease.Renewable = secret.Renewable
+	return nil
+}
+
+// Release revokes the lease, Vault drops the credentials right away.
+func (p *VaultCredentialProvider) Release(lease *CredentialLease) error {
+	err := p.query(context.Background(), http.MethodPut, "/v1/sys/leases/revoke", map[string]string{"lease_id": lease.ID}, nil)
+	observeLease(CredentialProviderVault, "release", err)
+	if err != nil {
+		return fmt.Errorf("failed to revoke the Vault lease: %w", err)
+	}
+	return nil
+}
+
+func (p *VaultCredentialProvider) Close() error {
+	return nil
+}
+
+func (p *VaultCredentialProvider) query(ctx context.Context, method, path string, payload interface{}, response interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal json payload: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, p.URL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		vaultErr := &vaultErrors{}
+		if json.Unmarshal(data, vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.Join(vaultErr.Errors, ", "))
+		}
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if response == nil {
+		return nil
+	}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+	return nil
+}
+
+// leaseExpiration is the expiration of a lease of the duration in seconds,
+// the leases without a duration do not expire.
+func leaseExpiration(duration int) time.Time {
+	if duration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(duration) * time.Second)
+}
@@ -0,0 +1,160 @@
+package foodme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// fakeVault leases the credentials of the database secrets engine mounted at
+// database, every lease gets a new user.
+type fakeVault struct {
+	*httptest.Server
+
+	mutex         sync.Mutex
+	duration      int
+	renewDuration int
+	leases        int
+	renewed       []string
+	revoked       []string
+}
+
+func startFakeVault(t *testing.T, duration int) *fakeVault {
+	vault := &fakeVault{duration: duration, renewDuration: duration}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/database/creds/{role}", func(w http.ResponseWriter, r *http.Request) {
+		role := r.PathValue("role")
+		if role == "missing" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["unknown role: missing"]}`))
+			return
+		}
+		vault.mutex.Lock()
+		vault.leases++
+		lease, duration := vault.leases, vault.duration
+		vault.mutex.Unlock()
+		fmt.Fprintf(w, `{"lease_id":"database/creds/%s/%d","lease_duration":%d,"renewable":true,"data":{"username":"v-%s-%d","password":"secret"}}`, role, lease, duration, role, lease)
+	})
+	mux.HandleFunc("PUT /v1/sys/leases/renew", func(w http.ResponseWriter, r *http.Request) {
+		payload := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		vault.mutex.Lock()
+		vault.renewed = append(vault.renewed, payload["lease_id"])
+		duration := vault.renewDuration
+		vault.mutex.Unlock()
+		fmt.Fprintf(w, `{"lease_id":%q,"lease_duration":%d,"renewable":%t}`, payload["lease_id"], duration, duration > 0)
+	})
+	mux.HandleFunc("PUT /v1/sys/leases/revoke", func(w http.ResponseWriter, r *http.Request) {
+		payload := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		vault.mutex.Lock()
+		vault.revoked = append(vault.revoked, payload["lease_id"])
+		vault.mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	vault.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(vault.Close)
+	return vault
+}
+
+// SetDurations sets the durations in seconds of the new and the renewed leases.
+func (v *fakeVault) SetDurations(duration, renewDuration int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.duration, v.renewDuration = duration, renewDuration
+}
+
+func (v *fakeVault) Revoked() []string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return append([]string{}, v.revoked...)
+}
+
+func (v *fakeVault) Renewed() []string {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return append([]string{}, v.renewed...)
+}
+
+func TestVaultCredentialProvider(t *testing.T) {
+	vault := startFakeVault(t, 60)
+	conf := &Configuration{
+		DestinationCredentialsVaultURL:   vault.URL + "/",
+		DestinationCredentialsVaultToken: "root",
+		DestinationCredentialsVaultMount: "/database/",
+		DestinationCredentialsVaultRole:  `{{ if index .UserInfo "admin" }}{{ .Database }}_admin{{ else if ne .Database "postgres" }}{{ .Database }}{{ end }}`,
+		DestinationCredentialsTimeout:    5,
+	}
+	provider, err := NewVaultCredentialProvider(conf, &http.Client{})
+	assert.NilError(t, err)
+	assert.Equal(t, provider.URL, vault.URL)
+	assert.Equal(t, provider.Mount, "database")
+
+	lease, err := provider.Lease(context.Background(), "analytics", map[string]interface{}{"admin": true})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, lease.Credential, &UpstreamCredential{Username: "v-analytics_admin-1", Password: "secret"})
+	assert.Equal(t, lease.ID, "database/creds/analytics_admin/1")
+	assert.Assert(t, lease.Renewable)
+	assert.Assert(t, time.Until(lease.Expires) > 50*time.Second)
+
+	vault.SetDurations(60, 300)
+	assert.NilError(t, provider.Renew(lease))
+	assert.Assert(t, time.Until(lease.Expires) > 250*time.Second)
+	assert.DeepEqual(t, vault.Renewed(), []string{"database/creds/analytics_admin/1"})
+
+	// A lease past its maximum TTL is not extended
+	vault.SetDurations(60, 0)
+	assert.Error(t, provider.Renew(lease), "Vault lease has expired: database/creds/analytics_admin/1")
+
+	assert.NilError(t, provider.Release(lease))
+	assert.DeepEqual(t, vault.Revoked(), []string{"database/creds/analytics_admin/1"})
+
+	// An empty role leaves the session to the configured destination user
+	lease, err = provider.Lease(context.Background(), "postgres", nil)
+	assert.NilError(t, err)
+	assert.Assert(t, lease == nil)
+
+	_, err = provider.Lease(context.Background(), "missing", nil)
+	assert.Error(t, err, "failed to lease the credentials of the Vault role missing: unexpected status code: 400: unknown role: missing")
+
+	provider.Token = "wrong"
+	_, err = provider.Lease(context.Background(), "analytics", nil)
+	assert.Error(t, err, "failed to lease the credentials of the Vault role analytics: unexpected status code: 403: permission denied")
+	assert.ErrorContains(t, provider.Release(&CredentialLease{ID: "database/creds/analytics/2"}), "failed to revoke the Vault lease: unexpected status code: 403")
+
+	// The roles from the claims cannot leave the creds of the mount
+	conf.DestinationCredentialsVaultRole = `{{ index .UserInfo "team" }}`
+	provider, err = NewVaultCredentialProvider(conf, &http.Client{})
+	assert.NilError(t, err)
+	for _, team := range []string{"../../sys/raw", "..", "analytics/admin"} {
+		_, err = provider.Lease(context.Background(), "analytics", map[string]interface{}{"team": team})
+		assert.Error(t, err, fmt.Sprintf("invalid Vault role: %q", team))
+	}
+	lease, err = provider.Lease(context.Background(), "analytics", map[string]interface{}{"team": "data team?x"})
+	assert.NilError(t, err)
+	assert.Equal(t, lease.Credential.Username, "v-data team?x-2")
+
+	conf.DestinationCredentialsVaultRole = "{{ .UserInfo.missing.claim }}"
+	provider, err = NewVaultCredentialProvider(conf, &http.Client{})
+	assert.NilError(t, err)
+	_, err = provider.Lease(context.Background(), "analytics", map[string]interface{}{})
+	assert.ErrorContains(t, err, "failed to execute Vault role template")
+
+	conf.DestinationCredentialsVaultRole = "{{ .Database"
+	_, err = NewVaultCredentialProvider(conf, &http.Client{})
+	assert.ErrorContains(t, err, "failed to parse Vault role template")
+}
@@ -1,32 +1,61 @@
 package foodme
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-type BasicUpstreamHandler struct {
-	Address string
+// HandlerDeps are the dependencies the handlers of all the sessions share,
+// the server creates them once. The missing ones turn their features off.
+type HandlerDeps struct {
+	HTTPClient      IHttpClient
+	Auditor         *Auditor
+	Pool            *UpstreamPool
+	Upstream        IUpstreamHandler
+	Router          *Router
+	Certificates    *CertificateManager
+	Identities      *CertificateIdentities
+	Local           *LocalAuthenticator
+	Credentials     ICredentialProvider
+	Provisioner     *RoleProvisioner
+	Cancels         *CancelRegistry
+	PermissionAgent IPermissionAgent
+	RoleNames       *RoleNameRules
 }
 
-func (h *BasicUpstreamHandler) Connect() (net.Conn, error) {
-	return net.Dial("tcp", h.Address)
+// Prepare traces the HTTP client and creates the permission agent and the
+// role name rules of the configuration.
+func (d *HandlerDeps) Prepare(conf *Configuration) error {
+	if conf.TracingEnabled {
+		d.HTTPClient = NewTracingHTTPClient(d.HTTPClient)
+	}
+	if conf.PermissionAgentEnabled {
+		agent, err := NewPermissionAgent(conf, d.HTTPClient)
+		if err != nil {
+			return fmt.Errorf("failed to create permission agent: %w", err)
+		}
+		d.PermissionAgent = agent
+	}
+	d.RoleNames = NewRoleNameRules(conf)
+	return nil
 }
 
-func GetHandler(conf *Configuration, logger *logrus.Logger, httpClient IHttpClient) (IHandler, error) {
-	upstreamHandler := &BasicUpstreamHandler{
-		Address: conf.DestinationHost + ":" + fmt.Sprint(conf.DestinationPort),
+func GetHandler(conf *Configuration, logger *logrus.Logger, deps *HandlerDeps) (IHandler, error) {
+	upstreamHandler := deps.Upstream
+	if upstreamHandler == nil {
+		upstreamHandler = &BasicUpstreamHandler{
+			Address: conf.DestinationHost + ":" + fmt.Sprint(conf.DestinationPort),
+		}
 	}
 
+	// The SQL handler keeps the decisions of the session
 	var sqlHandler ISQLHandler
-	if conf.PermissionAgentEnabled {
-		pAgent, err := NewPermissionAgent(conf, httpClient)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create permission agent: %w", err)
-		}
-		sqlHandler, err = NewSQLHandler(conf.DestinationDatabaseType, logger, pAgent)
+	if deps.PermissionAgent != nil {
+		var err error
+		sqlHandler, err = NewSQLHandler(conf.DestinationDatabaseType, logger, deps.PermissionAgent)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create SQL handler: %w", err)
 		}
@@ -34,33 +63,128 @@ func GetHandler(conf *Configuration, logger *logrus.Logger, httpClient IHttpClie
 
 	switch conf.DestinationDatabaseType {
 	case "postgres":
-		return NewPostgresHandler(
-				conf.DestinationHost+":"+fmt.Sprint(conf.DestinationPort),
-				conf.DestinationUsername,
-				conf.DestinationPassword,
-				upstreamHandler,
-				logger,
-				conf.DestinationLogUpstream,
-				conf.DestinationLogDownstream,
-				conf.OIDCEnabled,
-				httpClient,
-				conf.OIDCClientID,
-				conf.OIDCClientSecret,
-				conf.OIDCTokenURL,
-				conf.OIDCUserInfoURL,
-				conf.OIDCDatabaseFallBackToBaseClient,
-				conf.OIDCDatabaseClients,
-				conf.OIDCPostAuthSQLTemplate,
-				sqlHandler,
-				conf.ServerTLSEnabled,
-				conf.ServerTLSCertificateFile,
-				conf.ServerTLSCertificateKeyFile,
-				conf.OIDCAssumeUserSession,
-				conf.OIDCAssumeUserSessionUsernameClaim,
-				conf.OIDCAssumeUserSessionAllowEscape,
-			),
-			nil
+		handler := NewPostgresHandler(
+			conf.DestinationHost+":"+fmt.Sprint(conf.DestinationPort),
+			conf.DestinationUsername,
+			conf.DestinationPassword,
+			upstreamHandler,
+			logger,
+			conf.DestinationLogUpstream,
+			conf.DestinationLogDownstream,
+			conf.OIDCEnabled,
+			deps.HTTPClient,
+			conf.OIDCClientID,
+			conf.OIDCClientSecret,
+			conf.OIDCTokenURL,
+			conf.OIDCUserInfoURL,
+			conf.OIDCDatabaseFallBackToBaseClient,
+			conf.OIDCDatabaseClients,
+			conf.OIDCPostAuthSQLTemplate,
+			sqlHandler,
+			conf.ServerTLSEnabled,
+			conf.ServerTLSCertificateFile,
+			conf.ServerTLSCertificateKeyFile,
+			conf.OIDCAssumeUserSession,
+			conf.OIDCAssumeUserSessionUsernameClaim,
+			conf.OIDCAssumeUserSessionAllowEscape,
+		)
+		handler.PasswordLogin = conf.OIDCPasswordLogin
+		handler.DeviceAuthorizationURL = conf.OIDCDeviceAuthorizationURL
+		handler.DeviceLoginUsername = conf.OIDCDeviceLoginUsername
+		handler.ClientCredentialsLogin = conf.OIDCClientCredentialsLogin
+		handler.TLSRequired = conf.ServerTLSRequired
+		handler.Certificates = deps.Certificates
+		handler.Identities = deps.Identities
+		handler.Local = deps.Local
+		handler.Credentials = deps.Credentials
+		handler.Provisioner = deps.Provisioner
+		handler.AssumeUserSessionMode = conf.OIDCAssumeUserSessionMode
+		handler.RoleNames = deps.RoleNames
+		handler.Auditor = deps.Auditor
+		handler.Pool = deps.Pool
+		handler.Router = deps.Router
+		handler.Cancels = deps.Cancels
+		handler.UpstreamTLSMode = conf.DestinationTLSMode
+		handler.UpstreamTLSCAFile = conf.DestinationTLSCAFile
+		handler.UpstreamInsecurePasswordAuth = conf.DestinationInsecurePasswordAuth
+		handler.UpstreamTLSCertificateFile = conf.DestinationTLSCertificateFile
+		handler.UpstreamTLSCertificateKeyFile = conf.DestinationTLSCertificateKeyFile
+		handler.UpstreamChannelBinding = conf.DestinationChannelBinding
+		handler.ReadOnlyRouting = conf.DestinationReadOnlyRouting
+		handler.ReadOnlyClaim = conf.DestinationReadOnlyClaim
+		handler.TraceFromApplicationName = conf.TracingFromApplicationName
+		handler.TraceFromSQLComment = conf.TracingFromSQLComment
+		handler.StartupParametersAllowed = conf.StartupParametersAllowed
+		handler.StartupParametersDenied = conf.StartupParametersDenied
+		handler.MaxMessageSize = conf.MaxMessageSize
+		handler.MetricsDatabases = conf.MetricsDatabases
+		return handler, nil
+	default:
+		return nil, fmt.Errorf("unknown destination database type: %s", conf.DestinationDatabaseType)
+	}
+}
+
+func GetUpstreamPool(conf *Configuration, logger *logrus.Logger, upstreamHandler IUpstreamHandler) (*UpstreamPool, error) {
+	switch conf.DestinationDatabaseType {
+	case "postgres":
+		dial := func(key PoolKey) (*PooledConn, error) {
+			handler := newUpstreamPostgresHandler(conf, logger, upstreamHandler)
+			handler.readOnly = key.ReadOnly
+			if key.Address != "" {
+				handler.UpstreamHandler = &BasicUpstreamHandler{Address: key.Address}
+			}
+			if key.Username != "" {
+				handler.Username = key.Username
+				handler.Password = key.Password
+			}
+			return handler.dialPooled(key)
+		}
+		return NewUpstreamPool(conf.PoolMode, conf.PoolSize, time.Duration(conf.PoolWaitTimeout)*time.Second, conf.PoolResetQuery, dial), nil
+	default:
+		return nil, fmt.Errorf("unknown destination database type: %s", conf.DestinationDatabaseType)
+	}
+}
+
+// GetUpstreamHandler connects to the single destination host, or to the
+// cluster of the destination hosts when more of them are configured.
+func GetUpstreamHandler(conf *Configuration, logger *logrus.Logger) (IUpstreamHandler, error) {
+	if len(conf.DestinationTargets) < 2 {
+		return &BasicUpstreamHandler{Address: conf.DestinationHost + ":" + fmt.Sprint(conf.DestinationPort)}, nil
+	}
+
+	targets := []*UpstreamTarget{}
+	for _, spec := range conf.DestinationTargets {
+		targets = append(targets, &UpstreamTarget{Address: spec.Address, Role: spec.Role})
+	}
+
+	switch conf.DestinationDatabaseType {
+	case "postgres":
+		timeout := time.Duration(conf.HealthCheckTimeout) * time.Second
+		check := func(target *UpstreamTarget) (bool, error) {
+			handler := newUpstreamPostgresHandler(conf, logger, &BasicUpstreamHandler{Address: target.Address})
+			return handler.InRecovery(conf.HealthCheckDatabase, timeout)
+		}
+		return NewUpstreamCluster(targets, time.Duration(conf.DestinationCheckPeriod)*time.Second, logger, check), nil
 	default:
 		return nil, fmt.Errorf("unknown destination database type: %s", conf.DestinationDatabaseType)
 	}
 }
+
+// newUpstreamPostgresHandler creates a handler for the connections to the
+// destination which do not serve any client.
+func newUpstreamPostgresHandler(conf *Configuration, logger *logrus.Logger, upstreamHandler IUpstreamHandler) *PostgresHandler {
+	return &PostgresHandler{
+		Username:                      conf.DestinationUsername,
+		Password:                      conf.DestinationPassword,
+		UpstreamHandler:               upstreamHandler,
+		Logger:                        logger,
+		LogUpstream:                   conf.DestinationLogUpstream,
+		UpstreamTLSMode:               conf.DestinationTLSMode,
+		UpstreamTLSCAFile:             conf.DestinationTLSCAFile,
+		UpstreamInsecurePasswordAuth:  conf.DestinationInsecurePasswordAuth,
+		UpstreamTLSCertificateFile:    conf.DestinationTLSCertificateFile,
+		UpstreamTLSCertificateKeyFile: conf.DestinationTLSCertificateKeyFile,
+		UpstreamChannelBinding:        conf.DestinationChannelBinding,
+		ctx:                           context.Background(),
+	}
+}
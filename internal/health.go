@@ -0,0 +1,200 @@
+package foodme
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HealthStatusOK     = "ok"
+	HealthStatusFailed = "failed"
+)
+
+type HealthCheckResult struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+type HealthReport struct {
+	Status string               `json:"status"`
+	Checks []*HealthCheckResult `json:"checks"`
+}
+
+type JWKS struct {
+	Keys []map[string]interface{} `json:"keys"`
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// HealthChecker verifies the dependencies of the proxy: the destination
+// database, the OIDC provider and the permission agent.
+type HealthChecker struct {
+	Configuration *Configuration
+	Logger        *logrus.Logger
+	HTTPClient    IHttpClient
+	Upstream      IUpstreamHandler
+
+	shuttingDown atomic.Bool
+}
+
+func NewHealthChecker(conf *Configuration, logger *logrus.Logger) *HealthChecker {
+	return &HealthChecker{
+		Configuration: conf,
+		Logger:        logger,
+		HTTPClient:    &http.Client{Timeout: time.Duration(conf.HealthCheckTimeout) * time.Second},
+	}
+}
+
+// SetShuttingDown turns the readiness off, the liveness is unaffected.
+func (c *HealthChecker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+func (c *HealthChecker) ShuttingDown() bool {
+	return c.shuttingDown.Load()
+}
+
+func (c *HealthChecker) Health() *HealthReport {
+	return runHealthChecks(c.checks())
+}
+
+func (c *HealthChecker) Readiness() *HealthReport {
+	if c.ShuttingDown() {
+		return &HealthReport{
+			Status: HealthStatusFailed,
+			Checks: []*HealthCheckResult{{Name: "shutdown", Status: HealthStatusFailed, Error: "server is shutting down"}},
+		}
+	}
+	return c.Health()
+}
+
+func (c *HealthChecker) checks() []*healthCheck {
+	checks := []*healthCheck{{name: "destination", check: c.checkDestination}}
+
+	if c.Configuration.OIDCEnabled {
+		checks = append(checks,
+			&healthCheck{name: "oidc-token-endpoint", check: func() error { return c.checkEndpoint(c.Configuration.OIDCTokenURL) }},
+			&healthCheck{name: "oidc-userinfo-endpoint", check: func() error { return c.checkEndpoint(c.Configuration.OIDCUserInfoURL) }},
+		)
+		if c.Configuration.OIDCJWKSURL != "" {
+			checks = append(checks, &healthCheck{name: "oidc-jwks", check: c.checkJWKS})
+		}
+	}
+
+	if c.Configuration.PermissionAgentEnabled {
+		checks = append(checks, &healthCheck{name: "permission-agent", check: c.checkPermissionAgent})
+	}
+
+	return checks
+}
+
+func runHealthChecks(checks []*healthCheck) *HealthReport {
+	report := &HealthReport{Status: HealthStatusOK, Checks: make([]*HealthCheckResult, len(checks))}
+
+	var wg sync.WaitGroup
+	for idx, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started := time.Now()
+			result := &HealthCheckResult{Name: check.name, Status: HealthStatusOK}
+			if err := check.check(); err != nil {
+				result.Status = HealthStatusFailed
+				result.Error = err.Error()
+			}
+			result.Duration = time.Since(started).Seconds()
+			report.Checks[idx] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != HealthStatusOK {
+			report.Status = HealthStatusFailed
+		}
+	}
+	return report
+}
+
+func (c *HealthChecker) checkDestination() error {
+	handler, err := GetHandler(c.Configuration, c.Logger, &HandlerDeps{HTTPClient: c.HTTPClient, Upstream: c.Upstream})
+	if err != nil {
+		return err
+	}
+	return handler.Ping(c.Configuration.HealthCheckDatabase, time.Duration(c.Configuration.HealthCheckTimeout)*time.Second)
+}
+
+// checkEndpoint only verifies the endpoint responds, the token and userinfo
+// endpoints reject anonymous requests anyway.
+func (c *HealthChecker) checkEndpoint(endpoint string) error {
+	resp, err := c.get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (c *HealthChecker) checkJWKS() error {
+	resp, err := c.get(c.Configuration.OIDCJWKSURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	jwks := &JWKS{}
+	err = json.Unmarshal(body, jwks)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+	if len(jwks.Keys) == 0 {
+		return fmt.Errorf("no keys found in the key set")
+	}
+	return nil
+}
+
+func (c *HealthChecker) checkPermissionAgent() error {
+	agent, err := NewPermissionAgent(c.Configuration, c.HTTPClient)
+	if err != nil {
+		return err
+	}
+	return agent.Ping()
+}
+
+func (c *HealthChecker) get(endpoint string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request: %w", err)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute request: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,106 @@
+package foodme
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+)
+
+func startFakeIdP(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusMethodNotAllowed) })
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusUnauthorized) })
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"keys":[{"kid":"1"}]}`)) })
+	mux.HandleFunc("/empty-jwks", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"keys":[]}`)) })
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) })
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{}`)) })
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHealthChecker(t *testing.T) {
+	logger := logrus.StandardLogger()
+	idp := startFakeIdP(t)
+	conf := &Configuration{
+		DestinationHost:         "127.0.0.1",
+		DestinationPort:         startFakePostgres(t),
+		DestinationDatabaseType: "postgres",
+		HealthCheckDatabase:     "postgres",
+		HealthCheckTimeout:      1,
+	}
+	checker := NewHealthChecker(conf, logger)
+
+	report := checker.Health()
+	assert.Equal(t, report.Status, HealthStatusOK)
+	assert.Equal(t, len(report.Checks), 1)
+	assert.Equal(t, report.Checks[0].Name, "destination")
+	assert.Equal(t, report.Checks[0].Status, HealthStatusOK)
+
+	// IdP and permission agent
+	conf.OIDCEnabled = true
+	conf.OIDCTokenURL = idp.URL + "/token"
+	conf.OIDCUserInfoURL = idp.URL + "/userinfo"
+	conf.OIDCJWKSURL = idp.URL + "/jwks"
+	conf.PermissionAgentEnabled = true
+	conf.PermissionAgentType = "opa"
+	conf.PermissionAgentOPAURL = idp.URL
+	report = checker.Health()
+	assert.Equal(t, report.Status, HealthStatusOK)
+	names := []string{}
+	for _, check := range report.Checks {
+		names = append(names, check.Name)
+		assert.Equal(t, check.Status, HealthStatusOK, check.Name)
+	}
+	assert.DeepEqual(t, names, []string{"destination", "oidc-token-endpoint", "oidc-userinfo-endpoint", "oidc-jwks", "permission-agent"})
+
+	// Failing checks
+	conf.OIDCUserInfoURL = idp.URL + "/broken"
+	conf.OIDCJWKSURL = idp.URL + "/empty-jwks"
+	conf.PermissionAgentOPAURL = idp.URL + "/broken"
+	report = checker.Health()
+	assert.Equal(t, report.Status, HealthStatusFailed)
+	assert.Equal(t, report.Checks[0].Status, HealthStatusOK)
+	assert.Equal(t, report.Checks[1].Status, HealthStatusOK)
+	assert.Equal(t, report.Checks[2].Error, "unexpected status code: 502")
+	assert.Equal(t, report.Checks[3].Error, "no keys found in the key set")
+	assert.Equal(t, report.Checks[4].Error, "unexpected status code from OPA: 404")
+
+	// Unreachable destination
+	conf.OIDCEnabled = false
+	conf.PermissionAgentEnabled = false
+	conf.DestinationPort = 1
+	report = checker.Health()
+	assert.Equal(t, report.Status, HealthStatusFailed)
+	assert.Assert(t, strings.HasPrefix(report.Checks[0].Error, "unable to connect to destination"), report.Checks[0].Error)
+}
+
+func TestHealthCheckerReadiness(t *testing.T) {
+	logger := logrus.StandardLogger()
+	conf := &Configuration{
+		DestinationHost:         "127.0.0.1",
+		DestinationPort:         startFakePostgres(t),
+		DestinationDatabaseType: "postgres",
+		HealthCheckDatabase:     "postgres",
+		HealthCheckTimeout:      1,
+	}
+	checker := NewHealthChecker(conf, logger)
+
+	report := checker.Readiness()
+	assert.Equal(t, report.Status, HealthStatusOK)
+	assert.Assert(t, !checker.ShuttingDown())
+
+	checker.SetShuttingDown()
+	assert.Assert(t, checker.ShuttingDown())
+	report = checker.Readiness()
+	assert.Equal(t, report.Status, HealthStatusFailed)
+	assert.DeepEqual(t, report.Checks, []*HealthCheckResult{{Name: "shutdown", Status: HealthStatusFailed, Error: "server is shutting down"}})
+
+	// Liveness is unaffected
+	report = checker.Health()
+	assert.Equal(t, report.Status, HealthStatusOK)
+}
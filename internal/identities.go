@@ -0,0 +1,61 @@
+package foodme
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// CertificateIdentities maps the names of the verified client certificates to
+// a synthetic userinfo, so the sessions continue the same way as with OIDC.
+type CertificateIdentities struct {
+	UsernameClaim string
+	Identities    map[string]map[string]interface{}
+}
+
+func NewCertificateIdentities(conf *Configuration) (*CertificateIdentities, error) {
+	data, err := os.ReadFile(conf.CertificateAuthIdentitiesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate identities: %w", err)
+	}
+
+	identities := &CertificateIdentities{UsernameClaim: conf.OIDCAssumeUserSessionUsernameClaim}
+	err = json.Unmarshal(data, &identities.Identities)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate identities: %w", err)
+	}
+	return identities, nil
+}
+
+// Userinfo returns the identity of the first certificate name found in the
+// mapping, the subject common name goes before the alternative names. The
+// matched name fills the sub and the username claims missing in it.
+func (c *CertificateIdentities) Userinfo(cert *x509.Certificate) (map[string]interface{}, bool) {
+	for _, name := range certificateNames(cert) {
+		claims, ok := c.Identities[name]
+		if !ok {
+			continue
+		}
+
+		userinfo := map[string]interface{}{"sub": name, c.UsernameClaim: name}
+		for claim, value := range claims {
+			userinfo[claim] = value
+		}
+		return userinfo, true
+	}
+	return nil, false
+}
+
+func certificateNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
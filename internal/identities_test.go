@@ -0,0 +1,122 @@
+package foodme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+)
+
+func TestNewCertificateIdentities(t *testing.T) {
+	identities, err := NewCertificateIdentities(&Configuration{CertificateAuthIdentitiesFile: "../data/test_identities.json", OIDCAssumeUserSessionUsernameClaim: "preferred_username"})
+	assert.NilError(t, err)
+	assert.Equal(t, identities.UsernameClaim, "preferred_username")
+	assert.Equal(t, len(identities.Identities), 3)
+
+	_, err = NewCertificateIdentities(&Configuration{CertificateAuthIdentitiesFile: "../data/nonexistent.json"})
+	assert.ErrorContains(t, err, "failed to read certificate identities")
+
+	_, err = NewCertificateIdentities(&Configuration{CertificateAuthIdentitiesFile: "../data/test_sql.sql"})
+	assert.ErrorContains(t, err, "failed to parse certificate identities")
+}
+
+func TestCertificateIdentitiesUserinfo(t *testing.T) {
+	identities, err := NewCertificateIdentities(&Configuration{CertificateAuthIdentitiesFile: "../data/test_identities.json", OIDCAssumeUserSessionUsernameClaim: "preferred_username"})
+	assert.NilError(t, err)
+	etl, err := url.Parse("spiffe://example.com/ns/etl")
+	assert.NilError(t, err)
+
+	// The common name, the claims of the mapping win
+	userinfo, ok := identities.Userinfo(&x509.Certificate{Subject: pkix.Name{CommonName: "billing"}, DNSNames: []string{"reports.svc.example.com"}})
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, userinfo, map[string]interface{}{"sub": "billing", "preferred_username": "svc_billing", "roles": []interface{}{"billing"}})
+
+	// The alternative names
+	userinfo, ok = identities.Userinfo(&x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}, DNSNames: []string{"reports.svc.example.com"}})
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, userinfo, map[string]interface{}{"sub": "reports.svc.example.com", "preferred_username": "reports.svc.example.com"})
+
+	userinfo, ok = identities.Userinfo(&x509.Certificate{URIs: []*url.URL{etl}})
+	assert.Assert(t, ok)
+	assert.DeepEqual(t, userinfo, map[string]interface{}{"sub": "spiffe://example.com/ns/etl", "preferred_username": "spiffe://example.com/ns/etl", "tenant": "acme"})
+
+	// Not mapped
+	_, ok = identities.Userinfo(&x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}, EmailAddresses: []string{"bob@example.com"}})
+	assert.Assert(t, !ok)
+}
+
+// handshakeTestClientCertificate returns the server side of a TLS connection
+// from a client presenting the certificate.
+func handshakeTestClientCertificate(t *testing.T, ca *testCertificate, client *testCertificate) net.Conn {
+	server := newTestCertificate(t, "server", "db.example.com", ca)
+	m := newTestCertificateManager(t, &Configuration{
+		ServerTLSCertificates: []*CertificateSpec{{CertificateFile: server.certFile, CertificateKeyFile: server.keyFile}},
+		ServerTLSClientAuth:   TLSClientAuthRequest,
+		ServerTLSClientCAFile: ca.certFile,
+	})
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", m.TLSConfig(postgresALPN))
+	assert.NilError(t, err)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			err = conn.(*tls.Conn).Handshake()
+		}
+		assert.Check(t, err)
+		accepted <- conn
+	}()
+
+	clientConf := &tls.Config{InsecureSkipVerify: true}
+	if client != nil {
+		cert, err := tls.LoadX509KeyPair(client.certFile, client.keyFile)
+		assert.NilError(t, err)
+		clientConf.Certificates = []tls.Certificate{cert}
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConf)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	serverConn := <-accepted
+	t.Cleanup(func() { serverConn.Close() })
+	return serverConn
+}
+
+func TestPGHandlerCertificateUserinfo(t *testing.T) {
+	logger := logrus.StandardLogger()
+	handler := NewPostgresHandler("addr", "user", "pwd", nil, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "preferred_username", false)
+	identities, err := NewCertificateIdentities(&Configuration{CertificateAuthIdentitiesFile: "../data/test_identities.json", OIDCAssumeUserSessionUsernameClaim: "preferred_username"})
+	assert.NilError(t, err)
+	ca := newTestCertificate(t, "ca", "", nil)
+	billing := handshakeTestClientCertificate(t, ca, newTestCertificate(t, "billing", "", ca))
+
+	// Disabled
+	handler.client = billing
+	assert.Assert(t, handler.certificateUserinfo("svc_billing") == nil)
+
+	// The client logs in as the identity of its certificate
+	handler.Identities = identities
+	userinfo := handler.certificateUserinfo("svc_billing")
+	assert.Equal(t, userinfo["sub"], "billing")
+	assert.Equal(t, userinfo["preferred_username"], "svc_billing")
+
+	// The client logs in as someone else
+	assert.Assert(t, handler.certificateUserinfo("bob") == nil)
+
+	// Not mapped
+	handler.client = handshakeTestClientCertificate(t, ca, newTestCertificate(t, "stranger", "", ca))
+	assert.Assert(t, handler.certificateUserinfo("stranger") == nil)
+
+	// No certificate
+	handler.client = handshakeTestClientCertificate(t, ca, nil)
+	assert.Assert(t, handler.certificateUserinfo("svc_billing") == nil)
+
+	// No TLS
+	handler.client = &MockNetConn{}
+	assert.Assert(t, handler.certificateUserinfo("svc_billing") == nil)
+}
@@ -1,8 +1,10 @@
 package foodme
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"time"
 )
 
 type IHttpClient interface {
@@ -11,28 +13,42 @@ type IHttpClient interface {
 
 type IServer interface {
 	Start() error
-	Listen(listener net.Listener) error
+	Listen(listener net.Listener, httpClient IHttpClient) error
+	Shutdown(ctx context.Context) error
 }
 
 type IHandler interface {
 	Handle(client net.Conn) error
+	Ping(database string, timeout time.Duration) error
+	Drain()
+	Terminate()
 }
 
 type IUpstreamHandler interface {
 	Connect() (net.Conn, error)
+	ConnectReadOnly() (net.Conn, error)
 }
 
 type ISQLHandler interface {
-	Handle(sql string, userInfo map[string]interface{}) (string, error)
-	SetDDL(userInfo map[string]interface{}) error
+	Handle(ctx context.Context, sql string, userInfo map[string]interface{}) (string, error)
+	SetDDL(ctx context.Context, userInfo map[string]interface{}) error
+	Decisions() []*PermissionDecision
 }
 
 type IPermissionAgent interface {
-	SelectFilters(tableName, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error)
-	CreateAllowed() bool
-	UpdateAllowed() bool
-	DeleteAllowed() bool
-	SetCreateAllowed(userInfo map[string]interface{}) error
-	SetUpdateAllowed(userInfo map[string]interface{}) error
-	SetDeleteAllowed(userInfo map[string]interface{}) error
+	SelectFilters(ctx context.Context, tableName, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error)
+	DDLAllowed(ctx context.Context, operation string, userInfo map[string]interface{}) (bool, error)
+	Ping() error
+}
+
+type IAuditSink interface {
+	Write(event *AuditEvent) error
+	Close() error
+}
+
+type ICredentialProvider interface {
+	Lease(ctx context.Context, database string, userinfo map[string]interface{}) (*CredentialLease, error)
+	Renew(lease *CredentialLease) error
+	Release(lease *CredentialLease) error
+	Close() error
 }
@@ -0,0 +1,57 @@
+package foodme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const ldapDefaultTimeout = 10 * time.Second
+
+// LDAPClient checks the passwords by the simple bind of the DN made of the
+// prefix, the username and the suffix, as the simple bind mode of Postgres.
+type LDAPClient struct {
+	URL     *url.URL
+	Prefix  string
+	Suffix  string
+	Timeout time.Duration
+}
+
+func NewLDAPClient(conf *Configuration) (*LDAPClient, error) {
+	u, err := url.Parse(conf.LocalAuthLDAPURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URL: %w", err)
+	}
+	return &LDAPClient{URL: u, Prefix: conf.LocalAuthLDAPPrefix, Suffix: conf.LocalAuthLDAPSuffix, Timeout: ldapDefaultTimeout}, nil
+}
+
+// Bind binds as the user with the password and unbinds right away.
+func (c *LDAPClient) Bind(username, password string) error {
+	// An empty password is an unauthenticated bind, which always succeeds
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+	// Like Postgres, refuse the usernames which would change the DN
+	if strings.ContainsAny(username, ",+\"\\<>;=\x00") || strings.TrimSpace(username) != username || strings.HasPrefix(username, "#") {
+		return fmt.Errorf("invalid character in user name for LDAP authentication")
+	}
+
+	conn, err := ldap.DialURL(c.URL.String(), ldap.DialWithDialer(&net.Dialer{Timeout: c.Timeout}), ldap.DialWithTLSConfig(&tls.Config{ServerName: c.URL.Hostname()}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetTimeout(c.Timeout)
+
+	err = conn.Bind(c.Prefix+username+c.Suffix, password)
+	conn.Unbind()
+	if err != nil {
+		return fmt.Errorf("LDAP bind failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package foodme
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"gotest.tools/v3/assert"
+)
+
+// startFakeLDAP accepts the simple binds of the DN with the password, each
+// bind is recorded.
+func startFakeLDAP(t *testing.T, dn, password string) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	binds := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				packet, err := ber.ReadPacket(conn)
+				if err != nil || len(packet.Children) < 2 || len(packet.Children[1].Children) < 3 {
+					return
+				}
+				request := packet.Children[1]
+				name, secret := request.Children[1].Data.String(), request.Children[2].Data.String()
+				binds <- name
+
+				code, message := ldap.LDAPResultSuccess, ""
+				if name != dn || secret != password {
+					code, message = ldap.LDAPResultInvalidCredentials, "invalid credentials"
+				}
+				response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "")
+				response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+				response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+				response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, ""))
+				envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				envelope.AppendChild(packet.Children[0])
+				envelope.AppendChild(response)
+				conn.Write(envelope.Bytes())
+
+				// The unbind
+				packet, err = ber.ReadPacket(conn)
+				if err == nil && len(packet.Children) > 1 && packet.Children[1].Tag == ldap.ApplicationUnbindRequest {
+					binds <- "unbind"
+				}
+			}()
+		}
+	}()
+	return "ldap://" + listener.Addr().String(), binds
+}
+
+func TestLDAPClientBind(t *testing.T) {
+	address, binds := startFakeLDAP(t, "uid=alice,ou=people,dc=example,dc=com", "secret")
+	client, err := NewLDAPClient(&Configuration{LocalAuthLDAPURL: address, LocalAuthLDAPPrefix: "uid=", LocalAuthLDAPSuffix: ",ou=people,dc=example,dc=com"})
+	assert.NilError(t, err)
+	client.Timeout = time.Second
+
+	assert.NilError(t, client.Bind("alice", "secret"))
+	assert.Equal(t, <-binds, "uid=alice,ou=people,dc=example,dc=com")
+	assert.Equal(t, <-binds, "unbind")
+
+	assert.Error(t, client.Bind("alice", "wrong"), `LDAP bind failed: LDAP Result Code 49 "Invalid Credentials": invalid credentials`)
+	assert.Equal(t, <-binds, "uid=alice,ou=people,dc=example,dc=com")
+	assert.Equal(t, <-binds, "unbind")
+
+	// Neither the unauthenticated binds nor the DN injections reach the server
+	assert.Error(t, client.Bind("alice", ""), "empty password")
+	assert.Error(t, client.Bind("alice,ou=admins", "secret"), "invalid character in user name for LDAP authentication")
+	assert.Error(t, client.Bind(" alice", "secret"), "invalid character in user name for LDAP authentication")
+}
@@ -0,0 +1,112 @@
+package foodme
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	LocalAuthDisabled = "disabled"
+	LocalAuthFile     = "file"
+	LocalAuthLDAP     = "ldap"
+
+	// Iterations of the secret of the unknown users, the default of Postgres
+	scramDefaultIterations = 4096
+)
+
+// LocalUser is a user of the local users file, the password is the
+// SCRAM-SHA-256 secret as in pg_authid and the claims extend the userinfo.
+type LocalUser struct {
+	Password string                 `json:"password"`
+	Claims   map[string]interface{} `json:"claims"`
+
+	secret *SCRAMSecret
+}
+
+// LocalAuthenticator authenticates the clients without the tokens on the
+// proxy, the sessions continue with a synthetic userinfo as with OIDC.
+type LocalAuthenticator struct {
+	Mode          string
+	UsernameClaim string
+	Users         map[string]*LocalUser
+	LDAP          *LDAPClient
+
+	mockSecret *SCRAMSecret
+}
+
+func NewLocalAuthenticator(conf *Configuration) (*LocalAuthenticator, error) {
+	local := &LocalAuthenticator{Mode: conf.LocalAuth, UsernameClaim: conf.OIDCAssumeUserSessionUsernameClaim, Users: map[string]*LocalUser{}}
+
+	// The users file is optional with LDAP, it only adds the claims then
+	if conf.LocalAuthUsersFile != "" {
+		data, err := os.ReadFile(conf.LocalAuthUsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read local users: %w", err)
+		}
+		err = json.Unmarshal(data, &local.Users)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse local users: %w", err)
+		}
+		for name, user := range local.Users {
+			if user == nil {
+				local.Users[name] = &LocalUser{}
+			}
+		}
+	}
+
+	if local.Mode == LocalAuthFile {
+		for name, user := range local.Users {
+			secret, err := ParseSCRAMSecret(user.Password)
+			if err != nil {
+				return nil, fmt.Errorf("invalid password of the local user %s: %w", name, err)
+			}
+			user.secret = secret
+		}
+
+		// The unknown users go through the same exchange with a secret of a
+		// random password, the clients cannot tell which users exist
+		password := make([]byte, 32)
+		_, err := rand.Read(password)
+		if err != nil {
+			return nil, err
+		}
+		local.mockSecret, err = newSCRAMSecret(base64.StdEncoding.EncodeToString(password), scramDefaultIterations)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if local.Mode == LocalAuthLDAP {
+		var err error
+		local.LDAP, err = NewLDAPClient(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return local, nil
+}
+
+// Secret returns the SCRAM secret of the user, the mock secret for the
+// unknown users.
+func (l *LocalAuthenticator) Secret(name string) (*SCRAMSecret, bool) {
+	user, ok := l.Users[name]
+	if !ok || user.secret == nil {
+		return l.mockSecret, false
+	}
+	return user.secret, true
+}
+
+// Userinfo returns the identity of the user, the name fills the sub and the
+// username claims missing in the claims of the users file.
+func (l *LocalAuthenticator) Userinfo(name string) map[string]interface{} {
+	userinfo := map[string]interface{}{"sub": name, l.UsernameClaim: name}
+	if user, ok := l.Users[name]; ok {
+		for claim, value := range user.Claims {
+			userinfo[claim] = value
+		}
+	}
+	return userinfo
+}
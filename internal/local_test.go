@@ -0,0 +1,40 @@
+package foodme
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestNewLocalAuthenticator(t *testing.T) {
+	local, err := NewLocalAuthenticator(&Configuration{LocalAuth: LocalAuthFile, LocalAuthUsersFile: "../data/test_local_users.json", OIDCAssumeUserSessionUsernameClaim: "preferred_username"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(local.Users), 2)
+
+	secret, ok := local.Secret("alice")
+	assert.Assert(t, ok)
+	assert.Equal(t, secret.Iterations, 4096)
+
+	// The unknown users get the mock secret
+	secret, ok = local.Secret("mallory")
+	assert.Assert(t, !ok)
+	assert.Assert(t, secret != nil)
+
+	assert.DeepEqual(t, local.Userinfo("alice"), map[string]interface{}{"sub": "alice", "preferred_username": "alice", "roles": []interface{}{"analyst"}})
+	assert.DeepEqual(t, local.Userinfo("mallory"), map[string]interface{}{"sub": "mallory", "preferred_username": "mallory"})
+
+	_, err = NewLocalAuthenticator(&Configuration{LocalAuth: LocalAuthFile, LocalAuthUsersFile: "../data/nonexistent.json"})
+	assert.ErrorContains(t, err, "failed to read local users")
+
+	_, err = NewLocalAuthenticator(&Configuration{LocalAuth: LocalAuthFile, LocalAuthUsersFile: "../data/test_sql.sql"})
+	assert.ErrorContains(t, err, "failed to parse local users")
+
+	_, err = NewLocalAuthenticator(&Configuration{LocalAuth: LocalAuthFile, LocalAuthUsersFile: "../data/test_identities.json"})
+	assert.ErrorContains(t, err, "invalid password of the local user")
+
+	// With LDAP, the users file only adds the claims
+	local, err = NewLocalAuthenticator(&Configuration{LocalAuth: LocalAuthLDAP, LocalAuthLDAPURL: "ldap://127.0.0.1:389", LocalAuthUsersFile: "../data/test_local_users.json", OIDCAssumeUserSessionUsernameClaim: "preferred_username"})
+	assert.NilError(t, err)
+	assert.Equal(t, local.LDAP.URL.Host, "127.0.0.1:389")
+	assert.DeepEqual(t, local.Userinfo("alice"), map[string]interface{}{"sub": "alice", "preferred_username": "alice", "roles": []interface{}{"analyst"}})
+}
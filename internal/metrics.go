@@ -0,0 +1,181 @@
+package foodme
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	connectionsActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "foodme",
+		Name:      "connections_active",
+		Help:      "Number of currently open client connections",
+	}, []string{"database"})
+
+	connectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "connections_total",
+		Help:      "Total number of established client connections",
+	}, []string{"database"})
+
+	authenticationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "upstream_authentications_total",
+		Help:      "Total number of authentications against the destination database",
+	}, []string{"method", "outcome"})
+
+	tokenRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "token_refreshes_total",
+		Help:      "Total number of access token refreshes",
+	}, []string{"outcome"})
+
+	passwordLoginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "password_logins_total",
+		Help:      "Total number of IdP logins with the password of the client",
+	}, []string{"mode", "outcome"})
+
+	localLoginsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "local_logins_total",
+		Help:      "Total number of logins of the clients authenticated by the proxy itself",
+	}, []string{"method", "outcome"})
+
+	credentialLeasesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "credential_leases_total",
+		Help:      "Total number of destination credentials leased, renewed and released by the credentials provider",
+	}, []string{"provider", "operation", "outcome"})
+
+	roleProvisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "role_provisions_total",
+		Help:      "Total number of provisioned roles of the users",
+	}, []string{"outcome"})
+
+	cancelRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "cancel_requests_total",
+		Help:      "Total number of cancel requests of the clients by outcome",
+	}, []string{"outcome"})
+
+	permissionAgentDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "foodme",
+		Name:      "permission_agent_request_duration_seconds",
+		Help:      "Latency of the permission agent requests",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	permissionAgentDecisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "permission_agent_decisions_total",
+		Help:      "Total number of permission decisions applied to statements",
+	}, []string{"operation", "decision"})
+
+	rewriteFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "rewrite_failures_total",
+		Help:      "Total number of statements the SQL handler failed to rewrite",
+	})
+
+	auditEventsDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "audit_events_dropped_total",
+		Help:      "Total number of audit events the HTTP sink dropped",
+	}, []string{"reason"})
+
+	bytesProxiedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "bytes_proxied_total",
+		Help:      "Total number of bytes proxied between the clients and the destination database",
+	}, []string{"database", "direction"})
+
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "foodme",
+		Name:      "query_duration_seconds",
+		Help:      "Latency between a Query and the ReadyForQuery of the destination database",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"database"})
+
+	poolConnectionsOpen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "foodme",
+		Name:      "pool_connections_open",
+		Help:      "Number of open pooled connections to the destination database",
+	}, []string{"database"})
+
+	poolWaitTimeoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "foodme",
+		Name:      "pool_wait_timeouts_total",
+		Help:      "Total number of clients which timed out waiting for a pooled connection",
+	}, []string{"database"})
+
+	upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "foodme",
+		Name:      "upstream_healthy",
+		Help:      "Whether the destination host passed its last check",
+	}, []string{"address"})
+
+	upstreamPrimary = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "foodme",
+		Name:      "upstream_primary",
+		Help:      "Whether the destination host is the primary according to its last check",
+	}, []string{"address"})
+)
+
+// sessionMetrics counts a session under the database label once the session
+// is logged in at the database, until it is closed.
+type sessionMetrics struct {
+	mutex    sync.Mutex
+	database string
+	closed   bool
+}
+
+func (m *sessionMetrics) established(database string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.database != "" || m.closed {
+		return
+	}
+	m.database = database
+	connectionsTotal.WithLabelValues(database).Inc()
+	connectionsActive.WithLabelValues(database).Inc()
+}
+
+// label returns the database label of the established session, empty before.
+func (m *sessionMetrics) label() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.database
+}
+
+func (m *sessionMetrics) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	if m.database != "" {
+		connectionsActive.WithLabelValues(m.database).Dec()
+	}
+}
+
+func observeOutcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+func observeDecision(decision *PermissionDecision) {
+	if decision.Allowed {
+		permissionAgentDecisionsTotal.WithLabelValues(decision.Operation, "allowed").Inc()
+	} else {
+		permissionAgentDecisionsTotal.WithLabelValues(decision.Operation, "denied").Inc()
+	}
+}
+
+func observeDuration(histogram *prometheus.HistogramVec, started time.Time, labels ...string) {
+	histogram.WithLabelValues(labels...).Observe(time.Since(started).Seconds())
+}
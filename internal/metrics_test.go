@@ -0,0 +1,83 @@
+package foodme
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ryshoooo/food-me/internal/pgwire"
+	"gotest.tools/v3/assert"
+)
+
+func TestObserveOutcome(t *testing.T) {
+	assert.Equal(t, observeOutcome(nil), "success")
+	assert.Equal(t, observeOutcome(fmt.Errorf("failed")), "failure")
+}
+
+func TestObserveDecision(t *testing.T) {
+	allowed := testutil.ToFloat64(permissionAgentDecisionsTotal.WithLabelValues("select", "allowed"))
+	denied := testutil.ToFloat64(permissionAgentDecisionsTotal.WithLabelValues("select", "denied"))
+
+	observeDecision(&PermissionDecision{Table: "pets", Operation: "select", Allowed: true})
+	observeDecision(&PermissionDecision{Table: "pets", Operation: "select", Allowed: false})
+	observeDecision(&PermissionDecision{Table: "pets", Operation: "select", Allowed: false})
+
+	assert.Equal(t, testutil.ToFloat64(permissionAgentDecisionsTotal.WithLabelValues("select", "allowed")), allowed+1)
+	assert.Equal(t, testutil.ToFloat64(permissionAgentDecisionsTotal.WithLabelValues("select", "denied")), denied+2)
+}
+
+func TestObserveQueryDuration(t *testing.T) {
+	handler := &PostgresHandler{database: "metrics-test", MetricsDatabases: []string{"metrics-test"}}
+	handler.pending.push(&pendingStatement{query: true, started: time.Now()})
+	handler.pending.push(&pendingStatement{started: time.Now()})
+
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+	m := &dto.Metric{}
+	assert.NilError(t, queryDuration.WithLabelValues("metrics-test").(prometheus.Histogram).Write(m))
+	assert.Equal(t, m.GetHistogram().GetSampleCount(), uint64(1))
+}
+
+func TestSessionMetrics(t *testing.T) {
+	total := testutil.ToFloat64(connectionsTotal.WithLabelValues("metrics-session"))
+
+	// Not counted until it is established
+	m := &sessionMetrics{}
+	assert.Equal(t, m.label(), "")
+	m.established("metrics-session")
+	m.established("metrics-session")
+	assert.Equal(t, m.label(), "metrics-session")
+	assert.Equal(t, testutil.ToFloat64(connectionsTotal.WithLabelValues("metrics-session")), total+1)
+	assert.Equal(t, testutil.ToFloat64(connectionsActive.WithLabelValues("metrics-session")), float64(1))
+	m.close()
+	assert.Equal(t, testutil.ToFloat64(connectionsActive.WithLabelValues("metrics-session")), float64(0))
+
+	// Closed before it was established
+	m = &sessionMetrics{}
+	m.close()
+	m.established("metrics-session")
+	assert.Equal(t, testutil.ToFloat64(connectionsTotal.WithLabelValues("metrics-session")), total+1)
+	assert.Equal(t, testutil.ToFloat64(connectionsActive.WithLabelValues("metrics-session")), float64(0))
+}
+
+func TestDatabaseLabel(t *testing.T) {
+	handler := &PostgresHandler{
+		OIDCDatabaseClients: map[string]*OIDCDatabaseClientSpec{"pets": {ClientID: "pets"}},
+		MetricsDatabases:    []string{"reports"},
+	}
+	for database, label := range map[string]string{"pets": "pets", "reports": "reports", "random-1234": "other"} {
+		handler.database = database
+		assert.Equal(t, handler.databaseLabel(), label)
+	}
+
+	// The databases of the routes
+	handler.database = "tenant"
+	handler.route = &UpstreamRoute{Address: "tenant:5432", Database: "tenant"}
+	assert.Equal(t, handler.databaseLabel(), "tenant")
+	handler.route = &UpstreamRoute{Address: "tenant:5432"}
+	assert.Equal(t, handler.databaseLabel(), "other")
+}
@@ -1,7 +1,9 @@
 package foodme
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,14 +14,76 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const (
+	PasswordLoginDisabled      = "disabled"
+	PasswordLoginToken         = "token"
+	PasswordLoginPassword      = "password"
+	PasswordLoginTokenExchange = "token-exchange"
+
+	PasswordLoginClientCredentials = "client-credentials"
+)
+
+const (
+	// clientIDUsernamePrefix marks the clients logging in by the client
+	// credentials grant
+	clientIDUsernamePrefix = "client_id="
+	// clientIDClaim names the client of the client credentials sessions
+	clientIDClaim = "client_id"
+)
+
+// clientSessionKey is the context key of the client ID of the sessions logged
+// in by the client credentials grant. It is set by the proxy alone, a claim of
+// the other sessions cannot pose as it.
+type clientSessionKey struct{}
+
+func withClientSession(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, clientSessionKey{}, clientID)
+}
+
+// clientSession returns the client ID of the client credentials session.
+func clientSession(ctx context.Context) (string, bool) {
+	clientID, ok := ctx.Value(clientSessionKey{}).(string)
+	return clientID, ok
+}
+
+const (
+	tokenErrorAuthorizationPending = "authorization_pending"
+	tokenErrorSlowDown             = "slow_down"
+)
+
+// TokenError is the error response of the token endpoint, the code is the
+// OAuth error of its body.
+type TokenError struct {
+	Grant      string
+	StatusCode int
+	Body       string
+	Code       string
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("unexpected status code from %s: %d. Body: %s", e.Grant, e.StatusCode, e.Body)
+}
+
+// DeviceAuthorization is the response of the device authorization endpoint,
+// as in RFC 8628.
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
 type OIDCClient struct {
-	HTTPClient   IHttpClient
-	ClientID     string
-	ClientSecret string
-	TokenURL     string
-	UserInfoURL  string
-	AccessToken  string
-	RefreshToken string
+	HTTPClient        IHttpClient
+	ClientID          string
+	ClientSecret      string
+	TokenURL          string
+	UserInfoURL       string
+	AccessToken       string
+	RefreshToken      string
+	ClientCredentials bool
 }
 
 func NewOIDCClient(httpClient IHttpClient, clientId, clientSecret, tokenUrl, userInfoUrl, accessToken, refreshToken string) *OIDCClient {
@@ -69,15 +133,154 @@ func (c *OIDCClient) IsAccessTokenValid() bool {
 	return (dt.Time.Unix() - time.Now().Unix()) >= 0
 }
 
-func (c *OIDCClient) RefreshAccessToken() error {
+func (c *OIDCClient) RefreshAccessToken(ctx context.Context) (err error) {
+	defer func() { tokenRefreshesTotal.WithLabelValues(observeOutcome(err)).Inc() }()
+
+	// The client credentials grant issues no refresh token, the client logs
+	// in again instead
+	if c.ClientCredentials && c.RefreshToken == "" {
+		return c.ClientCredentialsGrant(ctx)
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "refresh_token")
+	data.Set("refresh_token", c.RefreshToken)
+	return c.requestTokens(ctx, data, "refresh token")
+}
+
+// ClientCredentialsGrant logs the client itself in with its secret, the
+// access token identifies the client instead of a user.
+func (c *OIDCClient) ClientCredentialsGrant(ctx context.Context) error {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	c.ClientCredentials = true
+	return c.requestTokens(ctx, data, "client credentials grant")
+}
+
+// AccessTokenClaims returns the claims of the access token. The signature is
+// not verified, the token is trusted only as it came from the token endpoint.
+func (c *OIDCClient) AccessTokenClaims() (map[string]interface{}, error) {
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(c.AccessToken, claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse access token: %w", err)
+	}
+	return claims, nil
+}
+
+// PasswordGrant logs the user in with the username and the password, the
+// resource owner password credentials grant.
+func (c *OIDCClient) PasswordGrant(ctx context.Context, username, password string) error {
+	data := url.Values{}
+	data.Set("grant_type", "password")
+	data.Set("username", username)
+	data.Set("password", password)
+	data.Set("scope", "openid")
+	return c.requestTokens(ctx, data, "password grant")
+}
+
+// ExchangeToken exchanges an access token of the user issued to another
+// client for the tokens of this client, as in RFC 8693.
+func (c *OIDCClient) ExchangeToken(ctx context.Context, subjectToken string) error {
+	data := url.Values{}
+	data.Set("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	data.Set("subject_token", subjectToken)
+	data.Set("subject_token_type", "urn:ietf:params:oauth:token-type:access_token")
+	data.Set("scope", "openid")
+	return c.requestTokens(ctx, data, "token exchange")
+}
+
+// AuthorizeDevice starts the device authorization of the user, who approves
+// it in a browser with the returned user code.
+func (c *OIDCClient) AuthorizeDevice(ctx context.Context, deviceAuthorizationURL string) (*DeviceAuthorization, error) {
 	data := url.Values{}
 	data.Set("client_id", c.ClientID)
 	if c.ClientSecret != "" {
 		data.Set("client_secret", c.ClientSecret)
 	}
-	data.Set("grant_type", "refresh_token")
-	data.Set("refresh_token", c.RefreshToken)
-	req, err := http.NewRequest(http.MethodPost, c.TokenURL, strings.NewReader(data.Encode()))
+	data.Set("scope", "openid")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, deviceAuthorizationURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from device authorization: %d. Body: %s", resp.StatusCode, string(b))
+	}
+
+	var auth DeviceAuthorization
+	err = json.Unmarshal(b, &auth)
+	if err != nil {
+		return nil, err
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return nil, fmt.Errorf("incomplete device authorization: %s", string(b))
+	}
+	return &auth, nil
+}
+
+// PollDeviceToken waits until the user approves the device authorization and
+// fetches the tokens, the IdP decides how often it may be asked.
+func (c *OIDCClient) PollDeviceToken(ctx context.Context, auth *DeviceAuthorization) error {
+	expiresIn := time.Duration(auth.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 5 * time.Minute
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, expiresIn)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("device authorization expired")
+			}
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+
+		data := url.Values{}
+		data.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+		data.Set("device_code", auth.DeviceCode)
+		err := c.requestTokens(ctx, data, "device token")
+		var tokenErr *TokenError
+		if !errors.As(err, &tokenErr) {
+			return err
+		}
+		switch tokenErr.Code {
+		case tokenErrorAuthorizationPending:
+		case tokenErrorSlowDown:
+			interval += 5 * time.Second
+		default:
+			return err
+		}
+	}
+}
+
+// requestTokens posts the grant to the token endpoint, the refresh token is
+// replaced only when the IdP issues a new one.
+func (c *OIDCClient) requestTokens(ctx context.Context, data url.Values, grant string) error {
+	data.Set("client_id", c.ClientID)
+	if c.ClientSecret != "" {
+		data.Set("client_secret", c.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
@@ -95,12 +298,20 @@ func (c *OIDCClient) RefreshAccessToken() error {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code from refresh token: %d. Body: %s", resp.StatusCode, string(b))
+		tokenErr := &TokenError{Grant: grant, StatusCode: resp.StatusCode, Body: string(b)}
+		var errorResponse struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &errorResponse) == nil {
+			tokenErr.Code = errorResponse.Error
+		}
+		return tokenErr
 	}
 
 	// Parse the response
 	var tokenResponse struct {
-		AccessToken string `json:"access_token"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	err = json.Unmarshal(b, &tokenResponse)
@@ -109,15 +320,37 @@ func (c *OIDCClient) RefreshAccessToken() error {
 	}
 
 	c.AccessToken = tokenResponse.AccessToken
+	if tokenResponse.RefreshToken != "" {
+		c.RefreshToken = tokenResponse.RefreshToken
+	}
 	return nil
 }
 
-func (c *OIDCClient) GetUserInfo() (map[string]interface{}, error) {
+// isTokenFor tells whether the claims name the client as the audience or the
+// authorized party of the token.
+func isTokenFor(claims map[string]interface{}, clientID string) bool {
+	if azp, ok := claims["azp"].(string); ok && azp == clientID {
+		return true
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, value := range aud {
+			if value == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *OIDCClient) GetUserInfo(ctx context.Context) (map[string]interface{}, error) {
 	if c.AccessToken == "" {
 		return nil, fmt.Errorf("access token is required to get user info")
 	}
 
-	req, err := http.NewRequest(http.MethodGet, c.UserInfoURL, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.UserInfoURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package foodme
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -59,6 +60,19 @@ func (m *MockHttpClient) Do(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+// MockSequenceHttpClient answers the requests with the responses in turns,
+// the last one is repeated.
+type MockSequenceHttpClient struct {
+	Responses []*MockHttpClient
+	Requests  int
+}
+
+func (m *MockSequenceHttpClient) Do(req *http.Request) (*http.Response, error) {
+	response := m.Responses[min(m.Requests, len(m.Responses)-1)]
+	m.Requests++
+	return response.Do(req)
+}
+
 func createToken(t *testing.T, data map[string]interface{}) string {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims(data))
 	tokenString, err := token.SignedString([]byte("secret"))
@@ -133,34 +147,34 @@ func TestIsAccessTokenValid(t *testing.T) {
 func TestRefreshAccessToken(t *testing.T) {
 	// Bad url
 	client := NewOIDCClient(&MockHttpClient{}, "client-id", "", "blah://bad url", "http://user-info-url", "access", "refresh")
-	err := client.RefreshAccessToken()
+	err := client.RefreshAccessToken(context.Background())
 	assert.Error(t, err, "parse \"blah://bad url\": invalid character \" \" in host name")
 
 	// Fail on do request
 	client.TokenURL = "http://token-url"
 	client.HTTPClient = &MockHttpClient{DoSucceed: false}
-	err = client.RefreshAccessToken()
+	err = client.RefreshAccessToken(context.Background())
 	assert.Error(t, err, "failed to do request")
 
 	// Fail on body reading
 	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: "bad response", FailBodyRead: true}
-	err = client.RefreshAccessToken()
+	err = client.RefreshAccessToken(context.Background())
 	assert.Error(t, err, "body read failure")
 
 	// Fail on status code
 	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: "bad response", StatusCode: 500}
-	err = client.RefreshAccessToken()
+	err = client.RefreshAccessToken(context.Background())
 	assert.Error(t, err, "unexpected status code from refresh token: 500. Body: bad response")
 
 	// Fail on unmarshal
 	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: "bad response", StatusCode: 200}
-	err = client.RefreshAccessToken()
+	err = client.RefreshAccessToken(context.Background())
 	assert.Error(t, err, "invalid character 'b' looking for beginning of value")
 
 	// Test OK
 	httpClient := &MockHttpClient{DoSucceed: true, Response: "{\"access_token\":\"new-access\"}", StatusCode: 200}
 	client.HTTPClient = httpClient
-	err = client.RefreshAccessToken()
+	err = client.RefreshAccessToken(context.Background())
 	assert.NilError(t, err)
 	assert.Equal(t, client.AccessToken, "new-access")
 	assert.Equal(t, client.RefreshToken, "refresh")
@@ -169,7 +183,7 @@ func TestRefreshAccessToken(t *testing.T) {
 
 	// Test OK with client secret
 	client.ClientSecret = "secret"
-	err = client.RefreshAccessToken()
+	err = client.RefreshAccessToken(context.Background())
 	assert.NilError(t, err)
 	assert.Equal(t, client.AccessToken, "new-access")
 	assert.Equal(t, client.RefreshToken, "refresh")
@@ -177,43 +191,162 @@ func TestRefreshAccessToken(t *testing.T) {
 	assert.DeepEqual(t, httpClient.RequestHeader, http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
 }
 
+func TestPasswordGrant(t *testing.T) {
+	client := NewOIDCClient(&MockHttpClient{DoSucceed: true, Response: "invalid_grant", StatusCode: 401}, "client-id", "", "http://token-url", "http://user-info-url", "", "")
+	err := client.PasswordGrant(context.Background(), "bob", "secret")
+	assert.Error(t, err, "unexpected status code from password grant: 401. Body: invalid_grant")
+
+	httpClient := &MockHttpClient{DoSucceed: true, Response: "{\"access_token\":\"new-access\",\"refresh_token\":\"new-refresh\"}", StatusCode: 200}
+	client.HTTPClient = httpClient
+	err = client.PasswordGrant(context.Background(), "bob", "secret")
+	assert.NilError(t, err)
+	assert.Equal(t, client.AccessToken, "new-access")
+	assert.Equal(t, client.RefreshToken, "new-refresh")
+	assert.Equal(t, httpClient.RequestBody, "client_id=client-id&grant_type=password&password=secret&scope=openid&username=bob")
+}
+
+func TestExchangeToken(t *testing.T) {
+	client := NewOIDCClient(&MockHttpClient{DoSucceed: true, Response: "invalid_token", StatusCode: 400}, "client-id", "secret", "http://token-url", "http://user-info-url", "", "")
+	err := client.ExchangeToken(context.Background(), "subject")
+	assert.Error(t, err, "unexpected status code from token exchange: 400. Body: invalid_token")
+
+	httpClient := &MockHttpClient{DoSucceed: true, Response: "{\"access_token\":\"new-access\",\"refresh_token\":\"new-refresh\"}", StatusCode: 200}
+	client.HTTPClient = httpClient
+	err = client.ExchangeToken(context.Background(), "subject")
+	assert.NilError(t, err)
+	assert.Equal(t, client.AccessToken, "new-access")
+	assert.Equal(t, client.RefreshToken, "new-refresh")
+	assert.Equal(t, httpClient.RequestBody, "client_id=client-id&client_secret=secret&grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Atoken-exchange&scope=openid&subject_token=subject&subject_token_type=urn%3Aietf%3Aparams%3Aoauth%3Atoken-type%3Aaccess_token")
+}
+
+func TestClientCredentialsGrant(t *testing.T) {
+	httpClient := &MockHttpClient{DoSucceed: true, Response: "{\"access_token\":\"new-access\"}", StatusCode: 200}
+	client := NewOIDCClient(httpClient, "batch", "batch-secret", "http://token-url", "http://user-info-url", "", "")
+	err := client.ClientCredentialsGrant(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, client.AccessToken, "new-access")
+	assert.Equal(t, client.ClientCredentials, true)
+	assert.Equal(t, httpClient.RequestBody, "client_id=batch&client_secret=batch-secret&grant_type=client_credentials")
+
+	// Without a refresh token the client logs in again
+	client.AccessToken = ""
+	err = client.RefreshAccessToken(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, client.AccessToken, "new-access")
+	assert.Equal(t, httpClient.RequestBody, "client_id=batch&client_secret=batch-secret&grant_type=client_credentials")
+
+	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: "unauthorized_client", StatusCode: 401}
+	err = client.ClientCredentialsGrant(context.Background())
+	assert.Error(t, err, "unexpected status code from client credentials grant: 401. Body: unauthorized_client")
+}
+
+func TestAccessTokenClaims(t *testing.T) {
+	client := NewOIDCClient(&MockHttpClient{}, "batch", "", "http://token-url", "http://user-info-url", "not a token", "")
+	_, err := client.AccessTokenClaims()
+	assert.ErrorContains(t, err, "failed to parse access token")
+
+	client.AccessToken = createToken(t, map[string]interface{}{"azp": "batch", "aud": []string{"pets", "account"}})
+	claims, err := client.AccessTokenClaims()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, claims, map[string]interface{}{"azp": "batch", "aud": []interface{}{"pets", "account"}})
+}
+
+func TestIsTokenFor(t *testing.T) {
+	assert.Assert(t, isTokenFor(map[string]interface{}{"azp": "pets"}, "pets"))
+	assert.Assert(t, isTokenFor(map[string]interface{}{"azp": "batch", "aud": "pets"}, "pets"))
+	assert.Assert(t, isTokenFor(map[string]interface{}{"azp": "batch", "aud": []interface{}{"account", "pets"}}, "pets"))
+	assert.Assert(t, !isTokenFor(map[string]interface{}{"azp": "batch", "aud": []interface{}{"account"}}, "pets"))
+	assert.Assert(t, !isTokenFor(map[string]interface{}{"aud": 1}, "pets"))
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+	client := NewOIDCClient(&MockHttpClient{DoSucceed: true, Response: "unauthorized_client", StatusCode: 400}, "client-id", "", "http://token-url", "http://user-info-url", "", "")
+	_, err := client.AuthorizeDevice(context.Background(), "http://device-url")
+	assert.Error(t, err, "unexpected status code from device authorization: 400. Body: unauthorized_client")
+
+	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: `{"device_code":"device"}`, StatusCode: 200}
+	_, err = client.AuthorizeDevice(context.Background(), "http://device-url")
+	assert.Error(t, err, `incomplete device authorization: {"device_code":"device"}`)
+
+	httpClient := &MockHttpClient{DoSucceed: true, Response: `{"device_code":"device","user_code":"ABCD-EFGH","verification_uri":"http://idp/device","expires_in":600,"interval":5}`, StatusCode: 200}
+	client.HTTPClient = httpClient
+	auth, err := client.AuthorizeDevice(context.Background(), "http://device-url")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, auth, &DeviceAuthorization{DeviceCode: "device", UserCode: "ABCD-EFGH", VerificationURI: "http://idp/device", ExpiresIn: 600, Interval: 5})
+	assert.Equal(t, httpClient.RequestBody, "client_id=client-id&scope=openid")
+}
+
+func TestPollDeviceToken(t *testing.T) {
+	pending := &MockHttpClient{DoSucceed: true, Response: `{"error":"authorization_pending"}`, StatusCode: 400}
+	tokens := &MockHttpClient{DoSucceed: true, Response: `{"access_token":"new-access","refresh_token":"new-refresh"}`, StatusCode: 200}
+	denied := &MockHttpClient{DoSucceed: true, Response: `{"error":"access_denied"}`, StatusCode: 400}
+	auth := &DeviceAuthorization{DeviceCode: "device", ExpiresIn: 60, Interval: 1}
+
+	// Approved after a while
+	httpClient := &MockSequenceHttpClient{Responses: []*MockHttpClient{pending, tokens}}
+	client := NewOIDCClient(httpClient, "client-id", "", "http://token-url", "http://user-info-url", "", "")
+	err := client.PollDeviceToken(context.Background(), auth)
+	assert.NilError(t, err)
+	assert.Equal(t, httpClient.Requests, 2)
+	assert.Equal(t, client.AccessToken, "new-access")
+	assert.Equal(t, client.RefreshToken, "new-refresh")
+	assert.Equal(t, tokens.RequestBody, "client_id=client-id&device_code=device&grant_type=urn%3Aietf%3Aparams%3Aoauth%3Agrant-type%3Adevice_code")
+
+	// Denied
+	client.HTTPClient = &MockSequenceHttpClient{Responses: []*MockHttpClient{denied}}
+	err = client.PollDeviceToken(context.Background(), auth)
+	tokenErr, ok := err.(*TokenError)
+	assert.Assert(t, ok, err)
+	assert.Equal(t, tokenErr.Code, "access_denied")
+
+	// Expired before the next poll
+	err = client.PollDeviceToken(context.Background(), &DeviceAuthorization{DeviceCode: "device", ExpiresIn: 1, Interval: 5})
+	assert.Error(t, err, "device authorization expired")
+
+	// The client left
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.PollDeviceToken(ctx, auth)
+	assert.Error(t, err, "context canceled")
+}
+
 func TestGetUserInfo(t *testing.T) {
 	// Test empty access token
 	client := NewOIDCClient(&MockHttpClient{}, "client-id", "client-secret", "http://token-url", "http://user-info-url", "", "refresh")
-	_, err := client.GetUserInfo()
+	_, err := client.GetUserInfo(context.Background())
 	assert.Error(t, err, "access token is required to get user info")
 
 	// Test bad url
 	client.AccessToken = "access"
 	client.UserInfoURL = "blah://bad url"
-	_, err = client.GetUserInfo()
+	_, err = client.GetUserInfo(context.Background())
 	assert.Error(t, err, "parse \"blah://bad url\": invalid character \" \" in host name")
 
 	// Test fail to do request
 	client.UserInfoURL = "http://user-info-url"
 	client.HTTPClient = &MockHttpClient{DoSucceed: false}
-	_, err = client.GetUserInfo()
+	_, err = client.GetUserInfo(context.Background())
 	assert.Error(t, err, "failed to do request")
 
 	// Fail body read
 	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: "bad response", FailBodyRead: true}
-	_, err = client.GetUserInfo()
+	_, err = client.GetUserInfo(context.Background())
 	assert.Error(t, err, "body read failure")
 
 	// Test bad status code
 	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: "bad response", StatusCode: 500}
-	_, err = client.GetUserInfo()
+	_, err = client.GetUserInfo(context.Background())
 	assert.Error(t, err, "unexpected status code from user info: 500. Body: bad response")
 
 	// Fail unmarshal
 	client.HTTPClient = &MockHttpClient{DoSucceed: true, Response: "bad response", StatusCode: 200}
-	_, err = client.GetUserInfo()
+	_, err = client.GetUserInfo(context.Background())
 	assert.Error(t, err, "invalid character 'b' looking for beginning of value")
 
 	// Test OK
 	httpClient := &MockHttpClient{DoSucceed: true, Response: "{\"name\":\"John\"}", StatusCode: 200}
 	client.HTTPClient = httpClient
-	data, err := client.GetUserInfo()
+	data, err := client.GetUserInfo(context.Background())
 	assert.NilError(t, err)
 	assert.DeepEqual(t, data, map[string]interface{}{"name": "John"})
 	assert.DeepEqual(t, httpClient.RequestHeader, http.Header{"Authorization": {"Bearer access"}})
@@ -2,6 +2,7 @@ package foodme
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -254,11 +255,8 @@ type OPASQL struct {
 	UpdateQuery         string
 	DeleteQuery         string
 	StringEscapeChar    string
+	ClientPolicyPath    string
 	httpClient          IHttpClient
-
-	allowedCreate bool
-	allowedUpdate bool
-	allowedDelete bool
 }
 
 func NewOPASQL(
@@ -276,40 +274,15 @@ func NewOPASQL(
 	}
 }
 
-func (o *OPASQL) SetCreateAllowed(userInfo map[string]interface{}) error {
-	allowed, err := o.getDDLAllowed("create", userInfo)
-	if err != nil {
-		return err
-	}
-	o.allowedCreate = allowed
-	return nil
-}
-
-func (o *OPASQL) SetUpdateAllowed(userInfo map[string]interface{}) error {
-	allowed, err := o.getDDLAllowed("update", userInfo)
-	if err != nil {
-		return err
-	}
-	o.allowedUpdate = allowed
-	return nil
-}
-
-func (o *OPASQL) SetDeleteAllowed(userInfo map[string]interface{}) error {
-	allowed, err := o.getDDLAllowed("delete", userInfo)
-	if err != nil {
-		return err
-	}
-	o.allowedDelete = allowed
-	return nil
-}
-
-func (o *OPASQL) getDDLAllowed(operation string, userInfo map[string]interface{}) (bool, error) {
-	payload, err := o.BuildPayload(operation, "", userInfo)
+// DDLAllowed asks whether the user may run the create, update or delete
+// statements.
+func (o *OPASQL) DDLAllowed(ctx context.Context, operation string, userInfo map[string]interface{}) (bool, error) {
+	payload, err := o.BuildPayload(ctx, operation, "", userInfo)
 	if err != nil {
 		return false, err
 	}
 
-	resp, err := o.Query(payload)
+	resp, err := o.Query(ctx, payload)
 	if err != nil {
 		return false, err
 	}
@@ -317,13 +290,13 @@ func (o *OPASQL) getDDLAllowed(operation string, userInfo map[string]interface{}
 	return resp.IsAllowed(), nil
 }
 
-func (o *OPASQL) Query(payload *CompilePayload) (*CompileResponse, error) {
+func (o *OPASQL) Query(ctx context.Context, payload *CompilePayload) (*CompileResponse, error) {
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal json payload: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/compile", o.Address), bytes.NewBuffer(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/v1/compile", o.Address), bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -352,7 +325,25 @@ func (o *OPASQL) Query(payload *CompilePayload) (*CompileResponse, error) {
 	return compileResp, nil
 }
 
-func (o *OPASQL) BuildPayload(operation, tableName string, userInfo map[string]interface{}) (*CompilePayload, error) {
+func (o *OPASQL) Ping() error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/health", o.Address), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from OPA: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (o *OPASQL) BuildPayload(ctx context.Context, operation, tableName string, userInfo map[string]interface{}) (*CompilePayload, error) {
 	var query string
 	switch operation {
 	case "create":
@@ -376,16 +367,30 @@ func (o *OPASQL) BuildPayload(operation, tableName string, userInfo map[string]i
 		return nil, fmt.Errorf("unexpected operation: %s", operation)
 	}
 
+	if clientID, ok := clientSession(ctx); ok && o.ClientPolicyPath != "" {
+		query = o.clientQuery(query, clientID)
+	}
+
 	return &CompilePayload{Query: query, Unknowns: []string{"data.tables"}, Input: CompilePayloadInput{UserInfo: userInfo}}, nil
 }
 
-func (o *OPASQL) SelectFilters(tableName, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
-	payload, err := o.BuildPayload("select", tableName, userInfo)
+// clientQuery moves the query into the package of the client, the clients
+// logged in by the client credentials grant have policies of their own.
+func (o *OPASQL) clientQuery(query, clientID string) string {
+	rest, ok := strings.CutPrefix(query, "data.")
+	if !ok {
+		return query
+	}
+	return fmt.Sprintf("%s[%q].%s", o.ClientPolicyPath, clientID, rest)
+}
+
+func (o *OPASQL) SelectFilters(ctx context.Context, tableName, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
+	payload, err := o.BuildPayload(ctx, "select", tableName, userInfo)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build payload: %w", err)
 	}
 
-	resp, err := o.Query(payload)
+	resp, err := o.Query(ctx, payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query OPA: %w", err)
 	}
@@ -406,18 +411,6 @@ func (o *OPASQL) SelectFilters(tableName, tableAlias string, userInfo map[string
 	return &SelectFilters{WhereFilters: []string{wfs}, JoinFilters: []*JoinFilter{}}, nil
 }
 
-func (o *OPASQL) CreateAllowed() bool {
-	return o.allowedCreate
-}
-
-func (o *OPASQL) UpdateAllowed() bool {
-	return o.allowedUpdate
-}
-
-func (o *OPASQL) DeleteAllowed() bool {
-	return o.allowedDelete
-}
-
 func setIndicesForCompiledTerms(compiledTerms []*CompiledTerm) error {
 	if len(compiledTerms) != 3 {
 		return fmt.Errorf("unexpected number of terms in query: %d", len(compiledTerms))
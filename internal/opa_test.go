@@ -1,6 +1,7 @@
 package foodme
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -381,7 +382,7 @@ func TestCompileResponseEdge(t *testing.T) {
 func TestOPASQLBuildPayload(t *testing.T) {
 	opa := NewOPASQL("opa-server", "data.{{ .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", nil)
 	userInfo := map[string]interface{}{"preferred_username": "test"}
-	payload, err := opa.BuildPayload("select", "tablename", userInfo)
+	payload, err := opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
 	assert.DeepEqual(t, payload, &CompilePayload{
 		Query:    "data.tablename.allow == true",
@@ -390,10 +391,38 @@ func TestOPASQLBuildPayload(t *testing.T) {
 	})
 }
 
+func TestOPASQLBuildPayloadClient(t *testing.T) {
+	opa := NewOPASQL("opa-server", "data.{{ .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", nil)
+	opa.ClientPolicyPath = "data.clients"
+	userInfo := map[string]interface{}{"client_id": "batch-job"}
+	ctx := withClientSession(context.Background(), "batch-job")
+
+	payload, err := opa.BuildPayload(ctx, "select", "tablename", userInfo)
+	assert.NilError(t, err)
+	assert.Equal(t, payload.Query, `data.clients["batch-job"].tablename.allow == true`)
+	payload, err = opa.BuildPayload(ctx, "create", "", userInfo)
+	assert.NilError(t, err)
+	assert.Equal(t, payload.Query, `data.clients["batch-job"].ddl_create.allow == true`)
+
+	// The users keep their policies, even with a client_id claim of their own
+	payload, err = opa.BuildPayload(context.Background(), "create", "", map[string]interface{}{"preferred_username": "test"})
+	assert.NilError(t, err)
+	assert.Equal(t, payload.Query, "data.ddl_create.allow == true")
+	payload, err = opa.BuildPayload(context.Background(), "create", "", userInfo)
+	assert.NilError(t, err)
+	assert.Equal(t, payload.Query, "data.ddl_create.allow == true")
+
+	// As do the clients without the path
+	opa.ClientPolicyPath = ""
+	payload, err = opa.BuildPayload(ctx, "create", "", userInfo)
+	assert.NilError(t, err)
+	assert.Equal(t, payload.Query, "data.ddl_create.allow == true")
+}
+
 func TestOPASQLBuildPayloadFailures(t *testing.T) {
 	opa := NewOPASQL("opa-server", "data.{{ eq .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", nil)
 	userInfo := map[string]interface{}{"preferred_username": "test"}
-	_, err := opa.BuildPayload("select", "tablename", userInfo)
+	_, err := opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.Error(t, err, "failed to execute SELECT query template: template: query:1:8: executing \"query\" at <eq .TableName>: error calling eq: missing argument for comparison")
 }
 
@@ -428,9 +457,9 @@ func TestOPASQLQueryOK(t *testing.T) {
 	opaHttpClient := &MockOPAHTTPClient{DoSucceed: true, Response: `{"result": {"queries": [[]]}}`, StatusCode: 200}
 	opa := NewOPASQL("opa-server", "data.{{ .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
 	userInfo := map[string]interface{}{"preferred_username": "test"}
-	payload, err := opa.BuildPayload("select", "tablename", userInfo)
+	payload, err := opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
-	resp, err := opa.Query(payload)
+	resp, err := opa.Query(context.Background(), payload)
 	assert.NilError(t, err)
 	assert.DeepEqual(t, resp, &CompileResponse{Result: CompileResponseResult{Queries: [][]CompileResponseQuery{{}}}})
 }
@@ -441,49 +470,49 @@ func TestOPASQLQueryFailures(t *testing.T) {
 	// Bad payload
 	opa := NewOPASQL("opa-server", "data.{{ .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
 	userInfo := map[string]interface{}{"preferred_username": map[interface{}]bool{nil: false}}
-	payload, err := opa.BuildPayload("select", "tablename", userInfo)
+	payload, err := opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
-	_, err = opa.Query(payload)
+	_, err = opa.Query(context.Background(), payload)
 	assert.Error(t, err, "failed to marshal json payload: json: unsupported type: map[interface {}]bool")
 
 	// Bad address
 	userInfo = map[string]interface{}{"preferred_username": "user"}
 	opa.Address = "bad://bad url"
-	payload, err = opa.BuildPayload("select", "tablename", userInfo)
+	payload, err = opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
-	_, err = opa.Query(payload)
+	_, err = opa.Query(context.Background(), payload)
 	assert.Error(t, err, "failed to create request: parse \"bad://bad url/v1/compile\": invalid character \" \" in host name")
 
 	// Bad request
 	opa.Address = "http://opa-server"
 	opaHttpClient.DoSucceed = false
-	payload, err = opa.BuildPayload("select", "tablename", userInfo)
+	payload, err = opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
-	_, err = opa.Query(payload)
+	_, err = opa.Query(context.Background(), payload)
 	assert.Error(t, err, "failed to execute request: failed to do request")
 
 	// Bad response code
 	opaHttpClient.DoSucceed = true
 	opaHttpClient.StatusCode = 500
-	payload, err = opa.BuildPayload("select", "tablename", userInfo)
+	payload, err = opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
-	_, err = opa.Query(payload)
+	_, err = opa.Query(context.Background(), payload)
 	assert.Error(t, err, "unexpected status code from OPA: 500")
 
 	// Fail body read
 	opaHttpClient.StatusCode = 200
 	opaHttpClient.FailBodyRead = true
-	payload, err = opa.BuildPayload("select", "tablename", userInfo)
+	payload, err = opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
-	_, err = opa.Query(payload)
+	_, err = opa.Query(context.Background(), payload)
 	assert.Error(t, err, "failed to read response body: body read failure")
 
 	// Fail unmarshal
 	opaHttpClient.FailBodyRead = false
 	opaHttpClient.Response = "bad response"
-	payload, err = opa.BuildPayload("select", "tablename", userInfo)
+	payload, err = opa.BuildPayload(context.Background(), "select", "tablename", userInfo)
 	assert.NilError(t, err)
-	_, err = opa.Query(payload)
+	_, err = opa.Query(context.Background(), payload)
 	assert.Error(t, err, "failed to unmarshal response body: invalid character 'b' looking for beginning of value")
 }
 
@@ -492,26 +521,26 @@ func TestOPASQLGetFilters(t *testing.T) {
 	opaHttpClient := &MockOPAHTTPClient{DoSucceed: true, Response: `{"result": {"queries": [[]]}}`, StatusCode: 200}
 	opa := NewOPASQL("opa-server", "data.{{ .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
 	userInfo := map[string]interface{}{"preferred_username": "test"}
-	filters, err := opa.SelectFilters("pets", "p", userInfo)
+	filters, err := opa.SelectFilters(context.Background(), "pets", "p", userInfo)
 	assert.NilError(t, err)
 	assert.Equal(t, len(filters.WhereFilters), 0)
 	assert.Equal(t, len(filters.JoinFilters), 0)
 
 	// Is disallowed
 	opaHttpClient.Response = `{"result": {}}`
-	_, err = opa.SelectFilters("pets", "p", userInfo)
+	_, err = opa.SelectFilters(context.Background(), "pets", "p", userInfo)
 	assert.Error(t, err, "permission denied to access table pets")
 
 	// Simple filter
 	opaHttpClient.Response = `{"result": {"queries": [[{"index": 0, "terms": [{"type": "ref", "value": [{"type": "var", "value": "eq"}]}, {"type": "string", "value": "dog"}, {"type": "ref", "value": [{"type": "var", "value": "data"}, {"type": "string", "value": "tables"}, {"type": "string", "value": "pets"}, {"type": "string", "value": "animal_type"}]}]}]]}}`
-	filters, err = opa.SelectFilters("pets", "p", userInfo)
+	filters, err = opa.SelectFilters(context.Background(), "pets", "p", userInfo)
 	assert.NilError(t, err)
 	assert.Equal(t, len(filters.WhereFilters), 1)
 	assert.Equal(t, filters.WhereFilters[0], "((p.animal_type = 'dog'))")
 
 	// Failing filter
 	opaHttpClient.Response = `{"result": {"queries": [[{"index": 0, "terms": [{"type": "ref", "value": [{"type": "var", "value": "eq"}]}]}]]}}`
-	_, err = opa.SelectFilters("pets", "p", userInfo)
+	_, err = opa.SelectFilters(context.Background(), "pets", "p", userInfo)
 	assert.Error(t, err, "failed to compile response: failed to compile response: unexpected number of terms in query: 1")
 }
 
@@ -519,12 +548,12 @@ func TestOPASQLGetFiltersFailures(t *testing.T) {
 	opaHttpClient := &MockOPAHTTPClient{}
 	opa := NewOPASQL("opa-server", "data.{{ eq .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
 	userInfo := map[string]interface{}{"preferred_username": "test"}
-	_, err := opa.SelectFilters("pets", "p", userInfo)
+	_, err := opa.SelectFilters(context.Background(), "pets", "p", userInfo)
 	assert.Error(t, err, "failed to build payload: failed to execute SELECT query template: template: query:1:8: executing \"query\" at <eq .TableName>: error calling eq: missing argument for comparison")
 
 	opa.SelectQueryTemplate = "data.{{ .TableName }}.allow == true"
 	opaHttpClient.DoSucceed = false
-	_, err = opa.SelectFilters("pets", "p", userInfo)
+	_, err = opa.SelectFilters(context.Background(), "pets", "p", userInfo)
 	assert.Error(t, err, "failed to query OPA: failed to execute request: failed to do request")
 }
 
@@ -544,52 +573,67 @@ func TestSetIndicesForCompiledTerms(t *testing.T) {
 func TestSetDDLCreateOPA(t *testing.T) {
 	opaHttpClient := &MockOPAHTTPClient{}
 	opa := NewOPASQL("opa-server", "data.{{ eq .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
-	assert.Assert(t, !opa.CreateAllowed())
-	err := opa.SetCreateAllowed(nil)
+	allowed, err := opa.DDLAllowed(context.Background(), "create", nil)
 	assert.Error(t, err, "failed to execute request: failed to do request")
+	assert.Assert(t, !allowed)
 
 	opaHttpClient.DoSucceed = true
 	opaHttpClient.StatusCode = 200
 	opaHttpClient.Response = `{"result": {"queries": [[]]}}`
-	err = opa.SetCreateAllowed(nil)
+	allowed, err = opa.DDLAllowed(context.Background(), "create", nil)
 	assert.NilError(t, err)
-	assert.Assert(t, opa.CreateAllowed())
+	assert.Assert(t, allowed)
 }
 
 func TestSetDDLUpdateOPA(t *testing.T) {
 	opaHttpClient := &MockOPAHTTPClient{}
 	opa := NewOPASQL("opa-server", "data.{{ eq .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
-	assert.Assert(t, !opa.UpdateAllowed())
-	err := opa.SetUpdateAllowed(nil)
+	allowed, err := opa.DDLAllowed(context.Background(), "update", nil)
 	assert.Error(t, err, "failed to execute request: failed to do request")
+	assert.Assert(t, !allowed)
 
 	opaHttpClient.DoSucceed = true
 	opaHttpClient.StatusCode = 200
 	opaHttpClient.Response = `{"result": {"queries": [[]]}}`
-	err = opa.SetUpdateAllowed(nil)
+	allowed, err = opa.DDLAllowed(context.Background(), "update", nil)
 	assert.NilError(t, err)
-	assert.Assert(t, opa.UpdateAllowed())
+	assert.Assert(t, allowed)
 }
 
 func TestSetDDLDeleteOPA(t *testing.T) {
 	opaHttpClient := &MockOPAHTTPClient{}
 	opa := NewOPASQL("opa-server", "data.{{ eq .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
-	assert.Assert(t, !opa.DeleteAllowed())
-	err := opa.SetDeleteAllowed(nil)
+	allowed, err := opa.DDLAllowed(context.Background(), "delete", nil)
 	assert.Error(t, err, "failed to execute request: failed to do request")
+	assert.Assert(t, !allowed)
 
 	opaHttpClient.DoSucceed = true
 	opaHttpClient.StatusCode = 200
 	opaHttpClient.Response = `{"result": {"queries": [[]]}}`
-	err = opa.SetDeleteAllowed(nil)
+	allowed, err = opa.DDLAllowed(context.Background(), "delete", nil)
 	assert.NilError(t, err)
-	assert.Assert(t, opa.DeleteAllowed())
+	assert.Assert(t, allowed)
 }
 
 func TestGetDDLAllowedFail(t *testing.T) {
 	opaHttpClient := &MockOPAHTTPClient{}
 	opa := NewOPASQL("opa-server", "data.{{ eq .TableName }}.allow == true", "data.ddl_create.allow == true", "data.ddl_update.allow == true", "data.ddl_delete.allow == true", "'", opaHttpClient)
 
-	_, err := opa.getDDLAllowed("bad", nil)
+	_, err := opa.DDLAllowed(context.Background(), "bad", nil)
 	assert.Error(t, err, "unexpected operation: bad")
 }
+
+func TestOPASQLPing(t *testing.T) {
+	opaHttpClient := &MockOPAHTTPClient{DoSucceed: true, Response: `{}`, StatusCode: 200}
+	opa := NewOPASQL("opa-server", "", "", "", "", "'", opaHttpClient)
+	assert.NilError(t, opa.Ping())
+
+	opaHttpClient.StatusCode = 500
+	assert.Error(t, opa.Ping(), "unexpected status code from OPA: 500")
+
+	opaHttpClient.DoSucceed = false
+	assert.ErrorContains(t, opa.Ping(), "failed to execute request")
+
+	opa.Address = "http://bad\x00url"
+	assert.ErrorContains(t, opa.Ping(), "failed to create request")
+}
@@ -15,7 +15,7 @@ type JoinFilter struct {
 func NewPermissionAgent(conf *Configuration, httpClient IHttpClient) (IPermissionAgent, error) {
 	switch conf.PermissionAgentType {
 	case "opa":
-		return NewOPASQL(
+		agent := NewOPASQL(
 			conf.PermissionAgentOPAURL,
 			conf.PermissionAgentOPASelectQueryTemplate,
 			conf.PermissionAgentOPACreateQuery,
@@ -23,7 +23,9 @@ func NewPermissionAgent(conf *Configuration, httpClient IHttpClient) (IPermissio
 			conf.PermissionAgentOPADeleteQuery,
 			conf.PermissionAgentOPAStringEscapeCharacter,
 			httpClient,
-		), nil
+		)
+		agent.ClientPolicyPath = conf.PermissionAgentOPAClientPolicyPath
+		return agent, nil
 	case "http":
 		return NewHTTPPermissionAgent(conf.PermissionAgentHTTPDDLEndpoint, conf.PermissionAgentHTTPSelectEndpoint, httpClient), nil
 	default:
@@ -2,6 +2,7 @@ package foodme
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,10 +13,7 @@ type HTTPPermissionAgent struct {
 	DDLEndpoint    string
 	SelectEndpoint string
 
-	client        IHttpClient
-	createAllowed bool
-	updateAllowed bool
-	deleteAllowed bool
+	client IHttpClient
 }
 
 type DDLPayload struct {
@@ -42,7 +40,7 @@ func NewHTTPPermissionAgent(ddlEndpoint, selectEndpoint string, httpClient IHttp
 	return &HTTPPermissionAgent{DDLEndpoint: ddlEndpoint, SelectEndpoint: selectEndpoint, client: httpClient}
 }
 
-func (h *HTTPPermissionAgent) ddlQuery(operation string, userInfo map[string]interface{}) (*DDLResponse, error) {
+func (h *HTTPPermissionAgent) ddlQuery(ctx context.Context, operation string, userInfo map[string]interface{}) (*DDLResponse, error) {
 	payload := &DDLPayload{UserInfo: userInfo, Operation: operation}
 
 	body, err := json.Marshal(payload)
@@ -50,7 +48,7 @@ func (h *HTTPPermissionAgent) ddlQuery(operation string, userInfo map[string]int
 		return nil, fmt.Errorf("failed to marshal json payload: %w", err)
 	}
 
-	respBody, err := h.query(http.MethodPost, h.DDLEndpoint, body)
+	respBody, err := h.query(ctx, http.MethodPost, h.DDLEndpoint, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query ddl: %w", err)
 	}
@@ -63,8 +61,8 @@ func (h *HTTPPermissionAgent) ddlQuery(operation string, userInfo map[string]int
 	return ddlResp, nil
 }
 
-func (h *HTTPPermissionAgent) query(method, endpoint string, body []byte) ([]byte, error) {
-	req, err := http.NewRequest(method, endpoint, bytes.NewBuffer(body))
+func (h *HTTPPermissionAgent) query(ctx context.Context, method, endpoint string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http request: %w", err)
 	}
@@ -88,37 +86,24 @@ func (h *HTTPPermissionAgent) query(method, endpoint string, body []byte) ([]byt
 	return respBody, nil
 }
 
-func (h *HTTPPermissionAgent) SetCreateAllowed(userInfo map[string]interface{}) error {
-	ddlResp, err := h.ddlQuery("create", userInfo)
+// DDLAllowed asks whether the user may run the create, update or delete
+// statements.
+func (h *HTTPPermissionAgent) DDLAllowed(ctx context.Context, operation string, userInfo map[string]interface{}) (bool, error) {
+	ddlResp, err := h.ddlQuery(ctx, operation, userInfo)
 	if err != nil {
-		return fmt.Errorf("failed to query ddl: %w", err)
+		return false, fmt.Errorf("failed to query ddl: %w", err)
 	}
-
-	h.createAllowed = ddlResp.Allowed
-	return nil
+	return ddlResp.Allowed, nil
 }
 
-func (h *HTTPPermissionAgent) SetUpdateAllowed(userInfo map[string]interface{}) error {
-	ddlResp, err := h.ddlQuery("update", userInfo)
-	if err != nil {
-		return fmt.Errorf("failed to query ddl: %w", err)
-	}
-
-	h.updateAllowed = ddlResp.Allowed
-	return nil
+// Ping asks the DDL endpoint for a decision of an anonymous user, the agent
+// has no dedicated health endpoint.
+func (h *HTTPPermissionAgent) Ping() error {
+	_, err := h.ddlQuery(context.Background(), "create", map[string]interface{}{})
+	return err
 }
 
-func (h *HTTPPermissionAgent) SetDeleteAllowed(userInfo map[string]interface{}) error {
-	ddlResp, err := h.ddlQuery("delete", userInfo)
-	if err != nil {
-		return fmt.Errorf("failed to query ddl: %w", err)
-	}
-
-	h.deleteAllowed = ddlResp.Allowed
-	return nil
-}
-
-func (h *HTTPPermissionAgent) SelectFilters(tableName, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
+func (h *HTTPPermissionAgent) SelectFilters(ctx context.Context, tableName, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
 	payload := &SelectPayload{UserInfo: userInfo, TableName: tableName, TableAlias: tableAlias}
 
 	body, err := json.Marshal(payload)
@@ -126,7 +111,7 @@ func (h *HTTPPermissionAgent) SelectFilters(tableName, tableAlias string, userIn
 		return nil, fmt.Errorf("failed to marshal json payload: %w", err)
 	}
 
-	respBody, err := h.query(http.MethodPost, h.SelectEndpoint, body)
+	respBody, err := h.query(ctx, http.MethodPost, h.SelectEndpoint, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query select filters: %w", err)
 	}
@@ -147,15 +132,3 @@ func (h *HTTPPermissionAgent) SelectFilters(tableName, tableAlias string, userIn
 	return selectResp.Filters, nil
 
 }
-
-func (h *HTTPPermissionAgent) CreateAllowed() bool {
-	return h.createAllowed
-}
-
-func (h *HTTPPermissionAgent) UpdateAllowed() bool {
-	return h.updateAllowed
-}
-
-func (h *HTTPPermissionAgent) DeleteAllowed() bool {
-	return h.deleteAllowed
-}
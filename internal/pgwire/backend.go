@@ -0,0 +1,275 @@
+package pgwire
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The authentication requests of the backend.
+const (
+	AuthenticationOk                = 0
+	AuthenticationCleartextPassword = 3
+	AuthenticationMD5Password       = 5
+	AuthenticationGSS               = 7
+	AuthenticationGSSContinue       = 8
+	AuthenticationSSPI              = 9
+	AuthenticationSASL              = 10
+	AuthenticationSASLContinue      = 11
+	AuthenticationSASLFinal         = 12
+)
+
+// Authentication is any of the authentication requests, the data depends on
+// the type.
+type Authentication struct {
+	Type uint32
+	Data []byte
+}
+
+func (m *Authentication) Decode(body []byte) error {
+	d := &decoder{name: "Authentication", body: body}
+	m.Type = d.uint32()
+	m.Data = d.rest()
+	return d.err
+}
+
+func (m *Authentication) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'R')
+	dst = binary.BigEndian.AppendUint32(dst, m.Type)
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+// SASLMechanisms lists the mechanisms of the AuthenticationSASL request.
+func (m *Authentication) SASLMechanisms() ([]string, error) {
+	if m.Type != AuthenticationSASL {
+		return nil, fmt.Errorf("not a SASL authentication request: %d", m.Type)
+	}
+	d := &decoder{name: "AuthenticationSASL", body: m.Data}
+	mechanisms := []string{}
+	for {
+		mechanism := d.string()
+		if mechanism == "" {
+			break
+		}
+		mechanisms = append(mechanisms, mechanism)
+	}
+	return mechanisms, d.finish()
+}
+
+// BackendKeyData is the key of the backend for the cancels of the client.
+type BackendKeyData struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+func (m *BackendKeyData) Decode(body []byte) error {
+	d := &decoder{name: "BackendKeyData", body: body}
+	m.ProcessID = d.uint32()
+	m.SecretKey = d.uint32()
+	return d.finish()
+}
+
+func (m *BackendKeyData) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'K')
+	dst = binary.BigEndian.AppendUint32(dst, m.ProcessID)
+	dst = binary.BigEndian.AppendUint32(dst, m.SecretKey)
+	return finishMessage(dst, start)
+}
+
+// ParameterStatus reports a setting of the session.
+type ParameterStatus struct {
+	Name  string
+	Value string
+}
+
+func (m *ParameterStatus) Decode(body []byte) error {
+	d := &decoder{name: "ParameterStatus", body: body}
+	m.Name = d.string()
+	m.Value = d.string()
+	return d.finish()
+}
+
+func (m *ParameterStatus) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'S')
+	dst = appendString(dst, m.Name)
+	dst = appendString(dst, m.Value)
+	return finishMessage(dst, start)
+}
+
+// The transaction statuses of the ReadyForQuery.
+const (
+	TxStatusIdle   = 'I'
+	TxStatusActive = 'T'
+	TxStatusFailed = 'E'
+)
+
+// ReadyForQuery ends every exchange, the backend waits for the next one.
+type ReadyForQuery struct {
+	TxStatus byte
+}
+
+func (m *ReadyForQuery) Decode(body []byte) error {
+	d := &decoder{name: "ReadyForQuery", body: body}
+	m.TxStatus = d.byte()
+	return d.finish()
+}
+
+func (m *ReadyForQuery) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'Z')
+	dst = append(dst, m.TxStatus)
+	return finishMessage(dst, start)
+}
+
+// Notice holds the fields of the ErrorResponse and the NoticeResponse the
+// proxy understands, the others are skipped.
+type Notice struct {
+	Severity string
+	Code     string
+	Message  string
+	Detail   string
+	Hint     string
+}
+
+func (n *Notice) decode(name string, body []byte) error {
+	d := &decoder{name: name, body: body}
+	for {
+		field := d.byte()
+		if field == 0 {
+			break
+		}
+		value := d.string()
+		switch field {
+		case 'S':
+			n.Severity = value
+		case 'C':
+			n.Code = value
+		case 'M':
+			n.Message = value
+		case 'D':
+			n.Detail = value
+		case 'H':
+			n.Hint = value
+		}
+	}
+	return d.finish()
+}
+
+// encode appends the fields, the severity is sent both localized and not.
+func (n *Notice) encode(dst []byte, typ byte) []byte {
+	dst, start := beginMessage(dst, typ)
+	for _, field := range []struct {
+		code  byte
+		value string
+	}{{'S', n.Severity}, {'V', n.Severity}, {'C', n.Code}, {'M', n.Message}, {'D', n.Detail}, {'H', n.Hint}} {
+		if field.value != "" {
+			dst = appendString(append(dst, field.code), field.value)
+		}
+	}
+	dst = append(dst, 0)
+	return finishMessage(dst, start)
+}
+
+// ErrorResponse reports a failure, the statement or the session is over.
+type ErrorResponse struct {
+	Notice
+}
+
+func (m *ErrorResponse) Decode(body []byte) error {
+	return m.decode("ErrorResponse", body)
+}
+
+func (m *ErrorResponse) Encode(dst []byte) []byte {
+	return m.encode(dst, 'E')
+}
+
+// NoticeResponse informs the client without interrupting anything.
+type NoticeResponse struct {
+	Notice
+}
+
+func (m *NoticeResponse) Decode(body []byte) error {
+	return m.decode("NoticeResponse", body)
+}
+
+func (m *NoticeResponse) Encode(dst []byte) []byte {
+	return m.encode(dst, 'N')
+}
+
+// CommandComplete ends a statement with its command tag.
+type CommandComplete struct {
+	Tag string
+}
+
+func (m *CommandComplete) Decode(body []byte) error {
+	d := &decoder{name: "CommandComplete", body: body}
+	m.Tag = d.string()
+	return d.finish()
+}
+
+func (m *CommandComplete) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'C')
+	dst = appendString(dst, m.Tag)
+	return finishMessage(dst, start)
+}
+
+// DataRow is a row of the result, the NULL values are nil.
+type DataRow struct {
+	Values [][]byte
+}
+
+func (m *DataRow) Decode(body []byte) error {
+	d := &decoder{name: "DataRow", body: body}
+	count := int(d.uint16())
+	m.Values = make([][]byte, 0, count)
+	for idx := 0; idx < count && d.err == nil; idx++ {
+		length := int32(d.uint32())
+		if length < 0 {
+			m.Values = append(m.Values, nil)
+			continue
+		}
+		m.Values = append(m.Values, d.bytes(int(length)))
+	}
+	return d.finish()
+}
+
+func (m *DataRow) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'D')
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(m.Values)))
+	for _, value := range m.Values {
+		if value == nil {
+			dst = binary.BigEndian.AppendUint32(dst, 0xFFFFFFFF)
+			continue
+		}
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(value)))
+		dst = append(dst, value...)
+	}
+	return finishMessage(dst, start)
+}
+
+// NegotiateProtocolVersion tells the client the newest minor version and the
+// protocol options the backend does not support.
+type NegotiateProtocolVersion struct {
+	MinorVersion uint32
+	Options      []string
+}
+
+func (m *NegotiateProtocolVersion) Decode(body []byte) error {
+	d := &decoder{name: "NegotiateProtocolVersion", body: body}
+	m.MinorVersion = d.uint32()
+	count := int(d.uint32())
+	m.Options = []string{}
+	for idx := 0; idx < count && d.err == nil; idx++ {
+		m.Options = append(m.Options, d.string())
+	}
+	return d.finish()
+}
+
+func (m *NegotiateProtocolVersion) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'v')
+	dst = binary.BigEndian.AppendUint32(dst, m.MinorVersion)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(m.Options)))
+	for _, option := range m.Options {
+		dst = appendString(dst, option)
+	}
+	return finishMessage(dst, start)
+}
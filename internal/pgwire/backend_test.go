@@ -0,0 +1,85 @@
+package pgwire
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAuthentication(t *testing.T) {
+	assert.DeepEqual(t, Encode(&Authentication{Type: AuthenticationOk}), []byte{'R', 0, 0, 0, 8, 0, 0, 0, 0})
+
+	msg := &Authentication{}
+	assert.NilError(t, msg.Decode([]byte{0, 0, 0, 5, 1, 0, 2, 3}))
+	assert.DeepEqual(t, msg, &Authentication{Type: AuthenticationMD5Password, Data: []byte{1, 0, 2, 3}})
+	_, err := msg.SASLMechanisms()
+	assert.Error(t, err, "not a SASL authentication request: 5")
+	assert.Error(t, msg.Decode([]byte{0, 0}), "malformed Authentication message")
+
+	assert.NilError(t, msg.Decode(Encode(&Authentication{Type: AuthenticationSASL, Data: []byte("SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00")})[5:]))
+	mechanisms, err := msg.SASLMechanisms()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mechanisms, []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"})
+	msg.Data = []byte("SCRAM-SHA-256\x00")
+	_, err = msg.SASLMechanisms()
+	assert.Error(t, err, "malformed AuthenticationSASL message")
+}
+
+func TestSessionMessages(t *testing.T) {
+	encoded := Encode(&BackendKeyData{ProcessID: 0x01020304, SecretKey: 0x05060708})
+	assert.DeepEqual(t, encoded, []byte{'K', 0, 0, 0, 12, 1, 2, 3, 4, 5, 6, 7, 8})
+	key := &BackendKeyData{}
+	assert.NilError(t, key.Decode(encoded[5:]))
+	assert.DeepEqual(t, key, &BackendKeyData{ProcessID: 0x01020304, SecretKey: 0x05060708})
+	assert.Error(t, key.Decode([]byte{1, 2, 3}), "malformed BackendKeyData message")
+
+	encoded = Encode(&ParameterStatus{Name: "DateStyle", Value: "ISO"})
+	assert.DeepEqual(t, encoded, []byte("S\x00\x00\x00\x12DateStyle\x00ISO\x00"))
+	status := &ParameterStatus{}
+	assert.NilError(t, status.Decode(encoded[5:]))
+	assert.DeepEqual(t, status, &ParameterStatus{Name: "DateStyle", Value: "ISO"})
+
+	assert.DeepEqual(t, Encode(&ReadyForQuery{TxStatus: TxStatusFailed}), []byte{'Z', 0, 0, 0, 5, 'E'})
+	ready := &ReadyForQuery{}
+	assert.NilError(t, ready.Decode([]byte{'T'}))
+	assert.Equal(t, ready.TxStatus, byte(TxStatusActive))
+	assert.Error(t, ready.Decode([]byte{}), "malformed ReadyForQuery message")
+
+	encoded = Encode(&NegotiateProtocolVersion{Options: []string{"_pq_.test"}})
+	assert.DeepEqual(t, encoded, []byte("v\x00\x00\x00\x16\x00\x00\x00\x00\x00\x00\x00\x01_pq_.test\x00"))
+	negotiate := &NegotiateProtocolVersion{}
+	assert.NilError(t, negotiate.Decode(encoded[5:]))
+	assert.DeepEqual(t, negotiate, &NegotiateProtocolVersion{Options: []string{"_pq_.test"}})
+	assert.Error(t, negotiate.Decode([]byte{0, 0, 0, 0, 0, 0, 0, 2, 'a', 0}), "malformed NegotiateProtocolVersion message")
+}
+
+func TestNotices(t *testing.T) {
+	encoded := Encode(&ErrorResponse{Notice: Notice{Severity: "FATAL", Code: "28000", Message: "denied"}})
+	assert.DeepEqual(t, encoded, []byte("E\x00\x00\x00\x22SFATAL\x00VFATAL\x00C28000\x00Mdenied\x00\x00"))
+	msg := &ErrorResponse{}
+	assert.NilError(t, msg.Decode(encoded[5:]))
+	assert.DeepEqual(t, msg.Notice, Notice{Severity: "FATAL", Code: "28000", Message: "denied"})
+
+	// The unknown fields are skipped
+	notice := &NoticeResponse{}
+	assert.NilError(t, notice.Decode([]byte("SNOTICE\x00Ftest.c\x00Mhello\x00Hsay hi\x00\x00")))
+	assert.DeepEqual(t, notice.Notice, Notice{Severity: "NOTICE", Message: "hello", Hint: "say hi"})
+	assert.Equal(t, Encode(notice)[0], byte('N'))
+	assert.Error(t, notice.Decode([]byte("SNOTICE\x00Mhello")), "malformed NoticeResponse message")
+}
+
+func TestResultMessages(t *testing.T) {
+	encoded := Encode(&CommandComplete{Tag: "SELECT 1"})
+	assert.DeepEqual(t, encoded, []byte("C\x00\x00\x00\x0dSELECT 1\x00"))
+	complete := &CommandComplete{}
+	assert.NilError(t, complete.Decode(encoded[5:]))
+	assert.Equal(t, complete.Tag, "SELECT 1")
+
+	row := &DataRow{Values: [][]byte{[]byte("bob"), nil, {}}}
+	encoded = Encode(row)
+	assert.DeepEqual(t, encoded, []byte("D\x00\x00\x00\x15\x00\x03\x00\x00\x00\x03bob\xff\xff\xff\xff\x00\x00\x00\x00"))
+	decoded := &DataRow{}
+	assert.NilError(t, decoded.Decode(encoded[5:]))
+	assert.DeepEqual(t, decoded, row)
+	assert.Error(t, decoded.Decode([]byte{0, 1, 0, 0, 0, 5, 'b'}), "malformed DataRow message")
+}
@@ -0,0 +1,363 @@
+package pgwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ProtocolOptionPrefix marks the protocol options among the startup
+// parameters.
+const ProtocolOptionPrefix = "_pq_."
+
+// Parameter is a key-value pair of the startup message.
+type Parameter struct {
+	Key   string
+	Value string
+}
+
+// Parameters keeps the parameters in the order the client sent them.
+type Parameters []Parameter
+
+// DecodeParameters reads the null-terminated keys and values.
+func DecodeParameters(data []byte) (Parameters, error) {
+	d := &decoder{name: "startup", body: data}
+	params := Parameters{}
+	for len(d.body) > 0 && d.err == nil {
+		key := d.string()
+		value := d.string()
+		if key == "" {
+			d.fail()
+		}
+		params = append(params, Parameter{Key: key, Value: value})
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return params, nil
+}
+
+// Encode appends the null-terminated keys and values, the way they are sent
+// in the startup message.
+func (p Parameters) Encode(dst []byte) []byte {
+	for _, param := range p {
+		dst = appendString(dst, param.Key)
+		dst = appendString(dst, param.Value)
+	}
+	return dst
+}
+
+// Get returns the value of the parameter, empty when the client did not send it.
+func (p Parameters) Get(key string) string {
+	for _, param := range p {
+		if param.Key == key {
+			return param.Value
+		}
+	}
+	return ""
+}
+
+// Filter keeps the parameters matching any of the names, the names of the
+// settings are case-insensitive.
+func (p Parameters) Filter(names []string) Parameters {
+	filtered := Parameters{}
+	for _, param := range p {
+		for _, name := range names {
+			if strings.EqualFold(name, param.Key) {
+				filtered = append(filtered, param)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// StartupMessage starts the session, the protocol version is followed by the
+// parameters and a closing null byte.
+type StartupMessage struct {
+	ProtocolVersion uint32
+	Parameters      Parameters
+}
+
+// Decode reads the packet without its length.
+func (m *StartupMessage) Decode(packet []byte) error {
+	if len(packet) < 5 || packet[len(packet)-1] != 0 {
+		return fmt.Errorf("invalid startup packet")
+	}
+	params, err := DecodeParameters(packet[4 : len(packet)-1])
+	if err != nil {
+		return fmt.Errorf("invalid startup packet")
+	}
+	m.ProtocolVersion = binary.BigEndian.Uint32(packet)
+	m.Parameters = params
+	return nil
+}
+
+func (m *StartupMessage) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, m.ProtocolVersion)
+	dst = append(m.Parameters.Encode(dst), 0)
+	return finishMessage(dst, start)
+}
+
+// RequestCode returns the code of the 8-byte requests for the encryption,
+// zero for the other packets of the startup.
+func RequestCode(packet []byte) uint32 {
+	if len(packet) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(packet)
+}
+
+// SSLRequest asks for TLS before the startup message.
+type SSLRequest struct{}
+
+func (m *SSLRequest) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, SSLRequestCode)
+	return finishMessage(dst, start)
+}
+
+// CancelRequest asks for the cancel of the statement running in the backend
+// identified by the key, it is sent in place of the startup message.
+type CancelRequest struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+// IsCancelRequest tells whether the packet without its length is a
+// CancelRequest.
+func IsCancelRequest(packet []byte) bool {
+	return len(packet) == 12 && binary.BigEndian.Uint32(packet) == CancelRequestCode
+}
+
+// Decode reads the packet without its length.
+func (m *CancelRequest) Decode(packet []byte) error {
+	if !IsCancelRequest(packet) {
+		return fmt.Errorf("malformed CancelRequest message")
+	}
+	m.ProcessID = binary.BigEndian.Uint32(packet[4:])
+	m.SecretKey = binary.BigEndian.Uint32(packet[8:])
+	return nil
+}
+
+func (m *CancelRequest) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, CancelRequestCode)
+	dst = binary.BigEndian.AppendUint32(dst, m.ProcessID)
+	dst = binary.BigEndian.AppendUint32(dst, m.SecretKey)
+	return finishMessage(dst, start)
+}
+
+// Query is a simple query.
+type Query struct {
+	String string
+}
+
+func (m *Query) Decode(body []byte) error {
+	d := &decoder{name: "Query", body: body}
+	m.String = d.string()
+	return d.finish()
+}
+
+func (m *Query) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'Q')
+	dst = appendString(dst, m.String)
+	return finishMessage(dst, start)
+}
+
+// Parse prepares the statement of the extended query protocol, the unnamed
+// statement has an empty name.
+type Parse struct {
+	Name           string
+	Query          string
+	ParameterTypes []uint32
+}
+
+func (m *Parse) Decode(body []byte) error {
+	d := &decoder{name: "Parse", body: body}
+	m.Name = d.string()
+	m.Query = d.string()
+	m.ParameterTypes = nil
+	for n := d.uint16(); n > 0 && d.err == nil; n-- {
+		m.ParameterTypes = append(m.ParameterTypes, d.uint32())
+	}
+	return d.finish()
+}
+
+func (m *Parse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'P')
+	dst = appendString(dst, m.Name)
+	dst = appendString(dst, m.Query)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(m.ParameterTypes)))
+	for _, oid := range m.ParameterTypes {
+		dst = binary.BigEndian.AppendUint32(dst, oid)
+	}
+	return finishMessage(dst, start)
+}
+
+// Bind binds the parameters to the prepared statement into the portal, a nil
+// parameter is NULL.
+type Bind struct {
+	Portal           string
+	Statement        string
+	ParameterFormats []uint16
+	Parameters       [][]byte
+	ResultFormats    []uint16
+}
+
+func (m *Bind) Decode(body []byte) error {
+	d := &decoder{name: "Bind", body: body}
+	m.Portal = d.string()
+	m.Statement = d.string()
+	m.ParameterFormats = d.formats()
+	m.Parameters = nil
+	for n := d.uint16(); n > 0 && d.err == nil; n-- {
+		var param []byte
+		if length := int32(d.uint32()); length >= 0 {
+			param = d.bytes(int(length))
+		}
+		m.Parameters = append(m.Parameters, param)
+	}
+	m.ResultFormats = d.formats()
+	return d.finish()
+}
+
+func (m *Bind) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'B')
+	dst = appendString(dst, m.Portal)
+	dst = appendString(dst, m.Statement)
+	dst = appendFormats(dst, m.ParameterFormats)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(m.Parameters)))
+	for _, param := range m.Parameters {
+		if param == nil {
+			dst = binary.BigEndian.AppendUint32(dst, 0xFFFFFFFF)
+			continue
+		}
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(param)))
+		dst = append(dst, param...)
+	}
+	dst = appendFormats(dst, m.ResultFormats)
+	return finishMessage(dst, start)
+}
+
+// Execute runs the portal, zero rows means no limit.
+type Execute struct {
+	Portal  string
+	MaxRows uint32
+}
+
+func (m *Execute) Decode(body []byte) error {
+	d := &decoder{name: "Execute", body: body}
+	m.Portal = d.string()
+	m.MaxRows = d.uint32()
+	return d.finish()
+}
+
+func (m *Execute) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'E')
+	dst = appendString(dst, m.Portal)
+	dst = binary.BigEndian.AppendUint32(dst, m.MaxRows)
+	return finishMessage(dst, start)
+}
+
+// Close closes the prepared statement ('S') or the portal ('P') of the name.
+type Close struct {
+	Kind byte
+	Name string
+}
+
+func (m *Close) Decode(body []byte) error {
+	d := &decoder{name: "Close", body: body}
+	m.Kind = d.byte()
+	m.Name = d.string()
+	if m.Kind != 'S' && m.Kind != 'P' {
+		d.fail()
+	}
+	return d.finish()
+}
+
+func (m *Close) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'C')
+	dst = append(dst, m.Kind)
+	dst = appendString(dst, m.Name)
+	return finishMessage(dst, start)
+}
+
+// Sync ends the messages of the extended query protocol.
+type Sync struct{}
+
+func (m *Sync) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'S')
+	return finishMessage(dst, start)
+}
+
+// PasswordMessage answers the cleartext and the MD5 password requests.
+type PasswordMessage struct {
+	Password string
+}
+
+func (m *PasswordMessage) Decode(body []byte) error {
+	d := &decoder{name: "PasswordMessage", body: body}
+	m.Password = d.string()
+	return d.finish()
+}
+
+func (m *PasswordMessage) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'p')
+	dst = appendString(dst, m.Password)
+	return finishMessage(dst, start)
+}
+
+// SASLInitialResponse picks the SASL mechanism and starts the exchange.
+type SASLInitialResponse struct {
+	Mechanism string
+	Data      []byte
+}
+
+func (m *SASLInitialResponse) Decode(body []byte) error {
+	d := &decoder{name: "SASLInitialResponse", body: body}
+	m.Mechanism = d.string()
+	length := int32(d.uint32())
+	m.Data = nil
+	if length >= 0 {
+		m.Data = d.bytes(int(length))
+	}
+	return d.finish()
+}
+
+func (m *SASLInitialResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'p')
+	dst = appendString(dst, m.Mechanism)
+	if m.Data == nil {
+		dst = binary.BigEndian.AppendUint32(dst, 0xFFFFFFFF)
+	} else {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(m.Data)))
+		dst = append(dst, m.Data...)
+	}
+	return finishMessage(dst, start)
+}
+
+// SASLResponse continues the SASL exchange.
+type SASLResponse struct {
+	Data []byte
+}
+
+func (m *SASLResponse) Decode(body []byte) error {
+	m.Data = body
+	return nil
+}
+
+func (m *SASLResponse) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'p')
+	dst = append(dst, m.Data...)
+	return finishMessage(dst, start)
+}
+
+// Terminate closes the session.
+type Terminate struct{}
+
+func (m *Terminate) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, 'X')
+	return finishMessage(dst, start)
+}
@@ -0,0 +1,123 @@
+package pgwire
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestStartupMessage(t *testing.T) {
+	packet := []byte("\x00\x00\x00\x2e\x00\x03\x00\x00user\x00bob\x00database\x00pets\x00DateStyle\x00ISO\x00\x00")
+	msg := &StartupMessage{}
+	assert.NilError(t, msg.Decode(packet[4:]))
+	assert.Equal(t, msg.ProtocolVersion, uint32(ProtocolVersion30))
+	assert.DeepEqual(t, msg.Parameters, Parameters{{Key: "user", Value: "bob"}, {Key: "database", Value: "pets"}, {Key: "DateStyle", Value: "ISO"}})
+	assert.DeepEqual(t, msg.Encode(nil), packet)
+
+	assert.Equal(t, msg.Parameters.Get("user"), "bob")
+	assert.Equal(t, msg.Parameters.Get("options"), "")
+	assert.DeepEqual(t, msg.Parameters.Filter([]string{"datestyle", "options"}), Parameters{{Key: "DateStyle", Value: "ISO"}})
+
+	for _, packet := range []string{
+		"\x00\x03\x00\x00",
+		"\x00\x03\x00\x00user\x00bob\x00",
+		"\x00\x03\x00\x00user\x00bob",
+		"\x00\x03\x00\x00user\x00bob\x00\x00pets\x00\x00",
+	} {
+		assert.Error(t, (&StartupMessage{}).Decode([]byte(packet)), "invalid startup packet", packet)
+	}
+}
+
+func TestDecodeParameters(t *testing.T) {
+	params, err := DecodeParameters(nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(params), 0)
+
+	params, err = DecodeParameters([]byte("application_name\x00psql\x00search_path\x00\x00"))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, params, Parameters{{Key: "application_name", Value: "psql"}, {Key: "search_path", Value: ""}})
+	assert.Equal(t, string(params.Encode(nil)), "application_name\x00psql\x00search_path\x00\x00")
+
+	_, err = DecodeParameters([]byte("application_name\x00psql"))
+	assert.Error(t, err, "malformed startup message")
+}
+
+func TestStartupRequests(t *testing.T) {
+	ssl := Encode(&SSLRequest{})
+	assert.DeepEqual(t, ssl, []byte{0, 0, 0, 8, 4, 210, 22, 47})
+	assert.Equal(t, RequestCode(ssl[4:]), uint32(SSLRequestCode))
+	assert.Equal(t, RequestCode([]byte{0, 3, 0, 0, 0}), uint32(0))
+
+	cancel := Encode(&CancelRequest{ProcessID: 0x01020304, SecretKey: 0x05060708})
+	assert.DeepEqual(t, cancel, []byte{0, 0, 0, 16, 4, 210, 22, 46, 1, 2, 3, 4, 5, 6, 7, 8})
+	assert.Assert(t, IsCancelRequest(cancel[4:]))
+	assert.Assert(t, !IsCancelRequest([]byte{0, 3, 0, 0, 'u', 's', 'e', 'r', 0, 'a', 0, 0}))
+	req := &CancelRequest{}
+	assert.NilError(t, req.Decode(cancel[4:]))
+	assert.DeepEqual(t, req, &CancelRequest{ProcessID: 0x01020304, SecretKey: 0x05060708})
+	assert.Error(t, req.Decode(ssl[4:]), "malformed CancelRequest message")
+}
+
+func TestFrontendMessages(t *testing.T) {
+	assert.DeepEqual(t, Encode(&Query{String: "select 1"}), []byte("Q\x00\x00\x00\x0dselect 1\x00"))
+	assert.DeepEqual(t, Encode(&PasswordMessage{Password: "pwd"}), []byte("p\x00\x00\x00\x08pwd\x00"))
+	assert.DeepEqual(t, Encode(&Terminate{}), []byte{'X', 0, 0, 0, 4})
+	assert.DeepEqual(t, Encode(&Sync{}), []byte{'S', 0, 0, 0, 4})
+
+	query := &Query{}
+	assert.NilError(t, query.Decode([]byte("select 1\x00")))
+	assert.Equal(t, query.String, "select 1")
+	assert.Error(t, query.Decode([]byte("select 1")), "malformed Query message")
+	assert.Error(t, query.Decode([]byte("select 1\x00;\x00")), "malformed Query message")
+
+	password := &PasswordMessage{}
+	assert.NilError(t, password.Decode([]byte("pwd\x00")))
+	assert.Equal(t, password.Password, "pwd")
+
+	initial := &SASLInitialResponse{Mechanism: "SCRAM-SHA-256", Data: []byte("n,,n=,r=nonce")}
+	encoded := Encode(initial)
+	assert.DeepEqual(t, encoded, []byte("p\x00\x00\x00\x23SCRAM-SHA-256\x00\x00\x00\x00\x0dn,,n=,r=nonce"))
+	decoded := &SASLInitialResponse{}
+	assert.NilError(t, decoded.Decode(encoded[5:]))
+	assert.DeepEqual(t, decoded, initial)
+
+	// Without the initial response
+	encoded = Encode(&SASLInitialResponse{Mechanism: "SCRAM-SHA-256"})
+	assert.NilError(t, decoded.Decode(encoded[5:]))
+	assert.Assert(t, decoded.Data == nil)
+	assert.Error(t, decoded.Decode([]byte("SCRAM-SHA-256\x00\x00\x00\x00\x0dn,,")), "malformed SASLInitialResponse message")
+
+	assert.DeepEqual(t, Encode(&SASLResponse{Data: []byte("c=biws")}), []byte("p\x00\x00\x00\x0ac=biws"))
+
+	parse := &Parse{Name: "s1", Query: "select $1", ParameterTypes: []uint32{23}}
+	encoded = Encode(parse)
+	assert.DeepEqual(t, encoded, []byte("P\x00\x00\x00\x17s1\x00select $1\x00\x00\x01\x00\x00\x00\x17"))
+	decodedParse := &Parse{}
+	assert.NilError(t, decodedParse.Decode(encoded[5:]))
+	assert.DeepEqual(t, decodedParse, parse)
+	assert.Error(t, decodedParse.Decode([]byte("s1\x00select $1\x00\x00\x02\x00\x00\x00\x17")), "malformed Parse message")
+
+	bind := &Bind{Portal: "p1", Statement: "s1", ParameterFormats: []uint16{0}, Parameters: [][]byte{[]byte("42"), nil}, ResultFormats: []uint16{1}}
+	encoded = Encode(bind)
+	assert.DeepEqual(t, encoded, []byte("B\x00\x00\x00\x1ep1\x00s1\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x0242\xff\xff\xff\xff\x00\x01\x00\x01"))
+	decodedBind := &Bind{}
+	assert.NilError(t, decodedBind.Decode(encoded[5:]))
+	assert.DeepEqual(t, decodedBind, bind)
+	assert.Error(t, decodedBind.Decode([]byte("p1\x00s1\x00\x00\x00\x00\x01\x00\x00\x00\x05ab\x00\x00")), "malformed Bind message")
+
+	execute := &Execute{Portal: "p1", MaxRows: 10}
+	encoded = Encode(execute)
+	assert.DeepEqual(t, encoded, []byte("E\x00\x00\x00\x0bp1\x00\x00\x00\x00\x0a"))
+	decodedExecute := &Execute{}
+	assert.NilError(t, decodedExecute.Decode(encoded[5:]))
+	assert.DeepEqual(t, decodedExecute, execute)
+	assert.Error(t, decodedExecute.Decode([]byte("p1\x00")), "malformed Execute message")
+
+	closeMsg := &Close{Kind: 'S', Name: "s1"}
+	encoded = Encode(closeMsg)
+	assert.DeepEqual(t, encoded, []byte("C\x00\x00\x00\x08Ss1\x00"))
+	decodedClose := &Close{}
+	assert.NilError(t, decodedClose.Decode(encoded[5:]))
+	assert.DeepEqual(t, decodedClose, closeMsg)
+	assert.Error(t, decodedClose.Decode([]byte("Xs1\x00")), "malformed Close message")
+}
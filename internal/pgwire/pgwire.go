@@ -0,0 +1,181 @@
+// Package pgwire frames the messages of the Postgres frontend/backend
+// protocol 3.0. The messages are read whole or not at all and every message
+// the proxy understands has a typed struct encoding and decoding its body.
+package pgwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ProtocolVersion30 is the only protocol version the messages follow.
+	ProtocolVersion30 = 3 << 16
+	CancelRequestCode = 80877102
+	SSLRequestCode    = 80877103
+	GSSEncRequestCode = 80877104
+
+	// MaxStartupPacketSize is the limit of Postgres on the packets of the
+	// startup, which are read before the client is authenticated.
+	MaxStartupPacketSize = 10000
+	// MaxAuthMessageSize is the limit of Postgres on the messages of the
+	// authentication exchange.
+	MaxAuthMessageSize = 65535
+	// DefaultMaxMessageSize is the limit of Postgres on the other messages.
+	DefaultMaxMessageSize = 1<<30 - 1
+)
+
+// ErrMessageTooLarge is returned for the messages over the size limit.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// Encoder appends the message to the buffer, including its type and length.
+type Encoder interface {
+	Encode(dst []byte) []byte
+}
+
+// Encode concatenates the messages, so they are sent with a single write.
+func Encode(msgs ...Encoder) []byte {
+	var buf []byte
+	for _, msg := range msgs {
+		buf = msg.Encode(buf)
+	}
+	return buf
+}
+
+// Message is a message as it was read, the messages passed through the proxy
+// are never decoded.
+type Message struct {
+	Type byte
+	Body []byte
+}
+
+func (m *Message) Encode(dst []byte) []byte {
+	dst, start := beginMessage(dst, m.Type)
+	dst = append(dst, m.Body...)
+	return finishMessage(dst, start)
+}
+
+// Size is the length of the encoded message.
+func (m *Message) Size() int {
+	return len(m.Body) + 5
+}
+
+// beginMessage appends the type and a placeholder of the length, the startup
+// packets without a type pass zero.
+func beginMessage(dst []byte, typ byte) ([]byte, int) {
+	if typ != 0 {
+		dst = append(dst, typ)
+	}
+	return append(dst, 0, 0, 0, 0), len(dst)
+}
+
+func finishMessage(dst []byte, start int) []byte {
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+func appendString(dst []byte, s string) []byte {
+	return append(append(dst, s...), 0)
+}
+
+// appendFormats appends the count and the format codes of the values.
+func appendFormats(dst []byte, formats []uint16) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(formats)))
+	for _, format := range formats {
+		dst = binary.BigEndian.AppendUint16(dst, format)
+	}
+	return dst
+}
+
+// decoder reads the fields of a body, the first failure is kept until the
+// end of the decoding.
+type decoder struct {
+	name string
+	body []byte
+	err  error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("malformed %s message", d.name)
+	}
+	d.body = nil
+}
+
+func (d *decoder) uint32() uint32 {
+	if len(d.body) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.body)
+	d.body = d.body[4:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if len(d.body) < 2 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.body)
+	d.body = d.body[2:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if len(d.body) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.body[0]
+	d.body = d.body[1:]
+	return v
+}
+
+// string reads a null-terminated string.
+func (d *decoder) string() string {
+	for idx, b := range d.body {
+		if b == 0 {
+			s := string(d.body[:idx])
+			d.body = d.body[idx+1:]
+			return s
+		}
+	}
+	d.fail()
+	return ""
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if n < 0 || len(d.body) < n {
+		d.fail()
+		return nil
+	}
+	v := d.body[:n]
+	d.body = d.body[n:]
+	return v
+}
+
+// formats reads the count and the format codes of the values.
+func (d *decoder) formats() []uint16 {
+	var formats []uint16
+	for n := d.uint16(); n > 0 && d.err == nil; n-- {
+		formats = append(formats, d.uint16())
+	}
+	return formats
+}
+
+// rest reads the remaining bytes.
+func (d *decoder) rest() []byte {
+	v := d.body
+	d.body = nil
+	return v
+}
+
+// finish fails when any bytes were left over.
+func (d *decoder) finish() error {
+	if len(d.body) > 0 {
+		d.fail()
+	}
+	return d.err
+}
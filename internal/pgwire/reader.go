@@ -0,0 +1,93 @@
+package pgwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+const (
+	// readBufferSize is the buffer of the reader, the messages are mostly
+	// smaller than it
+	readBufferSize = 8192
+	// readChunkSize is the most the reader allocates ahead of the bytes of a
+	// large message, the declared length alone does not allocate the memory
+	readChunkSize = 64 * 1024
+)
+
+// Reader reads whole messages however the bytes arrive. It reads ahead into
+// its buffer, so a connection keeps its reader as long as it lives, and
+// nothing may be buffered when the connection is upgraded to TLS.
+type Reader struct {
+	r              *bufio.Reader
+	MaxMessageSize int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, readBufferSize), MaxMessageSize: DefaultMaxMessageSize}
+}
+
+// Read reads the raw bytes through the buffer, for the packets of the
+// startup which are not typed messages.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// Buffered returns the number of bytes read ahead of the last message.
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadMessage reads a typed message. The messages over MaxMessageSize are not
+// read, the stream cannot continue after them.
+func (r *Reader) ReadMessage() (*Message, error) {
+	typ, err := r.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, 4)
+	_, err = io.ReadFull(r.r, length)
+	if err != nil {
+		return nil, eofMidMessage(err)
+	}
+	size := int(binary.BigEndian.Uint32(length))
+	if size < 4 {
+		return nil, fmt.Errorf("invalid length of message %q: %d", typ, size)
+	}
+	if size-4 > r.MaxMessageSize {
+		return nil, fmt.Errorf("%w: message %q of %d bytes exceeds the limit of %d bytes", ErrMessageTooLarge, typ, size-4, r.MaxMessageSize)
+	}
+
+	body, err := r.readBody(size - 4)
+	if err != nil {
+		return nil, eofMidMessage(err)
+	}
+	return &Message{Type: typ, Body: body}, nil
+}
+
+// readBody reads the body in chunks, the buffer grows only as the bytes
+// arrive.
+func (r *Reader) readBody(size int) ([]byte, error) {
+	body := make([]byte, 0, min(size, readChunkSize))
+	for len(body) < size {
+		chunk := min(size-len(body), readChunkSize)
+		body = slices.Grow(body, chunk)[:len(body)+chunk]
+		_, err := io.ReadFull(r.r, body[len(body)-chunk:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// eofMidMessage tells the connections closed in the middle of a message
+// apart from the ones closed between the messages.
+func eofMidMessage(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
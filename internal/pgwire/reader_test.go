@@ -0,0 +1,80 @@
+package pgwire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"testing/iotest"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestReadMessage(t *testing.T) {
+	stream := Encode(&Query{String: "select 1"}, &Message{Type: 'S'}, &Terminate{})
+
+	// The messages are read whole however the bytes arrive
+	r := NewReader(iotest.OneByteReader(bytes.NewReader(stream)))
+	msg, err := r.ReadMessage()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg, &Message{Type: 'Q', Body: []byte("select 1\x00")})
+	assert.Equal(t, msg.Size(), 14)
+	msg, err = r.ReadMessage()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg, &Message{Type: 'S', Body: []byte{}})
+	msg, err = r.ReadMessage()
+	assert.NilError(t, err)
+	assert.Equal(t, msg.Type, byte('X'))
+	_, err = r.ReadMessage()
+	assert.Equal(t, err, io.EOF)
+
+	// The connections closed in the middle of a message
+	for _, size := range []int{1, 3, 7} {
+		_, err = NewReader(bytes.NewReader(stream[:size])).ReadMessage()
+		assert.Equal(t, err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReadMessageLimits(t *testing.T) {
+	stream := Encode(&Query{String: "select 1"})
+
+	r := NewReader(bytes.NewReader(stream))
+	r.MaxMessageSize = 9
+	_, err := r.ReadMessage()
+	assert.NilError(t, err)
+
+	r = NewReader(bytes.NewReader(stream))
+	r.MaxMessageSize = 8
+	_, err = r.ReadMessage()
+	assert.Assert(t, errors.Is(err, ErrMessageTooLarge))
+	assert.Error(t, err, "message too large: message 'Q' of 9 bytes exceeds the limit of 8 bytes")
+
+	_, err = NewReader(bytes.NewReader([]byte{'Q', 0, 0, 0, 3})).ReadMessage()
+	assert.Error(t, err, "invalid length of message 'Q': 3")
+
+	// The declared length alone does not allocate the body
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = NewReader(bytes.NewReader([]byte{'Q', 0x3f, 0xff, 0xff, 0xff, 's', 'e', 'l'})).ReadMessage()
+	runtime.ReadMemStats(&after)
+	assert.Equal(t, err, io.ErrUnexpectedEOF)
+	assert.Assert(t, after.TotalAlloc-before.TotalAlloc < 1<<20)
+}
+
+func TestReadMessageChunks(t *testing.T) {
+	query := &Query{String: string(bytes.Repeat([]byte("a"), 3*readChunkSize+1))}
+	stream := Encode(query, &Terminate{})
+
+	r := NewReader(iotest.HalfReader(bytes.NewReader(stream)))
+	msg, err := r.ReadMessage()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg.Body, []byte(query.String+"\x00"))
+	assert.Equal(t, r.Buffered(), 5)
+
+	// The raw bytes go through the same buffer
+	raw := make([]byte, 5)
+	_, err = io.ReadFull(r, raw)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, raw, []byte{'X', 0, 0, 0, 4})
+}
@@ -0,0 +1,189 @@
+package foodme
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ryshoooo/food-me/internal/pgwire"
+)
+
+const (
+	PoolModeDisabled    = "disabled"
+	PoolModeSession     = "session"
+	PoolModeTransaction = "transaction"
+)
+
+// PoolKey identifies the interchangeable connections. The read-only
+// connections to the replicas and the routed sessions are pooled separately
+// from the connections to the configured destination. The parameters of the
+// clients are set on the borrowed connections, so they do not split the pool.
+type PoolKey struct {
+	Database string
+	ReadOnly bool
+	Address  string
+	Username string
+	Password string
+}
+
+// PooledConn is an upstream connection authenticated as the configured user.
+// The messages the upstream sent after the authentication are kept, so that
+// they can be replayed to every client borrowing the connection.
+type PooledConn struct {
+	net.Conn
+	PoolKey
+	Parameters []*pgwire.Message
+	Cancel     *CancelTarget
+
+	pool   *databasePool
+	reader *pgwire.Reader
+}
+
+// Reader returns the buffered reader of the connection, the bytes read ahead
+// go along with the connection to the next borrower.
+func (c *PooledConn) Reader() *pgwire.Reader {
+	if c.reader == nil {
+		c.reader = pgwire.NewReader(c.Conn)
+	}
+	return c.reader
+}
+
+// UpstreamPool keeps the authenticated upstream connections per database.
+// At most Size connections per key are borrowed at once, the borrowers above
+// the limit wait up to WaitTimeout for a connection to be returned.
+type UpstreamPool struct {
+	Mode        string
+	Size        int
+	WaitTimeout time.Duration
+	ResetQuery  string
+	Dial        func(key PoolKey) (*PooledConn, error)
+
+	mutex     sync.Mutex
+	databases map[PoolKey]*databasePool
+	closed    bool
+}
+
+type databasePool struct {
+	slots chan struct{}
+	idle  []*PooledConn
+}
+
+func NewUpstreamPool(mode string, size int, waitTimeout time.Duration, resetQuery string, dial func(key PoolKey) (*PooledConn, error)) *UpstreamPool {
+	return &UpstreamPool{
+		Mode:        mode,
+		Size:        size,
+		WaitTimeout: waitTimeout,
+		ResetQuery:  resetQuery,
+		Dial:        dial,
+		databases:   make(map[PoolKey]*databasePool),
+	}
+}
+
+func (p *UpstreamPool) database(key PoolKey) (*databasePool, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, fmt.Errorf("connection pool is closed")
+	}
+
+	pool, ok := p.databases[key]
+	if !ok {
+		pool = &databasePool{slots: make(chan struct{}, p.Size)}
+		p.databases[key] = pool
+	}
+	return pool, nil
+}
+
+// Get borrows an idle connection for the key or dials a new one.
+func (p *UpstreamPool) Get(key PoolKey) (*PooledConn, error) {
+	pool, err := p.database(key)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(p.WaitTimeout)
+	defer timer.Stop()
+	select {
+	case pool.slots <- struct{}{}:
+	case <-timer.C:
+		poolWaitTimeoutsTotal.WithLabelValues(key.Database).Inc()
+		return nil, fmt.Errorf("timed out waiting for a connection to database %s", key.Database)
+	}
+
+	p.mutex.Lock()
+	if len(pool.idle) > 0 {
+		conn := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		p.mutex.Unlock()
+		conn.pool = pool
+		return conn, nil
+	}
+	p.mutex.Unlock()
+
+	conn, err := p.Dial(key)
+	if err != nil {
+		<-pool.slots
+		return nil, err
+	}
+	poolConnectionsOpen.WithLabelValues(key.Database).Inc()
+	conn.pool = pool
+	return conn, nil
+}
+
+// Put returns a clean connection to the pool. The connections of the closed
+// pool and of the evicted keys are closed instead.
+func (p *UpstreamPool) Put(conn *PooledConn) {
+	p.mutex.Lock()
+	if p.closed || p.databases[conn.PoolKey] != conn.pool {
+		p.mutex.Unlock()
+		p.close(conn)
+	} else {
+		conn.pool.idle = append(conn.pool.idle, conn)
+		p.mutex.Unlock()
+	}
+	<-conn.pool.slots
+}
+
+// Discard closes a borrowed connection which can not be reused.
+func (p *UpstreamPool) Discard(conn *PooledConn) {
+	p.close(conn)
+	<-conn.pool.slots
+}
+
+func (p *UpstreamPool) close(conn *PooledConn) {
+	conn.Close()
+	poolConnectionsOpen.WithLabelValues(conn.Database).Dec()
+}
+
+// Evict closes the idle connections of the user and forgets its keys, the
+// borrowed connections are closed once they are returned.
+func (p *UpstreamPool) Evict(username string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, pool := range p.databases {
+		if key.Username != username {
+			continue
+		}
+		for _, conn := range pool.idle {
+			p.close(conn)
+		}
+		pool.idle = nil
+		delete(p.databases, key)
+	}
+}
+
+// Close closes the idle connections, the borrowed ones are closed once they
+// are returned.
+func (p *UpstreamPool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for _, pool := range p.databases {
+		for _, conn := range pool.idle {
+			p.close(conn)
+		}
+		pool.idle = nil
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package foodme
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func newTestPool(size int, dials *int) *UpstreamPool {
+	return NewUpstreamPool(PoolModeSession, size, 50*time.Millisecond, "DISCARD ALL", func(key PoolKey) (*PooledConn, error) {
+		*dials++
+		if key.Database == "broken" {
+			return nil, fmt.Errorf("unable to connect to destination")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return &PooledConn{Conn: client, PoolKey: key}, nil
+	})
+}
+
+func TestUpstreamPoolReuse(t *testing.T) {
+	dials := 0
+	pool := newTestPool(2, &dials)
+
+	first, err := pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	second, err := pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	assert.Equal(t, dials, 2)
+
+	pool.Put(first)
+	conn, err := pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	assert.Equal(t, conn, first)
+	assert.Equal(t, dials, 2)
+
+	// Discarded connections are dialed again
+	pool.Discard(second)
+	_, err = pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	assert.Equal(t, dials, 3)
+
+	// Databases have their own limit
+	_, err = pool.Get(PoolKey{Database: "other"})
+	assert.NilError(t, err)
+	assert.Equal(t, dials, 4)
+
+	// So do the read-only connections
+	conn, err = pool.Get(PoolKey{Database: "db", ReadOnly: true})
+	assert.NilError(t, err)
+	assert.Assert(t, conn.ReadOnly)
+	assert.Equal(t, dials, 5)
+}
+
+func TestUpstreamPoolWaitTimeout(t *testing.T) {
+	dials := 0
+	pool := newTestPool(1, &dials)
+
+	conn, err := pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	_, err = pool.Get(PoolKey{Database: "db"})
+	assert.Error(t, err, "timed out waiting for a connection to database db")
+
+	// A returned connection unblocks the waiting borrower
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.Put(conn)
+	}()
+	borrowed, err := pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	assert.Equal(t, borrowed, conn)
+	assert.Equal(t, dials, 1)
+}
+
+func TestUpstreamPoolDialError(t *testing.T) {
+	dials := 0
+	pool := newTestPool(1, &dials)
+
+	_, err := pool.Get(PoolKey{Database: "broken"})
+	assert.Error(t, err, "unable to connect to destination")
+	// The slot is released
+	_, err = pool.Get(PoolKey{Database: "broken"})
+	assert.Error(t, err, "unable to connect to destination")
+	assert.Equal(t, dials, 2)
+}
+
+func TestUpstreamPoolClose(t *testing.T) {
+	dials := 0
+	pool := newTestPool(2, &dials)
+
+	idle, err := pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	borrowed, err := pool.Get(PoolKey{Database: "db"})
+	assert.NilError(t, err)
+	pool.Put(idle)
+
+	assert.NilError(t, pool.Close())
+	_, err = idle.Write([]byte{0})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	_, err = pool.Get(PoolKey{Database: "db"})
+	assert.Error(t, err, "connection pool is closed")
+
+	// Borrowed connections are closed once returned
+	pool.Put(borrowed)
+	_, err = borrowed.Write([]byte{0})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestUpstreamPoolEvict(t *testing.T) {
+	dials := 0
+	pool := newTestPool(2, &dials)
+
+	idle, err := pool.Get(PoolKey{Database: "db", Username: "v-token-1"})
+	assert.NilError(t, err)
+	borrowed, err := pool.Get(PoolKey{Database: "db", Username: "v-token-1"})
+	assert.NilError(t, err)
+	other, err := pool.Get(PoolKey{Database: "db", Username: "v-token-2"})
+	assert.NilError(t, err)
+	pool.Put(idle)
+	pool.Put(other)
+
+	pool.Evict("v-token-1")
+	_, err = idle.Write([]byte{0})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.Equal(t, len(pool.databases), 1)
+
+	// Borrowed connections of the evicted user are closed once returned
+	pool.Put(borrowed)
+	_, err = borrowed.Write([]byte{0})
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+	assert.Equal(t, len(pool.databases), 1)
+
+	// The other users keep their connections
+	conn, err := pool.Get(PoolKey{Database: "db", Username: "v-token-2"})
+	assert.NilError(t, err)
+	assert.Equal(t, conn, other)
+	assert.Equal(t, dials, 3)
+}
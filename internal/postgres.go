@@ -2,17 +2,27 @@ package foodme
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
+	"github.com/ryshoooo/food-me/internal/pgwire"
 	"github.com/sirupsen/logrus"
 	"github.com/xdg-go/scram"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PostgresHandler struct {
@@ -33,20 +43,81 @@ type PostgresHandler struct {
 	OIDCDatabaseFallBackToBaseClient bool
 	OIDCDatabaseClients              map[string]*OIDCDatabaseClientSpec
 	OIDCPostAuthSQLTemplate          string
+	PasswordLogin                    string
+	DeviceAuthorizationURL           string
+	DeviceLoginUsername              string
+	ClientCredentialsLogin           bool
 	SQLHandler                       ISQLHandler
 	TLSEnabled                       bool
 	TLSCertificateFile               string
 	TLSCertificateKeyFile            string
+	TLSRequired                      bool
+	Certificates                     *CertificateManager
+	Identities                       *CertificateIdentities
+	Local                            *LocalAuthenticator
+	Credentials                      ICredentialProvider
+	Provisioner                      *RoleProvisioner
+	UpstreamTLSMode                  string
+	UpstreamTLSCAFile                string
+	UpstreamInsecurePasswordAuth     bool
+	UpstreamTLSCertificateFile       string
+	UpstreamTLSCertificateKeyFile    string
+	UpstreamChannelBinding           string
 	AssumeUserSession                bool
 	UsernameClaim                    string
 	AllowSessionEscape               bool
+	AssumeUserSessionMode            string
+	RoleNames                        *RoleNameRules
+	Auditor                          *Auditor
+	Pool                             *UpstreamPool
+	Router                           *Router
+	Cancels                          *CancelRegistry
+	ReadOnlyRouting                  bool
+	ReadOnlyClaim                    string
+	TraceFromApplicationName         bool
+	TraceFromSQLComment              bool
+	StartupParametersAllowed         []string
+	StartupParametersDenied          []string
+	MaxMessageSize                   int
+	MetricsDatabases                 []string
 
 	// Runtime
+	ctx        context.Context
 	client     net.Conn
 	upstream   net.Conn
 	database   string
+	user       string
+	parameters pgwire.Parameters
+	forwarded  pgwire.Parameters
 	oidcClient *OIDCClient
 	userinfo   map[string]interface{}
+	clientID   string
+	readOnly   bool
+	route      *UpstreamRoute
+	pending    pendingStatements
+	prepared   map[string]string
+	portals    map[string]string
+	authOk     bool
+
+	// Buffered readers of the connections
+	clientReader   connReader
+	upstreamReader connReader
+	unsynced       atomic.Bool
+	cancelKey      BackendKey
+	lease          *CredentialLease
+	backend        atomic.Pointer[CancelTarget]
+	metrics        sessionMetrics
+
+	// Pooling
+	upstreamMutex  sync.Mutex
+	downstreamDone chan struct{}
+
+	// Shutdown
+	clientMutex   sync.Mutex
+	established   atomic.Bool
+	draining      atomic.Bool
+	txStatus      atomic.Int32
+	terminateOnce sync.Once
 }
 
 func NewPostgresHandler(
@@ -87,120 +158,487 @@ func NewPostgresHandler(
 		AssumeUserSession:                assumeUserSession,
 		UsernameClaim:                    usernameClaim,
 		AllowSessionEscape:               allowSessionEscape,
+		ctx:                              context.Background(),
 	}
 }
 
 func (h *PostgresHandler) Handle(conn net.Conn) error {
 	h.client = conn
 	defer h.client.Close()
+	// The leased credentials go once the upstream is closed
+	defer h.releaseLease()
 
-	destination, err := h.UpstreamHandler.Connect()
-	if err != nil {
-		h.Logger.Errorf("Unable to connect to destination: %v", err)
-		return err
+	if h.Pool != nil {
+		defer h.stopDownstream()
+	} else {
+		defer h.closeUpstream()
 	}
-	h.upstream = destination
-	defer h.upstream.Close()
 
-	// Startup
+	// Startup, the upstream is connected only with the authentication
 	size, err := h.startup()
 	if err != nil {
 		h.Logger.Errorf("Error on startup: %v", err)
 		return h.sendErrorMessage("08000", err)
 	}
 
+	length := calculatePacketSize(size)
+	if length < 8 || length > pgwire.MaxStartupPacketSize {
+		h.Logger.Errorf("Error on startup: invalid length of startup packet: %d", length)
+		return h.sendErrorMessage("08P01", fmt.Errorf("invalid length of startup packet"))
+	}
+	packet, err := h.read(length-4, "client")
+	if err != nil {
+		h.Logger.Errorf("Error on startup: %v", err)
+		return err
+	}
+	if pgwire.IsCancelRequest(packet) {
+		return h.forwardCancel(packet)
+	}
+	if h.Cancels != nil {
+		h.cancelKey = h.Cancels.Register(h.cancelTarget)
+		defer h.Cancels.Unregister(h.cancelKey)
+	}
+
+	startup, err := parseStartupMessage(packet)
+	if err != nil {
+		h.Logger.Errorf("Error on startup: %v", err)
+		return h.sendErrorMessage("08P01", err)
+	}
+	h.parameters = startup.Parameters
+	err = h.negotiateProtocol(startup.ProtocolVersion)
+	if err != nil {
+		h.Logger.Errorf("Error on startup: %v", err)
+		return h.sendErrorMessage("0A000", err)
+	}
+	for _, param := range h.parameters {
+		if containsFold(h.StartupParametersDenied, param.Key) {
+			h.Logger.Warnf("Rejecting the startup parameter %s", param.Key)
+			return h.sendErrorMessage("08004", fmt.Errorf("startup parameter %s is not allowed", param.Key))
+		}
+	}
+
 	// Authenticate
-	err = h.authenticate(size)
+	err = h.authenticate()
 	if err != nil {
 		h.Logger.Errorf("Error on authentication: %v", err)
 		return h.sendErrorMessage("28000", err)
 	}
+	// The sessions passed through are logged in once the destination says so
+	defer h.metrics.close()
+	if h.authOk {
+		h.metrics.established(h.databaseLabel())
+	}
 
-	// Continue as proxy
-	go h.proxyDownstream()
+	// The shutdown started during the authentication
+	h.established.Store(true)
+	if h.draining.Load() {
+		h.Terminate()
+		return nil
+	}
+	defer h.watchLease()()
+
+	// Continue as proxy, in the transaction mode the connection is borrowed
+	// again with the next statement
+	if _, pooled := h.upstream.(*PooledConn); pooled && h.Pool.Mode == PoolModeTransaction {
+		h.upstreamMutex.Lock()
+		h.releaseUpstream(true)
+		h.upstreamMutex.Unlock()
+	} else {
+		h.startDownstream()
+	}
 	h.proxyUpstream()
 
 	return nil
 }
 
-func (h *PostgresHandler) startup() ([]byte, error) {
-	size, err := h.read(4, "client")
+// watchLease renews the leased credentials of the session in the background,
+// the returned function stops it. Once the lease can not be renewed anymore,
+// the session is drained as it expires, the client reconnects with new
+// credentials.
+func (h *PostgresHandler) watchLease() func() {
+	if h.lease == nil || h.lease.Expires.IsZero() {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		renewable := h.lease.Renewable
+		for {
+			// Renew with a third of the lease left, the failures are retried
+			// until the lease expires
+			wait := time.Until(h.lease.Expires)
+			if renewable {
+				wait = wait * 2 / 3
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if !renewable || !time.Now().Before(h.lease.Expires) {
+				h.Logger.Warn("Destination credentials of the session expired, draining the session")
+				h.Drain()
+				return
+			}
+			err := h.Credentials.Renew(h.lease)
+			if err != nil {
+				h.Logger.Warnf("Failed to renew the destination credentials: %v", err)
+			}
+			renewable = h.lease.Renewable && time.Until(h.lease.Expires) > time.Second
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// releaseLease gives the leased credentials of the session back. The idle
+// pooled connections logged in with the short-lived credentials are closed
+// first, no other session borrows them.
+func (h *PostgresHandler) releaseLease() {
+	if h.lease == nil {
+		return
+	}
+	if h.Pool != nil && !h.lease.Expires.IsZero() {
+		h.Pool.Evict(h.lease.Credential.Username)
+	}
+	err := h.Credentials.Release(h.lease)
 	if err != nil {
-		return []byte{}, err
+		h.Logger.Errorf("Failed to release the destination credentials: %v", err)
 	}
+}
 
-	sizeInt := calculatePacketSize(size)
+// Drain lets the session finish its current transaction and terminates it
+// as soon as it is idle.
+func (h *PostgresHandler) Drain() {
+	h.draining.Store(true)
+	if h.established.Load() && h.idle() {
+		h.Terminate()
+	}
+}
 
-	// If the size is 8, it is a startup message
-	if sizeInt != 8 {
-		h.Logger.Info("Startup message not found, continue without startup exchange")
-		return size, nil
+// Terminate sends the admin_shutdown error to the client of an established
+// session and closes both of the connections.
+func (h *PostgresHandler) Terminate() {
+	if !h.established.Load() {
+		return
 	}
 
-	h.Logger.Info("Commencing startup")
-	startup, err := h.read(4, "client")
+	h.terminateOnce.Do(func() {
+		h.Logger.Info("Terminating connection due to administrator command")
+		err := h.sendErrorResponse("FATAL", "57P01", fmt.Errorf("terminating connection due to administrator command"))
+		if err != nil {
+			h.Logger.Errorf("Error sending error message to client: %v", err)
+		}
+		h.client.Close()
+		if h.Pool == nil {
+			h.upstream.Close()
+		}
+	})
+}
+
+func (h *PostgresHandler) idle() bool {
+	return h.txStatus.Load() == 'I' && !h.unsynced.Load() && h.pending.head() == nil
+}
+
+// Ping connects to the destination and authenticates as the configured user
+// without serving any client.
+func (h *PostgresHandler) Ping(database string, timeout time.Duration) error {
+	err := h.openUpstream(database, timeout, "ping")
 	if err != nil {
-		return []byte{}, err
+		return err
+	}
+	defer h.upstream.Close()
+
+	// Terminate
+	return h.send("upstream", &pgwire.Terminate{})
+}
+
+// InRecovery reports whether the destination is a replica.
+func (h *PostgresHandler) InRecovery(database string, timeout time.Duration) (bool, error) {
+	err := h.openUpstream(database, timeout, "checking recovery")
+	if err != nil {
+		return false, err
 	}
-	h.Logger.Debugf("Read startup packet from client: %v", startup)
-	err = h.write(append([]byte{0, 0, 0, 8}, startup...), "upstream")
+	defer h.upstream.Close()
+
+	value, err := h.queryValue("SELECT pg_is_in_recovery()", "checking recovery")
 	if err != nil {
-		return []byte{}, err
+		return false, err
+	}
+
+	// Terminate
+	return value == "t", h.send("upstream", &pgwire.Terminate{})
+}
+
+// openUpstream connects and authenticates a connection which is not serving
+// any client, the timeout applies to the whole connection.
+func (h *PostgresHandler) openUpstream(database string, timeout time.Duration, process string) error {
+	destination, err := h.UpstreamHandler.Connect()
+	if err != nil {
+		return fmt.Errorf("unable to connect to destination: %w", err)
+	}
+	h.upstream = destination
+
+	if timeout > 0 {
+		err = h.upstream.SetDeadline(time.Now().Add(timeout))
+		if err != nil {
+			h.upstream.Close()
+			return err
+		}
+	}
+
+	err = h.negotiateUpstreamTLS()
+	if err == nil {
+		h.database = database
+		err = h.auth()
+	}
+	if err == nil {
+		err = h.readUntilReadyForQuery(process, false)
+	}
+	if err != nil {
+		h.upstream.Close()
+		return err
+	}
+	return nil
+}
+
+func (h *PostgresHandler) closeUpstream() {
+	if h.upstream != nil {
+		h.upstream.Close()
+	}
+}
+
+// connectUpstream dials the destination for a connection which is not tied to
+// the startup of a client.
+func (h *PostgresHandler) connectUpstream() error {
+	connect := h.UpstreamHandler.Connect
+	if h.readOnly {
+		connect = h.UpstreamHandler.ConnectReadOnly
+	}
+	destination, err := connect()
+	if err != nil {
+		return fmt.Errorf("unable to connect to destination: %w", err)
+	}
+	h.upstream = destination
+
+	err = h.negotiateUpstreamTLS()
+	if err != nil {
+		h.upstream.Close()
+		return err
+	}
+	return nil
+}
+
+// negotiateUpstreamTLS requests TLS from the destination unless it is
+// disabled.
+func (h *PostgresHandler) negotiateUpstreamTLS() error {
+	if h.UpstreamTLSMode == TLSModeDisable {
+		return nil
+	}
+
+	err := h.send("upstream", &pgwire.SSLRequest{})
+	if err != nil {
+		return err
 	}
 	resp, err := h.read(1, "upstream")
 	if err != nil {
-		return []byte{}, err
+		return err
+	}
+	switch resp[0] {
+	case 'S':
+		// Like libpq, the bytes before the handshake may not be trusted
+		if h.reader("upstream").Buffered() > 0 {
+			return fmt.Errorf("received unencrypted data after SSL response")
+		}
+		return h.upgradeUpstream()
+	case 'N':
+		if tlsRequired(h.UpstreamTLSMode) {
+			return fmt.Errorf("destination does not support TLS")
+		}
+	default:
+		return fmt.Errorf("unexpected response from upstream: %v", resp)
+	}
+	return nil
+}
+
+// upgradeUpstream wraps the upstream connection with TLS, the certificate of
+// the destination is verified with the first write.
+func (h *PostgresHandler) upgradeUpstream() error {
+	h.Logger.Debug("Upgrading upstream connection with TLS handler")
+	config, err := UpstreamTLSConfig(h.UpstreamTLSMode, h.UpstreamTLSCAFile, h.UpstreamTLSCertificateFile, h.UpstreamTLSCertificateKeyFile, upstreamHost(h.upstream))
+	if err != nil {
+		return err
+	}
+	h.upstream = tls.Client(h.upstream, config)
+	return nil
+}
+
+// dialPooled connects and authenticates a new connection for the pool.
+func (h *PostgresHandler) dialPooled(key PoolKey) (conn *PooledConn, err error) {
+	err = h.connectUpstream()
+	if err != nil {
+		return nil, err
+	}
+
+	// The connection never reaches the pool when its session fails to start
+	defer func() {
+		if err != nil {
+			h.upstream.Close()
+		}
+	}()
+
+	h.database = key.Database
+	err = h.auth()
+	if err != nil {
+		return nil, err
+	}
+
+	parameters := []*pgwire.Message{}
+	var target *CancelTarget
+	for {
+		msg, err := h.readFullMessage("upstream")
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type == 'E' {
+			return nil, fmt.Errorf("error authentication: %v", getErrorMessage(msg.Body))
+		}
+		if msg.Type == 'Z' {
+			break
+		}
+		if key, ok := parseBackendKey(msg.Body); ok && msg.Type == 'K' {
+			target = h.newCancelTarget(key)
+		}
+		parameters = append(parameters, msg)
 	}
 
-	h.Logger.Debugf("Read startup response from upstream: %v", resp)
-	if resp[0] != 'N' && resp[0] != 'S' {
-		return []byte{}, fmt.Errorf("unexpected response from upstream: %v", resp)
+	return &PooledConn{Conn: h.upstream, PoolKey: key, Parameters: parameters, Cancel: target, reader: h.reader("upstream")}, nil
+}
+
+// startup negotiates TLS with the client on the configuration of the proxy
+// alone, the upstream negotiates TLS on its own once it is connected.
+func (h *PostgresHandler) startup() ([]byte, error) {
+	size, err := h.read(4, "client")
+	if err != nil {
+		return []byte{}, err
 	}
 
-	if resp[0] == 'S' {
-		h.Logger.Info("TLS requested from upstream")
-		if !h.TLSEnabled {
-			h.Logger.Warn("TLS is not enabled, but upstream requested it. The data sent to the client will be decrypted!")
-			h.Logger.Warn("Please enable TLS to secure the connection, this is a security risk!")
-			h.Logger.Warn("To enable TLS, set the server-tls-enabled flag to true and specify the certificate and key files")
-			h.Logger.Warn("IMMEDIATELY! or not.. up to you really...")
-			h.Logger.Debug("Settings response to 'N' to continue without TLS")
-			resp[0] = 'N'
+	// The direct TLS connections start with the TLS handshake right away
+	if size[0] == tlsHandshakeRecord {
+		return h.startupDirectTLS(size)
+	}
 
-			err = h.write(resp, "client")
+	// If the size is 8, the client asks for the encryption first. Like in
+	// Postgres, GSSAPI and TLS may be requested once each, in either order.
+	if calculatePacketSize(size) != 8 {
+		h.Logger.Info("Startup message not found, continue without startup exchange")
+	}
+	gssDone, sslDone := false, false
+	for calculatePacketSize(size) == 8 {
+		h.Logger.Info("Commencing startup")
+		startup, err := h.read(4, "client")
+		if err != nil {
+			return []byte{}, err
+		}
+		h.Logger.Debugf("Read startup packet from client: %v", startup)
+
+		switch code := pgwire.RequestCode(startup); {
+		case code == pgwire.GSSEncRequestCode && !gssDone:
+			// GSSAPI is not supported, the clients continue with TLS or without encryption
+			h.Logger.Debug("Declining GSSAPI encryption")
+			gssDone = true
+			err = h.write([]byte{'N'}, "client")
 			if err != nil {
 				return []byte{}, err
 			}
-		} else {
+		case code == pgwire.SSLRequestCode && !sslDone && h.TLSEnabled:
 			h.Logger.Debug("Upgrading downstream connection with TLS handler")
-			cert, err := tls.LoadX509KeyPair(h.TLSCertificateFile, h.TLSCertificateKeyFile)
+			// Like Postgres, the bytes before the handshake may not be trusted
+			if h.reader("client").Buffered() > 0 {
+				return []byte{}, fmt.Errorf("received unencrypted data after SSL request")
+			}
+			config, err := h.serverTLSConfig()
+			if err != nil {
+				return []byte{}, err
+			}
+			err = h.write([]byte{'S'}, "client")
 			if err != nil {
 				return []byte{}, err
 			}
-			err = h.write(resp, "client")
+			h.client = tls.Server(h.client, config)
+			gssDone, sslDone = true, true
+		case code == pgwire.SSLRequestCode && !sslDone:
+			sslDone = true
+			err = h.write([]byte{'N'}, "client")
 			if err != nil {
 				return []byte{}, err
 			}
-			h.client = tls.Server(h.client, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+		default:
+			return []byte{}, fmt.Errorf("unexpected encryption request: %d", code)
 		}
-		h.Logger.Debug("Upgrading upstream connection with TLS handler")
-		h.upstream = tls.Client(h.upstream, &tls.Config{InsecureSkipVerify: true})
-	} else {
-		err = h.write(resp, "client")
+
+		h.Logger.Info("Startup successful")
+		size, err = h.read(4, "client")
 		if err != nil {
+			h.Logger.Errorf("Error reading from client: %v", err)
 			return []byte{}, err
 		}
 	}
 
-	h.Logger.Info("Startup successful")
+	if _, ok := h.client.(*tls.Conn); !ok && h.TLSRequired {
+		return []byte{}, fmt.Errorf("TLS connection is required")
+	}
+	return size, nil
+}
+
+// startupDirectTLS serves the clients starting with the TLS handshake instead
+// of the SSL request. As in Postgres, they have to negotiate the postgresql
+// ALPN protocol.
+func (h *PostgresHandler) startupDirectTLS(record []byte) ([]byte, error) {
+	if !h.TLSEnabled {
+		return []byte{}, fmt.Errorf("direct TLS connection is not supported without TLS enabled")
+	}
 
-	// Read the next size from the client
-	size, err = h.read(4, "client")
+	h.Logger.Info("Commencing direct TLS startup")
+	config, err := h.serverTLSConfig()
 	if err != nil {
-		h.Logger.Errorf("Error reading from client: %v", err)
 		return []byte{}, err
 	}
-	return size, nil
+	// The handshake continues with the bytes already read ahead
+	buffered := make([]byte, h.reader("client").Buffered())
+	_, err = io.ReadFull(h.reader("client"), buffered)
+	if err != nil {
+		return []byte{}, err
+	}
+	conn := tls.Server(&prefixedConn{Conn: h.client, prefix: append(record, buffered...)}, config)
+	err = conn.Handshake()
+	if err != nil {
+		return []byte{}, err
+	}
+	h.client = conn
+	if conn.ConnectionState().NegotiatedProtocol != postgresALPN {
+		return []byte{}, fmt.Errorf("direct TLS connection requires the %s ALPN protocol", postgresALPN)
+	}
+
+	h.Logger.Info("Startup successful")
+	return h.read(4, "client")
+}
+
+// serverTLSConfig serves the shared certificates, the handlers without them
+// load the configured files.
+func (h *PostgresHandler) serverTLSConfig() (*tls.Config, error) {
+	if h.Certificates != nil {
+		return h.Certificates.TLSConfig(postgresALPN), nil
+	}
+	return ServerTLSConfig(h.TLSCertificateFile, h.TLSCertificateKeyFile)
 }
 
 func (h *PostgresHandler) write(data []byte, name string) error {
@@ -209,7 +647,9 @@ func (h *PostgresHandler) write(data []byte, name string) error {
 	var n int
 	var err error
 	if name == "client" {
+		h.clientMutex.Lock()
 		n, err = h.client.Write(data)
+		h.clientMutex.Unlock()
 	} else {
 		n, err = h.upstream.Write(data)
 	}
@@ -221,17 +661,30 @@ func (h *PostgresHandler) write(data []byte, name string) error {
 	return nil
 }
 
+// send writes the messages at once.
+func (h *PostgresHandler) send(name string, msgs ...pgwire.Encoder) error {
+	return h.write(pgwire.Encode(msgs...), name)
+}
+
+// reader returns the buffered reader of the client or the destination, the
+// pooled connections keep theirs across the sessions.
+func (h *PostgresHandler) reader(name string) *pgwire.Reader {
+	if name == "client" {
+		return h.clientReader.of(h.client)
+	}
+	if conn, ok := h.upstream.(*PooledConn); ok {
+		return conn.Reader()
+	}
+	return h.upstreamReader.of(h.upstream)
+}
+
 func (h *PostgresHandler) read(size int, name string) ([]byte, error) {
 	h.Logger.Debugf("Reading %v bytes from %s", size, name)
 	buff := make([]byte, size)
 
 	var n int
 	var err error
-	if name == "client" {
-		n, err = h.client.Read(buff)
-	} else {
-		n, err = h.upstream.Read(buff)
-	}
+	n, err = io.ReadFull(h.reader(name), buff)
 
 	if err != nil || n != size {
 		if err == io.EOF {
@@ -244,50 +697,94 @@ func (h *PostgresHandler) read(size int, name string) ([]byte, error) {
 }
 
 func (h *PostgresHandler) sendErrorMessage(code string, err error) error {
-	resp := []byte("E")
-	msg := []byte("SERROR")
-	msg = append(msg, 0)
-	msg = append(msg, []byte("VERROR")...)
-	msg = append(msg, 0)
-	msg = append(msg, append([]byte("C"), []byte(code)...)...)
-	msg = append(msg, 0)
-	msg = append(msg, append([]byte("M"), []byte(err.Error())...)...)
-	msg = append(msg, 0)
-	msg = append(msg, 0)
-
-	s := createPacketSize(len(msg) + 4)
-	resp = append(resp, s...)
-	resp = append(resp, msg...)
-	return h.write(resp, "client")
-}
-
-func (h *PostgresHandler) authenticate(sizebuff []byte) error {
+	return h.sendErrorResponse("ERROR", code, err)
+}
+
+func (h *PostgresHandler) sendErrorResponse(severity, code string, err error) error {
+	return h.send("client", &pgwire.ErrorResponse{Notice: pgwire.Notice{Severity: severity, Code: code, Message: err.Error()}})
+}
+
+// negotiateProtocol settles the protocol version with the client. The proxy
+// speaks the version 3.0 only, so the clients asking for a newer minor version
+// or for the protocol options get the NegotiateProtocolVersion message and
+// continue with 3.0, the same way as with an older Postgres.
+func (h *PostgresHandler) negotiateProtocol(version uint32) error {
+	major, minor := version>>16, version&0xFFFF
+	if major != 3 {
+		return fmt.Errorf("unsupported frontend protocol %d.%d: server supports 3.0 to 3.0", major, minor)
+	}
+
+	// The options are not settings, they never reach the destination
+	options := []string{}
+	params := pgwire.Parameters{}
+	for _, param := range h.parameters {
+		if strings.HasPrefix(param.Key, pgwire.ProtocolOptionPrefix) {
+			options = append(options, param.Key)
+		} else {
+			params = append(params, param)
+		}
+	}
+	h.parameters = params
+	if minor == 0 && len(options) == 0 {
+		return nil
+	}
+
+	h.Logger.Infof("Client asked for the protocol 3.%d with the options %v, continue with 3.0", minor, options)
+	return h.send("client", &pgwire.NegotiateProtocolVersion{MinorVersion: 0, Options: options})
+}
+
+func (h *PostgresHandler) authenticate() (err error) {
 	h.Logger.Info("Commencing authentication")
 
-	size := calculatePacketSize(sizebuff)
-	auth, err := h.read(size-4, "client")
-	if err != nil {
-		return err
+	h.Logger.Debugf("Startup parameters: %v", h.parameters)
+	uv := h.parameters.Get("user")
+	h.user = uv
+	// Like in Postgres, the database defaults to the user the session logs in as
+	h.database = h.parameters.Get("database")
+	if h.database == "" {
+		h.database = h.Username
+	}
+	h.forwarded = h.parameters.Filter(h.StartupParametersAllowed)
+	if h.TraceFromApplicationName {
+		h.ctx = contextFromTraceparent(h.ctx, h.parameters.Get("application_name"))
+	}
+	ctx, span := tracer().Start(h.ctx, "PostgresHandler.authenticate", trace.WithAttributes(attribute.String("db.name", h.database)))
+	defer func() { endSpan(span, err) }()
+
+	if h.ReadOnlyRouting && isParameterOn(h.parameters.Get("default_transaction_read_only")) {
+		err = h.routeReadOnly()
+		if err != nil {
+			return err
+		}
 	}
-	h.Logger.Debugf("Read authentication packet from client: %v (%s)", auth, auth)
 
-	parts := bytes.Split(auth, []byte{0})
-	if len(parts) < 7 {
-		return fmt.Errorf("invalid authentication packet: %v", parts)
+	if userinfo := h.certificateUserinfo(uv); userinfo != nil {
+		h.Logger.Info("Client certificate identifies the user, continue with its identity")
+		return h.authenticateIdentity(ctx, userinfo)
 	}
-	u := string(parts[3])
-	uv := string(parts[4])
-	d := string(parts[5])
-	dv := string(parts[6])
-	h.Logger.Debugf("Authentication: %v=%v %v=%v", u, uv, d, dv)
 
-	h.database = dv
 	accessToken, refreshToken := GlobalState.GetTokens(uv)
 	if accessToken == "" || refreshToken == "" {
 		uvs := strings.Split(uv, ";")
+		if len(uvs) < 2 && h.ClientCredentialsLogin && strings.HasPrefix(uv, clientIDUsernamePrefix) {
+			h.Logger.Info("Username carries a client ID, log in the client with the password as its secret")
+			return h.authenticateClientCredentials(ctx, strings.TrimPrefix(uv, clientIDUsernamePrefix))
+		}
+		if len(uvs) < 2 && h.DeviceAuthorizationURL != "" && uv == h.DeviceLoginUsername {
+			h.Logger.Info("Username asks for the device login")
+			return h.authenticateDevice(ctx)
+		}
+		if len(uvs) < 2 && h.PasswordLogin != "" && h.PasswordLogin != PasswordLoginDisabled {
+			h.Logger.Info("Username does not contain OIDC data, log in with the password")
+			return h.authenticatePassword(ctx, uv)
+		}
+		if len(uvs) < 2 && h.Local != nil && h.Local.Mode != LocalAuthDisabled {
+			h.Logger.Info("Username does not contain OIDC data, authenticate the user on the proxy")
+			return h.authenticateLocal(ctx, uv)
+		}
 		if len(uvs) < 2 {
 			h.Logger.Info("Username does not contain OIDC data, proxy all the requests going forward")
-			return h.write(append(sizebuff, auth...), "upstream")
+			return h.proxyStartup()
 		}
 		h.Logger.Debugf("OIDC data: %v", uvs)
 		for _, ov := range uvs {
@@ -304,14 +801,23 @@ func (h *PostgresHandler) authenticate(sizebuff []byte) error {
 	h.Logger.Debugf("Refresh token: %v", refreshToken)
 	if accessToken == "" || refreshToken == "" {
 		h.Logger.Info("Access token or refresh token is missing, proxy all the requests going forward")
-		return h.write(append(sizebuff, auth...), "upstream")
+		return h.proxyStartup()
+	}
+
+	h.oidcClient, err = h.newOIDCClient(accessToken, refreshToken)
+	if err != nil {
+		return err
 	}
+	return h.authenticateOIDC(ctx)
+}
 
+// newOIDCClient creates the client of the database the session connects to.
+func (h *PostgresHandler) newOIDCClient(accessToken, refreshToken string) (*OIDCClient, error) {
 	// Strange situation here, we have access and refresh tokens, but OIDC is disabled
 	// Send an informative error message to the client
 	if !h.OIDCEnabled {
 		h.Logger.Error("OIDC is disabled, but access and refresh tokens are present")
-		return fmt.Errorf("oidc as auth method is disabled, use username/password")
+		return nil, fmt.Errorf("oidc as auth method is disabled, use username/password")
 	}
 
 	var clientId string
@@ -322,79 +828,664 @@ func (h *PostgresHandler) authenticate(sizebuff []byte) error {
 			clientSecret = h.OIDCClientSecret
 		} else {
 			h.Logger.Errorf("Client ID not found for database: %v", h.database)
-			return fmt.Errorf("client ID not found for database: %v", h.database)
+			return nil, fmt.Errorf("client ID not found for database: %v", h.database)
 		}
 	} else {
 		clientId = cv.ClientID
 		clientSecret = cv.ClientSecret
 	}
 
-	h.oidcClient = NewOIDCClient(h.HTTPClient, clientId, clientSecret, h.OIDCTokenURL, h.OIDCUserInfoURL, accessToken, refreshToken)
+	return NewOIDCClient(h.HTTPClient, clientId, clientSecret, h.OIDCTokenURL, h.OIDCUserInfoURL, accessToken, refreshToken), nil
+}
+
+// authenticateOIDC authenticates the user of the tokens of the OIDC client.
+func (h *PostgresHandler) authenticateOIDC(ctx context.Context) (err error) {
 	if !h.oidcClient.IsAccessTokenValid() {
 		h.Logger.Info("Access token is invalid, refreshing the token")
-		err = h.oidcClient.RefreshAccessToken()
+		refreshCtx, refreshSpan := tracer().Start(ctx, "OIDCClient.RefreshAccessToken")
+		err = h.oidcClient.RefreshAccessToken(refreshCtx)
+		endSpan(refreshSpan, err)
 		if err != nil {
 			return err
 		}
 	}
 
-	userinfo, err := h.oidcClient.GetUserInfo()
+	userinfoCtx, userinfoSpan := tracer().Start(ctx, "OIDCClient.GetUserInfo")
+	userinfo, err := h.oidcClient.GetUserInfo(userinfoCtx)
+	endSpan(userinfoSpan, err)
 	if err != nil {
 		return err
 	}
-	h.userinfo = userinfo
-	h.Logger.Infof("User info: %v", userinfo)
+	return h.authenticateIdentity(ctx, userinfo)
+}
 
-	// Authenticate as the configured user
-	err = h.auth()
+// authenticatePassword asks the client for the password and logs in at the
+// IdP with it, so the clients unable to put the tokens into the username
+// still authenticate by OIDC.
+func (h *PostgresHandler) authenticatePassword(ctx context.Context, user string) (err error) {
+	h.oidcClient, err = h.newOIDCClient("", "")
 	if err != nil {
 		return err
 	}
+	if _, ok := h.client.(*tls.Conn); !ok {
+		h.Logger.Warn("Client sends the password without TLS, this is a security risk")
+	}
 
-	// Auth successful, send the auth OK to the client
-	err = h.write([]byte{82, 0, 0, 0, 8, 0, 0, 0, 0}, "client")
+	password, err := h.readPassword()
 	if err != nil {
 		return err
 	}
 
-	// Pipe the rest of the metadata until ready for query
-	err = h.readUntilReadyForQuery("authentication", true)
+	loginCtx, loginSpan := tracer().Start(ctx, "OIDCClient.PasswordLogin")
+	switch h.PasswordLogin {
+	case PasswordLoginToken:
+		// A password which is not a valid access token is the refresh token
+		h.oidcClient.AccessToken = password
+		if !h.oidcClient.IsAccessTokenValid() {
+			h.oidcClient.AccessToken = ""
+			h.oidcClient.RefreshToken = password
+			err = h.oidcClient.RefreshAccessToken(loginCtx)
+		}
+	case PasswordLoginPassword:
+		err = h.oidcClient.PasswordGrant(loginCtx, user, password)
+	case PasswordLoginTokenExchange:
+		err = h.oidcClient.ExchangeToken(loginCtx, password)
+	default:
+		err = fmt.Errorf("unknown password login: %s", h.PasswordLogin)
+	}
+	endSpan(loginSpan, err)
+	passwordLoginsTotal.WithLabelValues(h.PasswordLogin, observeOutcome(err)).Inc()
+	if err != nil {
+		h.Logger.Errorf("Password login failed: %v", err)
+		return fmt.Errorf("password authentication failed for user %s", user)
+	}
+	return h.authenticateOIDC(ctx)
+}
+
+// authenticateLocal checks the password of the user on the proxy itself, the
+// session then logs in upstream with the service account.
+func (h *PostgresHandler) authenticateLocal(ctx context.Context, user string) (err error) {
+	switch h.Local.Mode {
+	case LocalAuthFile:
+		err = h.authenticateSCRAM(user)
+	case LocalAuthLDAP:
+		err = h.authenticateLDAP(ctx, user)
+	default:
+		err = fmt.Errorf("unknown local authentication: %s", h.Local.Mode)
+	}
+	localLoginsTotal.WithLabelValues(h.Local.Mode, observeOutcome(err)).Inc()
+	if err != nil {
+		h.Logger.Errorf("Local login failed: %v", err)
+		return fmt.Errorf("password authentication failed for user %s", user)
+	}
+	return h.authenticateIdentity(ctx, h.Local.Userinfo(user))
+}
+
+// authenticateSCRAM runs the SCRAM-SHA-256 exchange with the client against
+// the secret of the user, the password never reaches the proxy.
+func (h *PostgresHandler) authenticateSCRAM(user string) error {
+	secret, known := h.Local.Secret(user)
+	server, err := newSCRAMServer(secret)
 	if err != nil {
 		return err
 	}
 
-	// Post-authentication script
-	if h.OIDCPostAuthSQLTemplate != "" {
-		h.Logger.Info("Executing post-authentication script")
-		err = h.executePostAuthStatement()
+	// The list of the mechanisms ends with an empty name
+	mechanisms := append([]byte(scramSHA256), 0, 0)
+	err = h.send("client", &pgwire.Authentication{Type: pgwire.AuthenticationSASL, Data: mechanisms})
+	if err != nil {
+		return err
+	}
+
+	msg, err := h.readAuthMessage()
+	if err != nil {
+		return err
+	}
+	if msg.Type != 'p' {
+		return fmt.Errorf("expected SASL response, got: %c", msg.Type)
+	}
+	initial := &pgwire.SASLInitialResponse{}
+	err = initial.Decode(msg.Body)
+	if err != nil {
+		return err
+	}
+	if initial.Mechanism != scramSHA256 {
+		return fmt.Errorf("client selected an invalid SASL authentication mechanism: %s", initial.Mechanism)
+	}
+	serverFirst, err := server.Step(string(initial.Data))
+	if err != nil {
+		return err
+	}
+	if server.AuthzID() != "" {
+		return fmt.Errorf("SCRAM authorization identities are not supported")
+	}
+	err = h.send("client", &pgwire.Authentication{Type: pgwire.AuthenticationSASLContinue, Data: []byte(serverFirst)})
+	if err != nil {
+		return err
+	}
+
+	msg, err = h.readAuthMessage()
+	if err != nil {
+		return err
+	}
+	if msg.Type != 'p' {
+		return fmt.Errorf("expected SASL response, got: %c", msg.Type)
+	}
+	serverFinal, err := server.Step(string(msg.Body))
+	if err != nil {
+		return err
+	}
+	if !known {
+		return fmt.Errorf("unknown local user: %s", user)
+	}
+	return h.send("client", &pgwire.Authentication{Type: pgwire.AuthenticationSASLFinal, Data: []byte(serverFinal)})
+}
+
+// authenticateLDAP asks the client for the password and binds as the user.
+func (h *PostgresHandler) authenticateLDAP(ctx context.Context, user string) (err error) {
+	if _, ok := h.client.(*tls.Conn); !ok {
+		h.Logger.Warn("Client sends the password without TLS, this is a security risk")
+	}
+	password, err := h.readPassword()
+	if err != nil {
+		return err
+	}
+
+	_, bindSpan := tracer().Start(ctx, "LDAPClient.Bind")
+	err = h.Local.LDAP.Bind(user, password)
+	endSpan(bindSpan, err)
+	return err
+}
+
+// authenticateClientCredentials logs in a client without any user, the
+// claims of its access token are the userinfo of the session. The token has
+// to be meant for the client of the database.
+func (h *PostgresHandler) authenticateClientCredentials(ctx context.Context, clientID string) (err error) {
+	databaseClient, err := h.newOIDCClient("", "")
+	if err != nil {
+		return err
+	}
+	password, err := h.readPassword()
+	if err != nil {
+		return err
+	}
+
+	h.oidcClient = NewOIDCClient(h.HTTPClient, clientID, password, h.OIDCTokenURL, h.OIDCUserInfoURL, "", "")
+	loginCtx, loginSpan := tracer().Start(ctx, "OIDCClient.ClientCredentialsGrant")
+	err = h.oidcClient.ClientCredentialsGrant(loginCtx)
+	endSpan(loginSpan, err)
+	passwordLoginsTotal.WithLabelValues(PasswordLoginClientCredentials, observeOutcome(err)).Inc()
+	if err != nil {
+		h.Logger.Errorf("Client credentials login failed: %v", err)
+		return fmt.Errorf("password authentication failed for user %s", h.user)
+	}
+
+	claims, err := h.oidcClient.AccessTokenClaims()
+	if err != nil {
+		return err
+	}
+	if !isTokenFor(claims, databaseClient.ClientID) {
+		h.Logger.Errorf("Access token of the client %s is not meant for the client %s", clientID, databaseClient.ClientID)
+		return fmt.Errorf("client %s is not allowed to access the database %s", clientID, h.database)
+	}
+	claims[clientIDClaim] = clientID
+	h.clientID = clientID
+	return h.authenticateIdentity(ctx, claims)
+}
+
+// authenticateDevice holds the startup while the user approves the device
+// authorization in a browser, the client is told where to go by a notice.
+func (h *PostgresHandler) authenticateDevice(ctx context.Context) (err error) {
+	h.oidcClient, err = h.newOIDCClient("", "")
+	if err != nil {
+		return err
+	}
+
+	authorizeCtx, authorizeSpan := tracer().Start(ctx, "OIDCClient.AuthorizeDevice")
+	auth, err := h.oidcClient.AuthorizeDevice(authorizeCtx, h.DeviceAuthorizationURL)
+	endSpan(authorizeSpan, err)
+	if err != nil {
+		return err
+	}
+
+	// The clients take the notices only once they are authenticated, so the
+	// AuthenticationOk goes first and the failed logins end with an error
+	err = h.sendAuthenticationOk()
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("To log in, open %s and enter the code %s", auth.VerificationURI, auth.UserCode)
+	if auth.VerificationURIComplete != "" {
+		message = fmt.Sprintf("To log in, open %s and confirm the code %s", auth.VerificationURIComplete, auth.UserCode)
+	}
+	err = h.sendNoticeResponse(message)
+	if err != nil {
+		return err
+	}
+
+	pollCtx, pollSpan := tracer().Start(ctx, "OIDCClient.PollDeviceToken")
+	pollCtx, stopWatching := h.watchClient(pollCtx)
+	err = h.oidcClient.PollDeviceToken(pollCtx, auth)
+	endSpan(pollSpan, err)
+	stopWatching()
+	var tokenErr *TokenError
+	if errors.As(err, &tokenErr) && tokenErr.Code != "" {
+		return fmt.Errorf("device login failed: %s", tokenErr.Code)
+	}
+	if err != nil {
+		return err
+	}
+	return h.authenticateOIDC(ctx)
+}
+
+// watchClient cancels the context once the client goes away while nothing
+// is expected from it, the returned function stops watching.
+func (h *PostgresHandler) watchClient(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := h.client.Read(make([]byte, 1))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			h.Logger.Info("Client left during the authentication")
+			cancel()
+		}
+	}()
+
+	return ctx, func() {
+		h.client.SetReadDeadline(time.Now())
+		<-done
+		h.client.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
+// sendAuthenticationOk tells the client it is authenticated, only once.
+func (h *PostgresHandler) sendAuthenticationOk() error {
+	if h.authOk {
+		return nil
+	}
+	h.authOk = true
+	return h.send("client", &pgwire.Authentication{Type: pgwire.AuthenticationOk})
+}
+
+func (h *PostgresHandler) sendNoticeResponse(message string) error {
+	return h.send("client", &pgwire.NoticeResponse{Notice: pgwire.Notice{Severity: "NOTICE", Code: "00000", Message: message}})
+}
+
+// readPassword sends the AuthenticationCleartextPassword request and reads
+// the PasswordMessage of the client.
+func (h *PostgresHandler) readPassword() (string, error) {
+	err := h.send("client", &pgwire.Authentication{Type: pgwire.AuthenticationCleartextPassword})
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := h.readAuthMessage()
+	if err != nil {
+		return "", err
+	}
+	if msg.Type != 'p' {
+		return "", fmt.Errorf("expected password message, got: %c", msg.Type)
+	}
+	password := &pgwire.PasswordMessage{}
+	err = password.Decode(msg.Body)
+	if err != nil {
+		return "", err
+	}
+	return password.Password, nil
+}
+
+// proxyBackendKey replaces the BackendKeyData of the destination with the key
+// of the session, so the cancels of the client come through the proxy. The
+// other messages are passed as they are.
+func (h *PostgresHandler) proxyBackendKey(msg *pgwire.Message) pgwire.Encoder {
+	if h.Cancels == nil || msg.Type != 'K' {
+		return msg
+	}
+	key, ok := parseBackendKey(msg.Body)
+	if !ok {
+		return msg
+	}
+	if _, pooled := h.upstream.(*PooledConn); !pooled {
+		h.backend.Store(h.newCancelTarget(key))
+	}
+	return &pgwire.BackendKeyData{ProcessID: h.cancelKey.ProcessID, SecretKey: h.cancelKey.SecretKey}
+}
+
+func (h *PostgresHandler) newCancelTarget(key BackendKey) *CancelTarget {
+	return &CancelTarget{Address: h.upstream.RemoteAddr().String(), Host: upstreamHost(h.upstream), Key: key}
+}
+
+// cancelTarget returns the backend serving the session at the moment, the
+// sessions pooled per transaction have none between the transactions.
+func (h *PostgresHandler) cancelTarget() *CancelTarget {
+	return h.backend.Load()
+}
+
+// forwardCancel passes the CancelRequest of a client to the backend of the
+// session the key was issued for. As in Postgres, the client gets no answer
+// either way.
+func (h *PostgresHandler) forwardCancel(packet []byte) error {
+	req := &pgwire.CancelRequest{}
+	var target *CancelTarget
+	if h.Cancels != nil && req.Decode(packet) == nil {
+		target = h.Cancels.Target(BackendKey{ProcessID: req.ProcessID, SecretKey: req.SecretKey})
+	}
+	if target == nil {
+		h.Logger.Info("Cancel request does not match any running session")
+		cancelRequestsTotal.WithLabelValues("unknown").Inc()
+		return nil
+	}
+
+	h.Logger.Info("Forwarding the cancel request")
+	err := h.sendCancel(target)
+	cancelRequestsTotal.WithLabelValues(observeOutcome(err)).Inc()
+	if err != nil {
+		h.Logger.Errorf("Error forwarding the cancel request: %v", err)
+	}
+	return err
+}
+
+func (h *PostgresHandler) sendCancel(target *CancelTarget) error {
+	conn, err := dialUpstream(target.Address)
+	if err != nil {
+		return fmt.Errorf("unable to connect to destination: %w", err)
+	}
+	if upstream, ok := conn.(*UpstreamConn); ok {
+		upstream.Host = target.Host
+	}
+	h.upstream = conn
+
+	err = h.negotiateUpstreamTLS()
+	if err != nil {
+		return err
+	}
+	return h.write(target.Key.cancelRequest(), "upstream")
+}
+
+// authenticateIdentity authenticates upstream for the user identified by the
+// userinfo, whether it came from OIDC or from the client certificate.
+func (h *PostgresHandler) authenticateIdentity(ctx context.Context, userinfo map[string]interface{}) (err error) {
+	h.userinfo = userinfo
+	h.Logger.Infof("User info: %v", userinfo)
+
+	if h.ReadOnlyClaim != "" && isClaimOn(userinfo[h.ReadOnlyClaim]) {
+		err = h.routeReadOnly()
 		if err != nil {
 			return err
 		}
 	}
 
-	// Assume user session
-	if h.AssumeUserSession {
-		h.Logger.Info("Assuming user session")
-		err = h.assumeUserSession()
+	// Pick the destination of the session
+	if h.Router != nil {
+		var route *UpstreamRoute
+		route, err = h.Router.Route(userinfo)
 		if err != nil {
 			return err
 		}
+		h.routeSession(route)
+	}
+
+	// Pick the service account of the session, the credentials of the route
+	// go first
+	if h.Credentials != nil && (h.route == nil || h.route.Username == "") {
+		leaseCtx, leaseSpan := tracer().Start(ctx, "CredentialProvider.Lease")
+		h.lease, err = h.Credentials.Lease(leaseCtx, h.database, userinfo)
+		endSpan(leaseSpan, err)
+		if err != nil {
+			h.Logger.Errorf("Failed to lease the destination credentials: %v", err)
+			return fmt.Errorf("failed to obtain the destination credentials")
+		}
+		if h.lease != nil {
+			h.Logger.Infof("Authenticating upstream as %s", h.lease.Credential.Username)
+			h.Username = h.lease.Credential.Username
+			h.Password = h.lease.Credential.Password
+		}
+	}
+
+	// Authenticate as the configured user
+	_, authSpan := tracer().Start(ctx, "PostgresHandler.auth")
+	var conn *PooledConn
+	if h.Pool != nil {
+		conn, err = h.Pool.Get(h.poolKey(h.readOnly))
+		if err == nil {
+			h.upstream = conn
+			h.backend.Store(conn.Cancel)
+		}
+	} else {
+		if h.upstream == nil {
+			err = h.connectUpstream()
+		}
+		if err == nil {
+			err = h.auth()
+		}
+	}
+	endSpan(authSpan, err)
+	if err != nil {
+		return err
+	}
+
+	// Auth successful, send the auth OK to the client
+	err = h.sendAuthenticationOk()
+	if err != nil {
+		return err
+	}
+
+	// Pipe the rest of the metadata until ready for query
+	if conn != nil {
+		for _, msg := range conn.Parameters {
+			err = h.send("client", h.proxyBackendKey(msg))
+			if err != nil {
+				return err
+			}
+		}
+		err = h.setParameters(true)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = h.readUntilReadyForQuery("authentication", true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = h.prepareSession()
+	if err != nil {
+		return err
 	}
 
 	// Set DDL for SQL Handler
 	if h.SQLHandler != nil {
 		h.Logger.Info("Setting DDL for SQL handler")
-		err = h.SQLHandler.SetDDL(h.userinfo)
+		ddlCtx, ddlSpan := tracer().Start(h.policyContext(ctx), "SQLHandler.SetDDL")
+		err = h.SQLHandler.SetDDL(ddlCtx, h.userinfo)
+		endSpan(ddlSpan, err)
 		if err != nil {
 			return err
 		}
 	}
 
 	// Send OK to client
-	err = h.write([]byte{90, 0, 0, 0, 5, 73}, "client")
+	err = h.send("client", &pgwire.ReadyForQuery{TxStatus: pgwire.TxStatusIdle})
 	if err != nil {
 		return err
 	}
+	h.txStatus.Store('I')
+
+	return nil
+}
+
+// certificateUserinfo returns the identity of the verified client certificate
+// when the client logs in as it, the other clients authenticate as usual.
+func (h *PostgresHandler) certificateUserinfo(user string) map[string]interface{} {
+	conn, ok := h.client.(*tls.Conn)
+	if !ok || h.Identities == nil {
+		return nil
+	}
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return nil
+	}
+
+	userinfo, ok := h.Identities.Userinfo(chains[0][0])
+	if !ok {
+		h.Logger.Debugf("No identity mapped to the client certificate: %v", chains[0][0].Subject)
+		return nil
+	}
+	if fmt.Sprint(userinfo[h.Identities.UsernameClaim]) != user {
+		h.Logger.Debugf("Client certificate identifies %v, not the user %s", userinfo[h.Identities.UsernameClaim], user)
+		return nil
+	}
+	return userinfo
+}
+
+// routeReadOnly moves a session to a replica before it authenticates upstream.
+func (h *PostgresHandler) routeReadOnly() error {
+	if h.readOnly {
+		return nil
+	}
+	h.Logger.Info("Routing the read-only session to a replica")
+	h.readOnly = true
+	if h.upstream == nil {
+		return nil
+	}
+
+	h.upstream.Close()
+	h.upstream = nil
+	return h.connectUpstream()
+}
+
+// routeSession points the session to the destination picked by the router.
+func (h *PostgresHandler) routeSession(route *UpstreamRoute) {
+	h.Logger.Infof("Routing the session to %s", route.Address)
+	h.route = route
+	h.UpstreamHandler = &BasicUpstreamHandler{Address: route.Address}
+	if route.Username != "" {
+		h.Username = route.Username
+		h.Password = route.Password
+	}
+	if route.Database != "" {
+		h.database = route.Database
+	}
+}
+
+// databaseLabel is the database of the session in the metrics. The clients
+// pick the databases, so only the configured and the routed databases keep
+// their names.
+func (h *PostgresHandler) databaseLabel() string {
+	if _, ok := h.OIDCDatabaseClients[h.database]; ok {
+		return h.database
+	}
+	if slices.Contains(h.MetricsDatabases, h.database) || (h.route != nil && h.route.Database == h.database) {
+		return h.database
+	}
+	return "other"
+}
+
+// poolKey identifies the pooled connections the session can borrow.
+func (h *PostgresHandler) poolKey(readOnly bool) PoolKey {
+	key := PoolKey{Database: h.database, ReadOnly: readOnly, Username: h.Username, Password: h.Password}
+	if h.route != nil {
+		key.Address = h.route.Address
+	}
+	return key
+}
+
+// proxyStartup forwards the startup of a client authenticating on its own.
+func (h *PostgresHandler) proxyStartup() error {
+	if h.parameters.Get("database") == "" {
+		h.database = h.user
+	}
+	if h.upstream == nil {
+		err := h.connectUpstream()
+		if err != nil {
+			return err
+		}
+	}
+	return h.send("upstream", &pgwire.StartupMessage{ProtocolVersion: pgwire.ProtocolVersion30, Parameters: h.parameters})
+}
+
+// setParameters sets the forwarded parameters of the client on the borrowed
+// connection, the pooled connections start without them. The settings the
+// destination reports back are passed to the client with sendDownstream.
+func (h *PostgresHandler) setParameters(sendDownstream bool) error {
+	if len(h.forwarded) == 0 {
+		return nil
+	}
+	statements := make([]string, 0, len(h.forwarded))
+	for _, param := range h.forwarded {
+		statements = append(statements, fmt.Sprintf("SET %s TO %s", quoteIdentifier(param.Key), quoteLiteral(param.Value)))
+	}
+	err := h.sendQuery(strings.Join(statements, "; "))
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := h.readFullMessage("upstream")
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case 'E':
+			return fmt.Errorf("error setting parameters: %v", getErrorMessage(msg.Body))
+		case 'Z':
+			return nil
+		case 'S':
+			if sendDownstream {
+				err = h.send("client", msg)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// resetParameters resets the forwarded parameters of the client before the
+// connection goes back to the pool.
+func (h *PostgresHandler) resetParameters() error {
+	if len(h.forwarded) == 0 {
+		return nil
+	}
+	statements := make([]string, 0, len(h.forwarded))
+	for _, param := range h.forwarded {
+		statements = append(statements, "RESET "+quoteIdentifier(param.Key))
+	}
+	return h.runQuery(strings.Join(statements, "; "), "resetting parameters")
+}
+
+// prepareSession runs the post-authentication script and assumes the user
+// session on the upstream connection.
+func (h *PostgresHandler) prepareSession() error {
+	// Post-authentication script
+	if h.OIDCPostAuthSQLTemplate != "" {
+		h.Logger.Info("Executing post-authentication script")
+		err := h.executePostAuthStatement()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Provision the role of the user
+	if h.Provisioner != nil {
+		h.Logger.Info("Provisioning user role")
+		err := h.provisionRole()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Assume user session
+	if h.AssumeUserSession {
+		h.Logger.Info("Assuming user session")
+		err := h.assumeUserSession()
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -402,100 +1493,107 @@ func (h *PostgresHandler) authenticate(sizebuff []byte) error {
 func (h *PostgresHandler) auth() error {
 	h.Logger.Info("Authenticating as configured user")
 
-	// Send initial auth request
-	msg := []byte{0, 3, 0, 0}
-	msg = append(msg, []byte("user")...)
-	msg = append(msg, 0)
-	msg = append(msg, []byte(h.Username)...)
-	msg = append(msg, 0)
-	msg = append(msg, []byte("database")...)
-	msg = append(msg, 0)
-	msg = append(msg, []byte(h.database)...)
-	msg = append(msg, []byte{0, 0}...)
-	size := createPacketSize(len(msg) + 4)
-	msg = append(size, msg...)
-	err := h.write(msg, "upstream")
+	// Send initial auth request with the parameters forwarded from the client
+	params := append(pgwire.Parameters{{Key: "user", Value: h.Username}, {Key: "database", Value: h.database}}, h.forwarded...)
+	err := h.send("upstream", &pgwire.StartupMessage{ProtocolVersion: pgwire.ProtocolVersion30, Parameters: params})
 	if err != nil {
 		return err
 	}
 
 	// Read auth response challenge
-	r, err := h.readMessage('R')
+	r, err := h.readAuthentication()
 	if err != nil {
 		return err
 	}
-
-	// Check trust auth method
-	if checkAuthenticationSuccess(r) {
-		h.Logger.Info("Trust auth method reply. Authentication successful")
-		return nil
+	h.Logger.Debugf("Auth method: %v", r.Type)
+	if h.UpstreamChannelBinding == ChannelBindingRequire && r.Type != pgwire.AuthenticationSASL {
+		return fmt.Errorf("channel binding required, but the destination authenticated without it")
 	}
 
-	// Determine the method
-	rs := bytes.Split(r, []byte{0})
-	if len(rs) < 3 {
-		return fmt.Errorf("unexpected response from db: %v", rs)
-	}
-	h.Logger.Debugf("Auth method: %v", rs)
-	method := rs[3][0]
-	switch int(method) {
-	case 3:
+	switch r.Type {
+	case pgwire.AuthenticationOk:
+		h.Logger.Info("Trust auth method reply. Authentication successful")
+		authenticationsTotal.WithLabelValues("trust", observeOutcome(nil)).Inc()
+	case pgwire.AuthenticationCleartextPassword:
 		h.Logger.Info("Clear password auth method")
-		return h.handleClearPasswordAuth()
-	case 5:
+		err = h.checkPasswordAuth()
+		if err == nil {
+			err = h.handleClearPasswordAuth()
+		}
+		authenticationsTotal.WithLabelValues("password", observeOutcome(err)).Inc()
+	case pgwire.AuthenticationMD5Password:
 		h.Logger.Info("MD5 password auth method")
-		return h.handleMD5PasswordAuth(string(rs[3][1:]))
-	case 7, 8:
+		err = h.checkPasswordAuth()
+		if err == nil {
+			err = h.handleMD5PasswordAuth(string(r.Data))
+		}
+		authenticationsTotal.WithLabelValues("md5", observeOutcome(err)).Inc()
+	case pgwire.AuthenticationGSS, pgwire.AuthenticationGSSContinue:
 		h.Logger.Info("GSSAPI auth method")
-		return fmt.Errorf("GSSAPI auth method not supported")
-	case 10:
-		h.Logger.Info("SCRAM-SHA-256 auth method")
-		return h.handleSCRAMSHA256Auth()
+		err = fmt.Errorf("GSSAPI auth method not supported")
+		authenticationsTotal.WithLabelValues("gss", observeOutcome(err)).Inc()
+	case pgwire.AuthenticationSASL:
+		var mechanism string
+		mechanism, err = h.handleSCRAMAuth(r)
+		authenticationsTotal.WithLabelValues(strings.ToLower(mechanism), observeOutcome(err)).Inc()
 	default:
-		return fmt.Errorf("unknown auth method: %v", method)
+		err = fmt.Errorf("unknown auth method: %v", r.Type)
 	}
+	return err
 }
 
-func (h *PostgresHandler) readMessage(expR byte) ([]byte, error) {
-	r, err := h.read(1, "upstream")
+// readAuthentication reads the next authentication request of the
+// destination, the error response rejecting the user fails it.
+func (h *PostgresHandler) readAuthentication() (*pgwire.Authentication, error) {
+	msg, err := h.readFullMessage("upstream")
 	if err != nil {
 		return nil, err
 	}
-	if r[0] != expR {
-		return nil, fmt.Errorf("unexpected response from db: %v %s", r, r)
+	if msg.Type == 'E' {
+		return nil, fmt.Errorf("error authentication: %v", getErrorMessage(msg.Body))
 	}
-	r, err = h.read(4, "upstream")
-	if err != nil {
-		return nil, err
+	if msg.Type != 'R' {
+		return nil, fmt.Errorf("unexpected response from db: %c", msg.Type)
 	}
-	rsize := calculatePacketSize(r)
-	r, err = h.read(rsize-4, "upstream")
+	r := &pgwire.Authentication{}
+	err = r.Decode(msg.Body)
 	if err != nil {
 		return nil, err
 	}
 	return r, nil
 }
 
-func (h *PostgresHandler) handleClearPasswordAuth() error {
-	msg := []byte{'p'}
-	pwd := []byte(h.Password)
-	s := createPacketSize(len(pwd) + 5)
-	msg = append(msg, s...)
-	msg = append(msg, pwd...)
-	msg = append(msg, 0)
-	err := h.write(msg, "upstream")
+// readAuthenticationOk expects the destination to accept the authentication.
+func (h *PostgresHandler) readAuthenticationOk() error {
+	r, err := h.readAuthentication()
 	if err != nil {
 		return err
 	}
+	if r.Type != pgwire.AuthenticationOk {
+		return fmt.Errorf("authentication failed, response from db: %v", r.Type)
+	}
+	return nil
+}
 
-	// Read auth response
-	r, err := h.readMessage('R')
+// checkPasswordAuth refuses to give the password away, in clear text or as an
+// MD5 hash open to replays, to a destination whose certificate is not verified.
+func (h *PostgresHandler) checkPasswordAuth() error {
+	if h.UpstreamInsecurePasswordAuth || tlsVerified(h.UpstreamTLSMode, h.UpstreamTLSCAFile) {
+		return nil
+	}
+	return fmt.Errorf("destination asked for a cleartext or MD5 password without a verified TLS connection, use the verify-ca or verify-full destination TLS mode")
+}
+
+func (h *PostgresHandler) handleClearPasswordAuth() error {
+	err := h.send("upstream", &pgwire.PasswordMessage{Password: h.Password})
 	if err != nil {
 		return err
 	}
 
-	if !checkAuthenticationSuccess(r) {
-		return fmt.Errorf("authentication failed, response from db: %v", r)
+	// Read auth response
+	err = h.readAuthenticationOk()
+	if err != nil {
+		return err
 	}
 
 	h.Logger.Info("Clear password auth successful")
@@ -503,8 +1601,6 @@ func (h *PostgresHandler) handleClearPasswordAuth() error {
 }
 
 func (h *PostgresHandler) handleMD5PasswordAuth(key string) error {
-	msg := []byte{'p'}
-
 	// Calculate the MD5 hash
 	md5H := md5.New()
 	_, err := md5H.Write([]byte(h.Password + h.Username))
@@ -520,138 +1616,138 @@ func (h *PostgresHandler) handleMD5PasswordAuth(key string) error {
 	pwd := fmt.Sprintf("md5%x", md5H.Sum(nil))
 
 	// Send the password
-	s := createPacketSize(len(pwd) + 5)
-	msg = append(msg, s...)
-	msg = append(msg, []byte(pwd)...)
-	msg = append(msg, 0)
-	err = h.write(msg, "upstream")
+	err = h.send("upstream", &pgwire.PasswordMessage{Password: pwd})
 	if err != nil {
 		return err
 	}
 
 	// Handle response
-	r, err := h.readMessage('R')
+	err = h.readAuthenticationOk()
 	if err != nil {
 		return err
 	}
-
-	if !checkAuthenticationSuccess(r) {
-		return fmt.Errorf("authentication failed, response from db: %v", r)
-	}
 	h.Logger.Info("MD5 password auth successful")
 	return nil
 }
 
-func (h *PostgresHandler) handleSCRAMSHA256Auth() error {
-	msg := []byte{'p'}
-
-	// First step
+// handleSCRAMAuth authenticates with the SCRAM mechanism picked from the
+// SASL request and returns its name, SASL when none of them is supported.
+func (h *PostgresHandler) handleSCRAMAuth(r *pgwire.Authentication) (string, error) {
+	mechanisms, err := r.SASLMechanisms()
+	if err != nil {
+		return "SASL", err
+	}
 	client, err := scram.SHA256.NewClient(h.Username, h.Password, "")
 	if err != nil {
-		return err
+		return "SASL", err
+	}
+	mechanism, conv, err := h.chooseSCRAMMechanism(client, mechanisms)
+	if err != nil {
+		return "SASL", err
 	}
-	conv := client.NewConversation()
-	var resp string
-	firstMsg, err := conv.Step(resp)
+	h.Logger.Infof("%s auth method", mechanism)
+	return mechanism, h.handleSCRAMSHA256Auth(mechanism, conv)
+}
+
+// chooseSCRAMMechanism prefers the channel binding whenever the connection to
+// the destination is TLS, the same as libpq.
+func (h *PostgresHandler) chooseSCRAMMechanism(client *scram.Client, mechanisms []string) (string, *scram.ClientConversation, error) {
+	var binding scram.ChannelBinding
+	if h.UpstreamChannelBinding != ChannelBindingDisable {
+		binding = tlsServerEndPointBinding(h.upstream)
+	}
+
+	switch {
+	case binding.IsSupported() && contains(mechanisms, scramSHA256Plus):
+		return scramSHA256Plus, client.NewConversationWithChannelBinding(binding), nil
+	case h.UpstreamChannelBinding == ChannelBindingRequire:
+		return "", nil, fmt.Errorf("channel binding required, but the destination does not support it: %s", strings.Join(mechanisms, ", "))
+	case binding.IsSupported() && contains(mechanisms, scramSHA256):
+		// Tell the destination the binding was possible, so a stripped PLUS is caught
+		return scramSHA256, client.NewConversationAdvertisingChannelBinding(), nil
+	case contains(mechanisms, scramSHA256):
+		return scramSHA256, client.NewConversation(), nil
+	}
+	return "", nil, fmt.Errorf("destination requires an unsupported SASL mechanism: %s", strings.Join(mechanisms, ", "))
+}
+
+func (h *PostgresHandler) handleSCRAMSHA256Auth(mechanism string, conv *scram.ClientConversation) error {
+	// First step
+	firstMsg, err := conv.Step("")
 	if err != nil {
 		return err
 	}
 	h.Logger.Debugf("First step: %v", firstMsg)
 
 	// Send the first step to the db
-	pwd := []byte("SCRAM-SHA-256")
-	pwd = append(pwd, 0)
-	firstStepSize := createPacketSize(len(firstMsg))
-	pwd = append(pwd, firstStepSize...)
-	pwd = append(pwd, []byte(firstMsg)...)
-	size := createPacketSize(len(pwd) + 4)
-	msg = append(msg, size...)
-	msg = append(msg, pwd...)
-	err = h.write(msg, "upstream")
+	err = h.send("upstream", &pgwire.SASLInitialResponse{Mechanism: mechanism, Data: []byte(firstMsg)})
 	if err != nil {
 		return err
 	}
 
 	// Get the data for second step
-	r, err := h.readMessage('R')
+	r, err := h.readAuthentication()
 	if err != nil {
 		return err
 	}
-	rs := bytes.Split(r, []byte{0})
-	if len(rs) < 4 {
-		return fmt.Errorf("unexpected response from db: %v", rs)
+	if r.Type != pgwire.AuthenticationSASLContinue {
+		return fmt.Errorf("unexpected response from db: %v", r.Type)
 	}
-	if rs[3][0] != 11 {
-		return fmt.Errorf("unexpected response from db: %v", rs)
-	}
-	resp = string(rs[3][1:])
-	h.Logger.Debugf("First step response: %v", resp)
+	h.Logger.Debugf("First step response: %s", r.Data)
 
 	// Second step
-	secondMsg, err := conv.Step(resp)
+	secondMsg, err := conv.Step(string(r.Data))
 	if err != nil {
 		return err
 	}
 	h.Logger.Debugf("Second step: %v", secondMsg)
 
 	// Send the second step to the db
-	msg = []byte{'p'}
-	size = createPacketSize(len(secondMsg) + 4)
-	msg = append(msg, size...)
-	msg = append(msg, []byte(secondMsg)...)
-	err = h.write(msg, "upstream")
+	err = h.send("upstream", &pgwire.SASLResponse{Data: []byte(secondMsg)})
 	if err != nil {
 		return err
 	}
 
 	// Get the data for the third step
-	r, err = h.readMessage('R')
+	r, err = h.readAuthentication()
 	if err != nil {
 		return err
 	}
-	rs = bytes.Split(r, []byte{0})
-	if len(rs) < 4 {
-		return fmt.Errorf("unexpected response from db: %v", rs)
-	}
-	if rs[3][0] != 12 {
-		return fmt.Errorf("unexpected response from db: %v", rs)
+	if r.Type != pgwire.AuthenticationSASLFinal {
+		return fmt.Errorf("unexpected response from db: %v", r.Type)
 	}
-	resp = string(rs[3][1:])
-	h.Logger.Debugf("Second step response: %v", resp)
+	h.Logger.Debugf("Second step response: %s", r.Data)
 
 	// Third step (validation)
-	_, err = conv.Step(resp)
+	_, err = conv.Step(string(r.Data))
 	if err != nil {
 		return err
 	}
 
 	// Expecting success from the db
-	r, err = h.readMessage('R')
+	err = h.readAuthenticationOk()
 	if err != nil {
 		return err
 	}
-	if !checkAuthenticationSuccess(r) {
-		return fmt.Errorf("authentication failed, response from db: %v", r)
-	}
 
-	h.Logger.Info("SCRAM-SHA-256 auth successful")
+	h.Logger.Infof("%s auth successful", mechanism)
 	return nil
 }
 
 func (h *PostgresHandler) readUntilReadyForQuery(process string, sendDownstream bool) error {
 	for {
-		op, size, data, err := h.readFullMessage("upstream")
+		msg, err := h.readFullMessage("upstream")
 		if err != nil {
 			return err
 		}
-		if op[0] == 'E' {
-			return fmt.Errorf("error %s: %v", process, getErrorMessage(data))
+		if msg.Type == 'E' {
+			return fmt.Errorf("error %s: %v", process, getErrorMessage(msg.Body))
 		}
-		if op[0] == 'Z' {
+		if msg.Type == 'Z' {
 			break
 		}
 		if sendDownstream {
-			err = h.write(append(op, append(size, data...)...), "client")
+			err = h.send("client", h.proxyBackendKey(msg))
 			if err != nil {
 				return err
 			}
@@ -660,31 +1756,44 @@ func (h *PostgresHandler) readUntilReadyForQuery(process string, sendDownstream
 	return nil
 }
 
-func (h *PostgresHandler) readFullMessage(name string) ([]byte, []byte, []byte, error) {
-	var doLog bool
-	if name == "client" {
-		doLog = h.LogDownstream
-	} else {
-		doLog = h.LogUpstream
+// readFullMessage reads the next message of the client or the destination,
+// the messages of the client are limited to MaxMessageSize.
+func (h *PostgresHandler) readFullMessage(name string) (*pgwire.Message, error) {
+	limit := pgwire.DefaultMaxMessageSize
+	if name == "client" && h.MaxMessageSize > 0 {
+		limit = h.MaxMessageSize
 	}
+	return h.readLimitedMessage(name, limit)
+}
 
-	operation, err := h.read(1, name)
-	if err != nil {
-		return nil, nil, nil, err
+// readAuthMessage reads a message of the client authenticating on the proxy,
+// the messages are limited as in Postgres until the client is known.
+func (h *PostgresHandler) readAuthMessage() (*pgwire.Message, error) {
+	limit := pgwire.MaxAuthMessageSize
+	if h.MaxMessageSize > 0 {
+		limit = min(limit, h.MaxMessageSize)
 	}
-	size, err := h.read(4, name)
-	if err != nil {
-		return nil, nil, nil, err
+	return h.readLimitedMessage("client", limit)
+}
+
+func (h *PostgresHandler) readLimitedMessage(name string, limit int) (*pgwire.Message, error) {
+	reader, doLog := h.reader(name), h.LogUpstream
+	if name == "client" {
+		doLog = h.LogDownstream
 	}
-	sizeInt := calculatePacketSize(size)
-	data, err := h.read(sizeInt-4, name)
+	reader.MaxMessageSize = limit
+
+	msg, err := reader.ReadMessage()
 	if err != nil {
-		return nil, nil, nil, err
+		if err != io.EOF {
+			h.Logger.Errorf("Error reading from %s: %v", name, err)
+		}
+		return nil, err
 	}
 	if doLog {
-		h.Logger.Debugf("Operation: %v (%s); Read %v bytes from %s: %s", operation, operation, sizeInt, name, data)
+		h.Logger.Debugf("Operation: %c; Read %v bytes from %s: %s", msg.Type, msg.Size(), name, msg.Body)
 	}
-	return operation, size, data, nil
+	return msg, nil
 }
 
 func (h *PostgresHandler) executePostAuthStatement() error {
@@ -715,75 +1824,186 @@ func (h *PostgresHandler) executePostAuthStatement() error {
 }
 
 func (h *PostgresHandler) executeQuery(query, process string) error {
-	// Start
-	msg := []byte{'Q'}
-	q := []byte("BEGIN")
-	q = append(q, 0)
-	size := createPacketSize(len(q) + 4)
-	msg = append(msg, size...)
-	msg = append(msg, q...)
-	err := h.write(msg, "upstream")
+	for _, q := range []string{"BEGIN", query, "END"} {
+		err := h.runQuery(q, process)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runQuery sends a simple query upstream and waits until it is done.
+func (h *PostgresHandler) runQuery(query, process string) error {
+	err := h.sendQuery(query)
 	if err != nil {
 		return err
 	}
+	return h.readUntilReadyForQuery(process, false)
+}
 
-	err = h.readUntilReadyForQuery(process, false)
+// queryValue sends a simple query upstream and returns the first column of
+// the first row as text.
+func (h *PostgresHandler) queryValue(query, process string) (string, error) {
+	err := h.sendQuery(query)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	var value string
+	found := false
+	for {
+		msg, err := h.readFullMessage("upstream")
+		if err != nil {
+			return "", err
+		}
+		switch msg.Type {
+		case 'E':
+			return "", fmt.Errorf("error %s: %v", process, getErrorMessage(msg.Body))
+		case 'D':
+			row := &pgwire.DataRow{}
+			if found || row.Decode(msg.Body) != nil || len(row.Values) == 0 {
+				continue
+			}
+			value = string(row.Values[0])
+			found = true
+		}
+		if msg.Type == 'Z' {
+			break
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("error %s: no rows returned", process)
 	}
+	return value, nil
+}
+
+func (h *PostgresHandler) sendQuery(query string) error {
+	return h.send("upstream", &pgwire.Query{String: query})
+}
+
+// sessionRole returns the role of the user, the username claim turned by
+// the role name rules.
+func (h *PostgresHandler) sessionRole() (string, error) {
+	u, ok := h.userinfo[h.UsernameClaim]
+	if !ok {
+		return "", fmt.Errorf("username claim not found in userinfo: %v", h.UsernameClaim)
+	}
+
+	username, ok := u.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected username claim type: %T with value %v", u, u)
+	}
+	if h.RoleNames == nil {
+		return username, nil
+	}
+	return h.RoleNames.Apply(username)
+}
+
+// upstreamReadOnly tells whether the upstream connection goes to a replica.
+// policyContext marks the client credentials sessions for the permission
+// agent, which picks the policies of the clients by it.
+func (h *PostgresHandler) policyContext(ctx context.Context) context.Context {
+	if h.clientID == "" {
+		return ctx
+	}
+	return withClientSession(ctx, h.clientID)
+}
+
+func (h *PostgresHandler) upstreamReadOnly() bool {
+	if conn, ok := h.upstream.(*PooledConn); ok {
+		return conn.ReadOnly
+	}
+	return h.readOnly
+}
 
-	// Execute
-	msg = []byte{'Q'}
-	q = []byte(query)
-	q = append(q, 0)
-	size = createPacketSize(len(q) + 4)
-	msg = append(msg, size...)
-	msg = append(msg, q...)
-	err = h.write(msg, "upstream")
+// provisionRole creates the role of the user and syncs its group roles,
+// unless they were provisioned on the destination lately.
+func (h *PostgresHandler) provisionRole() error {
+	role, err := h.sessionRole()
 	if err != nil {
 		return err
 	}
-	err = h.readUntilReadyForQuery(process, false)
+	grants := h.Provisioner.Grants(h.userinfo)
+	destination := h.Address
+	if h.route != nil {
+		destination = h.route.Address
+	}
+	if h.Provisioner.Provisioned(destination, role, grants) {
+		h.Logger.Debugf("Role %s is already provisioned", role)
+		return nil
+	}
+
+	stmt := h.Provisioner.Statement(role, grants)
+	h.Logger.Debugf("Provisioning statement: %s", stmt)
+	if h.upstreamReadOnly() {
+		err = h.provisionOnPrimary(stmt)
+	} else {
+		err = h.executeQuery(stmt, "provisioning role")
+	}
+	roleProvisionsTotal.WithLabelValues(observeOutcome(err)).Inc()
 	if err != nil {
 		return err
 	}
 
-	// Commit
-	msg = []byte{'Q'}
-	q = []byte("END")
-	q = append(q, 0)
-	size = createPacketSize(len(q) + 4)
-	msg = append(msg, size...)
-	msg = append(msg, q...)
-	err = h.write(msg, "upstream")
+	h.Provisioner.Remember(destination, role, grants)
+	h.Logger.Infof("Provisioned role %s with the group roles %v", role, grants)
+	return nil
+}
+
+// provisionOnPrimary runs the provisioning statement on a connection to the
+// primary, the replica of the session cannot create the role and gets it
+// from the primary by the replication.
+func (h *PostgresHandler) provisionOnPrimary(stmt string) error {
+	h.Logger.Info("Provisioning user role on the primary")
+	upstream, reader, readOnly := h.upstream, h.upstreamReader, h.readOnly
+	defer func() {
+		h.upstream, h.upstreamReader, h.readOnly = upstream, reader, readOnly
+	}()
+	h.upstream, h.upstreamReader, h.readOnly = nil, connReader{}, false
+
+	if h.Pool != nil {
+		conn, err := h.Pool.Get(h.poolKey(false))
+		if err != nil {
+			return err
+		}
+		h.upstream = conn
+		err = h.executeQuery(stmt, "provisioning role")
+		if err != nil {
+			h.Pool.Discard(conn)
+			return err
+		}
+		h.Pool.Put(conn)
+		return nil
+	}
+
+	err := h.connectUpstream()
 	if err != nil {
 		return err
 	}
-	err = h.readUntilReadyForQuery(process, false)
+	defer h.upstream.Close()
+	err = h.auth()
 	if err != nil {
 		return err
 	}
-
-	return nil
+	err = h.readUntilReadyForQuery("authentication", false)
+	if err != nil {
+		return err
+	}
+	return h.executeQuery(stmt, "provisioning role")
 }
 
 func (h *PostgresHandler) assumeUserSession() error {
-	// Get the username
-	var username string
-
-	u, ok := h.userinfo[h.UsernameClaim]
-	if !ok {
-		return fmt.Errorf("username claim not found in userinfo: %v", h.UsernameClaim)
+	role, err := h.sessionRole()
+	if err != nil {
+		return err
 	}
 
-	switch v := u.(type) {
-	case string:
-		username = u.(string)
-	default:
-		return fmt.Errorf("unexpected username claim type: %v with value %v", v, u)
+	if h.AssumeUserSessionMode == AssumeSessionRole {
+		err = h.executeQuery("SET ROLE "+quoteIdentifier(role), "setting role")
+	} else {
+		err = h.executeQuery("SET SESSION AUTHORIZATION "+quoteIdentifier(role), "setting session authorization")
 	}
-
-	err := h.executeQuery(fmt.Sprintf("SET SESSION AUTHORIZATION %s", username), "setting session authorization")
 	if err != nil {
 		return err
 	}
@@ -792,34 +2012,269 @@ func (h *PostgresHandler) assumeUserSession() error {
 	return nil
 }
 
-func (h *PostgresHandler) proxyDownstream() {
-	if h.LogUpstream {
-		buffer := make([]byte, 1024)
-		for {
-			n, err := h.upstream.Read(buffer)
-			if err != nil {
-				if err != io.EOF {
-					h.Logger.Errorf("Error reading from upstream: %v", err)
-				}
+func (h *PostgresHandler) startDownstream() {
+	h.downstreamDone = make(chan struct{})
+	go h.proxyDownstream(h.downstreamDone)
+}
+
+func (h *PostgresHandler) proxyDownstream(done chan struct{}) {
+	released := false
+	defer func() {
+		if h.Pool != nil {
+			h.finishDownstream(released)
+		}
+		close(done)
+	}()
+
+	for {
+		msg, err := h.readFullMessage("upstream")
+		if err != nil {
+			break
+		}
+
+		h.trackUpstreamMessage(msg)
+		if label := h.metrics.label(); label != "" {
+			bytesProxiedTotal.WithLabelValues(label, "downstream").Add(float64(msg.Size()))
+		} else if isAuthenticationOk(msg) {
+			h.metrics.established(h.databaseLabel())
+		}
+
+		err = h.send("client", h.proxyBackendKey(msg))
+		if err != nil {
+			h.Logger.Errorf("Error writing to client: %v", err)
+			break
+		}
+
+		if msg.Type == 'Z' && h.draining.Load() && h.idle() {
+			h.Terminate()
+			break
+		}
+
+		if msg.Type == 'Z' && h.Pool != nil && h.Pool.Mode == PoolModeTransaction {
+			released = h.releaseIdleUpstream()
+			if released {
 				break
 			}
-			h.Logger.Debugf("Read %v bytes from upstream: %v; %s", n, buffer[:n], buffer[:n])
-			_, err = h.client.Write(buffer[:n])
+		}
+	}
+}
+
+// finishDownstream returns the connection of a finished session to the pool
+// and ends the session if the connection was lost.
+func (h *PostgresHandler) finishDownstream(released bool) {
+	if released {
+		return
+	}
+
+	h.upstreamMutex.Lock()
+	if h.upstream != nil {
+		h.releaseUpstream(h.idle())
+	}
+	h.upstreamMutex.Unlock()
+	h.client.Close()
+}
+
+// stopDownstream interrupts the reading from the upstream connection once the
+// client is gone, the downstream returns the connection to the pool.
+func (h *PostgresHandler) stopDownstream() {
+	h.upstreamMutex.Lock()
+	done := h.downstreamDone
+	if h.upstream != nil {
+		if done == nil {
+			h.releaseUpstream(h.established.Load() && h.idle())
+		} else {
+			err := h.upstream.SetReadDeadline(time.Now())
 			if err != nil {
-				h.Logger.Errorf("Error writing to client: %v", err)
-				break
+				h.Logger.Errorf("Error interrupting the upstream: %v", err)
 			}
 		}
+	}
+	h.upstreamMutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// releaseIdleUpstream returns the connection to the pool between the transactions.
+func (h *PostgresHandler) releaseIdleUpstream() bool {
+	h.upstreamMutex.Lock()
+	defer h.upstreamMutex.Unlock()
+
+	if _, pooled := h.upstream.(*PooledConn); !pooled || !h.idle() {
+		return false
+	}
+	h.releaseUpstream(true)
+	return true
+}
+
+// releaseUpstream resets a clean pooled connection and returns it to the pool,
+// the others are closed. The caller holds the upstream mutex.
+func (h *PostgresHandler) releaseUpstream(clean bool) {
+	h.backend.Store(nil)
+	conn, pooled := h.upstream.(*PooledConn)
+	if !pooled {
+		h.upstream.Close()
+		h.upstream = nil
+		return
+	}
+
+	if clean {
+		err := conn.SetReadDeadline(time.Time{})
+		if err == nil {
+			err = h.runQuery(h.Pool.ResetQuery, "resetting pooled connection")
+		}
+		if err == nil {
+			err = h.resetParameters()
+		}
+		if err != nil {
+			h.Logger.Errorf("Error resetting pooled connection: %v", err)
+			clean = false
+		}
+	}
+
+	h.upstream = nil
+	if clean {
+		h.Pool.Put(conn)
 	} else {
-		_, err := io.Copy(h.client, h.upstream)
-		if err != nil && err != io.EOF {
-			h.Logger.Errorf("Error copying from upstream to client: %v", err)
+		h.Pool.Discard(conn)
+	}
+}
+
+// acquireUpstream borrows a pooled connection and prepares the user session
+// on it. The caller holds the upstream mutex.
+func (h *PostgresHandler) acquireUpstream(readOnly bool) error {
+	conn, err := h.Pool.Get(h.poolKey(readOnly))
+	if err != nil {
+		return err
+	}
+
+	h.upstream = conn
+	h.backend.Store(conn.Cancel)
+	err = h.setParameters(false)
+	if err == nil {
+		err = h.prepareSession()
+	}
+	if err != nil {
+		h.upstream = nil
+		h.backend.Store(nil)
+		h.Pool.Discard(conn)
+		return err
+	}
+
+	h.startDownstream()
+	return nil
+}
+
+func (h *PostgresHandler) newAuditEvent(stmt string) *AuditEvent {
+	event := &AuditEvent{Time: time.Now(), SQL: stmt, Database: h.database}
+	if h.client.RemoteAddr() != nil {
+		event.ClientAddress = h.client.RemoteAddr().String()
+	}
+	if sub, ok := h.userinfo["sub"].(string); ok {
+		event.Subject = sub
+	}
+	if username, ok := h.userinfo[h.UsernameClaim].(string); ok {
+		event.Username = username
+	}
+
+	// Only the sessions authenticating on their own log in as the startup
+	// user, the OIDC data of the startup user never goes to the audit log
+	if h.userinfo == nil && !strings.Contains(h.user, "=") {
+		event.Username = h.user
+	}
+	return event
+}
+
+func (h *PostgresHandler) trackUpstreamMessage(msg *pgwire.Message) {
+	switch msg.Type {
+	case 'C', 's', 'I':
+		statement := h.pending.head()
+		if statement == nil || statement.event == nil {
+			break
+		}
+		complete := &pgwire.CommandComplete{}
+		if msg.Type == 'C' && complete.Decode(msg.Body) == nil {
+			statement.event.Complete(complete.Tag)
+		}
+		if statement.execute {
+			h.pending.pop()
+			h.Auditor.Record(statement.event)
+		}
+	case 'E':
+		message := getErrorMessage(msg.Body)
+		statement := h.pending.head()
+		if statement != nil && statement.execute {
+			statement.event.Fail(AuditOutcomeError, fmt.Errorf("%s", message))
+			h.Auditor.Record(statement.event)
+			h.pending.dropExecutes()
+			statement = h.pending.head()
+		}
+		if statement == nil {
+			break
+		}
+		if statement.event != nil {
+			statement.event.Fail(AuditOutcomeError, fmt.Errorf("%s", message))
+		}
+		if statement.span != nil {
+			statement.span.SetStatus(codes.Error, message)
+		}
+	case 'Z':
+		ready := &pgwire.ReadyForQuery{}
+		if ready.Decode(msg.Body) == nil {
+			h.txStatus.Store(int32(ready.TxStatus))
+		}
+		h.pending.dropExecutes()
+		statement := h.pending.pop()
+		if statement == nil {
+			break
+		}
+		if statement.query {
+			observeDuration(queryDuration, statement.started, h.databaseLabel())
+		}
+		if statement.span != nil {
+			statement.span.End()
+		}
+		if statement.event != nil {
+			h.Auditor.Record(statement.event)
+		}
+	}
+}
+
+// trackExtendedQuery keeps the queries of the prepared statements and of the
+// portals, the executes of the portals are audited with the query of the
+// Parse.
+func (h *PostgresHandler) trackExtendedQuery(msg *pgwire.Message) {
+	if h.prepared == nil {
+		h.prepared = map[string]string{}
+		h.portals = map[string]string{}
+	}
+
+	switch msg.Type {
+	case 'P':
+		parse := &pgwire.Parse{}
+		if parse.Decode(msg.Body) == nil {
+			h.prepared[parse.Name] = parse.Query
+		}
+	case 'B':
+		bind := &pgwire.Bind{}
+		if bind.Decode(msg.Body) == nil {
+			h.portals[bind.Portal] = h.prepared[bind.Statement]
+		}
+	case 'C':
+		closed := &pgwire.Close{}
+		if closed.Decode(msg.Body) != nil {
+			break
+		}
+		if closed.Kind == 'S' {
+			delete(h.prepared, closed.Name)
+		} else {
+			delete(h.portals, closed.Name)
 		}
 	}
 }
 
 func (h *PostgresHandler) handleError(err error, code, message string) error {
-	readyMessage := []byte{90, 0, 0, 0, 5, 69}
 	h.Logger.Errorf("%s: %v", message, err)
 
 	err = h.sendErrorMessage(code, fmt.Errorf("%s: %v", message, err))
@@ -828,7 +2283,7 @@ func (h *PostgresHandler) handleError(err error, code, message string) error {
 		return fmt.Errorf("error sending message to client: %v", err)
 	}
 
-	err = h.write(readyMessage, "client")
+	err = h.send("client", &pgwire.ReadyForQuery{TxStatus: pgwire.TxStatusFailed})
 	if err != nil {
 		h.Logger.Errorf("Error writing to client: %v", err)
 		return fmt.Errorf("error writing to client: %v", err)
@@ -839,65 +2294,145 @@ func (h *PostgresHandler) handleError(err error, code, message string) error {
 
 func (h *PostgresHandler) proxyUpstream() {
 	for {
-		op, size, data, err := h.readFullMessage("client")
+		msg, err := h.readFullMessage("client")
 
 		// Handle errors first
 		if err == io.EOF {
 			h.Logger.Info("Client closed connection")
 			break
 		}
+		if errors.Is(err, pgwire.ErrMessageTooLarge) {
+			_ = h.sendErrorResponse("FATAL", "08P01", err)
+			break
+		}
 		if err != nil {
-			h.Logger.Errorf("Error reading from client: %v", err)
 			break
 		}
-		if len(data) == 0 {
-			h.Logger.Info("Client closed connection")
+		if msg.Type == 'X' {
+			h.Logger.Info("Client terminated the session")
 			break
 		}
 
-		// Check token validity
-		if h.oidcClient != nil && !h.oidcClient.IsAccessTokenValid() {
-			h.Logger.Debug("Access token is invalid, refreshing the token")
-			err = h.oidcClient.RefreshAccessToken()
-			if err != nil {
-				err = h.handleError(err, "28000", "error refreshing access token")
-				if err != nil {
-					break
-				}
-				continue
-			}
+		err = h.proxyClientMessage(msg)
+		if err != nil {
+			break
 		}
+	}
+}
 
-		stmt := string(data[:len(data)-1])
-		if isEscapeSession(stmt) && !h.AllowSessionEscape {
-			h.Logger.Info("Session escape detected, ignoring the request")
-			err = h.handleError(fmt.Errorf("session escape detected"), "28000", "unallowed session escape")
-			if err != nil {
-				break
-			}
-			continue
+// proxyClientMessage applies the session policies to a single client message
+// and forwards it upstream. An error is returned only when the connection
+// cannot continue.
+func (h *PostgresHandler) proxyClientMessage(msg *pgwire.Message) (err error) {
+	stmt := string(bytes.TrimSuffix(msg.Body, []byte{0}))
+
+	ctx := h.ctx
+	if msg.Type == 'Q' && h.TraceFromSQLComment {
+		ctx = contextFromSQLComment(ctx, stmt)
+	}
+	ctx, span := tracer().Start(ctx, "PostgresHandler.proxyClientMessage", trace.WithAttributes(attribute.String("pg.message", string(msg.Type))))
+	defer func() { endSpan(span, err) }()
+
+	// Check token validity
+	if h.oidcClient != nil && !h.oidcClient.IsAccessTokenValid() {
+		h.Logger.Debug("Access token is invalid, refreshing the token")
+		refreshCtx, refreshSpan := tracer().Start(ctx, "OIDCClient.RefreshAccessToken")
+		err = h.oidcClient.RefreshAccessToken(refreshCtx)
+		endSpan(refreshSpan, err)
+		if err != nil {
+			return h.handleError(err, "28000", "error refreshing access token")
 		}
+	}
 
-		if h.SQLHandler != nil {
-			h.Logger.Debugf("Using SQL handler for statement: %s", stmt)
-			newStmt, err := h.SQLHandler.Handle(stmt, h.userinfo)
-			if err != nil {
-				err = h.handleError(err, "28000", "error while handling SQL statement")
-				if err != nil {
-					break
-				}
-				continue
+	var event *AuditEvent
+	if h.Auditor != nil {
+		h.trackExtendedQuery(msg)
+		execute := &pgwire.Execute{}
+		if msg.Type == 'Q' {
+			event = h.newAuditEvent(stmt)
+		} else if msg.Type == 'E' && execute.Decode(msg.Body) == nil {
+			event = h.newAuditEvent(h.portals[execute.Portal])
+		}
+	}
+
+	if isEscapeSession(stmt) && !h.AllowSessionEscape {
+		h.Logger.Info("Session escape detected, ignoring the request")
+		if event != nil {
+			event.Fail(AuditOutcomeDenied, fmt.Errorf("session escape detected"))
+			h.Auditor.Record(event)
+		}
+		span.SetStatus(codes.Error, "session escape detected")
+		return h.handleError(fmt.Errorf("session escape detected"), "28000", "unallowed session escape")
+	}
+
+	if h.SQLHandler != nil {
+		h.Logger.Debugf("Using SQL handler for statement: %s", stmt)
+		rewriteCtx, rewriteSpan := tracer().Start(h.policyContext(ctx), "SQLHandler.Handle")
+		newStmt, err := h.SQLHandler.Handle(rewriteCtx, stmt, h.userinfo)
+		endSpan(rewriteSpan, err)
+		if event != nil && msg.Type == 'Q' {
+			event.Decisions = h.SQLHandler.Decisions()
+		}
+		if err != nil {
+			rewriteFailuresTotal.Inc()
+			if event != nil {
+				event.Fail(AuditOutcomeDenied, err)
+				h.Auditor.Record(event)
 			}
-			h.Logger.Debugf("Modified statement received from SQL handler: %s", newStmt)
+			span.SetStatus(codes.Error, err.Error())
+			return h.handleError(err, "28000", "error while handling SQL statement")
+		}
+		h.Logger.Debugf("Modified statement received from SQL handler: %s", newStmt)
+		if event != nil && msg.Type == 'Q' {
+			event.RewrittenSQL = newStmt
+		}
+
+		msg = &pgwire.Message{Type: msg.Type, Body: append([]byte(newStmt), 0)}
+	}
 
-			data = append([]byte(newStmt), 0)
-			size = createPacketSize(len(data) + 4)
+	h.upstreamMutex.Lock()
+	defer h.upstreamMutex.Unlock()
+	if h.upstream == nil {
+		if h.Pool == nil || h.Pool.Mode != PoolModeTransaction {
+			return fmt.Errorf("connection to the destination is closed")
 		}
 
-		err = h.write(append(op, append(size, data...)...), "upstream")
+		// Read-only transactions may run on a replica
+		readOnly := h.readOnly || (h.ReadOnlyRouting && msg.Type == 'Q' && isReadOnlyTransaction(stmt))
+		_, acquireSpan := tracer().Start(ctx, "PostgresHandler.acquireUpstream")
+		err = h.acquireUpstream(readOnly)
+		endSpan(acquireSpan, err)
 		if err != nil {
-			h.Logger.Errorf("Error writing to upstream: %v", err)
-			break
+			if event != nil {
+				event.Fail(AuditOutcomeError, err)
+				h.Auditor.Record(event)
+			}
+			span.SetStatus(codes.Error, err.Error())
+			return h.handleError(err, "53300", "error acquiring a connection to the destination")
 		}
 	}
+
+	switch msg.Type {
+	case 'P', 'B', 'E', 'D', 'C', 'H':
+		h.unsynced.Store(true)
+	case 'S':
+		h.unsynced.Store(false)
+	}
+	if msg.Type == 'Q' || msg.Type == 'S' {
+		_, executeSpan := tracer().Start(ctx, "PostgresHandler.execute")
+		h.pending.push(&pendingStatement{query: msg.Type == 'Q', started: time.Now(), event: event, span: executeSpan})
+	}
+	if msg.Type == 'E' && event != nil {
+		h.pending.push(&pendingStatement{execute: true, started: time.Now(), event: event})
+	}
+	if label := h.metrics.label(); label != "" {
+		bytesProxiedTotal.WithLabelValues(label, "upstream").Add(float64(msg.Size()))
+	}
+
+	err = h.send("upstream", msg)
+	if err != nil {
+		h.Logger.Errorf("Error writing to upstream: %v", err)
+		return err
+	}
+	return nil
 }
@@ -1,8 +1,10 @@
 package foodme
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/auxten/postgresql-parser/pkg/sql/parser"
 	"github.com/auxten/postgresql-parser/pkg/sql/sem/tree"
@@ -17,19 +19,28 @@ type PostgresSQLHandler struct {
 	withTables   map[string]string
 	handleFailed bool
 	handleError  error
+	ctx          context.Context
 	userInfo     map[string]interface{}
+	decisions    []*PermissionDecision
+
+	// DDL decisions of the session, the permission agent is shared
+	createAllowed bool
+	updateAllowed bool
+	deleteAllowed bool
 }
 
 func NewPostgresSQLHandler(logger *logrus.Logger, pAgent IPermissionAgent) *PostgresSQLHandler {
 	return &PostgresSQLHandler{Logger: logger, PermissionAgent: pAgent, withTables: make(map[string]string)}
 }
 
-func (p *PostgresSQLHandler) Handle(sql string, userInfo map[string]interface{}) (string, error) {
+func (p *PostgresSQLHandler) Handle(ctx context.Context, sql string, userInfo map[string]interface{}) (string, error) {
 	if p.PermissionAgent == nil {
 		return sql, nil
 	}
 
+	p.ctx = ctx
 	p.userInfo = userInfo
+	p.decisions = []*PermissionDecision{}
 
 	statements, err := parser.Parse(sql)
 	if err != nil {
@@ -53,19 +64,22 @@ func HandleTables(ctx interface{}, node interface{}) (stop bool) {
 			h.withTables[cte.Name.Alias.String()] = ""
 		}
 	case *tree.CreateTable, *tree.CreateChangefeed, *tree.CreateDatabase, *tree.CreateIndex, *tree.CreateRole, *tree.CreateSchema, *tree.CreateSequence, *tree.CreateView, *tree.CreateStats, *tree.CreateStatsOptions:
-		if !h.PermissionAgent.CreateAllowed() {
+		h.recordDecision(&PermissionDecision{Operation: "create", Allowed: h.createAllowed})
+		if !h.createAllowed {
 			h.handleFailed = true
 			h.handleError = fmt.Errorf("create operation is not allowed")
 			return true
 		}
 	case *tree.Update, *tree.UpdateExpr, *tree.Insert, *tree.AlterIndex, *tree.AlterIndexPartitionBy, *tree.AlterRole, *tree.AlterSequence, *tree.AlterTable:
-		if !h.PermissionAgent.UpdateAllowed() {
+		h.recordDecision(&PermissionDecision{Operation: "update", Allowed: h.updateAllowed})
+		if !h.updateAllowed {
 			h.handleFailed = true
 			h.handleError = fmt.Errorf("update operation is not allowed")
 			return true
 		}
 	case *tree.Delete, *tree.DropDatabase, *tree.DropIndex, *tree.DropRole, *tree.DropSequence, *tree.DropTable, *tree.DropView:
-		if !h.PermissionAgent.DeleteAllowed() {
+		h.recordDecision(&PermissionDecision{Operation: "delete", Allowed: h.deleteAllowed})
+		if !h.deleteAllowed {
 			h.handleFailed = true
 			h.handleError = fmt.Errorf("delete operation is not allowed")
 			return true
@@ -77,7 +91,10 @@ func HandleTables(ctx interface{}, node interface{}) (stop bool) {
 				if _, ok := h.withTables[tb.TableName]; ok {
 					continue
 				}
-				filters, err := h.PermissionAgent.SelectFilters(tb.TableName, tb.TableAlias, h.userInfo)
+				started := time.Now()
+				filters, err := h.PermissionAgent.SelectFilters(h.ctx, tb.TableName, tb.TableAlias, h.userInfo)
+				observeDuration(permissionAgentDuration, started, "select")
+				h.recordDecision(newSelectDecision(tb.TableName, filters, err))
 				if err != nil {
 					h.Logger.Errorf("failed to get filters for table %s: %v", tb.TableName, err)
 					h.handleFailed = true
@@ -131,18 +148,45 @@ func HandleTables(ctx interface{}, node interface{}) (stop bool) {
 	return false
 }
 
-func (p *PostgresSQLHandler) SetDDL(userInfo map[string]interface{}) error {
-	err := p.PermissionAgent.SetCreateAllowed(userInfo)
+func (p *PostgresSQLHandler) recordDecision(decision *PermissionDecision) {
+	observeDecision(decision)
+	p.decisions = append(p.decisions, decision)
+}
+
+func (p *PostgresSQLHandler) Decisions() []*PermissionDecision {
+	return p.decisions
+}
+
+func newSelectDecision(tableName string, filters *SelectFilters, err error) *PermissionDecision {
+	decision := &PermissionDecision{Table: tableName, Operation: "select", Allowed: err == nil}
+	if filters == nil {
+		return decision
+	}
+	decision.Filters = append(decision.Filters, filters.WhereFilters...)
+	for _, f := range filters.JoinFilters {
+		decision.Filters = append(decision.Filters, fmt.Sprintf("JOIN %s ON %s", f.TableName, f.Conditions))
+	}
+	return decision
+}
+
+func (p *PostgresSQLHandler) SetDDL(ctx context.Context, userInfo map[string]interface{}) (err error) {
+	started := time.Now()
+	p.createAllowed, err = p.PermissionAgent.DDLAllowed(ctx, "create", userInfo)
+	observeDuration(permissionAgentDuration, started, "create")
 	if err != nil {
 		return err
 	}
 
-	err = p.PermissionAgent.SetUpdateAllowed(userInfo)
+	started = time.Now()
+	p.updateAllowed, err = p.PermissionAgent.DDLAllowed(ctx, "update", userInfo)
+	observeDuration(permissionAgentDuration, started, "update")
 	if err != nil {
 		return err
 	}
 
-	err = p.PermissionAgent.SetDeleteAllowed(userInfo)
+	started = time.Now()
+	p.deleteAllowed, err = p.PermissionAgent.DDLAllowed(ctx, "delete", userInfo)
+	observeDuration(permissionAgentDuration, started, "delete")
 	if err != nil {
 		return err
 	}
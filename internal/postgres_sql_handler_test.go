@@ -1,6 +1,7 @@
 package foodme
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -29,7 +30,7 @@ type DummyAgent struct {
 	onlyForTable  string
 }
 
-func (d *DummyAgent) SelectFilters(tableName string, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
+func (d *DummyAgent) SelectFilters(ctx context.Context, tableName string, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
 	res := []string{}
 	for _, filter := range d.Filters {
 		if tableAlias != "" {
@@ -50,92 +51,52 @@ func (d *DummyAgent) SelectFilters(tableName string, tableAlias string, userInfo
 	}
 }
 
-func (d *DummyAgent) CreateAllowed() bool {
-	return d.create
-}
-
-func (d *DummyAgent) UpdateAllowed() bool {
-	return d.update
-}
-
-func (d *DummyAgent) DeleteAllowed() bool {
-	return d.delete
-}
-
-func (d *DummyAgent) SetCreateAllowed(userInfo map[string]interface{}) error {
-	if d.setCreateFail {
-		return fmt.Errorf("failed to set create allowed")
-	}
-	return nil
-}
-
-func (d *DummyAgent) SetUpdateAllowed(userInfo map[string]interface{}) error {
-	if d.setUpdateFail {
-		return fmt.Errorf("failed to set update allowed")
+func (d *DummyAgent) DDLAllowed(ctx context.Context, operation string, userInfo map[string]interface{}) (bool, error) {
+	switch operation {
+	case "create":
+		if d.setCreateFail {
+			return false, fmt.Errorf("failed to set create allowed")
+		}
+		return d.create, nil
+	case "update":
+		if d.setUpdateFail {
+			return false, fmt.Errorf("failed to set update allowed")
+		}
+		return d.update, nil
+	case "delete":
+		if d.setDeleteFail {
+			return false, fmt.Errorf("failed to set delete allowed")
+		}
+		return d.delete, nil
 	}
-	return nil
+	return false, fmt.Errorf("unexpected operation: %s", operation)
 }
 
-func (d *DummyAgent) SetDeleteAllowed(userInfo map[string]interface{}) error {
-	if d.setDeleteFail {
-		return fmt.Errorf("failed to set delete allowed")
-	}
+func (d *DummyAgent) Ping() error {
 	return nil
 }
 
-func (a *FailingAgent) SelectFilters(tableName string, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
+func (a *FailingAgent) SelectFilters(ctx context.Context, tableName string, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
 	return nil, fmt.Errorf("no filters")
 }
 
-func (a *FailingAgent) CreateAllowed() bool {
-	return false
+func (a *FailingAgent) DDLAllowed(ctx context.Context, operation string, userInfo map[string]interface{}) (bool, error) {
+	return false, nil
 }
 
-func (a *FailingAgent) UpdateAllowed() bool {
-	return false
-}
-
-func (a *FailingAgent) DeleteAllowed() bool {
-	return false
-}
-
-func (a *FailingAgent) SetCreateAllowed(userInfo map[string]interface{}) error {
+func (a *FailingAgent) Ping() error {
 	return nil
 }
 
-func (a *FailingAgent) SetUpdateAllowed(userInfo map[string]interface{}) error {
-	return nil
-}
-
-func (a *FailingAgent) SetDeleteAllowed(userInfo map[string]interface{}) error {
-	return nil
-}
-
-func (a *BadFiltersAgent) SelectFilters(tableName string, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
+func (a *BadFiltersAgent) SelectFilters(ctx context.Context, tableName string, tableAlias string, userInfo map[string]interface{}) (*SelectFilters, error) {
 	return &SelectFilters{WhereFilters: []string{"select * from abhram"}, JoinFilters: []*JoinFilter{}}, nil
 }
 
-func (a *BadFiltersAgent) CreateAllowed() bool {
-	return false
-}
-
-func (a *BadFiltersAgent) UpdateAllowed() bool {
-	return false
-}
-
-func (a *BadFiltersAgent) DeleteAllowed() bool {
-	return false
-}
-
-func (a *BadFiltersAgent) SetCreateAllowed(userInfo map[string]interface{}) error {
-	return nil
-}
-
-func (a *BadFiltersAgent) SetUpdateAllowed(userInfo map[string]interface{}) error {
-	return nil
+func (a *BadFiltersAgent) DDLAllowed(ctx context.Context, operation string, userInfo map[string]interface{}) (bool, error) {
+	return false, nil
 }
 
-func (a *BadFiltersAgent) SetDeleteAllowed(userInfo map[string]interface{}) error {
+func (a *BadFiltersAgent) Ping() error {
 	return nil
 }
 
@@ -143,7 +104,7 @@ func TestHandleSQLWithoutAgent(t *testing.T) {
 	log := logrus.StandardLogger()
 	sql := "SELECT * FROM tablename"
 	handler := NewPostgresSQLHandler(log, nil)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, sql)
 }
@@ -153,7 +114,7 @@ func TestHandleBadSQL(t *testing.T) {
 	sql := "not a sql statement"
 	agent := &DummyAgent{}
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.Error(t, err, "at or near \"not\": syntax error")
 	assert.Equal(t, res, sql)
 }
@@ -163,7 +124,7 @@ func TestFailToGetFilters(t *testing.T) {
 	sql := "SELECT * FROM tablename"
 	agent := &FailingAgent{}
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.Error(t, err, "failed to get filters for table tablename: no filters")
 	assert.Equal(t, res, sql)
 }
@@ -173,7 +134,7 @@ func TestBadFilters(t *testing.T) {
 	sql := "SELECT * FROM tablename"
 	agent := &BadFiltersAgent{}
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.Error(t, err, "failed to parse where statement for table tablename: at or near \"select\": syntax error")
 	assert.Equal(t, res, sql)
 }
@@ -188,7 +149,7 @@ func TestHandleSimpleSQL(t *testing.T) {
 		},
 	}
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, "SELECT * FROM tablename WHERE (age >= 18) AND (affiliation != 'royalty')")
 }
@@ -204,7 +165,7 @@ func TestHandleExistsSQL(t *testing.T) {
 		onlyForTable: "tablename",
 	}
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, "SELECT * FROM tablename WHERE EXISTS (SELECT 1 FROM othertable WHERE ((tablename.id = othertable.id) AND (othertable.othercolumn >= 18))) AND (affiliation != 'royalty')")
 }
@@ -219,7 +180,7 @@ func TestHandleSimpleJoinSQL(t *testing.T) {
 		},
 	}
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, "SELECT * FROM tablename INNER JOIN othertable ON (tablename.id = othertable.id) AND (tablename.secondid = othertable.secondid) INNER JOIN thirdtable ON (tablename.id = thirdtable.id) AND (tablename.thirdid = thirdtable.thirdid)")
 
@@ -228,7 +189,7 @@ func TestHandleSimpleJoinSQL(t *testing.T) {
 		JoinFilters: []JoinFilter{{TableName: "othertable", Conditions: "just a bad condition"}},
 	}
 	handler = NewPostgresSQLHandler(log, agent)
-	_, err = handler.Handle(sql, nil)
+	_, err = handler.Handle(context.Background(), sql, nil)
 	assert.Error(t, err, "failed to parse join statement for table tablename: at or near \"a\": syntax error")
 
 	// Both where and filter conditions together
@@ -243,7 +204,7 @@ func TestHandleSimpleJoinSQL(t *testing.T) {
 		},
 	}
 	handler = NewPostgresSQLHandler(log, agent)
-	res, err = handler.Handle(sql, nil)
+	res, err = handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, "SELECT * FROM tablename INNER JOIN othertable ON (tablename.id = othertable.id) AND (tablename.secondid = othertable.secondid) INNER JOIN thirdtable ON (tablename.id = thirdtable.id) AND (tablename.thirdid = thirdtable.thirdid) WHERE (age >= 18) AND (affiliation != 'royalty')")
 }
@@ -253,7 +214,7 @@ func TestHandleAllowSQL(t *testing.T) {
 	sql := "SELECT * FROM tablename"
 	agent := &DummyAgent{Filters: []ColFilter{}}
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, sql)
 }
@@ -395,7 +356,7 @@ ORDER BY
     e.employee_id;`
 	sqlRes := `WITH total_hours AS (SELECT ep.employee_id, sum(ep.hours_worked) AS total_hours FROM employee_projects AS ep WHERE ep.minifield = mine GROUP BY ep.employee_id), avg_department_salary AS (SELECT e.department_id, avg(e.salary) AS avg_salary FROM employees AS e WHERE e.minifield = mine GROUP BY e.department_id), latest_salary AS (SELECT s.employee_id, max(s.salary_date) AS latest_salary_date, max(s.salary_amount) AS latest_salary_amount FROM salaries AS s WHERE s.minifield = mine GROUP BY s.employee_id), latest_bonus AS (SELECT b.employee_id, max(b.bonus_date) AS latest_bonus_date, max(b.bonus_amount) AS latest_bonus_amount FROM bonuses AS b WHERE b.minifield = mine GROUP BY b.employee_id) SELECT e.employee_id, e.first_name, e.last_name, d.department_name, COALESCE(t.total_hours, 0) AS total_hours_worked, COALESCE(l.latest_salary_amount, e.salary) AS current_salary, COALESCE(lb.latest_bonus_amount, 0) AS latest_bonus, ads.avg_salary AS department_avg_salary, (CASE WHEN COALESCE(l.latest_salary_amount, e.salary) > ads.avg_salary THEN 'Above Average' WHEN COALESCE(l.latest_salary_amount, e.salary) = ads.avg_salary THEN 'Average' ELSE 'Below Average' END) AS salary_comparison FROM employees AS e LEFT JOIN departments AS d ON e.department_id = d.department_id LEFT JOIN total_hours AS t ON e.employee_id = t.employee_id LEFT JOIN latest_salary AS l ON e.employee_id = l.employee_id LEFT JOIN latest_bonus AS lb ON e.employee_id = lb.employee_id LEFT JOIN avg_department_salary AS ads ON e.department_id = ads.department_id WHERE (d.minifield = mine) AND ((e.minifield = mine) AND (EXISTS (SELECT 1 FROM employee_projects AS ep WHERE (ep.minifield = mine) AND (ep.employee_id = e.employee_id)) AND (NOT EXISTS (SELECT 1 FROM projects AS p WHERE (p.minifield = mine) AND (p.end_date < current_date()))))) UNION SELECT e.employee_id, e.first_name, e.last_name, d.department_name, 0 AS total_hours_worked, COALESCE(l.latest_salary_amount, e.salary) AS current_salary, COALESCE(lb.latest_bonus_amount, 0) AS latest_bonus, ads.avg_salary AS department_avg_salary, (CASE WHEN COALESCE(l.latest_salary_amount, e.salary) > ads.avg_salary THEN 'Above Average' WHEN COALESCE(l.latest_salary_amount, e.salary) = ads.avg_salary THEN 'Average' ELSE 'Below Average' END) AS salary_comparison FROM employees AS e LEFT JOIN departments AS d ON e.department_id = d.department_id LEFT JOIN latest_salary AS l ON e.employee_id = l.employee_id LEFT JOIN latest_bonus AS lb ON e.employee_id = lb.employee_id LEFT JOIN avg_department_salary AS ads ON e.department_id = ads.department_id WHERE (d.minifield = mine) AND ((e.minifield = mine) AND ((NOT EXISTS (SELECT 1 FROM employee_projects AS ep WHERE (ep.minifield = mine) AND (ep.employee_id = e.employee_id))) AND EXISTS (SELECT 1 FROM bonuses AS b WHERE (b.minifield = mine) AND (b.employee_id = e.employee_id)))) ORDER BY e.employee_id`
 	handler := NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, sqlRes)
 }
@@ -411,12 +372,13 @@ func TestCreate(t *testing.T) {
 	sql := "CREATE TABLE test (id INT8)"
 	agent := &DummyAgent{Filters: []ColFilter{}}
 	handler := NewPostgresSQLHandler(log, agent)
-	_, err := handler.Handle(sql, nil)
+	_, err := handler.Handle(context.Background(), sql, nil)
 	assert.Error(t, err, "create operation is not allowed")
 
 	agent.create = true
 	handler = NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	assert.NilError(t, handler.SetDDL(context.Background(), nil))
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, sql)
 }
@@ -426,12 +388,13 @@ func TestUpdate(t *testing.T) {
 	sql := "UPDATE test SET age = 18 WHERE name = 'john'"
 	agent := &DummyAgent{Filters: []ColFilter{}}
 	handler := NewPostgresSQLHandler(log, agent)
-	_, err := handler.Handle(sql, nil)
+	_, err := handler.Handle(context.Background(), sql, nil)
 	assert.Error(t, err, "update operation is not allowed")
 
 	agent.update = true
 	handler = NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	assert.NilError(t, handler.SetDDL(context.Background(), nil))
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, sql)
 }
@@ -441,12 +404,13 @@ func TestDelete(t *testing.T) {
 	sql := "DROP DATABASE test"
 	agent := &DummyAgent{Filters: []ColFilter{}}
 	handler := NewPostgresSQLHandler(log, agent)
-	_, err := handler.Handle(sql, nil)
+	_, err := handler.Handle(context.Background(), sql, nil)
 	assert.Error(t, err, "delete operation is not allowed")
 
 	agent.delete = true
 	handler = NewPostgresSQLHandler(log, agent)
-	res, err := handler.Handle(sql, nil)
+	assert.NilError(t, handler.SetDDL(context.Background(), nil))
+	res, err := handler.Handle(context.Background(), sql, nil)
 	assert.NilError(t, err)
 	assert.Equal(t, res, sql)
 }
@@ -457,20 +421,49 @@ func TestSetDDL(t *testing.T) {
 	handler := NewPostgresSQLHandler(log, agent)
 
 	agent.setCreateFail = true
-	err := handler.SetDDL(nil)
+	err := handler.SetDDL(context.Background(), nil)
 	assert.Error(t, err, "failed to set create allowed")
 
 	agent.setCreateFail = false
 	agent.setUpdateFail = true
-	err = handler.SetDDL(nil)
+	err = handler.SetDDL(context.Background(), nil)
 	assert.Error(t, err, "failed to set update allowed")
 
 	agent.setUpdateFail = false
 	agent.setDeleteFail = true
-	err = handler.SetDDL(nil)
+	err = handler.SetDDL(context.Background(), nil)
 	assert.Error(t, err, "failed to set delete allowed")
 
 	agent.setDeleteFail = false
-	err = handler.SetDDL(nil)
+	err = handler.SetDDL(context.Background(), nil)
 	assert.NilError(t, err)
 }
+
+func TestHandleSQLDecisions(t *testing.T) {
+	log := logrus.StandardLogger()
+	agent := &DummyAgent{
+		Filters:     []ColFilter{{ColumnName: "owner", ColumnValue: "'bob'", Operator: "="}},
+		JoinFilters: []JoinFilter{{TableName: "access", Conditions: "access.pet_id = pets.id"}},
+		update:      true,
+	}
+	handler := NewPostgresSQLHandler(log, agent)
+	assert.NilError(t, handler.SetDDL(context.Background(), nil))
+
+	_, err := handler.Handle(context.Background(), "SELECT * FROM pets", nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, handler.Decisions(), []*PermissionDecision{{
+		Table:     "pets",
+		Operation: "select",
+		Allowed:   true,
+		Filters:   []string{"owner = 'bob'", "JOIN access ON access.pet_id = pets.id"},
+	}})
+
+	_, err = handler.Handle(context.Background(), "UPDATE pets SET name = 'alice'", nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, handler.Decisions(), []*PermissionDecision{{Operation: "update", Allowed: true}})
+
+	handler = NewPostgresSQLHandler(log, &FailingAgent{})
+	_, err = handler.Handle(context.Background(), "SELECT * FROM pets", nil)
+	assert.Error(t, err, "failed to get filters for table pets: no filters")
+	assert.DeepEqual(t, handler.Decisions(), []*PermissionDecision{{Table: "pets", Operation: "select", Allowed: false}})
+}
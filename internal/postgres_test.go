@@ -1,12 +1,24 @@
 package foodme
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ryshoooo/food-me/internal/pgwire"
 	"github.com/sirupsen/logrus"
+	"github.com/xdg-go/scram"
 	"gotest.tools/v3/assert"
 )
 
@@ -16,9 +28,11 @@ type MockNetConn struct {
 	Responses   [][]byte
 	ResponseIdx int
 	Writes      [][]byte
+	Closed      bool
 }
 
 func (m *MockNetConn) Close() error {
+	m.Closed = true
 	return nil
 }
 
@@ -30,17 +44,21 @@ func (m *MockNetConn) RemoteAddr() net.Addr {
 	return nil
 }
 
+// Read returns the responses one by one, as the segments of a stream. An
+// empty response closes the stream.
 func (m *MockNetConn) Read(buff []byte) (int, error) {
 	if m.FailRead {
 		return 0, fmt.Errorf("read failed")
-	} else {
-		if len(buff) != len(m.Responses[m.ResponseIdx]) {
-			return 0, fmt.Errorf("buffer size mismatch: %d != %d", len(buff), len(m.Responses[m.ResponseIdx]))
-		}
-		copy(buff, m.Responses[m.ResponseIdx])
+	}
+	if m.ResponseIdx >= len(m.Responses) || len(m.Responses[m.ResponseIdx]) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buff, m.Responses[m.ResponseIdx])
+	m.Responses[m.ResponseIdx] = m.Responses[m.ResponseIdx][n:]
+	if len(m.Responses[m.ResponseIdx]) == 0 {
 		m.ResponseIdx++
-		return len(buff), nil
 	}
+	return n, nil
 }
 
 func (m *MockNetConn) SetDeadline(time.Time) error {
@@ -86,118 +104,809 @@ func TestPGHandlerStartup(t *testing.T) {
 	res, err = handler.startup()
 	assert.NilError(t, err)
 	assert.DeepEqual(t, res, []byte{0, 0, 0, 9})
+	assert.Equal(t, len(mc.Writes), 0)
 
 	// Fail mid-startup
 	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {}}}
 	handler.client = mc
 	res, err = handler.startup()
-	assert.Error(t, err, "buffer size mismatch: 4 != 0")
+	assert.Error(t, err, "EOF")
 	assert.DeepEqual(t, res, []byte{})
 
-	// Fail write to upstream
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}}}
-	mu := &MockNetConn{FailWrite: true}
+	// N response - client write fail
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 47}}, FailWrite: true}
 	handler.client = mc
-	handler.upstream = mu
 	res, err = handler.startup()
 	assert.Error(t, err, "write failed")
 	assert.DeepEqual(t, res, []byte{})
 
-	// Fail read from upstream
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}}}
-	mu = &MockNetConn{Responses: [][]byte{{}}}
+	// N response - client read fail
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 47}, {}}}
 	handler.client = mc
-	handler.upstream = mu
 	res, err = handler.startup()
-	assert.Error(t, err, "buffer size mismatch: 1 != 0")
+	assert.Error(t, err, "EOF")
 	assert.DeepEqual(t, res, []byte{})
 
-	// Bad PG response to startup
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}}}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("Q")}}
+	// N response - OK, the upstream is not involved
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 47}, {0, 0, 0, 1}}}
 	handler.client = mc
-	handler.upstream = mu
 	res, err = handler.startup()
-	assert.Error(t, err, "unexpected response from upstream: [81]")
-	assert.DeepEqual(t, res, []byte{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, res, []byte{0, 0, 0, 1})
+	assert.DeepEqual(t, mc.Writes, [][]byte{[]byte("N")})
+	assert.Assert(t, handler.upstream == nil)
 
-	// N response - client write fail
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}}, FailWrite: true}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("N")}}
-	handler.client = mc
-	handler.upstream = mu
-	res, err = handler.startup()
-	assert.Error(t, err, "write failed")
-	assert.DeepEqual(t, res, []byte{})
+	// GSSAPI encryption and TLS are declined in either order
+	for _, order := range [][][]byte{{{4, 210, 22, 48}, {4, 210, 22, 47}}, {{4, 210, 22, 47}, {4, 210, 22, 48}}} {
+		mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, order[0], {0, 0, 0, 8}, order[1], {0, 0, 0, 1}}}
+		handler.client = mc
+		res, err = handler.startup()
+		assert.NilError(t, err)
+		assert.DeepEqual(t, res, []byte{0, 0, 0, 1})
+		assert.DeepEqual(t, mc.Writes, [][]byte{[]byte("N"), []byte("N")})
+	}
 
-	// N response - client read fail
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}, {}}}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("N")}}
+	// Each of them is requested once
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 48}, {0, 0, 0, 8}, {4, 210, 22, 48}}}
 	handler.client = mc
-	handler.upstream = mu
 	res, err = handler.startup()
-	assert.Error(t, err, "buffer size mismatch: 4 != 0")
+	assert.Error(t, err, "unexpected encryption request: 80877104")
 	assert.DeepEqual(t, res, []byte{})
 
-	// N response - OK
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}, {0, 0, 0, 1}}}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("N")}}
-	handler.client = mc
-	handler.upstream = mu
+	// Direct TLS without TLS enabled
+	handler.client = &MockNetConn{Responses: [][]byte{{22, 3, 1, 2}}}
 	res, err = handler.startup()
-	assert.NilError(t, err)
-	assert.DeepEqual(t, res, []byte{0, 0, 0, 1})
+	assert.Error(t, err, "direct TLS connection is not supported without TLS enabled")
+	assert.DeepEqual(t, res, []byte{})
 }
 
 func TestPGHandlerStartupTLS(t *testing.T) {
 	logger := logrus.StandardLogger()
 	handler := NewPostgresHandler("addr", "user", "pwd", nil, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "", false)
 
-	// Client write fail
-	mc := &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}}, FailWrite: true}
-	mu := &MockNetConn{Responses: [][]byte{[]byte("S")}}
+	// TLS enabled, fail to load keys
+	handler.TLSEnabled = true
+	mc := &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 47}, {0, 0, 0, 1}}}
 	handler.client = mc
-	handler.upstream = mu
 	res, err := handler.startup()
+	assert.Error(t, err, "open : no such file or directory")
+	assert.DeepEqual(t, res, []byte{})
+
+	// TLS OK, fail to write to client
+	handler.TLSCertificateFile = "../data/cert.pem"
+	handler.TLSCertificateKeyFile = "../data/key.pem"
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 47}, {0, 0, 0, 1}}, FailWrite: true}
+	handler.client = mc
+	res, err = handler.startup()
 	assert.Error(t, err, "write failed")
 	assert.DeepEqual(t, res, []byte{})
 
-	// TLS disabled, OK
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}, {0, 0, 0, 1}}}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("S")}}
+	// TLS OK (expected failure as tests dont do TLS exchange)
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 47}, {0}}}
+	handler.client = mc
+	res, err = handler.startup()
+	assert.Error(t, err, "unexpected EOF")
+	assert.DeepEqual(t, res, []byte{})
+	assert.DeepEqual(t, mc.Writes, [][]byte{[]byte("S")})
+
+	// The bytes sent ahead of the handshake are rejected
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 47, 'Q', 0, 0, 0, 4}}}
+	handler.client = mc
+	_, err = handler.startup()
+	assert.Error(t, err, "received unencrypted data after SSL request")
+	assert.Equal(t, len(mc.Writes), 0)
+
+	// GSSAPI encryption is declined before TLS
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 48}, {0, 0, 0, 8}, {4, 210, 22, 47}, {0}}}
+	handler.client = mc
+	res, err = handler.startup()
+	assert.Error(t, err, "unexpected EOF")
+	assert.DeepEqual(t, mc.Writes, [][]byte{[]byte("N"), []byte("S")})
+
+	// GSSAPI encryption is still answered with N
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 48}, {0, 0, 0, 1}}}
 	handler.client = mc
-	handler.upstream = mu
 	res, err = handler.startup()
 	assert.NilError(t, err)
 	assert.DeepEqual(t, res, []byte{0, 0, 0, 1})
+	assert.DeepEqual(t, mc.Writes, [][]byte{[]byte("N")})
 
-	// TLS enabled, fail to load keys
-	handler.TLSEnabled = true
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}, {0, 0, 0, 1}}}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("S")}}
+	// TLS required
+	handler.TLSRequired = true
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {4, 210, 22, 48}, {0, 0, 0, 1}}}
 	handler.client = mc
-	handler.upstream = mu
 	res, err = handler.startup()
-	assert.Error(t, err, "open : no such file or directory")
+	assert.Error(t, err, "TLS connection is required")
 	assert.DeepEqual(t, res, []byte{})
 
-	// TLS OK, fail to write to client
-	handler.TLSCertificateFile = "../data/cert.pem"
-	handler.TLSCertificateKeyFile = "../data/key.pem"
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}, {0, 0, 0, 1}}, FailWrite: true}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("S")}}
+	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 9}}}
 	handler.client = mc
-	handler.upstream = mu
 	res, err = handler.startup()
-	assert.Error(t, err, "write failed")
+	assert.Error(t, err, "TLS connection is required")
 	assert.DeepEqual(t, res, []byte{})
+}
 
-	// TLS OK (expected failure as tests dont do TLS exchange)
-	mc = &MockNetConn{Responses: [][]byte{{0, 0, 0, 8}, {1, 2, 3, 4}, {0}}}
-	mu = &MockNetConn{Responses: [][]byte{[]byte("S")}}
+func TestPGHandlerNegotiateUpstreamTLS(t *testing.T) {
+	logger := logrus.StandardLogger()
+	handler := NewPostgresHandler("addr", "user", "pwd", nil, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "", false)
+
+	// Disabled, nothing is requested
+	handler.UpstreamTLSMode = TLSModeDisable
+	mu := &MockNetConn{}
+	handler.upstream = mu
+	assert.NilError(t, handler.negotiateUpstreamTLS())
+	assert.Equal(t, len(mu.Writes), 0)
+
+	// Preferred, the destination refuses TLS
+	handler.UpstreamTLSMode = TLSModePrefer
+	mu = &MockNetConn{Responses: [][]byte{[]byte("N")}}
+	handler.upstream = mu
+	assert.NilError(t, handler.negotiateUpstreamTLS())
+	assert.DeepEqual(t, mu.Writes, [][]byte{{0, 0, 0, 8, 4, 210, 22, 47}})
+	assert.Equal(t, handler.upstream, net.Conn(mu))
+
+	// Fail write to upstream
+	handler.upstream = &MockNetConn{FailWrite: true}
+	assert.Error(t, handler.negotiateUpstreamTLS(), "write failed")
+
+	// Fail read from upstream
+	handler.upstream = &MockNetConn{Responses: [][]byte{{}}}
+	assert.Error(t, handler.negotiateUpstreamTLS(), "EOF")
+
+	// The bytes sent ahead of the handshake are rejected
+	handler.upstream = &MockNetConn{Responses: [][]byte{[]byte("SQ")}}
+	assert.Error(t, handler.negotiateUpstreamTLS(), "received unencrypted data after SSL response")
+
+	// Bad PG response
+	handler.upstream = &MockNetConn{Responses: [][]byte{[]byte("Q")}}
+	assert.Error(t, handler.negotiateUpstreamTLS(), "unexpected response from upstream: [81]")
+
+	// Required, the destination refuses TLS
+	handler.UpstreamTLSMode = TLSModeRequire
+	handler.upstream = &MockNetConn{Responses: [][]byte{[]byte("N")}}
+	assert.Error(t, handler.negotiateUpstreamTLS(), "destination does not support TLS")
+
+	// Accepted, the connection is upgraded
+	handler.upstream = &MockNetConn{Responses: [][]byte{[]byte("S")}}
+	assert.NilError(t, handler.negotiateUpstreamTLS())
+	_, ok := handler.upstream.(*tls.Conn)
+	assert.Assert(t, ok)
+
+	// Bad CA file
+	handler.UpstreamTLSMode = TLSModeVerifyFull
+	handler.UpstreamTLSCAFile = "../data/test_sql.sql"
+	handler.upstream = &MockNetConn{Responses: [][]byte{[]byte("S")}}
+	assert.Error(t, handler.negotiateUpstreamTLS(), "no certificates found in destination TLS CA file: ../data/test_sql.sql")
+}
+
+func TestPGHandlerReadMessages(t *testing.T) {
+	logger := logrus.StandardLogger()
+	handler := NewPostgresHandler("addr", "user", "pwd", nil, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "", false)
+
+	// The messages arriving at once are read one by one
+	handler.client = &MockNetConn{Responses: [][]byte{pgwire.Encode(&pgwire.Query{String: "select 1"}, &pgwire.Query{String: "select 2"})}}
+	msg, err := handler.readFullMessage("client")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg.Body, []byte("select 1\x00"))
+	msg, err = handler.readFullMessage("client")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, msg.Body, []byte("select 2\x00"))
+
+	// The messages of the authentication are limited as in Postgres
+	password := strings.Repeat("x", pgwire.MaxAuthMessageSize)
+	handler.client = &MockNetConn{Responses: [][]byte{pgwire.Encode(&pgwire.PasswordMessage{Password: password})}}
+	_, err = handler.readPassword()
+	assert.Assert(t, errors.Is(err, pgwire.ErrMessageTooLarge))
+	assert.Error(t, err, "message too large: message 'p' of 65536 bytes exceeds the limit of 65535 bytes")
+
+	handler.client = &MockNetConn{Responses: [][]byte{pgwire.Encode(&pgwire.PasswordMessage{Password: password[1:]})}}
+	read, err := handler.readPassword()
+	assert.NilError(t, err)
+	assert.Equal(t, read, password[1:])
+
+	// Unless the configured limit is lower
+	handler.MaxMessageSize = 64
+	handler.client = &MockNetConn{Responses: [][]byte{pgwire.Encode(&pgwire.PasswordMessage{Password: password[:64]})}}
+	_, err = handler.readPassword()
+	assert.Error(t, err, "message too large: message 'p' of 65 bytes exceeds the limit of 64 bytes")
+}
+
+func TestPGHandlerAudit(t *testing.T) {
+	logger := logrus.StandardLogger()
+	handler := NewPostgresHandler("addr", "user", "pwd", nil, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "preferred_username", false)
+	sink := &MockAuditSink{}
+	handler.Auditor = &Auditor{Sink: sink, Logger: logger}
+	handler.database = "pets"
+	handler.user = "some-uuid"
+	handler.userinfo = map[string]interface{}{"sub": "1234", "preferred_username": "bob"}
+
+	query := append([]byte("select * from pets"), 0)
+	escape := append([]byte("set role admin"), 0)
+	mc := &MockNetConn{Responses: [][]byte{
+		{'Q'}, createPacketSize(len(query) + 4), query,
+		{'Q'}, createPacketSize(len(escape) + 4), escape,
+		{'S'}, {0, 0, 0, 5}, {0},
+		{},
+	}}
+	mu := &MockNetConn{}
 	handler.client = mc
 	handler.upstream = mu
-	res, err = handler.startup()
-	assert.Error(t, err, "buffer size mismatch: 576 != 1")
-	assert.DeepEqual(t, res, []byte{})
+	handler.proxyUpstream()
+
+	// Session escape is recorded right away
+	assert.Equal(t, len(sink.Events), 1)
+	assert.Equal(t, sink.Events[0].SQL, "set role admin")
+	assert.Equal(t, sink.Events[0].Outcome, AuditOutcomeDenied)
+	assert.Equal(t, sink.Events[0].Error, "session escape detected")
+	assert.Equal(t, len(mu.Writes), 2)
+
+	// The query is recorded after the upstream is ready for query
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'T', Body: []byte{}})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'C', Body: append([]byte("SELECT 3"), 0)})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+	assert.Equal(t, len(sink.Events), 2)
+	assert.Equal(t, sink.Events[1].SQL, "select * from pets")
+	assert.Equal(t, sink.Events[1].Subject, "1234")
+	assert.Equal(t, sink.Events[1].Username, "bob")
+	assert.Equal(t, sink.Events[1].Database, "pets")
+	assert.Equal(t, sink.Events[1].CommandTag, "SELECT 3")
+	assert.Equal(t, sink.Events[1].Rows, int64(3))
+	assert.Equal(t, sink.Events[1].Outcome, AuditOutcomeSuccess)
+
+	// Sync is not audited
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'E', Body: append([]byte("SERROR\x00Mboom\x00"), 0)})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+	assert.Equal(t, len(sink.Events), 2)
+
+	// Upstream errors are recorded as well
+	handler.pending.push(&pendingStatement{query: true, started: time.Now(), event: handler.newAuditEvent("select 1/0")})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'E', Body: append([]byte("SERROR\x00Mdivision by zero\x00"), 0)})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+	assert.Equal(t, len(sink.Events), 3)
+	assert.Equal(t, sink.Events[2].Outcome, AuditOutcomeError)
+	assert.Equal(t, sink.Events[2].Error, "division by zero")
+}
+
+func TestPGHandlerAuditExtendedQuery(t *testing.T) {
+	logger := logrus.StandardLogger()
+	handler := NewPostgresHandler("addr", "user", "pwd", nil, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "preferred_username", false)
+	sink := &MockAuditSink{}
+	handler.Auditor = &Auditor{Sink: sink, Logger: logger}
+	handler.database = "pets"
+	handler.user = "access_token=secret;refresh_token=secret"
+
+	// Every message is read as its type, length and body
+	responses := [][]byte{}
+	for _, msg := range []pgwire.Encoder{
+		&pgwire.Parse{Name: "s1", Query: "select * from pets where id = $1"},
+		&pgwire.Bind{Portal: "p1", Statement: "s1", Parameters: [][]byte{[]byte("1")}},
+		&pgwire.Execute{Portal: "p1"},
+		&pgwire.Parse{Query: "select 1/0"},
+		&pgwire.Bind{},
+		&pgwire.Execute{},
+		&pgwire.Execute{Portal: "p1"},
+		&pgwire.Close{Kind: 'S', Name: "s1"},
+		&pgwire.Sync{},
+	} {
+		encoded := pgwire.Encode(msg)
+		responses = append(responses, encoded[:1], encoded[1:5], encoded[5:])
+	}
+	handler.client = &MockNetConn{Responses: append(responses, []byte{})}
+	handler.upstream = &MockNetConn{}
+	handler.proxyUpstream()
+	assert.Equal(t, len(sink.Events), 0)
+	_, ok := handler.prepared["s1"]
+	assert.Assert(t, !ok)
+
+	// The executes are recorded with the query of the Parse as they complete
+	handler.trackUpstreamMessage(&pgwire.Message{Type: '1', Body: []byte{}})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: '2', Body: []byte{}})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'C', Body: append([]byte("SELECT 1"), 0)})
+	assert.Equal(t, len(sink.Events), 1)
+	assert.Equal(t, sink.Events[0].SQL, "select * from pets where id = $1")
+	assert.Equal(t, sink.Events[0].CommandTag, "SELECT 1")
+	assert.Equal(t, sink.Events[0].Outcome, AuditOutcomeSuccess)
+	assert.Equal(t, sink.Events[0].Username, "")
+
+	// The executes after an error are skipped by the destination
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'E', Body: append([]byte("SERROR\x00Mdivision by zero\x00"), 0)})
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+	assert.Equal(t, len(sink.Events), 2)
+	assert.Equal(t, sink.Events[1].SQL, "select 1/0")
+	assert.Equal(t, sink.Events[1].Outcome, AuditOutcomeError)
+	assert.Equal(t, sink.Events[1].Error, "division by zero")
+	assert.Assert(t, handler.pending.head() == nil)
+
+	// The startup user is the username of the sessions authenticating on their own
+	handler.user = "bob"
+	assert.Equal(t, handler.newAuditEvent("select 1").Username, "bob")
+}
+
+func TestPGHandlerTracing(t *testing.T) {
+	recorder := setupTestTracing(t)
+	logger := logrus.StandardLogger()
+	handler := NewPostgresHandler("addr", "user", "pwd", nil, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "preferred_username", false)
+	handler.TraceFromSQLComment = true
+
+	query := append([]byte("select 1 /*traceparent='"+testTraceparent+"'*/"), 0)
+	handler.client = &MockNetConn{Responses: [][]byte{{'Q'}, createPacketSize(len(query) + 4), query, {}}}
+	handler.upstream = &MockNetConn{}
+	handler.proxyUpstream()
+	handler.trackUpstreamMessage(&pgwire.Message{Type: 'Z', Body: []byte{'I'}})
+
+	spans := recorder.Ended()
+	assert.Equal(t, len(spans), 2)
+	assert.Equal(t, spans[0].Name(), "PostgresHandler.proxyClientMessage")
+	assert.Equal(t, spans[0].SpanContext().TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, spans[0].Parent().SpanID().String(), "00f067aa0ba902b7")
+	assert.Equal(t, spans[1].Name(), "PostgresHandler.execute")
+	assert.Equal(t, spans[1].Parent().SpanID(), spans[0].SpanContext().SpanID())
+}
+
+// serveSCRAMTestAuth plays the SCRAM exchange of Postgres for the password
+// pwd and reports the GS2 header and the binding data the client sent. Without
+// mechanisms the client is trusted.
+func serveSCRAMTestAuth(conn net.Conn, mechanisms []string, binding scram.ChannelBinding, header chan<- string) error {
+	_, err := readFakeMessage(conn, false)
+	if err != nil {
+		return err
+	}
+	if len(mechanisms) == 0 {
+		_, err = conn.Write(pgwire.Encode(&pgwire.Authentication{Type: pgwire.AuthenticationOk}))
+		return err
+	}
+	request := &pgwire.Authentication{Type: pgwire.AuthenticationSASL, Data: []byte(strings.Join(mechanisms, "\x00") + "\x00\x00")}
+	_, err = conn.Write(pgwire.Encode(request))
+	if err != nil {
+		return err
+	}
+
+	client, err := scram.SHA256.NewClient("", "pwd", "")
+	if err != nil {
+		return err
+	}
+	credentials, err := client.GetStoredCredentialsWithError(scram.KeyFactors{Salt: "salt", Iters: 4096})
+	if err != nil {
+		return err
+	}
+	server, err := scram.SHA256.NewServer(func(string) (scram.StoredCredentials, error) { return credentials, nil })
+	if err != nil {
+		return err
+	}
+	msg, err := readFakeMessage(conn, true)
+	if err != nil {
+		return err
+	}
+	initial := &pgwire.SASLInitialResponse{}
+	err = initial.Decode(msg[5:])
+	if err != nil {
+		return err
+	}
+	conv := server.NewConversation()
+	if initial.Mechanism == scramSHA256Plus {
+		conv = server.NewConversationWithChannelBinding(binding)
+	}
+	serverFirst, err := conv.Step(string(initial.Data))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(pgwire.Encode(&pgwire.Authentication{Type: pgwire.AuthenticationSASLContinue, Data: []byte(serverFirst)}))
+	if err != nil {
+		return err
+	}
+
+	msg, err = readFakeMessage(conn, true)
+	if err != nil {
+		return err
+	}
+	clientFinal := string(msg[5:])
+	channel, _, _ := strings.Cut(strings.TrimPrefix(clientFinal, "c="), ",")
+	sent, _ := base64.StdEncoding.DecodeString(channel)
+	header <- string(sent)
+
+	serverFinal, err := conv.Step(clientFinal)
+	if err != nil {
+		_, err = conn.Write(pgwire.Encode(&pgwire.ErrorResponse{Notice: pgwire.Notice{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"}}))
+		return err
+	}
+	final := &pgwire.Authentication{Type: pgwire.AuthenticationSASLFinal, Data: []byte(serverFinal)}
+	_, err = conn.Write(pgwire.Encode(final, &pgwire.Authentication{Type: pgwire.AuthenticationOk}))
+	return err
+}
+
+func TestPGHandlerSCRAMAuth(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair("../data/cert.pem", "../data/key.pem")
+	assert.NilError(t, err)
+	endPoint := sha256.Sum256(cert.Certificate[0])
+
+	for _, tc := range []struct {
+		name       string
+		password   string
+		tls        bool
+		mode       string
+		mechanisms []string
+		header     string
+		err        string
+	}{
+		{name: "binding preferred", tls: true, mode: ChannelBindingPrefer, mechanisms: []string{scramSHA256Plus, scramSHA256}, header: "p=tls-server-end-point,," + string(endPoint[:])},
+		{name: "binding not offered", tls: true, mode: ChannelBindingPrefer, mechanisms: []string{scramSHA256}, header: "y,,"},
+		{name: "binding disabled", tls: true, mode: ChannelBindingDisable, mechanisms: []string{scramSHA256Plus, scramSHA256}, header: "n,,"},
+		{name: "without TLS", mode: ChannelBindingPrefer, mechanisms: []string{scramSHA256}, header: "n,,"},
+		{name: "binding required", tls: true, mode: ChannelBindingRequire, mechanisms: []string{scramSHA256}, err: "channel binding required, but the destination does not support it: SCRAM-SHA-256"},
+		{name: "trust with binding required", tls: true, mode: ChannelBindingRequire, err: "channel binding required, but the destination authenticated without it"},
+		{name: "wrong password", password: "other", tls: true, mode: ChannelBindingPrefer, mechanisms: []string{scramSHA256Plus, scramSHA256}, err: "error authentication: password authentication failed"},
+		{name: "unsupported mechanism", mode: ChannelBindingPrefer, mechanisms: []string{"SCRAM-SHA-512"}, err: "destination requires an unsupported SASL mechanism: SCRAM-SHA-512"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			if tc.password == "" {
+				tc.password = "pwd"
+			}
+			handler := &PostgresHandler{Username: "user", Password: tc.password, Logger: logrus.StandardLogger(), UpstreamChannelBinding: tc.mode, upstream: client}
+			if tc.tls {
+				handler.upstream = tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+				server = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+			}
+
+			header := make(chan string, 1)
+			served := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				served <- serveSCRAMTestAuth(server, tc.mechanisms, scram.ChannelBinding{Type: scram.ChannelBindingTLSServerEndpoint, Data: endPoint[:]}, header)
+			}()
+
+			err := handler.auth()
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.NilError(t, <-served)
+			assert.Equal(t, <-header, tc.header)
+		})
+	}
+}
+
+func TestPGHandlerPasswordAuth(t *testing.T) {
+	cleartext := [][]byte{{'R'}, {0, 0, 0, 8}, {0, 0, 0, 3}}
+	md5 := [][]byte{{'R'}, {0, 0, 0, 12}, {0, 0, 0, 5, 1, 2, 3, 4}}
+	refused := "destination asked for a cleartext or MD5 password without a verified TLS connection, use the verify-ca or verify-full destination TLS mode"
+	for _, tc := range []struct {
+		name     string
+		request  [][]byte
+		mode     string
+		caFile   string
+		insecure bool
+		password string
+		err      string
+	}{
+		{name: "cleartext unverified", request: cleartext, mode: TLSModePrefer, err: refused},
+		{name: "md5 unverified", request: md5, mode: TLSModeRequire, err: refused},
+		{name: "cleartext verified", request: cleartext, mode: TLSModeVerifyFull, password: "pwd"},
+		{name: "md5 verified by the CA", request: md5, mode: TLSModeRequire, caFile: "../data/cert.pem"},
+		{name: "cleartext allowed", request: cleartext, mode: TLSModePrefer, insecure: true, password: "pwd"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mu := &MockNetConn{Responses: append(tc.request, []byte{'R'}, []byte{0, 0, 0, 8}, []byte{0, 0, 0, 0})}
+			handler := &PostgresHandler{Username: "user", Password: "pwd", Logger: logrus.StandardLogger(), UpstreamTLSMode: tc.mode, UpstreamTLSCAFile: tc.caFile, UpstreamInsecurePasswordAuth: tc.insecure, upstream: mu}
+			err := handler.auth()
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				assert.Equal(t, len(mu.Writes), 1)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, len(mu.Writes), 2)
+			if tc.password != "" {
+				assert.DeepEqual(t, mu.Writes[1], pgwire.Encode(&pgwire.PasswordMessage{Password: tc.password}))
+			}
+		})
+	}
+}
+
+type MockUpstreamHandler struct {
+	Conn net.Conn
+	Err  error
+}
+
+func (m *MockUpstreamHandler) Connect() (net.Conn, error) {
+	return m.Conn, m.Err
+}
+
+func (m *MockUpstreamHandler) ConnectReadOnly() (net.Conn, error) {
+	return m.Conn, m.Err
+}
+
+func TestPGHandlerDialPooled(t *testing.T) {
+	logger := logrus.StandardLogger()
+	upstreamHandler := &MockUpstreamHandler{}
+	handler := NewPostgresHandler("addr", "user", "pwd", upstreamHandler, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "", false)
+
+	// Authentication rejected
+	rejection := pgwire.Encode(&pgwire.ErrorResponse{Notice: pgwire.Notice{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"}})
+	mu := &MockNetConn{Responses: [][]byte{[]byte("N"), rejection[:1], rejection[1:5], rejection[5:]}}
+	upstreamHandler.Conn = mu
+	_, err := handler.dialPooled(PoolKey{Database: "pets"})
+	assert.Error(t, err, "error authentication: password authentication failed")
+	assert.Assert(t, mu.Closed)
+
+	// Connection lost before the session is ready
+	mu = &MockNetConn{Responses: [][]byte{
+		[]byte("N"),
+		{'R'}, {0, 0, 0, 8}, {0, 0, 0, 0},
+		{'S'}, {0, 0, 0, 9}, []byte("a\x00bc\x00"),
+		{},
+	}}
+	upstreamHandler.Conn = mu
+	_, err = handler.dialPooled(PoolKey{Database: "pets"})
+	assert.Error(t, err, "EOF")
+	assert.Assert(t, mu.Closed)
+
+	// OK
+	mu = &MockNetConn{Responses: [][]byte{
+		[]byte("N"),
+		{'R'}, {0, 0, 0, 8}, {0, 0, 0, 0},
+		{'S'}, {0, 0, 0, 9}, []byte("a\x00bc\x00"),
+		{'Z'}, {0, 0, 0, 5}, {'I'},
+	}}
+	upstreamHandler.Conn = mu
+	conn, err := handler.dialPooled(PoolKey{Database: "pets"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(conn.Parameters), 1)
+	assert.Assert(t, !mu.Closed)
+}
+
+func TestPGHandlerPing(t *testing.T) {
+	logger := logrus.StandardLogger()
+	upstreamHandler := &MockUpstreamHandler{Err: fmt.Errorf("connection refused")}
+	handler := NewPostgresHandler("addr", "user", "pwd", upstreamHandler, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "", false)
+
+	// Unreachable destination
+	err := handler.Ping("postgres", time.Second)
+	assert.Error(t, err, "unable to connect to destination: connection refused")
+
+	// Unexpected response to the TLS request
+	mu := &MockNetConn{Responses: [][]byte{[]byte("Q")}}
+	upstreamHandler.Conn, upstreamHandler.Err = mu, nil
+	err = handler.Ping("postgres", time.Second)
+	assert.Error(t, err, "unexpected response from upstream: [81]")
+
+	// Authentication rejected
+	rejection := pgwire.Encode(&pgwire.ErrorResponse{Notice: pgwire.Notice{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"}})
+	mu = &MockNetConn{Responses: [][]byte{[]byte("N"), rejection[:1], rejection[1:5], rejection[5:]}}
+	upstreamHandler.Conn = mu
+	err = handler.Ping("postgres", time.Second)
+	assert.Error(t, err, "error authentication: password authentication failed")
+
+	// OK
+	mu = &MockNetConn{Responses: [][]byte{
+		[]byte("N"),
+		{'R'}, {0, 0, 0, 8}, {0, 0, 0, 0},
+		{'S'}, {0, 0, 0, 9}, []byte("a\x00bc\x00"),
+		{'Z'}, {0, 0, 0, 5}, {'I'},
+	}}
+	upstreamHandler.Conn = mu
+	err = handler.Ping("pets", time.Second)
+	assert.NilError(t, err)
+	assert.Equal(t, handler.database, "pets")
+	assert.DeepEqual(t, mu.Writes[0], []byte{0, 0, 0, 8, 4, 210, 22, 47})
+	assert.DeepEqual(t, mu.Writes[len(mu.Writes)-1], []byte{'X', 0, 0, 0, 4})
+}
+
+func TestPGHandlerInRecovery(t *testing.T) {
+	logger := logrus.StandardLogger()
+	upstreamHandler := &MockUpstreamHandler{Err: fmt.Errorf("connection refused")}
+	handler := NewPostgresHandler("addr", "user", "pwd", upstreamHandler, logger, false, false, false, nil, "clientId", "clientSecret", "token-url", "userinfo-url", false, nil, "", nil, false, "", "", false, "", false)
+
+	// Unreachable destination
+	_, err := handler.InRecovery("postgres", time.Second)
+	assert.Error(t, err, "unable to connect to destination: connection refused")
+
+	authenticated := [][]byte{[]byte("N"), {'R'}, {0, 0, 0, 8}, {0, 0, 0, 0}, {'Z'}, {0, 0, 0, 5}, {'I'}}
+
+	// Replica
+	mu := &MockNetConn{Responses: append(authenticated,
+		[]byte{'T'}, []byte{0, 0, 0, 6}, []byte{0, 1},
+		[]byte{'D'}, []byte{0, 0, 0, 11}, []byte{0, 1, 0, 0, 0, 1, 't'},
+		[]byte{'C'}, []byte{0, 0, 0, 13}, []byte("SELECT 1\x00"),
+		[]byte{'Z'}, []byte{0, 0, 0, 5}, []byte{'I'},
+	)}
+	upstreamHandler.Conn, upstreamHandler.Err = mu, nil
+	inRecovery, err := handler.InRecovery("postgres", time.Second)
+	assert.NilError(t, err)
+	assert.Assert(t, inRecovery)
+	assert.DeepEqual(t, mu.Writes[len(mu.Writes)-2], append([]byte{'Q', 0, 0, 0, 31}, []byte("SELECT pg_is_in_recovery()\x00")...))
+	assert.DeepEqual(t, mu.Writes[len(mu.Writes)-1], []byte{'X', 0, 0, 0, 4})
+
+	// Primary
+	mu = &MockNetConn{Responses: append(authenticated,
+		[]byte{'D'}, []byte{0, 0, 0, 11}, []byte{0, 1, 0, 0, 0, 1, 'f'},
+		[]byte{'Z'}, []byte{0, 0, 0, 5}, []byte{'I'},
+	)}
+	upstreamHandler.Conn = mu
+	inRecovery, err = handler.InRecovery("postgres", time.Second)
+	assert.NilError(t, err)
+	assert.Assert(t, !inRecovery)
+
+	// Query failure
+	mu = &MockNetConn{Responses: append(authenticated,
+		[]byte{'E'}, []byte{0, 0, 0, 10}, []byte("Mnope\x00"),
+		[]byte{'Z'}, []byte{0, 0, 0, 5}, []byte{'I'},
+	)}
+	upstreamHandler.Conn = mu
+	_, err = handler.InRecovery("postgres", time.Second)
+	assert.Error(t, err, "error checking recovery: nope")
+}
+
+// startFakePostgres accepts connections trusting every user. BEGIN and
+// COMMIT statements switch the transaction status of the ReadyForQuery,
+// pg_sleep waits for a cancel.
+func startFakePostgres(t *testing.T) int {
+	port, _ := startCountingFakePostgres(t)
+	return port
+}
+
+// startCountingFakePostgres counts the authenticated connections as well.
+func startCountingFakePostgres(t *testing.T) (int, *atomic.Int32) {
+	connections := &atomic.Int32{}
+	return listenFakePostgres(t, connections, nil), connections
+}
+
+// startRecordingFakePostgres records the simple queries it receives as well.
+func startRecordingFakePostgres(t *testing.T) (int, *fakeQueries) {
+	queries := &fakeQueries{}
+	return listenFakePostgres(t, &atomic.Int32{}, queries), queries
+}
+
+func listenFakePostgres(t *testing.T, connections *atomic.Int32, queries *fakeQueries) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakePostgres(conn, connections, queries)
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// fakeQueries are the simple queries the fake backends received.
+type fakeQueries struct {
+	mutex   sync.Mutex
+	queries []string
+}
+
+func (q *fakeQueries) add(query string) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.queries = append(q.queries, query)
+}
+
+func (q *fakeQueries) List() []string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return append([]string{}, q.queries...)
+}
+
+// fakeBackends maps the keys of the fake backends to their cancels.
+var (
+	fakeBackends    sync.Map
+	fakeBackendPIDs atomic.Uint32
+)
+
+// fakeSetPattern matches the SET statements of the forwarded parameters.
+var fakeSetPattern = regexp.MustCompile(`SET "([^"]+)" TO '([^']*)'`)
+
+func serveFakePostgres(conn net.Conn, connections *atomic.Int32, queries *fakeQueries) {
+	defer conn.Close()
+
+	// Startup, optionally preceded by a TLS request
+	var startup []byte
+	for {
+		var err error
+		startup, err = readFakeMessage(conn, false)
+		if err != nil {
+			return
+		}
+		if len(startup) == 4 && calculatePacketSize(startup) == 80877103 {
+			conn.Write([]byte("N"))
+			continue
+		}
+		if req := (&pgwire.CancelRequest{}); req.Decode(startup) == nil {
+			key := BackendKey{ProcessID: req.ProcessID, SecretKey: req.SecretKey}
+			if canceled, ok := fakeBackends.Load(key); ok {
+				canceled.(chan struct{}) <- struct{}{}
+			}
+			return
+		}
+		break
+	}
+	if calculatePacketSize(startup) != 3<<16 {
+		msg := []byte("SFATAL\x00C0A000\x00Munsupported frontend protocol\x00\x00")
+		conn.Write(append(append([]byte{'E'}, createPacketSize(len(msg)+4)...), msg...))
+		return
+	}
+	connections.Add(1)
+	pid := fakeBackendPIDs.Add(1)
+	key := BackendKey{ProcessID: pid, SecretKey: pid * 7}
+	canceled := make(chan struct{}, 1)
+	fakeBackends.Store(key, canceled)
+	defer fakeBackends.Delete(key)
+	conn.Write([]byte{'R', 0, 0, 0, 8, 0, 0, 0, 0})
+	// Report the settings the session started with
+	params := &pgwire.StartupMessage{}
+	_ = params.Decode(startup)
+	for _, param := range params.Parameters {
+		if param.Key != "user" && param.Key != "database" {
+			conn.Write(pgwire.Encode(&pgwire.ParameterStatus{Name: param.Key, Value: param.Value}))
+		}
+	}
+	conn.Write(key.backendKeyData())
+	conn.Write([]byte{'Z', 0, 0, 0, 5, 'I'})
+
+	status := byte('I')
+	for {
+		msg, err := readFakeMessage(conn, true)
+		if err != nil || msg[0] == 'X' {
+			return
+		}
+		if msg[0] == 'Q' {
+			queries.add(string(bytes.TrimRight(msg[5:], "\x00")))
+		}
+		query := strings.ToUpper(string(bytes.TrimRight(msg[5:], "\x00")))
+		// Report the settings changed by the SET statements
+		for _, match := range fakeSetPattern.FindAllStringSubmatch(string(msg[5:]), -1) {
+			conn.Write(pgwire.Encode(&pgwire.ParameterStatus{Name: match[1], Value: match[2]}))
+		}
+		switch {
+		case strings.HasPrefix(query, "BEGIN"):
+			status = 'T'
+		case query == "COMMIT" || query == "END":
+			status = 'I'
+		case query == "SELECT CURRENT_USER":
+			conn.Write(pgwire.Encode(&pgwire.DataRow{Values: [][]byte{[]byte(params.Parameters.Get("user"))}}))
+		case strings.HasPrefix(query, "SELECT PG_SLEEP"):
+			select {
+			case <-canceled:
+				msg := []byte("SERROR\x00C57014\x00Mcanceling statement due to user request\x00\x00")
+				conn.Write(append(append([]byte{'E'}, createPacketSize(len(msg)+4)...), msg...))
+				conn.Write([]byte{'Z', 0, 0, 0, 5, status})
+				continue
+			case <-time.After(5 * time.Second):
+			}
+		}
+		tag := append([]byte(query), 0)
+		conn.Write(append(append([]byte{'C'}, createPacketSize(len(tag)+4)...), tag...))
+		conn.Write([]byte{'Z', 0, 0, 0, 5, status})
+	}
+}
+
+func readFakeMessage(conn net.Conn, typed bool) ([]byte, error) {
+	header := make([]byte, 4)
+	if typed {
+		header = make([]byte, 5)
+	}
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, calculatePacketSize(header[len(header)-4:])-4)
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		return nil, err
+	}
+	if typed {
+		return append(header, body...), nil
+	}
+	return body, nil
 }
@@ -2,7 +2,14 @@ package foodme
 
 import (
 	"bytes"
+	"fmt"
+	"net"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryshoooo/food-me/internal/pgwire"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func calculatePacketSize(sizebuff []byte) int {
@@ -13,16 +20,6 @@ func createPacketSize(size int) []byte {
 	return []byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}
 }
 
-func checkAuthenticationSuccess(r []byte) bool {
-	if len(r) != 4 {
-		return false
-	}
-	if r[0] != 0 || r[1] != 0 || r[2] != 0 || r[3] != 0 {
-		return false
-	}
-	return true
-}
-
 func getErrorMessage(data []byte) string {
 	parts := bytes.Split(data, []byte{0})
 	for _, p := range parts {
@@ -36,6 +33,29 @@ func getErrorMessage(data []byte) string {
 	return "unknown error"
 }
 
+// parseStartupMessage reads the startup packet without its length, the user
+// is the only parameter required.
+func parseStartupMessage(packet []byte) (*pgwire.StartupMessage, error) {
+	msg := &pgwire.StartupMessage{}
+	err := msg.Decode(packet)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Parameters.Get("user") == "" {
+		return nil, fmt.Errorf("no user name specified in startup packet")
+	}
+	return msg, nil
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
 func isEscapeSession(query string) bool {
 	q := strings.ToLower(query)
 	return strings.Contains(q, "reset session authorization") ||
@@ -44,3 +64,118 @@ func isEscapeSession(query string) bool {
 		strings.Contains(q, "set local authorization") ||
 		strings.Contains(q, "set local role")
 }
+
+// quoteIdentifier quotes a name as an SQL identifier, same as quote_ident of
+// Postgres without skipping the names which need no quoting.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a string as an SQL literal, same as quote_literal of
+// Postgres, the backslashes are escaped regardless of standard_conforming_strings.
+func quoteLiteral(value string) string {
+	quoted := "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	if strings.Contains(value, `\`) {
+		return "E" + strings.ReplaceAll(quoted, `\`, `\\`)
+	}
+	return quoted
+}
+
+// isReadOnlyTransaction detects the statements starting a read-only transaction.
+func isReadOnlyTransaction(query string) bool {
+	q := strings.ToLower(strings.Join(strings.Fields(query), " "))
+	if !strings.HasPrefix(q, "begin") && !strings.HasPrefix(q, "start transaction") {
+		return false
+	}
+	return strings.Contains(q, "read only")
+}
+
+// isAuthenticationOk tells whether the message of the destination logs the
+// session in.
+func isAuthenticationOk(msg *pgwire.Message) bool {
+	auth := &pgwire.Authentication{}
+	return msg.Type == 'R' && auth.Decode(msg.Body) == nil && auth.Type == pgwire.AuthenticationOk
+}
+
+// isParameterOn interprets a boolean setting the way Postgres does.
+func isParameterOn(value string) bool {
+	return contains([]string{"on", "true", "yes", "1"}, strings.ToLower(value))
+}
+
+// isClaimOn interprets a boolean claim of the UserInfo response.
+func isClaimOn(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return isParameterOn(v)
+	}
+	return false
+}
+
+// connReader is the buffered reader of a connection, a new one is created
+// once the connection is replaced.
+type connReader struct {
+	conn   net.Conn
+	reader *pgwire.Reader
+}
+
+func (c *connReader) of(conn net.Conn) *pgwire.Reader {
+	if c.reader == nil || c.conn != conn {
+		c.conn, c.reader = conn, pgwire.NewReader(conn)
+	}
+	return c.reader
+}
+
+// pendingStatement is a message sent upstream which is answered with a
+// ReadyForQuery, or an audited Execute of the extended query protocol which is
+// answered with a CommandComplete, a PortalSuspended or an error. Only the
+// simple queries and the executes carry an audit event.
+type pendingStatement struct {
+	query   bool
+	execute bool
+	started time.Time
+	event   *AuditEvent
+	span    trace.Span
+}
+
+type pendingStatements struct {
+	mutex      sync.Mutex
+	statements []*pendingStatement
+}
+
+func (p *pendingStatements) push(statement *pendingStatement) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.statements = append(p.statements, statement)
+}
+
+func (p *pendingStatements) head() *pendingStatement {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.statements) == 0 {
+		return nil
+	}
+	return p.statements[0]
+}
+
+// dropExecutes removes the executes at the head, the backend skips them after
+// an error until the Sync.
+func (p *pendingStatements) dropExecutes() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for len(p.statements) > 0 && p.statements[0].execute {
+		p.statements = p.statements[1:]
+	}
+}
+
+func (p *pendingStatements) pop() *pendingStatement {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.statements) == 0 {
+		return nil
+	}
+	statement := p.statements[0]
+	p.statements = p.statements[1:]
+	return statement
+}
@@ -3,6 +3,7 @@ package foodme
 import (
 	"testing"
 
+	"github.com/ryshoooo/food-me/internal/pgwire"
 	"gotest.tools/v3/assert"
 )
 
@@ -24,12 +25,6 @@ func TestCreatePacketSize(t *testing.T) {
 	assert.DeepEqual(t, createPacketSize(16777216+65536+256+1), []byte{1, 1, 1, 1})
 }
 
-func TestCheckAuthenticationSuccess(t *testing.T) {
-	assert.Assert(t, !checkAuthenticationSuccess([]byte{}))
-	assert.Assert(t, !checkAuthenticationSuccess([]byte{1, 2, 3, 4}))
-	assert.Assert(t, checkAuthenticationSuccess([]byte{0, 0, 0, 0}))
-}
-
 func TestGetErrorMessage(t *testing.T) {
 	assert.Equal(t, getErrorMessage([]byte{}), "unknown error")
 	assert.Equal(t, getErrorMessage([]byte{0, 0, 0, 0}), "unknown error")
@@ -49,3 +44,67 @@ func TestIsEscapeSession(t *testing.T) {
 	assert.Assert(t, !isEscapeSession("OK"))
 	assert.Assert(t, !isEscapeSession("ESCAPE NOW!"))
 }
+
+func TestPendingStatements(t *testing.T) {
+	p := &pendingStatements{}
+	assert.Assert(t, p.head() == nil)
+	assert.Assert(t, p.pop() == nil)
+
+	s1 := &pendingStatement{query: true, event: &AuditEvent{SQL: "select 1"}}
+	s2 := &pendingStatement{}
+	p.push(s1)
+	p.push(s2)
+
+	assert.Equal(t, p.head(), s1)
+	assert.Equal(t, p.pop(), s1)
+	assert.Equal(t, p.head(), s2)
+	assert.Equal(t, p.pop(), s2)
+	assert.Assert(t, p.pop() == nil)
+}
+
+func TestParseStartupMessage(t *testing.T) {
+	msg, err := parseStartupMessage([]byte("\x00\x03\x00\x00database\x00pets\x00user\x00bob\x00application_name\x00psql\x00\x00"))
+	assert.NilError(t, err)
+	assert.Equal(t, msg.ProtocolVersion, uint32(pgwire.ProtocolVersion30))
+	assert.Equal(t, msg.Parameters.Get("user"), "bob")
+	assert.Equal(t, msg.Parameters.Get("database"), "pets")
+	assert.Equal(t, msg.Parameters.Get("application_name"), "psql")
+
+	_, err = parseStartupMessage([]byte("\x00\x03\x00\x00user\x00bob"))
+	assert.Error(t, err, "invalid startup packet")
+	_, err = parseStartupMessage([]byte("\x00\x03\x00\x00database\x00pets\x00\x00"))
+	assert.Error(t, err, "no user name specified in startup packet")
+}
+
+func TestIsReadOnlyTransaction(t *testing.T) {
+	assert.Assert(t, isReadOnlyTransaction("BEGIN READ ONLY"))
+	assert.Assert(t, isReadOnlyTransaction("begin transaction isolation level serializable,  read\nonly;"))
+	assert.Assert(t, isReadOnlyTransaction("START TRANSACTION READ ONLY"))
+	assert.Assert(t, !isReadOnlyTransaction("BEGIN"))
+	assert.Assert(t, !isReadOnlyTransaction("BEGIN READ WRITE"))
+	assert.Assert(t, !isReadOnlyTransaction("SELECT 'read only'"))
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	assert.Equal(t, quoteIdentifier("bob"), `"bob"`)
+	assert.Equal(t, quoteIdentifier("Bob.Smith"), `"Bob.Smith"`)
+	assert.Equal(t, quoteIdentifier(`bob"; DROP TABLE x; --`), `"bob""; DROP TABLE x; --"`)
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	assert.Equal(t, quoteLiteral("bob"), `'bob'`)
+	assert.Equal(t, quoteLiteral("o'brien"), `'o''brien'`)
+	assert.Equal(t, quoteLiteral(`a\'b`), `E'a\\''b'`)
+}
+
+func TestIsClaimOn(t *testing.T) {
+	assert.Assert(t, isParameterOn("on"))
+	assert.Assert(t, isParameterOn("TRUE"))
+	assert.Assert(t, !isParameterOn("off"))
+	assert.Assert(t, !isParameterOn(""))
+	assert.Assert(t, isClaimOn(true))
+	assert.Assert(t, isClaimOn("yes"))
+	assert.Assert(t, !isClaimOn(false))
+	assert.Assert(t, !isClaimOn(nil))
+	assert.Assert(t, !isClaimOn(1))
+}
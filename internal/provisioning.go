@@ -0,0 +1,119 @@
+package foodme
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RoleProvisioner creates the roles of the users and syncs their memberships
+// of the group roles mapped from the groups of the users. Only the roles of
+// the mapping are granted and revoked, the other memberships are left alone.
+type RoleProvisioner struct {
+	GroupsClaim string
+	Mapping     map[string][]string
+	CacheTTL    time.Duration
+
+	managed     []string
+	mutex       sync.Mutex
+	provisioned map[string]*provisionedRole
+}
+
+// provisionedRole is a role provisioned on a destination with its group
+// roles, the role is not provisioned again until the cache expires or the
+// group roles change.
+type provisionedRole struct {
+	grants  string
+	expires time.Time
+}
+
+func NewRoleProvisioner(conf *Configuration) (*RoleProvisioner, error) {
+	data, err := os.ReadFile(conf.RoleProvisioningMappingFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read role mapping: %w", err)
+	}
+
+	p := &RoleProvisioner{
+		GroupsClaim: conf.RoleProvisioningGroupsClaim,
+		CacheTTL:    time.Duration(conf.RoleProvisioningCacheTTL) * time.Second,
+		provisioned: map[string]*provisionedRole{},
+	}
+	err = json.Unmarshal(data, &p.Mapping)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse role mapping: %w", err)
+	}
+
+	managed := map[string]bool{}
+	for group, roles := range p.Mapping {
+		for _, role := range roles {
+			if role == "" {
+				return nil, fmt.Errorf("role mapping of the group %s has an empty role", group)
+			}
+			managed[role] = true
+		}
+	}
+	for role := range managed {
+		p.managed = append(p.managed, role)
+	}
+	sort.Strings(p.managed)
+	return p, nil
+}
+
+// Grants returns the group roles of the user, sorted.
+func (p *RoleProvisioner) Grants(userinfo map[string]interface{}) []string {
+	grants := map[string]bool{}
+	for _, group := range claimValues(userinfo[p.GroupsClaim]) {
+		for _, role := range p.Mapping[group] {
+			grants[role] = true
+		}
+	}
+
+	roles := []string{}
+	for role := range grants {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// Statement creates the role unless it exists, grants it the group roles and
+// revokes the rest of the mapped ones.
+func (p *RoleProvisioner) Statement(role string, grants []string) string {
+	create := fmt.Sprintf("BEGIN CREATE ROLE %s NOLOGIN; EXCEPTION WHEN duplicate_object THEN NULL; END", quoteIdentifier(role))
+	statements := []string{"DO " + quoteLiteral(create)}
+	for _, group := range p.managed {
+		if contains(grants, group) {
+			statements = append(statements, fmt.Sprintf("GRANT %s TO %s", quoteIdentifier(group), quoteIdentifier(role)))
+		} else {
+			statements = append(statements, fmt.Sprintf("REVOKE %s FROM %s", quoteIdentifier(group), quoteIdentifier(role)))
+		}
+	}
+	return strings.Join(statements, ";\n")
+}
+
+// Provisioned tells whether the role was provisioned on the destination with
+// the same group roles within the cache TTL.
+func (p *RoleProvisioner) Provisioned(destination, role string, grants []string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	provisioned, ok := p.provisioned[destination+"\x00"+role]
+	return ok && provisioned.grants == strings.Join(grants, "\x00") && time.Now().Before(provisioned.expires)
+}
+
+// Remember caches the provisioned role of the destination and forgets the
+// expired ones, the cache holds only the users seen within the TTL.
+func (p *RoleProvisioner) Remember(destination, role string, grants []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for key, provisioned := range p.provisioned {
+		if !now.Before(provisioned.expires) {
+			delete(p.provisioned, key)
+		}
+	}
+	p.provisioned[destination+"\x00"+role] = &provisionedRole{grants: strings.Join(grants, "\x00"), expires: now.Add(p.CacheTTL)}
+}
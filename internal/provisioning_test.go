@@ -0,0 +1,62 @@
+package foodme
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestNewRoleProvisioner(t *testing.T) {
+	p, err := NewRoleProvisioner(&Configuration{RoleProvisioningMappingFile: "../data/test_role_mapping.json", RoleProvisioningGroupsClaim: "groups", RoleProvisioningCacheTTL: 300})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, p.managed, []string{`audit "readers"`, "dba", "reporting"})
+
+	assert.DeepEqual(t, p.Grants(map[string]interface{}{"groups": []interface{}{"admin", "analyst", "unknown"}}), []string{"dba", "reporting"})
+	assert.DeepEqual(t, p.Grants(map[string]interface{}{"groups": "analyst"}), []string{"reporting"})
+	assert.DeepEqual(t, p.Grants(map[string]interface{}{}), []string{})
+
+	assert.Equal(t, p.Statement("o'brien", []string{"reporting"}), `DO 'BEGIN CREATE ROLE "o''brien" NOLOGIN; EXCEPTION WHEN duplicate_object THEN NULL; END';
+REVOKE "audit ""readers""" FROM "o'brien";
+REVOKE "dba" FROM "o'brien";
+GRANT "reporting" TO "o'brien"`)
+
+	_, err = NewRoleProvisioner(&Configuration{RoleProvisioningMappingFile: "../data/nonexistent.json"})
+	assert.ErrorContains(t, err, "failed to read role mapping")
+
+	file := filepath.Join(t.TempDir(), "mapping.json")
+	for content, expected := range map[string]string{
+		`{"admin": "dba"}`: "failed to parse role mapping",
+		`{"admin": [""]}`:  "role mapping of the group admin has an empty role",
+	} {
+		assert.NilError(t, os.WriteFile(file, []byte(content), 0600))
+		_, err = NewRoleProvisioner(&Configuration{RoleProvisioningMappingFile: file})
+		assert.ErrorContains(t, err, expected)
+	}
+}
+
+func TestRoleProvisionerCache(t *testing.T) {
+	p, err := NewRoleProvisioner(&Configuration{RoleProvisioningMappingFile: "../data/test_role_mapping.json", RoleProvisioningCacheTTL: 300})
+	assert.NilError(t, err)
+
+	assert.Assert(t, !p.Provisioned("db:5432", "alice", []string{"reporting"}))
+	p.Remember("db:5432", "alice", []string{"reporting"})
+	assert.Assert(t, p.Provisioned("db:5432", "alice", []string{"reporting"}))
+
+	// Changed group roles and other destinations are provisioned again
+	assert.Assert(t, !p.Provisioned("db:5432", "alice", []string{"dba", "reporting"}))
+	assert.Assert(t, !p.Provisioned("other:5432", "alice", []string{"reporting"}))
+
+	// So are the expired ones
+	p.CacheTTL = -time.Second
+	p.Remember("db:5432", "bob", nil)
+	assert.Assert(t, !p.Provisioned("db:5432", "bob", nil))
+
+	// The expired roles are forgotten as the others are remembered
+	p.CacheTTL = 300 * time.Second
+	p.Remember("db:5432", "carol", nil)
+	assert.Equal(t, len(p.provisioned), 2)
+	assert.Assert(t, p.provisioned["db:5432\x00bob"] == nil)
+}
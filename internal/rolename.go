@@ -0,0 +1,57 @@
+package foodme
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	AssumeSessionAuthorization = "session-authorization"
+	AssumeSessionRole          = "role"
+
+	// Longest identifier of Postgres, the longer names are truncated
+	maxRoleNameLength = 63
+)
+
+// RoleNameRules turn the username claim into the role of the session. The
+// domain of an email is stripped first, then the name is lowercased and
+// prefixed, and the result has to match the pattern.
+type RoleNameRules struct {
+	Lowercase   bool
+	StripDomain bool
+	Prefix      string
+	Pattern     *regexp.Regexp
+}
+
+func NewRoleNameRules(conf *Configuration) *RoleNameRules {
+	return &RoleNameRules{
+		Lowercase:   conf.OIDCAssumeUserSessionUsernameLowercase,
+		StripDomain: conf.OIDCAssumeUserSessionUsernameStripDomain,
+		Prefix:      conf.OIDCAssumeUserSessionUsernamePrefix,
+		Pattern:     conf.OIDCAssumeUserSessionUsernameRegexp,
+	}
+}
+
+// Apply returns the role of the username, the names which would be truncated
+// or do not match the pattern are rejected.
+func (r *RoleNameRules) Apply(username string) (string, error) {
+	name := username
+	if r.StripDomain {
+		if i := strings.LastIndex(name, "@"); i >= 0 {
+			name = name[:i]
+		}
+	}
+	if r.Lowercase {
+		name = strings.ToLower(name)
+	}
+	name = r.Prefix + name
+
+	if name == "" || len(name) > maxRoleNameLength {
+		return "", fmt.Errorf("role name %q of the username %q must have 1 to %d bytes", name, username, maxRoleNameLength)
+	}
+	if r.Pattern != nil && !r.Pattern.MatchString(name) {
+		return "", fmt.Errorf("role name %q of the username %q does not match the pattern %s", name, username, r.Pattern)
+	}
+	return name, nil
+}
@@ -0,0 +1,33 @@
+package foodme
+
+import (
+	"regexp"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRoleNameRules(t *testing.T) {
+	rules := &RoleNameRules{}
+	name, err := rules.Apply("Bob.Smith@Example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "Bob.Smith@Example.com")
+
+	rules = &RoleNameRules{Lowercase: true, StripDomain: true, Prefix: "app_", Pattern: regexp.MustCompile(`^[a-z_][a-z0-9_.]*$`)}
+	name, err = rules.Apply("Bob.Smith@Example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "app_bob.smith")
+	name, err = rules.Apply("alice")
+	assert.NilError(t, err)
+	assert.Equal(t, name, "app_alice")
+
+	_, err = rules.Apply("bob; DROP TABLE x")
+	assert.Error(t, err, `role name "app_bob; drop table x" of the username "bob; DROP TABLE x" does not match the pattern ^[a-z_][a-z0-9_.]*$`)
+
+	// The names Postgres would truncate are rejected
+	rules = &RoleNameRules{}
+	_, err = rules.Apply("")
+	assert.Error(t, err, `role name "" of the username "" must have 1 to 63 bytes`)
+	_, err = rules.Apply(string(make([]byte, 64)))
+	assert.ErrorContains(t, err, "must have 1 to 63 bytes")
+}
@@ -0,0 +1,113 @@
+package foodme
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"text/template"
+)
+
+// UpstreamRoute is the destination of a session picked from its userinfo.
+// Empty credentials leave the session to the credentials of the database or
+// the configured destination user, an empty database keeps the one requested
+// by the client.
+type UpstreamRoute struct {
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Database string `json:"database"`
+}
+
+// Router maps the value of a userinfo claim to its destination through the
+// routing table, the address template covers the values missing in it. The
+// claims fill the template, so its host has to match the host pattern.
+type Router struct {
+	Claim           string
+	Table           map[string]*UpstreamRoute
+	AddressTemplate *template.Template
+	HostPattern     *regexp.Regexp
+}
+
+func NewRouter(conf *Configuration) (*Router, error) {
+	router := &Router{
+		Claim: conf.RoutingClaim,
+		Table: make(map[string]*UpstreamRoute),
+	}
+
+	if conf.RoutingTableFile != "" {
+		data, err := os.ReadFile(conf.RoutingTableFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read routing table: %w", err)
+		}
+		err = json.Unmarshal(data, &router.Table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse routing table: %w", err)
+		}
+		for value, route := range router.Table {
+			if route == nil || route.Address == "" {
+				return nil, fmt.Errorf("routing table entry has no address: %s", value)
+			}
+		}
+	}
+
+	if conf.RoutingAddressTemplate != "" {
+		tmpl, err := template.New("routing-address").Option("missingkey=error").Parse(conf.RoutingAddressTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse routing address template: %w", err)
+		}
+		router.AddressTemplate = tmpl
+		router.HostPattern = conf.RoutingHostRegexp
+		if router.HostPattern == nil {
+			return nil, fmt.Errorf("routing host pattern is required for the routing address template")
+		}
+	}
+
+	return router, nil
+}
+
+// Route picks the destination of a session.
+func (r *Router) Route(userinfo map[string]interface{}) (*UpstreamRoute, error) {
+	value, ok := userinfo[r.Claim]
+	if !ok {
+		return nil, fmt.Errorf("routing claim not found in userinfo: %v", r.Claim)
+	}
+
+	var route UpstreamRoute
+	if tableRoute, ok := r.Table[fmt.Sprint(value)]; ok {
+		route = *tableRoute
+	} else if r.AddressTemplate != nil {
+		var address bytes.Buffer
+		err := r.AddressTemplate.Execute(&address, userinfo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute routing address template: %w", err)
+		}
+		err = r.checkAddress(address.String())
+		if err != nil {
+			return nil, err
+		}
+		route.Address = address.String()
+	} else {
+		return nil, fmt.Errorf("no route found for %s: %v", r.Claim, value)
+	}
+	return &route, nil
+}
+
+// checkAddress refuses the templated addresses which are not a host and a
+// port or whose host does not match the host pattern.
+func (r *Router) checkAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid routed address %q: %w", address, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid routed address %q: bad port", address)
+	}
+	if !r.HostPattern.MatchString(host) {
+		return fmt.Errorf("routed host %q does not match the routing host pattern", host)
+	}
+	return nil
+}
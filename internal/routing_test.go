@@ -0,0 +1,85 @@
+package foodme
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestNewRouter(t *testing.T) {
+	conf := &Configuration{RoutingClaim: "tenant", RoutingTableFile: "../data/test_routing.json", DestinationUsername: "root", DestinationPassword: "pwd"}
+	router, err := NewRouter(conf)
+	assert.NilError(t, err)
+	assert.Equal(t, router.Claim, "tenant")
+	assert.DeepEqual(t, router.Table, map[string]*UpstreamRoute{
+		"acme":   {Address: "acme-db:5432", Username: "acme", Password: "acme-secret", Database: "app"},
+		"globex": {Address: "globex-db:5432"},
+	})
+	assert.Assert(t, router.AddressTemplate == nil)
+
+	// Bad routing tables
+	dir := t.TempDir()
+	for content, expected := range map[string]string{
+		`{"acme": "acme-db:5432"}`:    "failed to parse routing table",
+		`{"acme": {"database": "x"}}`: "routing table entry has no address: acme",
+	} {
+		conf.RoutingTableFile = filepath.Join(dir, "routing.json")
+		assert.NilError(t, os.WriteFile(conf.RoutingTableFile, []byte(content), 0600))
+		_, err = NewRouter(conf)
+		assert.ErrorContains(t, err, expected)
+	}
+
+	conf.RoutingTableFile = ""
+	conf.RoutingAddressTemplate = "{{ .tenant"
+	_, err = NewRouter(conf)
+	assert.ErrorContains(t, err, "failed to parse routing address template")
+
+	conf.RoutingAddressTemplate = "{{ .tenant }}.db:5432"
+	_, err = NewRouter(conf)
+	assert.Error(t, err, "routing host pattern is required for the routing address template")
+}
+
+func TestRouterRoute(t *testing.T) {
+	router, err := NewRouter(&Configuration{
+		RoutingClaim:           "tenant",
+		RoutingTableFile:       "../data/test_routing.json",
+		RoutingAddressTemplate: "{{ .tenant }}-{{ .region }}.db:5432",
+		RoutingHostRegexp:      regexp.MustCompile(`^(?:[a-z0-9-]+\.db)$`),
+	})
+	assert.NilError(t, err)
+
+	route, err := router.Route(map[string]interface{}{"tenant": "acme"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, route, &UpstreamRoute{Address: "acme-db:5432", Username: "acme", Password: "acme-secret", Database: "app"})
+
+	// The session keeps its credentials without the ones of the route
+	route, err = router.Route(map[string]interface{}{"tenant": "globex"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, route, &UpstreamRoute{Address: "globex-db:5432"})
+
+	// The template covers the rest
+	route, err = router.Route(map[string]interface{}{"tenant": "initech", "region": "eu"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, route, &UpstreamRoute{Address: "initech-eu.db:5432"})
+
+	_, err = router.Route(map[string]interface{}{"tenant": "initech"})
+	assert.ErrorContains(t, err, "failed to execute routing address template")
+
+	// The claims cannot steer the sessions out of the host pattern
+	_, err = router.Route(map[string]interface{}{"tenant": "evil.com:5432/", "region": "eu"})
+	assert.ErrorContains(t, err, "invalid routed address")
+	_, err = router.Route(map[string]interface{}{"tenant": "initech", "region": "eu.db.evil.com:80#"})
+	assert.ErrorContains(t, err, "invalid routed address")
+	_, err = router.Route(map[string]interface{}{"tenant": "attacker.example", "region": "eu"})
+	assert.Error(t, err, `routed host "attacker.example-eu.db" does not match the routing host pattern`)
+
+	_, err = router.Route(map[string]interface{}{"sub": "bob"})
+	assert.Error(t, err, "routing claim not found in userinfo: tenant")
+
+	router.AddressTemplate = nil
+	_, err = router.Route(map[string]interface{}{"tenant": "initech"})
+	assert.Error(t, err, "no route found for tenant: initech")
+}
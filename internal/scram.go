@@ -0,0 +1,130 @@
+package foodme
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/xdg-go/scram"
+)
+
+const (
+	scramSHA256     = "SCRAM-SHA-256"
+	scramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// The channel binding modes follow the channel_binding of libpq.
+const (
+	ChannelBindingDisable = "disable"
+	ChannelBindingPrefer  = "prefer"
+	ChannelBindingRequire = "require"
+)
+
+// tlsServerEndPointBinding returns the tls-server-end-point binding of the
+// connection (RFC 5929), the hash of the server certificate. It is not
+// supported without TLS and for the certificates whose signature names no
+// hash, which Postgres does not bind to either.
+func tlsServerEndPointBinding(conn net.Conn) scram.ChannelBinding {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return scram.ChannelBinding{}
+	}
+	state := tlsConn.ConnectionState()
+	binding, err := scram.NewTLSServerEndpointBinding(&state)
+	if err != nil {
+		return scram.ChannelBinding{}
+	}
+	return binding
+}
+
+// SCRAMSecret is the SCRAM-SHA-256 verifier of a password in the format
+// Postgres keeps in pg_authid: SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>.
+type SCRAMSecret struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+func ParseSCRAMSecret(secret string) (*SCRAMSecret, error) {
+	invalid := fmt.Errorf("invalid SCRAM-SHA-256 secret")
+	mechanism, rest, _ := strings.Cut(secret, "$")
+	parameters, keys, ok := strings.Cut(rest, "$")
+	if mechanism != scramSHA256 || !ok {
+		return nil, invalid
+	}
+	iterations, salt, ok := strings.Cut(parameters, ":")
+	if !ok {
+		return nil, invalid
+	}
+	storedKey, serverKey, ok := strings.Cut(keys, ":")
+	if !ok {
+		return nil, invalid
+	}
+
+	s := &SCRAMSecret{}
+	var err error
+	s.Iterations, err = strconv.Atoi(iterations)
+	if err != nil || s.Iterations < 1 {
+		return nil, invalid
+	}
+	s.Salt, err = base64.StdEncoding.DecodeString(salt)
+	if err != nil || len(s.Salt) == 0 {
+		return nil, invalid
+	}
+	s.StoredKey, err = base64.StdEncoding.DecodeString(storedKey)
+	if err != nil || len(s.StoredKey) != sha256.Size {
+		return nil, invalid
+	}
+	s.ServerKey, err = base64.StdEncoding.DecodeString(serverKey)
+	if err != nil || len(s.ServerKey) != sha256.Size {
+		return nil, invalid
+	}
+	return s, nil
+}
+
+// newSCRAMSecret derives the secret of the password with a random salt.
+func newSCRAMSecret(password string, iterations int) (*SCRAMSecret, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	client, err := scram.SHA256.NewClient("", password, "")
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := client.GetStoredCredentialsWithError(scram.KeyFactors{Salt: string(salt), Iters: iterations})
+	if err != nil {
+		return nil, err
+	}
+	return &SCRAMSecret{Iterations: iterations, Salt: salt, StoredKey: credentials.StoredKey, ServerKey: credentials.ServerKey}, nil
+}
+
+func (s *SCRAMSecret) String() string {
+	return fmt.Sprintf("%s$%d:%s$%s:%s", scramSHA256, s.Iterations, base64.StdEncoding.EncodeToString(s.Salt),
+		base64.StdEncoding.EncodeToString(s.StoredKey), base64.StdEncoding.EncodeToString(s.ServerKey))
+}
+
+// newSCRAMServer starts the server side of a SCRAM-SHA-256 exchange checking
+// the password against its secret. The channel binding is not offered.
+func newSCRAMServer(secret *SCRAMSecret) (*scram.ServerConversation, error) {
+	// As in Postgres, the user is the one of the startup packet and the
+	// username of the exchange is ignored
+	server, err := scram.SHA256.NewServer(func(string) (scram.StoredCredentials, error) {
+		return scram.StoredCredentials{
+			KeyFactors: scram.KeyFactors{Salt: string(secret.Salt), Iters: secret.Iterations},
+			StoredKey:  secret.StoredKey,
+			ServerKey:  secret.ServerKey,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return server.NewConversation(), nil
+}
@@ -0,0 +1,189 @@
+package foodme
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/xdg-go/scram"
+	"gotest.tools/v3/assert"
+)
+
+func TestSCRAMClient(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		hash        scram.HashGeneratorFcn
+		nonce       string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+	}{
+		{
+			name:        "RFC 5802",
+			hash:        scram.SHA1,
+			nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+			serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			name:        "RFC 7677",
+			hash:        scram.SHA256,
+			nonce:       "rOprNGfwEbeRWgbNEkqO",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := tc.hash.NewClient("user", "pencil", "")
+			assert.NilError(t, err)
+			conv := client.WithNonceGenerator(func() string { return tc.nonce }).NewConversation()
+			first, err := conv.Step("")
+			assert.NilError(t, err)
+			assert.Equal(t, first, "n,,n=user,r="+tc.nonce)
+			final, err := conv.Step(tc.serverFirst)
+			assert.NilError(t, err)
+			assert.Equal(t, final, tc.clientFinal)
+			_, err = conv.Step(tc.serverFinal)
+			assert.NilError(t, err)
+			assert.Assert(t, conv.Valid())
+		})
+	}
+
+	// The binding data follows the GS2 header
+	client, err := scram.SHA256.NewClient("user", "pencil", "")
+	assert.NilError(t, err)
+	client = client.WithNonceGenerator(func() string { return "nonce" })
+	conv := client.NewConversationWithChannelBinding(scram.ChannelBinding{Type: scram.ChannelBindingTLSServerEndpoint, Data: []byte{1, 2, 3}})
+	first, err := conv.Step("")
+	assert.NilError(t, err)
+	assert.Equal(t, first, "p=tls-server-end-point,,n=user,r=nonce")
+	final, err := conv.Step("r=nonce+server,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(final, "c="+base64.StdEncoding.EncodeToString([]byte("p=tls-server-end-point,,\x01\x02\x03"))+",r=nonce+server,p="))
+
+	// The binding possible but not offered is still announced
+	conv = client.NewConversationAdvertisingChannelBinding()
+	first, err = conv.Step("")
+	assert.NilError(t, err)
+	assert.Equal(t, first, "y,,n=user,r=nonce")
+}
+
+func TestTLSServerEndPointBinding(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	assert.Assert(t, !tlsServerEndPointBinding(client).IsSupported())
+
+	cert, err := tls.LoadX509KeyPair("../data/cert.pem", "../data/key.pem")
+	assert.NilError(t, err)
+	go func() { _ = tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake() }()
+	conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	assert.NilError(t, conn.Handshake())
+
+	// The certificate is signed with SHA-256
+	hash := sha256.Sum256(cert.Certificate[0])
+	binding := tlsServerEndPointBinding(conn)
+	assert.Equal(t, binding.Type, scram.ChannelBindingTLSServerEndpoint)
+	assert.DeepEqual(t, binding.Data, hash[:])
+}
+
+func TestSCRAMServer(t *testing.T) {
+	secret, err := newSCRAMSecret("pencil", 4096)
+	assert.NilError(t, err)
+	parsed, err := ParseSCRAMSecret(secret.String())
+	assert.NilError(t, err)
+	assert.DeepEqual(t, parsed, secret)
+
+	// The secret of the password of RFC 7677
+	rfc, err := ParseSCRAMSecret("SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=")
+	assert.NilError(t, err)
+
+	for _, tc := range []struct {
+		secret    *SCRAMSecret
+		password  string
+		advertise bool
+		err       string
+	}{
+		{secret: secret, password: "pencil"},
+		{secret: secret, password: "pencil", advertise: true},
+		{secret: rfc, password: "pencil"},
+		{secret: secret, password: "wrong", err: "challenge proof invalid"},
+	} {
+		server, err := newSCRAMServer(tc.secret)
+		assert.NilError(t, err)
+		client, err := scram.SHA256.NewClient("", tc.password, "")
+		assert.NilError(t, err)
+		conv := client.NewConversation()
+		if tc.advertise {
+			conv = client.NewConversationAdvertisingChannelBinding()
+		}
+
+		clientFirst, err := conv.Step("")
+		assert.NilError(t, err)
+		serverFirst, err := server.Step(clientFirst)
+		assert.NilError(t, err)
+		clientFinal, err := conv.Step(serverFirst)
+		assert.NilError(t, err)
+		serverFinal, err := server.Step(clientFinal)
+		if tc.err != "" {
+			assert.Error(t, err, tc.err)
+			continue
+		}
+		assert.NilError(t, err)
+		_, err = conv.Step(serverFinal)
+		assert.NilError(t, err)
+	}
+
+	for clientFirst, message := range map[string]string{
+		"p=tls-server-end-point,,n=,r=nonce": "client requires channel binding but server doesn't support it",
+		"n,,n=":                              "not enough fields",
+	} {
+		server, err := newSCRAMServer(secret)
+		assert.NilError(t, err)
+		_, err = server.Step(clientFirst)
+		assert.ErrorContains(t, err, message)
+	}
+
+	// The handler refuses the authorization identities
+	server, err := newSCRAMServer(secret)
+	assert.NilError(t, err)
+	_, err = server.Step("n,a=admin,n=,r=nonce")
+	assert.NilError(t, err)
+	assert.Equal(t, server.AuthzID(), "admin")
+
+	// The nonce and the GS2 header of the client are kept
+	for clientFinal, message := range map[string]string{
+		"c=biws,r=other,p=":        "nonce received did not match nonce sent",
+		"c=eSws,r=nonce+server,p=": "channel binding mismatch",
+	} {
+		server, err := newSCRAMServer(secret)
+		assert.NilError(t, err)
+		_, err = server.Step("n,,n=,r=nonce")
+		assert.NilError(t, err)
+		_, err = server.Step(clientFinal + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+		assert.ErrorContains(t, err, message)
+	}
+}
+
+func TestParseSCRAMSecret(t *testing.T) {
+	secret, err := ParseSCRAMSecret("SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=")
+	assert.NilError(t, err)
+	assert.Equal(t, secret.Iterations, 4096)
+	assert.Equal(t, len(secret.Salt), 16)
+
+	for _, invalid := range []string{
+		"",
+		"md5c8e0b2b5b7b5e0a2b1e5e1b4e0a2b1e5",
+		"SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==",
+		"SCRAM-SHA-256$0:W22ZaJ0SNY7soEsUEjb6gQ==$WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=",
+		"SCRAM-SHA-256$4096:W22ZaJ0SNY7soEsUEjb6gQ==$AAAA:wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=",
+	} {
+		_, err = ParseSCRAMSecret(invalid)
+		assert.Error(t, err, "invalid SCRAM-SHA-256 secret")
+	}
+}
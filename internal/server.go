@@ -1,9 +1,12 @@
 package foodme
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -11,10 +14,17 @@ import (
 type Server struct {
 	Configuration *Configuration
 	Logger        *logrus.Logger
+	HandlerDeps
+
+	mutex        sync.Mutex
+	listener     net.Listener
+	shuttingDown bool
+	sessions     map[IHandler]net.Conn
+	sessionsWG   sync.WaitGroup
 }
 
 func NewServer(conf *Configuration, logger *logrus.Logger) *Server {
-	return &Server{Configuration: conf, Logger: logger}
+	return &Server{Configuration: conf, Logger: logger, HandlerDeps: HandlerDeps{Cancels: NewCancelRegistry()}}
 }
 
 func (s *Server) Start() error {
@@ -25,25 +35,137 @@ func (s *Server) Start() error {
 	defer listener.Close()
 	s.Logger.Infof("Listening for TCP connections at :%v", s.Configuration.ServerPort)
 	httpClient := &http.Client{}
-	return s.Listen(listener, httpClient)
+
+	if !tlsVerified(s.Configuration.DestinationTLSMode, s.Configuration.DestinationTLSCAFile) {
+		if s.Configuration.DestinationInsecurePasswordAuth {
+			s.Logger.Warnf("Destination TLS mode %s does not verify the destination, its cleartext and MD5 password requests are answered anyway", s.Configuration.DestinationTLSMode)
+		} else {
+			s.Logger.Warnf("Destination TLS mode %s does not verify the destination, its cleartext and MD5 password requests are refused", s.Configuration.DestinationTLSMode)
+		}
+	}
+
+	if s.Configuration.AuditEnabled {
+		s.Auditor, err = NewAuditor(s.Configuration, s.Logger, httpClient)
+		if err != nil {
+			return err
+		}
+		defer s.Auditor.Close()
+	}
+
+	if s.Upstream == nil {
+		s.Upstream, err = GetUpstreamHandler(s.Configuration, s.Logger)
+		if err != nil {
+			return err
+		}
+	}
+	if cluster, ok := s.Upstream.(*UpstreamCluster); ok {
+		cluster.Start()
+		defer cluster.Close()
+	}
+
+	if s.Certificates == nil && s.Configuration.ServerTLSEnabled {
+		s.Certificates, err = NewCertificateManager(s.Configuration, s.Logger)
+		if err != nil {
+			return err
+		}
+		s.Certificates.Start()
+		defer s.Certificates.Close()
+	}
+
+	if s.Configuration.CertificateAuthEnabled {
+		s.Identities, err = NewCertificateIdentities(s.Configuration)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Configuration.LocalAuth != LocalAuthDisabled {
+		s.Local, err = NewLocalAuthenticator(s.Configuration)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Configuration.DestinationCredentialsProvider != CredentialProviderDisabled {
+		s.Credentials, err = NewCredentialProvider(s.Configuration, s.Logger, httpClient)
+		if err != nil {
+			return err
+		}
+		defer s.Credentials.Close()
+	}
+
+	if s.Configuration.RoleProvisioning {
+		s.Provisioner, err = NewRoleProvisioner(s.Configuration)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Configuration.RoutingEnabled {
+		s.Router, err = NewRouter(s.Configuration)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Configuration.PoolMode != PoolModeDisabled {
+		s.Pool, err = GetUpstreamPool(s.Configuration, s.Logger, s.Upstream)
+		if err != nil {
+			return err
+		}
+		defer s.Pool.Close()
+	}
+
+	err = s.Listen(listener, httpClient)
+
+	// The sessions still record their statements
+	s.sessionsWG.Wait()
+	return err
 }
 
+// Listen accepts the sessions on the listener, the dependencies the sessions
+// share are prepared once before.
 func (s *Server) Listen(listener net.Listener, httpClient IHttpClient) error {
+	s.mutex.Lock()
+	if s.shuttingDown {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.listener = listener
+	s.HTTPClient = httpClient
+	err := s.HandlerDeps.Prepare(s.Configuration)
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.Logger.WithField("component", "server").Info("Stopped accepting connections")
+			return nil
+		}
 		if err != nil {
 			s.Logger.WithField("component", "server").Errorf("Error accepting connection: %v", err)
 			continue
 		}
 
-		handler, err := GetHandler(s.Configuration, s.Logger, httpClient)
+		handler, err := GetHandler(s.Configuration, s.Logger, &s.HandlerDeps)
 		if err != nil {
 			s.Logger.WithField("component", "server").Errorf("Error getting handler: %v", err)
+			conn.Close()
+			continue
+		}
+
+		if !s.addSession(handler, conn) {
+			conn.Close()
 			continue
 		}
 
 		s.Logger.Infof("Accepted connection: %s", conn.RemoteAddr().String())
 		go func() {
+			defer s.removeSession(handler)
+			defer conn.Close()
 			err := handler.Handle(conn)
 			if err != nil {
 				s.Logger.WithField("component", "server").Errorf("Error handling connection: %v", err)
@@ -51,3 +173,75 @@ func (s *Server) Listen(listener net.Listener, httpClient IHttpClient) error {
 		}()
 	}
 }
+
+// Shutdown stops accepting new connections and lets the sessions finish
+// their transactions. The sessions still running once the context is done
+// are terminated.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shuttingDown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	sessions := s.activeSessions()
+	s.mutex.Unlock()
+
+	s.Logger.WithField("component", "server").Infof("Draining %d sessions", len(sessions))
+	for handler := range sessions {
+		handler.Drain()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	sessions = s.activeSessions()
+	s.mutex.Unlock()
+
+	s.Logger.WithField("component", "server").Warnf("Terminating %d sessions after the shutdown timeout", len(sessions))
+	for handler, conn := range sessions {
+		// Sessions still authenticating are not terminated by the handler
+		handler.Terminate()
+		conn.Close()
+	}
+	<-done
+	return ctx.Err()
+}
+
+func (s *Server) addSession(handler IHandler, conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[IHandler]net.Conn)
+	}
+	s.sessions[handler] = conn
+	s.sessionsWG.Add(1)
+	return true
+}
+
+func (s *Server) removeSession(handler IHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, handler)
+	s.sessionsWG.Done()
+}
+
+func (s *Server) activeSessions() map[IHandler]net.Conn {
+	sessions := make(map[IHandler]net.Conn, len(s.sessions))
+	for handler, conn := range s.sessions {
+		sessions[handler] = conn
+	}
+	return sessions
+}
@@ -1,8 +1,24 @@
 package foodme
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/ryshoooo/food-me/internal/pgwire"
+	"github.com/sirupsen/logrus"
+	"github.com/xdg-go/scram"
 	"gotest.tools/v3/assert"
 )
 
@@ -11,3 +27,1386 @@ func TestNewServer(t *testing.T) {
 	assert.Assert(t, server.Configuration == nil)
 	assert.Assert(t, server.Logger == nil)
 }
+
+func startTestServer(t *testing.T) (*Server, string, chan error) {
+	conf := &Configuration{DestinationHost: "127.0.0.1", DestinationPort: startFakePostgres(t), DestinationDatabaseType: "postgres"}
+	server := NewServer(conf, logrus.StandardLogger())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Listen(listener, &MockHttpClient{}) }()
+	return server, listener.Addr().String(), stopped
+}
+
+func connectTestClient(t *testing.T, address string) net.Conn {
+	return connectTestClientAs(t, address, "bob")
+}
+
+func connectTestClientAs(t *testing.T, address string, user string) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	sendTestStartup(t, conn, user)
+	return conn
+}
+
+func testStartupPacket(user string) []byte {
+	startup := []byte{0, 3, 0, 0}
+	startup = append(startup, []byte("user\x00"+user+"\x00database\x00pets\x00\x00")...)
+	return append(createPacketSize(len(startup)+4), startup...)
+}
+
+func sendTestStartup(t *testing.T, conn net.Conn, user string) {
+	_, err := conn.Write(testStartupPacket(user))
+	assert.NilError(t, err)
+	assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+}
+
+func sendTestQuery(t *testing.T, conn net.Conn, query string) byte {
+	q := append([]byte(query), 0)
+	_, err := conn.Write(append(append([]byte{'Q'}, createPacketSize(len(q)+4)...), q...))
+	assert.NilError(t, err)
+	return readTestReadyForQuery(t, conn)
+}
+
+func readTestReadyForQuery(t *testing.T, conn net.Conn) byte {
+	for {
+		op, data := readTestMessage(t, conn)
+		assert.Assert(t, op != 'E', "unexpected error: %s", getErrorMessage(data))
+		if op == 'Z' {
+			return data[0]
+		}
+	}
+}
+
+func readTestMessage(t *testing.T, conn net.Conn) (byte, []byte) {
+	assert.NilError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	msg, err := readFakeMessage(conn, true)
+	assert.NilError(t, err)
+	return msg[0], msg[5:]
+}
+
+func assertAdminShutdown(t *testing.T, conn net.Conn) {
+	op, data := readTestMessage(t, conn)
+	assert.Equal(t, op, byte('E'))
+	assert.Assert(t, bytes.Contains(data, []byte("SFATAL\x00")))
+	assert.Assert(t, bytes.Contains(data, []byte("C57P01\x00")))
+	assert.Equal(t, getErrorMessage(data), "terminating connection due to administrator command")
+
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestServerShutdownIdle(t *testing.T) {
+	server, address, stopped := startTestServer(t)
+	conn := connectTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+
+	err := server.Shutdown(context.Background())
+	assert.NilError(t, err)
+	assert.NilError(t, <-stopped)
+	assertAdminShutdown(t, conn)
+
+	// No new connections are accepted
+	_, err = net.Dial("tcp", address)
+	assert.ErrorContains(t, err, "connection refused")
+}
+
+func TestServerShutdownFinishesTransaction(t *testing.T) {
+	server, address, stopped := startTestServer(t)
+	conn := connectTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "BEGIN"), byte('T'))
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	assert.NilError(t, <-stopped)
+
+	// The transaction carries on
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('T'))
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown finished before the transaction")
+	default:
+	}
+
+	assert.Equal(t, sendTestQuery(t, conn, "COMMIT"), byte('I'))
+	assertAdminShutdown(t, conn)
+	assert.NilError(t, <-shutdown)
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	server, address, stopped := startTestServer(t)
+	conn := connectTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "BEGIN"), byte('T'))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	assert.Equal(t, err, context.DeadlineExceeded)
+	assert.NilError(t, <-stopped)
+	assertAdminShutdown(t, conn)
+}
+
+func startPooledTestServer(t *testing.T, mode string) (string, *atomic.Int32) {
+	logger := logrus.StandardLogger()
+	conf := &Configuration{
+		DestinationHost:                  "127.0.0.1",
+		DestinationPort:                  startFakePostgres(t),
+		DestinationDatabaseType:          "postgres",
+		OIDCEnabled:                      true,
+		OIDCClientID:                     "client",
+		OIDCDatabaseFallBackToBaseClient: true,
+		PoolMode:                         mode,
+		PoolSize:                         1,
+		PoolWaitTimeout:                  1,
+		PoolResetQuery:                   "DISCARD ALL",
+	}
+	server := NewServer(conf, logger)
+	pool, err := GetUpstreamPool(conf, logger, &BasicUpstreamHandler{Address: fmt.Sprintf("127.0.0.1:%d", conf.DestinationPort)})
+	assert.NilError(t, err)
+	dials := &atomic.Int32{}
+	dial := pool.Dial
+	pool.Dial = func(key PoolKey) (*PooledConn, error) {
+		dials.Add(1)
+		return dial(key)
+	}
+	server.Pool = pool
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	httpClient := &MockHttpClient{DoSucceed: true, StatusCode: 200, Response: `{"preferred_username":"bob"}`}
+	go server.Listen(listener, httpClient)
+	t.Cleanup(func() {
+		server.Shutdown(context.Background())
+		pool.Close()
+	})
+	return listener.Addr().String(), dials
+}
+
+func connectOIDCTestClient(t *testing.T, address string) net.Conn {
+	token := createToken(t, map[string]interface{}{"azp": "client", "exp": time.Now().Add(time.Hour).Unix()})
+	return connectTestClientAs(t, address, "access_token="+token+";refresh_token=refresh")
+}
+
+func closeTestClient(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte{'X', 0, 0, 0, 4})
+	assert.NilError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestServerPoolSession(t *testing.T) {
+	address, dials := startPooledTestServer(t, PoolModeSession)
+
+	conn := connectOIDCTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	closeTestClient(t, conn)
+
+	// The connection is reused once the first client is gone
+	conn = connectOIDCTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	assert.Equal(t, dials.Load(), int32(1))
+
+	// The pool is exhausted while the session lasts
+	waiting, err := net.Dial("tcp", address)
+	assert.NilError(t, err)
+	defer waiting.Close()
+	startup := []byte{0, 3, 0, 0}
+	token := createToken(t, map[string]interface{}{"azp": "client", "exp": time.Now().Add(time.Hour).Unix()})
+	startup = append(startup, []byte("user\x00access_token="+token+";refresh_token=refresh\x00database\x00pets\x00\x00")...)
+	_, err = waiting.Write(append(createPacketSize(len(startup)+4), startup...))
+	assert.NilError(t, err)
+	typ, body := readTestMessage(t, waiting)
+	assert.Equal(t, typ, byte('E'))
+	assert.Assert(t, bytes.Contains(body, []byte("timed out waiting for a connection to database pets")), string(body))
+}
+
+func TestServerPoolTransaction(t *testing.T) {
+	address, dials := startPooledTestServer(t, PoolModeTransaction)
+
+	// Both sessions share the single connection between their transactions
+	first := connectOIDCTestClient(t, address)
+	second := connectOIDCTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, first, "select 1"), byte('I'))
+	assert.Equal(t, sendTestQuery(t, second, "select 1"), byte('I'))
+
+	assert.Equal(t, sendTestQuery(t, first, "BEGIN"), byte('T'))
+	assert.Equal(t, sendTestQuery(t, first, "select 1"), byte('T'))
+	assert.Equal(t, sendTestQuery(t, first, "COMMIT"), byte('I'))
+	assert.Equal(t, sendTestQuery(t, second, "select 1"), byte('I'))
+	assert.Equal(t, dials.Load(), int32(1))
+}
+
+func startClusterTestServer(t *testing.T, conf *Configuration) (string, *atomic.Int32, *atomic.Int32) {
+	logger := logrus.StandardLogger()
+	primaryPort, primary := startCountingFakePostgres(t)
+	replicaPort, replica := startCountingFakePostgres(t)
+	targets := []*UpstreamTarget{
+		{Address: fmt.Sprintf("127.0.0.1:%d", primaryPort), Role: UpstreamRolePrimary},
+		{Address: fmt.Sprintf("127.0.0.1:%d", replicaPort), Role: UpstreamRoleReplica},
+	}
+	check := func(target *UpstreamTarget) (bool, error) { return target.Role == UpstreamRoleReplica, nil }
+
+	conf.DestinationDatabaseType = "postgres"
+	server := NewServer(conf, logger)
+	server.Upstream = NewUpstreamCluster(targets, time.Hour, logger, check)
+	if conf.PoolMode != "" && conf.PoolMode != PoolModeDisabled {
+		pool, err := GetUpstreamPool(conf, logger, server.Upstream)
+		assert.NilError(t, err)
+		server.Pool = pool
+		t.Cleanup(func() { pool.Close() })
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	httpClient := &MockHttpClient{DoSucceed: true, StatusCode: 200, Response: `{"preferred_username":"bob","read_only":true}`}
+	go server.Listen(listener, httpClient)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return listener.Addr().String(), primary, replica
+}
+
+func TestServerReadOnlyRouting(t *testing.T) {
+	address, primary, replica := startClusterTestServer(t, &Configuration{DestinationReadOnlyRouting: true})
+
+	conn := connectTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	assert.Equal(t, primary.Load(), int32(1))
+	assert.Equal(t, replica.Load(), int32(0))
+
+	// The read-only sessions run on the replica
+	conn = connectTestClientAs(t, address, "bob\x00default_transaction_read_only\x00on")
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	assert.Equal(t, primary.Load(), int32(1))
+	assert.Equal(t, replica.Load(), int32(1))
+}
+
+func TestServerReadOnlyClaimRouting(t *testing.T) {
+	address, primary, replica := startClusterTestServer(t, &Configuration{
+		OIDCEnabled:                      true,
+		OIDCClientID:                     "client",
+		OIDCDatabaseFallBackToBaseClient: true,
+		DestinationReadOnlyClaim:         "read_only",
+	})
+
+	conn := connectOIDCTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	assert.Equal(t, primary.Load(), int32(0))
+	assert.Equal(t, replica.Load(), int32(1))
+}
+
+func TestServerReadOnlyTransactionRouting(t *testing.T) {
+	address, primary, replica := startClusterTestServer(t, &Configuration{
+		OIDCEnabled:                      true,
+		OIDCClientID:                     "client",
+		OIDCDatabaseFallBackToBaseClient: true,
+		DestinationReadOnlyRouting:       true,
+		PoolMode:                         PoolModeTransaction,
+		PoolSize:                         1,
+		PoolWaitTimeout:                  1,
+		PoolResetQuery:                   "DISCARD ALL",
+	})
+
+	conn := connectOIDCTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "BEGIN READ ONLY"), byte('T'))
+	assert.Equal(t, sendTestQuery(t, conn, "COMMIT"), byte('I'))
+	assert.Equal(t, replica.Load(), int32(1))
+
+	// The other transactions stay on the primary
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	assert.Equal(t, primary.Load(), int32(1))
+}
+
+func TestServerClaimRouting(t *testing.T) {
+	for _, mode := range []string{PoolModeDisabled, PoolModeSession} {
+		t.Run(mode, func(t *testing.T) {
+			logger := logrus.StandardLogger()
+			defaultPort, defaultConnections := startCountingFakePostgres(t)
+			tenantPort, tenantConnections := startCountingFakePostgres(t)
+			table := filepath.Join(t.TempDir(), "routing.json")
+			err := os.WriteFile(table, []byte(fmt.Sprintf(`{"acme": {"address": "127.0.0.1:%d", "database": "acme"}}`, tenantPort)), 0600)
+			assert.NilError(t, err)
+
+			conf := &Configuration{
+				DestinationHost:                  "127.0.0.1",
+				DestinationPort:                  defaultPort,
+				DestinationDatabaseType:          "postgres",
+				OIDCEnabled:                      true,
+				OIDCClientID:                     "client",
+				OIDCDatabaseFallBackToBaseClient: true,
+				RoutingClaim:                     "tenant",
+				RoutingTableFile:                 table,
+				PoolMode:                         mode,
+				PoolSize:                         1,
+				PoolWaitTimeout:                  1,
+				PoolResetQuery:                   "DISCARD ALL",
+			}
+			server := NewServer(conf, logger)
+			server.Router, err = NewRouter(conf)
+			assert.NilError(t, err)
+			if mode != PoolModeDisabled {
+				server.Pool, err = GetUpstreamPool(conf, logger, &BasicUpstreamHandler{Address: fmt.Sprintf("127.0.0.1:%d", defaultPort)})
+				assert.NilError(t, err)
+				t.Cleanup(func() { server.Pool.Close() })
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NilError(t, err)
+			httpClient := &MockHttpClient{DoSucceed: true, StatusCode: 200, Response: `{"preferred_username":"bob","tenant":"acme"}`}
+			go server.Listen(listener, httpClient)
+			t.Cleanup(func() { server.Shutdown(context.Background()) })
+			address := listener.Addr().String()
+
+			// The OIDC sessions go to the tenant cluster
+			conn := connectOIDCTestClient(t, address)
+			assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+			assert.Equal(t, tenantConnections.Load(), int32(1))
+			assert.Equal(t, defaultConnections.Load(), int32(0))
+
+			// The others to the configured destination
+			conn = connectTestClient(t, address)
+			assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+			assert.Equal(t, tenantConnections.Load(), int32(1))
+			assert.Equal(t, defaultConnections.Load(), int32(1))
+		})
+	}
+}
+
+func startTLSTestServer(t *testing.T, required bool) string {
+	conf := &Configuration{
+		DestinationHost:             "127.0.0.1",
+		DestinationPort:             startFakePostgres(t),
+		DestinationDatabaseType:     "postgres",
+		ServerTLSEnabled:            true,
+		ServerTLSCertificateFile:    "../data/cert.pem",
+		ServerTLSCertificateKeyFile: "../data/key.pem",
+		ServerTLSRequired:           required,
+		ServerTLSCertificates:       []*CertificateSpec{{CertificateFile: "../data/cert.pem", CertificateKeyFile: "../data/key.pem"}},
+		ServerTLSReloadPeriod:       1,
+	}
+	server := NewServer(conf, logrus.StandardLogger())
+	certificates, err := NewCertificateManager(conf, logrus.StandardLogger())
+	assert.NilError(t, err)
+	server.Certificates = certificates
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go server.Listen(listener, &MockHttpClient{})
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return listener.Addr().String()
+}
+
+func TestServerClientTLS(t *testing.T) {
+	address := startTLSTestServer(t, false)
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{postgresALPN}}
+
+	// The client gets TLS even though the destination refuses it
+	conn, err := net.Dial("tcp", address)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+	assert.NilError(t, err)
+	resp := make([]byte, 1)
+	_, err = io.ReadFull(conn, resp)
+	assert.NilError(t, err)
+	assert.Equal(t, resp[0], byte('S'))
+	tlsConn := tls.Client(conn, tlsConf)
+	sendTestStartup(t, tlsConn, "bob")
+	assert.Equal(t, sendTestQuery(t, tlsConn, "select 1"), byte('I'))
+
+	// The GSSAPI encryption requested first is declined
+	conn, err = net.Dial("tcp", address)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 48})
+	assert.NilError(t, err)
+	_, err = io.ReadFull(conn, resp)
+	assert.NilError(t, err)
+	assert.Equal(t, resp[0], byte('N'))
+	_, err = conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+	assert.NilError(t, err)
+	_, err = io.ReadFull(conn, resp)
+	assert.NilError(t, err)
+	assert.Equal(t, resp[0], byte('S'))
+	tlsConn = tls.Client(conn, tlsConf)
+	sendTestStartup(t, tlsConn, "bob")
+	assert.Equal(t, sendTestQuery(t, tlsConn, "select 1"), byte('I'))
+
+	// Plaintext clients are still served
+	conn = connectTestClient(t, address)
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+
+	// Direct TLS
+	direct, err := tls.Dial("tcp", address, tlsConf)
+	assert.NilError(t, err)
+	t.Cleanup(func() { direct.Close() })
+	sendTestStartup(t, direct, "bob")
+	assert.Equal(t, direct.ConnectionState().NegotiatedProtocol, postgresALPN)
+	assert.Equal(t, sendTestQuery(t, direct, "select 1"), byte('I'))
+
+	// Direct TLS without the ALPN protocol
+	direct, err = tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	assert.NilError(t, err)
+	t.Cleanup(func() { direct.Close() })
+	op, data := readTestMessage(t, direct)
+	assert.Equal(t, op, byte('E'))
+	assert.Equal(t, getErrorMessage(data), "direct TLS connection requires the postgresql ALPN protocol")
+}
+
+func TestServerClientTLSRequired(t *testing.T) {
+	address := startTLSTestServer(t, true)
+
+	conn, err := net.Dial("tcp", address)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write(testStartupPacket("bob"))
+	assert.NilError(t, err)
+	op, data := readTestMessage(t, conn)
+	assert.Equal(t, op, byte('E'))
+	assert.Equal(t, getErrorMessage(data), "TLS connection is required")
+
+	direct, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{postgresALPN}})
+	assert.NilError(t, err)
+	t.Cleanup(func() { direct.Close() })
+	sendTestStartup(t, direct, "bob")
+}
+
+func TestServerCertificateAuth(t *testing.T) {
+	logger := logrus.StandardLogger()
+	ca := newTestCertificate(t, "ca", "", nil)
+	server := newTestCertificate(t, "server", "db.example.com", ca)
+	billing := newTestCertificate(t, "billing", "", ca)
+	port, connections := startCountingFakePostgres(t)
+
+	conf := &Configuration{
+		DestinationHost:                    "127.0.0.1",
+		DestinationPort:                    port,
+		DestinationDatabaseType:            "postgres",
+		ServerTLSEnabled:                   true,
+		ServerTLSCertificates:              []*CertificateSpec{{CertificateFile: server.certFile, CertificateKeyFile: server.keyFile}},
+		ServerTLSReloadPeriod:              1,
+		ServerTLSClientAuth:                TLSClientAuthRequest,
+		ServerTLSClientCAFile:              ca.certFile,
+		CertificateAuthEnabled:             true,
+		CertificateAuthIdentitiesFile:      "../data/test_identities.json",
+		OIDCAssumeUserSession:              true,
+		OIDCAssumeUserSessionUsernameClaim: "preferred_username",
+	}
+	s := NewServer(conf, logger)
+	var err error
+	s.Certificates, err = NewCertificateManager(conf, logger)
+	assert.NilError(t, err)
+	s.Identities, err = NewCertificateIdentities(conf)
+	assert.NilError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go s.Listen(listener, &MockHttpClient{})
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+
+	cert, err := tls.LoadX509KeyPair(billing.certFile, billing.keyFile)
+	assert.NilError(t, err)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{postgresALPN}, Certificates: []tls.Certificate{cert}})
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	sendTestStartup(t, conn, "svc_billing")
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	assert.Equal(t, connections.Load(), int32(1))
+}
+
+func TestServerPasswordLogin(t *testing.T) {
+	token := createToken(t, map[string]interface{}{"azp": "client", "exp": time.Now().Add(time.Hour).Unix()})
+	for _, tc := range []struct {
+		mode     string
+		password string
+		status   int
+		err      string
+	}{
+		{mode: PasswordLoginToken, password: token},
+		{mode: PasswordLoginToken, password: "refresh"},
+		{mode: PasswordLoginToken, password: "refresh", status: 400, err: "password authentication failed for user bob"},
+		{mode: PasswordLoginPassword, password: "secret"},
+		{mode: PasswordLoginPassword, password: "wrong", status: 401, err: "password authentication failed for user bob"},
+		{mode: PasswordLoginTokenExchange, password: "other-token"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			conf := &Configuration{
+				DestinationHost:                  "127.0.0.1",
+				DestinationPort:                  startFakePostgres(t),
+				DestinationDatabaseType:          "postgres",
+				OIDCEnabled:                      true,
+				OIDCClientID:                     "client",
+				OIDCDatabaseFallBackToBaseClient: true,
+				OIDCPasswordLogin:                tc.mode,
+			}
+			server := NewServer(conf, logrus.StandardLogger())
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NilError(t, err)
+			// The same response serves the token and the userinfo requests
+			status := tc.status
+			if status == 0 {
+				status = 200
+			}
+			httpClient := &MockHttpClient{DoSucceed: true, StatusCode: status, Response: `{"access_token":"` + token + `","refresh_token":"refresh","preferred_username":"bob"}`}
+			go server.Listen(listener, httpClient)
+			t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			assert.NilError(t, err)
+			t.Cleanup(func() { conn.Close() })
+			_, err = conn.Write(testStartupPacket("bob"))
+			assert.NilError(t, err)
+
+			// AuthenticationCleartextPassword
+			op, data := readTestMessage(t, conn)
+			assert.Equal(t, op, byte('R'))
+			assert.DeepEqual(t, data, []byte{0, 0, 0, 3})
+			password := append([]byte(tc.password), 0)
+			_, err = conn.Write(append(append([]byte{'p'}, createPacketSize(len(password)+4)...), password...))
+			assert.NilError(t, err)
+
+			if tc.err != "" {
+				op, data = readTestMessage(t, conn)
+				assert.Equal(t, op, byte('E'))
+				assert.Equal(t, getErrorMessage(data), tc.err)
+				return
+			}
+			assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+			assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+		})
+	}
+}
+
+func TestServerLocalAuth(t *testing.T) {
+	ldapURL, _ := startFakeLDAP(t, "cn=alice,dc=example,dc=com", "secret")
+	for _, tc := range []struct {
+		name     string
+		mode     string
+		user     string
+		password string
+		err      string
+	}{
+		{name: "scram", mode: LocalAuthFile, user: "alice", password: "secret"},
+		{name: "scram wrong password", mode: LocalAuthFile, user: "alice", password: "wrong", err: "password authentication failed for user alice"},
+		{name: "scram unknown user", mode: LocalAuthFile, user: "mallory", password: "secret", err: "password authentication failed for user mallory"},
+		{name: "ldap", mode: LocalAuthLDAP, user: "alice", password: "secret"},
+		{name: "ldap wrong password", mode: LocalAuthLDAP, user: "alice", password: "wrong", err: "password authentication failed for user alice"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			port, connections := startCountingFakePostgres(t)
+			conf := &Configuration{
+				DestinationHost:                    "127.0.0.1",
+				DestinationPort:                    port,
+				DestinationDatabaseType:            "postgres",
+				DestinationUsername:                "service",
+				LocalAuth:                          tc.mode,
+				LocalAuthUsersFile:                 "../data/test_local_users.json",
+				LocalAuthLDAPURL:                   ldapURL,
+				LocalAuthLDAPPrefix:                "cn=",
+				LocalAuthLDAPSuffix:                ",dc=example,dc=com",
+				OIDCAssumeUserSessionUsernameClaim: "preferred_username",
+			}
+			server := NewServer(conf, logrus.StandardLogger())
+			var err error
+			server.Local, err = NewLocalAuthenticator(conf)
+			assert.NilError(t, err)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NilError(t, err)
+			go server.Listen(listener, &MockHttpClient{})
+			t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			assert.NilError(t, err)
+			t.Cleanup(func() { conn.Close() })
+			_, err = conn.Write(testStartupPacket(tc.user))
+			assert.NilError(t, err)
+
+			if tc.mode == LocalAuthFile {
+				sendTestSCRAMAuth(t, conn, tc.password, tc.err == "")
+			} else {
+				op, data := readTestMessage(t, conn)
+				assert.Equal(t, op, byte('R'))
+				assert.DeepEqual(t, data, []byte{0, 0, 0, 3})
+				_, err = conn.Write(pgwire.Encode(&pgwire.PasswordMessage{Password: tc.password}))
+				assert.NilError(t, err)
+			}
+
+			if tc.err != "" {
+				op, data := readTestMessage(t, conn)
+				assert.Equal(t, op, byte('E'))
+				assert.Equal(t, getErrorMessage(data), tc.err)
+				assert.Equal(t, connections.Load(), int32(0))
+				return
+			}
+			assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+			assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+			assert.Equal(t, connections.Load(), int32(1))
+		})
+	}
+}
+
+// sendTestSCRAMAuth runs the client side of the SCRAM-SHA-256 exchange, the
+// server signature is checked when the exchange succeeds.
+func sendTestSCRAMAuth(t *testing.T, conn net.Conn, password string, succeeds bool) {
+	op, data := readTestMessage(t, conn)
+	assert.Equal(t, op, byte('R'))
+	auth := &pgwire.Authentication{}
+	assert.NilError(t, auth.Decode(data))
+	mechanisms, err := auth.SASLMechanisms()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, mechanisms, []string{scramSHA256})
+
+	client, err := scram.SHA256.NewClient("", password, "")
+	assert.NilError(t, err)
+	conv := client.NewConversation()
+	clientFirst, err := conv.Step("")
+	assert.NilError(t, err)
+	_, err = conn.Write(pgwire.Encode(&pgwire.SASLInitialResponse{Mechanism: scramSHA256, Data: []byte(clientFirst)}))
+	assert.NilError(t, err)
+
+	op, data = readTestMessage(t, conn)
+	assert.Equal(t, op, byte('R'))
+	assert.NilError(t, auth.Decode(data))
+	assert.Equal(t, auth.Type, uint32(pgwire.AuthenticationSASLContinue))
+	clientFinal, err := conv.Step(string(auth.Data))
+	assert.NilError(t, err)
+	_, err = conn.Write(pgwire.Encode(&pgwire.SASLResponse{Data: []byte(clientFinal)}))
+	assert.NilError(t, err)
+
+	// The failures are reported by an error response instead
+	if succeeds {
+		op, data = readTestMessage(t, conn)
+		assert.Equal(t, op, byte('R'))
+		assert.NilError(t, auth.Decode(data))
+		assert.Equal(t, auth.Type, uint32(pgwire.AuthenticationSASLFinal))
+		_, err = conv.Step(string(auth.Data))
+		assert.NilError(t, err)
+	}
+}
+
+func TestServerDestinationCredentials(t *testing.T) {
+	t.Setenv("FOODME_TEST_PETS_PASSWORD", "pets-secret")
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	err := os.WriteFile(file, []byte(`{
+		"databases": {"pets": {"username": "pets_ro", "password_env": "FOODME_TEST_PETS_PASSWORD"}},
+		"roles": {"analyst": {"username": "analyst_svc", "password": "analyst-secret"}}
+	}`), 0600)
+	assert.NilError(t, err)
+
+	conf := &Configuration{
+		DestinationHost:                    "127.0.0.1",
+		DestinationPort:                    startFakePostgres(t),
+		DestinationDatabaseType:            "postgres",
+		DestinationUsername:                "service",
+		DestinationCredentialsProvider:     CredentialProviderFile,
+		DestinationCredentialsFile:         file,
+		DestinationCredentialsClaim:        "roles",
+		DestinationCredentialsReloadPeriod: 1,
+		LocalAuth:                          LocalAuthFile,
+		LocalAuthUsersFile:                 "../data/test_local_users.json",
+		OIDCAssumeUserSessionUsernameClaim: "preferred_username",
+	}
+	server := NewServer(conf, logrus.StandardLogger())
+	server.Local, err = NewLocalAuthenticator(conf)
+	assert.NilError(t, err)
+	store, err := NewCredentialStore(conf, logrus.StandardLogger())
+	assert.NilError(t, err)
+	server.Credentials = store
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go server.Listen(listener, &MockHttpClient{})
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	login := func(user, password string) string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NilError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write(testStartupPacket(user))
+		assert.NilError(t, err)
+		sendTestSCRAMAuth(t, conn, password, true)
+		assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+		return queryTestValue(t, conn, "select current_user")
+	}
+
+	// The roles of the user go before the database
+	assert.Equal(t, login("alice", "secret"), "analyst_svc")
+	assert.Equal(t, login("bob", "pencil"), "pets_ro")
+
+	// The rotated credentials apply to the new sessions
+	err = os.WriteFile(file, []byte(`{"databases": {"pets": {"username": "pets_rw", "password": "rotated"}}}`), 0600)
+	assert.NilError(t, err)
+	store.reloadChanged()
+	assert.Equal(t, login("alice", "secret"), "pets_rw")
+
+	// Without a match, the session logs in as the configured user
+	err = os.WriteFile(file, []byte(`{}`), 0600)
+	assert.NilError(t, err)
+	store.reloadChanged()
+	assert.Equal(t, login("bob", "pencil"), "service")
+}
+
+// queryTestValue runs the query and returns the first value it returned.
+func queryTestValue(t *testing.T, conn net.Conn, query string) string {
+	q := append([]byte(query), 0)
+	_, err := conn.Write(append(append([]byte{'Q'}, createPacketSize(len(q)+4)...), q...))
+	assert.NilError(t, err)
+
+	var value string
+	for {
+		op, data := readTestMessage(t, conn)
+		assert.Assert(t, op != 'E', "unexpected error: %s", getErrorMessage(data))
+		if op == 'D' && value == "" {
+			row := &pgwire.DataRow{}
+			assert.NilError(t, row.Decode(data))
+			value = string(row.Values[0])
+		}
+		if op == 'Z' {
+			return value
+		}
+	}
+}
+
+func TestServerDeviceLogin(t *testing.T) {
+	conf := &Configuration{
+		DestinationHost:                  "127.0.0.1",
+		DestinationPort:                  startFakePostgres(t),
+		DestinationDatabaseType:          "postgres",
+		OIDCEnabled:                      true,
+		OIDCClientID:                     "client",
+		OIDCDatabaseFallBackToBaseClient: true,
+		OIDCDeviceAuthorizationURL:       "http://idp/device/auth",
+		OIDCDeviceLoginUsername:          "device",
+	}
+	server := NewServer(conf, logrus.StandardLogger())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	token := createToken(t, map[string]interface{}{"azp": "client", "exp": time.Now().Add(time.Hour).Unix()})
+	httpClient := &MockSequenceHttpClient{Responses: []*MockHttpClient{
+		{DoSucceed: true, StatusCode: 200, Response: `{"device_code":"device","user_code":"ABCD-EFGH","verification_uri":"http://idp/device","expires_in":60,"interval":1}`},
+		{DoSucceed: true, StatusCode: 200, Response: `{"access_token":"` + token + `","refresh_token":"refresh"}`},
+		{DoSucceed: true, StatusCode: 200, Response: `{"preferred_username":"bob"}`},
+	}}
+	go server.Listen(listener, httpClient)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write(testStartupPacket("device"))
+	assert.NilError(t, err)
+
+	// The notice follows the AuthenticationOk, which is sent only once
+	op, data := readTestMessage(t, conn)
+	assert.Equal(t, op, byte('R'))
+	assert.DeepEqual(t, data, []byte{0, 0, 0, 0})
+	op, data = readTestMessage(t, conn)
+	assert.Equal(t, op, byte('N'))
+	assert.Equal(t, getErrorMessage(data), "To log in, open http://idp/device and enter the code ABCD-EFGH")
+	for op != 'Z' {
+		op, _ = readTestMessage(t, conn)
+		assert.Assert(t, op != 'R')
+	}
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+	assert.Equal(t, httpClient.Requests, 3)
+}
+
+func TestServerDeviceLoginClientLeaves(t *testing.T) {
+	conf := &Configuration{
+		DestinationHost:                  "127.0.0.1",
+		DestinationPort:                  startFakePostgres(t),
+		DestinationDatabaseType:          "postgres",
+		OIDCEnabled:                      true,
+		OIDCClientID:                     "client",
+		OIDCDatabaseFallBackToBaseClient: true,
+		OIDCDeviceAuthorizationURL:       "http://idp/device/auth",
+		OIDCDeviceLoginUsername:          "device",
+	}
+	server := NewServer(conf, logrus.StandardLogger())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	httpClient := &MockSequenceHttpClient{Responses: []*MockHttpClient{
+		{DoSucceed: true, StatusCode: 200, Response: `{"device_code":"device","user_code":"ABCD-EFGH","verification_uri":"http://idp/device","expires_in":600,"interval":60}`},
+	}}
+	go server.Listen(listener, httpClient)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	_, err = conn.Write(testStartupPacket("device"))
+	assert.NilError(t, err)
+	op, _ := readTestMessage(t, conn)
+	assert.Equal(t, op, byte('R'))
+	op, _ = readTestMessage(t, conn)
+	assert.Equal(t, op, byte('N'))
+	conn.Close()
+
+	// The session stops polling, so the shutdown does not wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NilError(t, server.Shutdown(ctx))
+	assert.Equal(t, httpClient.Requests, 1)
+}
+
+func TestServerClientCredentialsLogin(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		audience []string
+		status   int
+		err      string
+	}{
+		{name: "allowed", audience: []string{"pets", "account"}},
+		{name: "other database", audience: []string{"account"}, err: "client batch is not allowed to access the database pets"},
+		{name: "bad secret", status: 401, err: "password authentication failed for user client_id=batch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := &Configuration{
+				DestinationHost:            "127.0.0.1",
+				DestinationPort:            startFakePostgres(t),
+				DestinationDatabaseType:    "postgres",
+				OIDCEnabled:                true,
+				OIDCDatabaseClients:        map[string]*OIDCDatabaseClientSpec{"pets": {ClientID: "pets", ClientSecret: "pets-secret"}},
+				OIDCClientCredentialsLogin: true,
+			}
+			server := NewServer(conf, logrus.StandardLogger())
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NilError(t, err)
+			status := tc.status
+			if status == 0 {
+				status = 200
+			}
+			token := createToken(t, map[string]interface{}{"azp": "batch", "aud": tc.audience, "exp": time.Now().Add(time.Hour).Unix()})
+			httpClient := &MockSequenceHttpClient{Responses: []*MockHttpClient{{DoSucceed: true, StatusCode: status, Response: `{"access_token":"` + token + `"}`}}}
+			go server.Listen(listener, httpClient)
+			t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			assert.NilError(t, err)
+			t.Cleanup(func() { conn.Close() })
+			_, err = conn.Write(testStartupPacket("client_id=batch"))
+			assert.NilError(t, err)
+
+			op, data := readTestMessage(t, conn)
+			assert.Equal(t, op, byte('R'))
+			assert.DeepEqual(t, data, []byte{0, 0, 0, 3})
+			password := append([]byte("batch-secret"), 0)
+			_, err = conn.Write(append(append([]byte{'p'}, createPacketSize(len(password)+4)...), password...))
+			assert.NilError(t, err)
+
+			if tc.err != "" {
+				op, data = readTestMessage(t, conn)
+				assert.Equal(t, op, byte('E'))
+				assert.Equal(t, getErrorMessage(data), tc.err)
+				return
+			}
+			assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+			assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+			// The claims come from the token, the userinfo is not asked
+			assert.Equal(t, httpClient.Requests, 1)
+		})
+	}
+}
+
+// startTestSession logs the client in and returns the backend key it got.
+func startTestSession(t *testing.T, address string, user string) (net.Conn, BackendKey) {
+	conn, err := net.Dial("tcp", address)
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write(testStartupPacket(user))
+	assert.NilError(t, err)
+
+	var key BackendKey
+	for {
+		op, data := readTestMessage(t, conn)
+		assert.Assert(t, op != 'E', "unexpected error: %s", getErrorMessage(data))
+		if op == 'K' {
+			key, _ = parseBackendKey(data)
+		}
+		if op == 'Z' {
+			return conn, key
+		}
+	}
+}
+
+func sendTestCancel(t *testing.T, address string, key BackendKey) {
+	conn, err := net.Dial("tcp", address)
+	assert.NilError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(key.cancelRequest())
+	assert.NilError(t, err)
+	// The proxy closes the connection without an answer
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+}
+
+func TestServerCancelRequest(t *testing.T) {
+	for _, mode := range []string{PoolModeDisabled, PoolModeSession, PoolModeTransaction} {
+		t.Run(mode, func(t *testing.T) {
+			var address string
+			user := "access_token=" + createToken(t, map[string]interface{}{"azp": "client", "exp": time.Now().Add(time.Hour).Unix()}) + ";refresh_token=refresh"
+			if mode == PoolModeDisabled {
+				// The sessions passed through get the key of the proxy too
+				_, address, _ = startTestServer(t)
+				user = "bob"
+			} else {
+				address, _ = startPooledTestServer(t, mode)
+			}
+
+			conn, key := startTestSession(t, address, user)
+			assert.Assert(t, key != BackendKey{})
+
+			// Unknown keys cancel nothing
+			sendTestCancel(t, address, BackendKey{ProcessID: key.ProcessID, SecretKey: key.SecretKey + 1})
+
+			q := append([]byte("select pg_sleep(10)"), 0)
+			_, err := conn.Write(append(append([]byte{'Q'}, createPacketSize(len(q)+4)...), q...))
+			assert.NilError(t, err)
+			// Give the statement time to reach the destination
+			time.Sleep(200 * time.Millisecond)
+			sendTestCancel(t, address, key)
+
+			op, data := readTestMessage(t, conn)
+			assert.Equal(t, op, byte('E'))
+			assert.Equal(t, getErrorMessage(data), "canceling statement due to user request")
+			assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+		})
+	}
+}
+
+// readTestParameters reads the parameters reported to the client until the
+// session is ready.
+func readTestParameters(t *testing.T, conn net.Conn) map[string]string {
+	params := map[string]string{}
+	for {
+		op, data := readTestMessage(t, conn)
+		assert.Assert(t, op != 'E', "unexpected error: %s", getErrorMessage(data))
+		if op == 'S' {
+			status := &pgwire.ParameterStatus{}
+			assert.NilError(t, status.Decode(data))
+			params[status.Name] = status.Value
+		}
+		if op == 'Z' {
+			return params
+		}
+	}
+}
+
+func TestServerStartupParameters(t *testing.T) {
+	for _, mode := range []string{PoolModeDisabled, PoolModeSession} {
+		t.Run(mode, func(t *testing.T) {
+			logger := logrus.StandardLogger()
+			connections, queries := &atomic.Int32{}, &fakeQueries{}
+			port := listenFakePostgres(t, connections, queries)
+			conf := &Configuration{
+				DestinationHost:                  "127.0.0.1",
+				DestinationPort:                  port,
+				DestinationDatabaseType:          "postgres",
+				DestinationUsername:              "foodme",
+				OIDCEnabled:                      true,
+				OIDCClientID:                     "client",
+				OIDCDatabaseFallBackToBaseClient: true,
+				PoolMode:                         mode,
+				PoolSize:                         1,
+				PoolWaitTimeout:                  1,
+				PoolResetQuery:                   "DISCARD ALL",
+				StartupParametersAllowed:         []string{"application_name", "DateStyle"},
+				StartupParametersDenied:          []string{"replication"},
+			}
+			server := NewServer(conf, logger)
+			if mode != PoolModeDisabled {
+				pool, err := GetUpstreamPool(conf, logger, &BasicUpstreamHandler{Address: fmt.Sprintf("127.0.0.1:%d", port)})
+				assert.NilError(t, err)
+				server.Pool = pool
+				t.Cleanup(func() { pool.Close() })
+			}
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NilError(t, err)
+			go server.Listen(listener, &MockHttpClient{DoSucceed: true, StatusCode: 200, Response: `{"preferred_username":"bob"}`})
+			t.Cleanup(func() { server.Shutdown(context.Background()) })
+			address := listener.Addr().String()
+
+			connect := func(params string) net.Conn {
+				conn, err := net.Dial("tcp", address)
+				assert.NilError(t, err)
+				t.Cleanup(func() { conn.Close() })
+				token := createToken(t, map[string]interface{}{"azp": "client", "exp": time.Now().Add(time.Hour).Unix()})
+				startup := []byte{0, 3, 0, 0}
+				startup = append(startup, []byte("database\x00pets\x00user\x00access_token="+token+";refresh_token=refresh\x00"+params+"\x00")...)
+				_, err = conn.Write(append(createPacketSize(len(startup)+4), startup...))
+				assert.NilError(t, err)
+				return conn
+			}
+
+			// Only the allowed parameters reach the destination
+			conn := connect("application_name\x00report\x00datestyle\x00ISO\x00search_path\x00other\x00")
+			assert.DeepEqual(t, readTestParameters(t, conn), map[string]string{"application_name": "report", "datestyle": "ISO"})
+			closeTestClient(t, conn)
+
+			// The pooled sessions share the connection whatever their parameters
+			conn = connect("application_name\x00report\x00datestyle\x00ISO\x00")
+			assert.DeepEqual(t, readTestParameters(t, conn), map[string]string{"application_name": "report", "datestyle": "ISO"})
+			closeTestClient(t, conn)
+			assert.Equal(t, connections.Load(), map[string]int32{PoolModeDisabled: 2, PoolModeSession: 1}[mode])
+			conn = connect("application_name\x00batch\x00")
+			assert.DeepEqual(t, readTestParameters(t, conn), map[string]string{"application_name": "batch"})
+			if mode != PoolModeDisabled {
+				// The parameters are set on the borrowed connection and reset once it is returned
+				assert.DeepEqual(t, queries.List(), []string{
+					`SET "application_name" TO 'report'; SET "datestyle" TO 'ISO'`,
+					"DISCARD ALL",
+					`RESET "application_name"; RESET "datestyle"`,
+					`SET "application_name" TO 'report'; SET "datestyle" TO 'ISO'`,
+					"DISCARD ALL",
+					`RESET "application_name"; RESET "datestyle"`,
+					`SET "application_name" TO 'batch'`,
+				})
+			}
+			closeTestClient(t, conn)
+			assert.Equal(t, connections.Load(), map[string]int32{PoolModeDisabled: 3, PoolModeSession: 1}[mode])
+
+			// The sessions passed through send all of them
+			conn, err = net.Dial("tcp", address)
+			assert.NilError(t, err)
+			defer conn.Close()
+			_, err = conn.Write(testStartupPacket("bob\x00search_path\x00other"))
+			assert.NilError(t, err)
+			assert.DeepEqual(t, readTestParameters(t, conn), map[string]string{"search_path": "other"})
+
+			// The denied ones are rejected
+			conn = connect("replication\x00database\x00")
+			op, data := readTestMessage(t, conn)
+			assert.Equal(t, op, byte('E'))
+			assert.Equal(t, getErrorMessage(data), "startup parameter replication is not allowed")
+		})
+	}
+}
+
+func TestServerNegotiateProtocolVersion(t *testing.T) {
+	_, address, _ := startTestServer(t)
+	startup := func(version []byte, params string) net.Conn {
+		conn, err := net.Dial("tcp", address)
+		assert.NilError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		packet := append(version, []byte("user\x00bob\x00database\x00pets\x00"+params+"\x00")...)
+		_, err = conn.Write(append(createPacketSize(len(packet)+4), packet...))
+		assert.NilError(t, err)
+		return conn
+	}
+
+	// The newer minor version is downgraded, the destination gets 3.0
+	conn := startup([]byte{0, 3, 0, 2}, "")
+	op, data := readTestMessage(t, conn)
+	assert.Equal(t, op, byte('v'))
+	assert.DeepEqual(t, data, []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+
+	// The protocol options are not recognized
+	conn = startup([]byte{0, 3, 0, 0}, "_pq_.test_option\x00on\x00application_name\x00psql\x00")
+	op, data = readTestMessage(t, conn)
+	assert.Equal(t, op, byte('v'))
+	assert.DeepEqual(t, data, append([]byte{0, 0, 0, 0, 0, 0, 0, 1}, []byte("_pq_.test_option\x00")...))
+	assert.DeepEqual(t, readTestParameters(t, conn), map[string]string{"application_name": "psql"})
+
+	// Nothing to negotiate
+	conn = startup([]byte{0, 3, 0, 0}, "")
+	op, _ = readTestMessage(t, conn)
+	assert.Equal(t, op, byte('R'))
+
+	// Other major versions are not supported
+	conn = startup([]byte{0, 2, 0, 0}, "")
+	op, data = readTestMessage(t, conn)
+	assert.Equal(t, op, byte('E'))
+	assert.Equal(t, getErrorMessage(data), "unsupported frontend protocol 2.0: server supports 3.0 to 3.0")
+}
+
+func TestServerMaxMessageSize(t *testing.T) {
+	conf := &Configuration{DestinationHost: "127.0.0.1", DestinationPort: startFakePostgres(t), DestinationDatabaseType: "postgres", MaxMessageSize: 64}
+	server := NewServer(conf, logrus.StandardLogger())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go func() { _ = server.Listen(listener, &MockHttpClient{}) }()
+
+	// The messages within the limit pass
+	conn := connectTestClient(t, listener.Addr().String())
+	assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+
+	// The larger ones close the session before they are read
+	_, err = conn.Write(pgwire.Encode(&pgwire.Query{String: "select '" + strings.Repeat("x", 64) + "'"}))
+	assert.NilError(t, err)
+	op, data := readTestMessage(t, conn)
+	assert.Equal(t, op, byte('E'))
+	assert.Equal(t, getErrorMessage(data), "message too large: message 'Q' of 74 bytes exceeds the limit of 64 bytes")
+	// The unread message resets the connection
+	_, err = conn.Read(make([]byte, 1))
+	assert.Assert(t, err != nil)
+
+	// So do the startup packets over the limit of Postgres
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(createPacketSize(pgwire.MaxStartupPacketSize + 1))
+	assert.NilError(t, err)
+	op, data = readTestMessage(t, conn)
+	assert.Equal(t, op, byte('E'))
+	assert.Equal(t, getErrorMessage(data), "invalid length of startup packet")
+}
+
+func TestServerDestinationCredentialLeases(t *testing.T) {
+	vault := startFakeVault(t, 60)
+	conf := &Configuration{
+		DestinationHost:                    "127.0.0.1",
+		DestinationPort:                    startFakePostgres(t),
+		DestinationDatabaseType:            "postgres",
+		DestinationUsername:                "service",
+		DestinationCredentialsProvider:     CredentialProviderVault,
+		DestinationCredentialsVaultURL:     vault.URL,
+		DestinationCredentialsVaultToken:   "root",
+		DestinationCredentialsVaultMount:   "database",
+		DestinationCredentialsVaultRole:    "{{ .Database }}",
+		DestinationCredentialsTimeout:      5,
+		LocalAuth:                          LocalAuthFile,
+		LocalAuthUsersFile:                 "../data/test_local_users.json",
+		OIDCAssumeUserSessionUsernameClaim: "preferred_username",
+	}
+	server := NewServer(conf, logrus.StandardLogger())
+	var err error
+	server.Local, err = NewLocalAuthenticator(conf)
+	assert.NilError(t, err)
+	server.Credentials, err = NewCredentialProvider(conf, logrus.StandardLogger(), &http.Client{})
+	assert.NilError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go server.Listen(listener, &MockHttpClient{})
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	login := func(user, password string) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NilError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write(testStartupPacket(user))
+		assert.NilError(t, err)
+		sendTestSCRAMAuth(t, conn, password, true)
+		assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+		return conn
+	}
+
+	// Every session gets its own user, revoked once the session ends
+	conn := login("alice", "secret")
+	assert.Equal(t, queryTestValue(t, conn, "select current_user"), "v-pets-1")
+	assert.Equal(t, queryTestValue(t, login("bob", "pencil"), "select current_user"), "v-pets-2")
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(vault.Revoked()) == 0 {
+		assert.Assert(t, time.Now().Before(deadline), "lease was not revoked")
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.DeepEqual(t, vault.Revoked(), []string{"database/creds/pets/1"})
+
+	// The session is drained once the lease cannot be renewed anymore
+	vault.SetDurations(1, 0)
+	conn = login("alice", "secret")
+	assertAdminShutdown(t, conn)
+	assert.DeepEqual(t, vault.Renewed(), []string{"database/creds/pets/3"})
+}
+
+func TestServerRoleProvisioning(t *testing.T) {
+	port, queries := startRecordingFakePostgres(t)
+	conf := &Configuration{
+		DestinationHost:                    "127.0.0.1",
+		DestinationPort:                    port,
+		DestinationDatabaseType:            "postgres",
+		DestinationUsername:                "service",
+		OIDCAssumeUserSession:              true,
+		OIDCAssumeUserSessionUsernameClaim: "preferred_username",
+		RoleProvisioning:                   true,
+		RoleProvisioningGroupsClaim:        "roles",
+		RoleProvisioningMappingFile:        "../data/test_role_mapping.json",
+		RoleProvisioningCacheTTL:           300,
+		LocalAuth:                          LocalAuthFile,
+		LocalAuthUsersFile:                 "../data/test_local_users.json",
+	}
+	server := NewServer(conf, logrus.StandardLogger())
+	var err error
+	server.Local, err = NewLocalAuthenticator(conf)
+	assert.NilError(t, err)
+	server.Provisioner, err = NewRoleProvisioner(conf)
+	assert.NilError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go server.Listen(listener, &MockHttpClient{})
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	login := func(user, password string) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NilError(t, err)
+		defer conn.Close()
+		_, err = conn.Write(testStartupPacket(user))
+		assert.NilError(t, err)
+		sendTestSCRAMAuth(t, conn, password, true)
+		assert.Equal(t, readTestReadyForQuery(t, conn), byte('I'))
+	}
+
+	// The role is created and synced before the session is assumed
+	login("alice", "secret")
+	assert.DeepEqual(t, queries.List(), []string{
+		"BEGIN",
+		`DO 'BEGIN CREATE ROLE "alice" NOLOGIN; EXCEPTION WHEN duplicate_object THEN NULL; END';
+REVOKE "audit ""readers""" FROM "alice";
+REVOKE "dba" FROM "alice";
+GRANT "reporting" TO "alice"`,
+		"END",
+		"BEGIN",
+		`SET SESSION AUTHORIZATION "alice"`,
+		"END",
+	})
+
+	// The provisioned roles are cached
+	login("alice", "secret")
+	assert.Equal(t, len(queries.List()), 9)
+	assert.Equal(t, queries.List()[6], "BEGIN")
+	assert.Equal(t, queries.List()[7], `SET SESSION AUTHORIZATION "alice"`)
+}
+
+func TestServerReplicaRoleProvisioning(t *testing.T) {
+	for _, mode := range []string{PoolModeDisabled, PoolModeSession} {
+		t.Run(mode, func(t *testing.T) {
+			logger := logrus.StandardLogger()
+			primaryQueries, replicaQueries := &fakeQueries{}, &fakeQueries{}
+			primaryPort := listenFakePostgres(t, &atomic.Int32{}, primaryQueries)
+			replicaPort := listenFakePostgres(t, &atomic.Int32{}, replicaQueries)
+			targets := []*UpstreamTarget{
+				{Address: fmt.Sprintf("127.0.0.1:%d", primaryPort), Role: UpstreamRolePrimary},
+				{Address: fmt.Sprintf("127.0.0.1:%d", replicaPort), Role: UpstreamRoleReplica},
+			}
+			check := func(target *UpstreamTarget) (bool, error) { return target.Role == UpstreamRoleReplica, nil }
+
+			conf := &Configuration{
+				DestinationDatabaseType:            "postgres",
+				OIDCEnabled:                        true,
+				OIDCClientID:                       "client",
+				OIDCDatabaseFallBackToBaseClient:   true,
+				OIDCAssumeUserSession:              true,
+				OIDCAssumeUserSessionUsernameClaim: "preferred_username",
+				DestinationReadOnlyClaim:           "read_only",
+				RoleProvisioning:                   true,
+				RoleProvisioningGroupsClaim:        "roles",
+				RoleProvisioningMappingFile:        "../data/test_role_mapping.json",
+				RoleProvisioningCacheTTL:           300,
+				PoolMode:                           mode,
+				PoolSize:                           2,
+				PoolWaitTimeout:                    1,
+				PoolResetQuery:                     "DISCARD ALL",
+			}
+			server := NewServer(conf, logger)
+			server.Upstream = NewUpstreamCluster(targets, time.Hour, logger, check)
+			var err error
+			server.Provisioner, err = NewRoleProvisioner(conf)
+			assert.NilError(t, err)
+			if mode != PoolModeDisabled {
+				server.Pool, err = GetUpstreamPool(conf, logger, server.Upstream)
+				assert.NilError(t, err)
+				t.Cleanup(func() { server.Pool.Close() })
+			}
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NilError(t, err)
+			httpClient := &MockHttpClient{DoSucceed: true, StatusCode: 200, Response: `{"preferred_username":"bob","read_only":true,"roles":["analyst"]}`}
+			go server.Listen(listener, httpClient)
+			t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+			// The first session on the replica provisions the role on the primary
+			conn := connectOIDCTestClient(t, listener.Addr().String())
+			assert.Equal(t, sendTestQuery(t, conn, "select 1"), byte('I'))
+			assert.DeepEqual(t, primaryQueries.List(), []string{
+				"BEGIN",
+				`DO 'BEGIN CREATE ROLE "bob" NOLOGIN; EXCEPTION WHEN duplicate_object THEN NULL; END';
+REVOKE "audit ""readers""" FROM "bob";
+REVOKE "dba" FROM "bob";
+GRANT "reporting" TO "bob"`,
+				"END",
+			})
+			assert.DeepEqual(t, replicaQueries.List(), []string{"BEGIN", `SET SESSION AUTHORIZATION "bob"`, "END", "select 1"})
+		})
+	}
+}
+
+func TestServerAssumeUserSessionRole(t *testing.T) {
+	port, queries := startRecordingFakePostgres(t)
+	conf := &Configuration{
+		DestinationHost:                     "127.0.0.1",
+		DestinationPort:                     port,
+		DestinationDatabaseType:             "postgres",
+		DestinationUsername:                 "service",
+		OIDCAssumeUserSession:               true,
+		OIDCAssumeUserSessionUsernameClaim:  "preferred_username",
+		OIDCAssumeUserSessionMode:           AssumeSessionRole,
+		OIDCAssumeUserSessionUsernamePrefix: "App_",
+		OIDCAssumeUserSessionUsernameRegexp: regexp.MustCompile(`^App_a`),
+		LocalAuth:                           LocalAuthFile,
+		LocalAuthUsersFile:                  "../data/test_local_users.json",
+	}
+	server := NewServer(conf, logrus.StandardLogger())
+	var err error
+	server.Local, err = NewLocalAuthenticator(conf)
+	assert.NilError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go server.Listen(listener, &MockHttpClient{})
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+
+	login := func(user, password string) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.NilError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write(testStartupPacket(user))
+		assert.NilError(t, err)
+		sendTestSCRAMAuth(t, conn, password, true)
+		return conn
+	}
+
+	// The role keeps its case with the quoting
+	assert.Equal(t, readTestReadyForQuery(t, login("alice", "secret")), byte('I'))
+	assert.DeepEqual(t, queries.List(), []string{"BEGIN", `SET ROLE "App_alice"`, "END"})
+
+	// The roles not matching the pattern are never set
+	conn := login("bob", "pencil")
+	for {
+		op, data := readTestMessage(t, conn)
+		if op == 'E' {
+			assert.Equal(t, getErrorMessage(data), `role name "App_bob" of the username "bob" does not match the pattern ^App_a`)
+			break
+		}
+		assert.Assert(t, op != 'Z')
+	}
+	assert.Equal(t, len(queries.List()), 3)
+}
+
+func TestHandlerDepsPrepare(t *testing.T) {
+	logger := logrus.StandardLogger()
+	conf := &Configuration{
+		DestinationHost:         "localhost",
+		DestinationPort:         5432,
+		DestinationDatabaseType: "postgres",
+		TracingEnabled:          true,
+		PermissionAgentEnabled:  true,
+		PermissionAgentType:     "opa",
+	}
+	deps := &HandlerDeps{HTTPClient: &MockHttpClient{}}
+	assert.NilError(t, deps.Prepare(conf))
+	_, traced := deps.HTTPClient.(*TracingHTTPClient)
+	assert.Assert(t, traced)
+
+	// The sessions share the agent and the rules, not the SQL handler
+	first, err := GetHandler(conf, logger, deps)
+	assert.NilError(t, err)
+	second, err := GetHandler(conf, logger, deps)
+	assert.NilError(t, err)
+	firstSQL := first.(*PostgresHandler).SQLHandler.(*PostgresSQLHandler)
+	secondSQL := second.(*PostgresHandler).SQLHandler.(*PostgresSQLHandler)
+	assert.Assert(t, firstSQL != secondSQL)
+	assert.Equal(t, firstSQL.PermissionAgent, deps.PermissionAgent)
+	assert.Equal(t, secondSQL.PermissionAgent, deps.PermissionAgent)
+	assert.Equal(t, first.(*PostgresHandler).RoleNames, second.(*PostgresHandler).RoleNames)
+	assert.Equal(t, first.(*PostgresHandler).HTTPClient, deps.HTTPClient)
+
+	conf.PermissionAgentType = "unknown"
+	err = (&HandlerDeps{}).Prepare(conf)
+	assert.Error(t, err, "failed to create permission agent: unknown permission agent type: unknown")
+}
@@ -0,0 +1,115 @@
+package foodme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+const (
+	// Record type of the TLS handshake, the first byte of a direct TLS connection
+	tlsHandshakeRecord = 0x16
+	// ALPN protocol of the Postgres direct TLS connections
+	postgresALPN = "postgresql"
+)
+
+// The upstream TLS modes follow the sslmode of libpq.
+const (
+	TLSModeDisable    = "disable"
+	TLSModePrefer     = "prefer"
+	TLSModeRequire    = "require"
+	TLSModeVerifyCA   = "verify-ca"
+	TLSModeVerifyFull = "verify-full"
+)
+
+// tlsRequired tells whether the mode refuses the destinations without TLS.
+func tlsRequired(mode string) bool {
+	return mode == TLSModeRequire || mode == TLSModeVerifyCA || mode == TLSModeVerifyFull
+}
+
+// tlsVerified tells whether the mode verifies the certificate of the
+// destination, the require mode does so with a CA bundle.
+func tlsVerified(mode, caFile string) bool {
+	return mode == TLSModeVerifyCA || mode == TLSModeVerifyFull || (mode == TLSModeRequire && caFile != "")
+}
+
+// UpstreamTLSConfig builds the client configuration for a connection to the
+// destination host. As in libpq, the require mode verifies the certificate
+// chain once a CA bundle is given.
+func UpstreamTLSConfig(mode, caFile, certificateFile, certificateKeyFile, host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+
+	if certificateFile != "" {
+		cert, err := tls.LoadX509KeyPair(certificateFile, certificateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load destination TLS certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	var roots *x509.CertPool
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read destination TLS CA file: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in destination TLS CA file: %s", caFile)
+		}
+	}
+
+	if mode == TLSModeRequire && roots != nil {
+		mode = TLSModeVerifyCA
+	}
+
+	switch mode {
+	case TLSModeVerifyFull:
+		config.RootCAs = roots
+	case TLSModeVerifyCA:
+		// The chain is verified without the host name
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("destination presented no certificate")
+			}
+			opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	default:
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
+
+// ServerTLSConfig builds the configuration of the TLS connections from the
+// clients.
+func ServerTLSConfig(certificateFile, certificateKeyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certificateFile, certificateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{postgresALPN}}, nil
+}
+
+// prefixedConn replays the bytes already read from the connection.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
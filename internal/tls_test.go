@@ -0,0 +1,173 @@
+package foodme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+type testCertificate struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCertificate writes a certificate for the host signed by the parent,
+// or a self-signed CA without the parent.
+func newTestCertificate(t *testing.T, name string, host string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if host != "" {
+		template.DNSNames = []string{host}
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+
+	dir := t.TempDir()
+	certificate := &testCertificate{cert: cert, key: key, certFile: filepath.Join(dir, name+".pem"), keyFile: filepath.Join(dir, name+"-key.pem")}
+	assert.NilError(t, os.WriteFile(certificate.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NilError(t, os.WriteFile(certificate.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certificate
+}
+
+// handshakeTestTLS runs the handshake of the client configuration against a
+// server presenting the certificate.
+func handshakeTestTLS(t *testing.T, server *testCertificate, config *tls.Config, clientCAs *x509.CertPool) (*x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(server.certFile, server.keyFile)
+	assert.NilError(t, err)
+	serverConf := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		serverConf.ClientAuth = tls.RequireAndVerifyClientCert
+		serverConf.ClientCAs = clientCAs
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+	peer := make(chan *x509.Certificate, 1)
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			peer <- nil
+			return
+		}
+		defer serverConn.Close()
+		conn := tls.Server(serverConn, serverConf)
+		err = conn.Handshake()
+		if err != nil || len(conn.ConnectionState().PeerCertificates) == 0 {
+			peer <- nil
+			return
+		}
+		peer <- conn.ConnectionState().PeerCertificates[0]
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	defer clientConn.Close()
+	err = tls.Client(clientConn, config).Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return <-peer, nil
+}
+
+func TestTLSVerified(t *testing.T) {
+	assert.Equal(t, tlsVerified(TLSModeDisable, ""), false)
+	assert.Equal(t, tlsVerified(TLSModePrefer, "../data/cert.pem"), false)
+	assert.Equal(t, tlsVerified(TLSModeRequire, ""), false)
+	assert.Equal(t, tlsVerified(TLSModeRequire, "../data/cert.pem"), true)
+	assert.Equal(t, tlsVerified(TLSModeVerifyCA, ""), true)
+	assert.Equal(t, tlsVerified(TLSModeVerifyFull, ""), true)
+}
+
+func TestUpstreamTLSConfigModes(t *testing.T) {
+	ca := newTestCertificate(t, "ca", "", nil)
+	server := newTestCertificate(t, "server", "db.internal", ca)
+	otherCA := newTestCertificate(t, "other-ca", "", nil)
+
+	for _, tc := range []struct {
+		mode   string
+		caFile string
+		host   string
+		err    string
+	}{
+		{mode: TLSModePrefer, host: "db.internal"},
+		{mode: TLSModeRequire, host: "elsewhere"},
+		{mode: TLSModeRequire, caFile: ca.certFile, host: "elsewhere"},
+		{mode: TLSModeRequire, caFile: otherCA.certFile, host: "db.internal", err: "x509: certificate signed by unknown authority"},
+		{mode: TLSModeVerifyCA, caFile: ca.certFile, host: "elsewhere"},
+		{mode: TLSModeVerifyCA, caFile: otherCA.certFile, host: "db.internal", err: "x509: certificate signed by unknown authority"},
+		{mode: TLSModeVerifyFull, caFile: ca.certFile, host: "db.internal"},
+		{mode: TLSModeVerifyFull, caFile: ca.certFile, host: "elsewhere", err: "x509: certificate is valid for db.internal, not elsewhere"},
+		{mode: TLSModeVerifyFull, host: "db.internal", err: "x509: certificate signed by unknown authority"},
+	} {
+		config, err := UpstreamTLSConfig(tc.mode, tc.caFile, "", "", tc.host)
+		assert.NilError(t, err)
+		assert.Equal(t, config.ServerName, tc.host)
+		_, err = handshakeTestTLS(t, server, config, nil)
+		if tc.err == "" {
+			assert.NilError(t, err, tc)
+		} else {
+			assert.ErrorContains(t, err, tc.err, tc)
+		}
+	}
+}
+
+func TestUpstreamTLSConfigClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "ca", "", nil)
+	server := newTestCertificate(t, "server", "db.internal", ca)
+	client := newTestCertificate(t, "foodme", "", ca)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	config, err := UpstreamTLSConfig(TLSModeVerifyFull, ca.certFile, client.certFile, client.keyFile, "db.internal")
+	assert.NilError(t, err)
+	peer, err := handshakeTestTLS(t, server, config, clientCAs)
+	assert.NilError(t, err)
+	assert.Equal(t, peer.Subject.CommonName, "foodme")
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	_, err := UpstreamTLSConfig(TLSModeVerifyFull, "../data/nonexistent.pem", "", "", "db")
+	assert.ErrorContains(t, err, "failed to read destination TLS CA file")
+
+	_, err = UpstreamTLSConfig(TLSModeVerifyFull, "../data/test_sql.sql", "", "", "db")
+	assert.Error(t, err, "no certificates found in destination TLS CA file: ../data/test_sql.sql")
+
+	_, err = UpstreamTLSConfig(TLSModeVerifyFull, "", "../data/cert.pem", "../data/nonexistent.pem", "db")
+	assert.ErrorContains(t, err, "failed to load destination TLS certificate")
+}
@@ -0,0 +1,125 @@
+package foodme
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	traceparentPattern = regexp.MustCompile(`00-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}`)
+	sqlCommentPattern  = regexp.MustCompile(`(?s)/\*.*?\*/`)
+)
+
+// tracer is looked up on each use, the tracers of the global provider
+// stay bound to the first provider ever registered.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/ryshoooo/food-me")
+}
+
+func NewTracerProvider(conf *Configuration) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracehttp.Option{}
+	if conf.TracingOTLPEndpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpoint(conf.TracingOTLPEndpoint))
+	}
+	if conf.TracingOTLPInsecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", conf.TracingServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.TracingSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider, nil
+}
+
+// TracingHTTPClient wraps the HTTP client with a span per request and
+// propagates the trace context via the traceparent header. The parent span
+// is taken from the context of the request.
+type TracingHTTPClient struct {
+	Client IHttpClient
+}
+
+func NewTracingHTTPClient(httpClient IHttpClient) *TracingHTTPClient {
+	return &TracingHTTPClient{Client: httpClient}
+}
+
+func (c *TracingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer().Start(req.Context(), fmt.Sprintf("HTTP %s", req.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+		),
+	)
+	defer span.End()
+
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	return resp, nil
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// contextFromTraceparent returns the context with the remote span found in
+// the value, e.g. an application_name of "psql;00-<trace-id>-<span-id>-01".
+func contextFromTraceparent(ctx context.Context, value string) context.Context {
+	traceparent := traceparentPattern.FindString(value)
+	if traceparent == "" {
+		return ctx
+	}
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// contextFromSQLComment returns the context with the remote span found in a
+// traceparent of a SQL comment, e.g. sqlcommenter's /*traceparent='...'*/.
+func contextFromSQLComment(ctx context.Context, sql string) context.Context {
+	for _, comment := range sqlCommentPattern.FindAllString(sql, -1) {
+		newCtx := contextFromTraceparent(ctx, comment)
+		if newCtx != ctx {
+			return newCtx
+		}
+	}
+	return ctx
+}
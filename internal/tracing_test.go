@@ -0,0 +1,101 @@
+package foodme
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gotest.tools/v3/assert"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func setupTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	return recorder
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	provider, err := NewTracerProvider(&Configuration{TracingOTLPEndpoint: "localhost:4318", TracingOTLPInsecure: true, TracingServiceName: "food-me", TracingSampleRatio: 1})
+	assert.NilError(t, err)
+	assert.Assert(t, provider != nil)
+	assert.NilError(t, provider.Shutdown(context.Background()))
+}
+
+func TestContextFromTraceparent(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, contextFromTraceparent(ctx, ""), ctx)
+	assert.Equal(t, contextFromTraceparent(ctx, "psql"), ctx)
+
+	sc := trace.SpanContextFromContext(contextFromTraceparent(ctx, "psql;"+testTraceparent))
+	assert.Assert(t, sc.IsValid())
+	assert.Assert(t, sc.IsRemote())
+	assert.Equal(t, sc.TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, sc.SpanID().String(), "00f067aa0ba902b7")
+}
+
+func TestContextFromSQLComment(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, contextFromSQLComment(ctx, "select 1"), ctx)
+	assert.Equal(t, contextFromSQLComment(ctx, "select '"+testTraceparent+"'"), ctx)
+	assert.Equal(t, contextFromSQLComment(ctx, "select 1 /* application='app' */"), ctx)
+
+	sc := trace.SpanContextFromContext(contextFromSQLComment(ctx, "select 1 /* application='app' */ /*traceparent='"+testTraceparent+"'*/"))
+	assert.Assert(t, sc.IsValid())
+	assert.Equal(t, sc.TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+}
+
+func TestTracingHTTPClient(t *testing.T) {
+	recorder := setupTestTracing(t)
+	httpClient := &MockHttpClient{DoSucceed: true, StatusCode: 200}
+	client := NewTracingHTTPClient(httpClient)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://opa/v1/compile", nil)
+	assert.NilError(t, err)
+	_, err = client.Do(req)
+	assert.NilError(t, err)
+	parent.End()
+
+	traceparent := httpClient.RequestHeader.Get("traceparent")
+	assert.Assert(t, traceparent != "")
+	assert.Equal(t, traceparent[3:35], parent.SpanContext().TraceID().String())
+
+	spans := recorder.Ended()
+	assert.Equal(t, len(spans), 2)
+	assert.Equal(t, spans[0].Name(), "HTTP POST")
+	assert.Equal(t, spans[0].Parent().SpanID(), parent.SpanContext().SpanID())
+	assert.Equal(t, spans[0].SpanKind(), trace.SpanKindClient)
+
+	// The parent comes with each request, the OIDC client passes it along
+	other, otherParent := otel.Tracer("test").Start(context.Background(), "other")
+	oidcClient := NewOIDCClient(client, "clientId", "clientSecret", "token-url", "userinfo-url", "access-token", "refresh-token")
+	httpClient.Response = `{"sub": "1234"}`
+	_, err = oidcClient.GetUserInfo(other)
+	assert.NilError(t, err)
+	otherParent.End()
+	assert.Equal(t, httpClient.RequestHeader.Get("traceparent")[3:35], otherParent.SpanContext().TraceID().String())
+	assert.Equal(t, recorder.Ended()[2].Parent().SpanID(), otherParent.SpanContext().SpanID())
+	httpClient.Response = ""
+
+	// Failures
+	httpClient.StatusCode = 500
+	_, err = client.Do(req)
+	assert.NilError(t, err)
+	assert.Equal(t, recorder.Ended()[4].Status().Code, codes.Error)
+
+	httpClient.DoSucceed = false
+	_, err = client.Do(req)
+	assert.Error(t, err, "failed to do request")
+	assert.Equal(t, recorder.Ended()[5].Status().Code, codes.Error)
+}
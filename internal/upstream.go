@@ -0,0 +1,251 @@
+package foodme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UpstreamRolePrimary = "primary"
+	UpstreamRoleReplica = "replica"
+)
+
+// UpstreamConn is a connection to a destination host, the host name is kept
+// for the verification of its TLS certificate.
+type UpstreamConn struct {
+	net.Conn
+	Host string
+}
+
+func dialUpstream(address string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return &UpstreamConn{Conn: conn, Host: host}, nil
+}
+
+// upstreamHost returns the host name the connection was dialed with.
+func upstreamHost(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if upstream, ok := conn.(*UpstreamConn); ok {
+		return upstream.Host
+	}
+	return ""
+}
+
+type BasicUpstreamHandler struct {
+	Address string
+}
+
+func (h *BasicUpstreamHandler) Connect() (net.Conn, error) {
+	return dialUpstream(h.Address)
+}
+
+func (h *BasicUpstreamHandler) ConnectReadOnly() (net.Conn, error) {
+	return h.Connect()
+}
+
+// UpstreamTarget is a destination host of a cluster. The configured role is
+// only the initial guess, the checks discover the actual one.
+type UpstreamTarget struct {
+	Address string
+	Role    string
+
+	healthy atomic.Bool
+	primary atomic.Bool
+}
+
+func (t *UpstreamTarget) Healthy() bool {
+	return t.healthy.Load()
+}
+
+func (t *UpstreamTarget) Primary() bool {
+	return t.primary.Load()
+}
+
+func (t *UpstreamTarget) setHealthy(healthy bool) {
+	t.healthy.Store(healthy)
+	upstreamHealthy.WithLabelValues(t.Address).Set(boolToFloat(healthy))
+}
+
+func (t *UpstreamTarget) setPrimary(primary bool) {
+	t.primary.Store(primary)
+	upstreamPrimary.WithLabelValues(t.Address).Set(boolToFloat(primary))
+}
+
+// UpstreamCluster connects to the current primary of several destination
+// hosts, the read-only connections prefer the replicas. The roles are checked
+// periodically, so a promoted replica takes over once the primary is down.
+type UpstreamCluster struct {
+	Targets     []*UpstreamTarget
+	CheckPeriod time.Duration
+	Check       func(target *UpstreamTarget) (inRecovery bool, err error)
+	Logger      *logrus.Logger
+
+	next      atomic.Uint64
+	stop      chan struct{}
+	stopOnce  sync.Once
+	stopped   sync.WaitGroup
+	checkLock sync.Mutex
+}
+
+func NewUpstreamCluster(targets []*UpstreamTarget, checkPeriod time.Duration, logger *logrus.Logger, check func(target *UpstreamTarget) (bool, error)) *UpstreamCluster {
+	for _, target := range targets {
+		target.setHealthy(true)
+		target.setPrimary(target.Role == UpstreamRolePrimary)
+	}
+	return &UpstreamCluster{
+		Targets:     targets,
+		CheckPeriod: checkPeriod,
+		Check:       check,
+		Logger:      logger,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start checks the targets once and keeps checking them in the background
+// until the cluster is closed.
+func (c *UpstreamCluster) Start() {
+	c.CheckTargets()
+
+	c.stopped.Add(1)
+	go func() {
+		defer c.stopped.Done()
+		ticker := time.NewTicker(c.CheckPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.CheckTargets()
+			}
+		}
+	}()
+}
+
+func (c *UpstreamCluster) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.stopped.Wait()
+	return nil
+}
+
+// CheckTargets updates the health and the role of every target.
+func (c *UpstreamCluster) CheckTargets() {
+	c.checkLock.Lock()
+	defer c.checkLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, target := range c.Targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inRecovery, err := c.Check(target)
+			if err != nil {
+				if target.Healthy() {
+					c.Logger.WithField("component", "upstream").Warnf("Destination %s is down: %v", target.Address, err)
+				}
+				target.setHealthy(false)
+				return
+			}
+
+			if !target.Healthy() {
+				c.Logger.WithField("component", "upstream").Infof("Destination %s is up", target.Address)
+			}
+			if target.Primary() == inRecovery {
+				c.Logger.WithField("component", "upstream").Infof("Destination %s is now a %s", target.Address, roleName(!inRecovery))
+			}
+			target.setHealthy(true)
+			target.setPrimary(!inRecovery)
+		}()
+	}
+	wg.Wait()
+}
+
+// Connect dials the first available primary. When none of them answers, the
+// roles are checked again in case a replica was promoted in the meantime.
+func (c *UpstreamCluster) Connect() (net.Conn, error) {
+	conn, err := c.dialPrimary()
+	if err == nil {
+		return conn, nil
+	}
+
+	c.Logger.WithField("component", "upstream").Warnf("No primary destination reachable, checking the destination roles: %v", err)
+	c.CheckTargets()
+	return c.dialPrimary()
+}
+
+// ConnectReadOnly dials the available replicas in turns and falls back to
+// the primary.
+func (c *UpstreamCluster) ConnectReadOnly() (net.Conn, error) {
+	replicas := []*UpstreamTarget{}
+	for _, target := range c.Targets {
+		if target.Healthy() && !target.Primary() {
+			replicas = append(replicas, target)
+		}
+	}
+
+	if len(replicas) > 0 {
+		start := int(c.next.Add(1) % uint64(len(replicas)))
+		for idx := range replicas {
+			target := replicas[(start+idx)%len(replicas)]
+			conn, err := c.dial(target)
+			if err == nil {
+				return conn, nil
+			}
+		}
+	}
+
+	c.Logger.WithField("component", "upstream").Debug("No replica destination reachable, falling back to the primary")
+	return c.Connect()
+}
+
+func (c *UpstreamCluster) dialPrimary() (net.Conn, error) {
+	for _, target := range c.Targets {
+		if !target.Healthy() || !target.Primary() {
+			continue
+		}
+		conn, err := c.dial(target)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no primary destination is available")
+}
+
+func (c *UpstreamCluster) dial(target *UpstreamTarget) (net.Conn, error) {
+	conn, err := dialUpstream(target.Address)
+	if err != nil {
+		c.Logger.WithField("component", "upstream").Warnf("Destination %s is down: %v", target.Address, err)
+		target.setHealthy(false)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func roleName(primary bool) string {
+	if primary {
+		return UpstreamRolePrimary
+	}
+	return UpstreamRoleReplica
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,140 @@
+package foodme
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gotest.tools/v3/assert"
+)
+
+func startTestTargets(t *testing.T, roles ...string) []*UpstreamTarget {
+	targets := []*UpstreamTarget{}
+	for _, role := range roles {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NilError(t, err)
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		targets = append(targets, &UpstreamTarget{Address: listener.Addr().String(), Role: role})
+	}
+	return targets
+}
+
+// recoveryCheck reports the roles from the map, the missing targets are down.
+type recoveryCheck struct {
+	mutex      sync.Mutex
+	inRecovery map[string]bool
+}
+
+func (c *recoveryCheck) set(address string, inRecovery bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.inRecovery[address] = inRecovery
+}
+
+func (c *recoveryCheck) remove(address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.inRecovery, address)
+}
+
+func (c *recoveryCheck) check(target *UpstreamTarget) (bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	inRecovery, ok := c.inRecovery[target.Address]
+	if !ok {
+		return false, fmt.Errorf("connection refused")
+	}
+	return inRecovery, nil
+}
+
+func dialedAddress(t *testing.T, conn net.Conn, err error) string {
+	assert.NilError(t, err)
+	defer conn.Close()
+	return conn.RemoteAddr().String()
+}
+
+func TestUpstreamClusterFailover(t *testing.T) {
+	targets := startTestTargets(t, "primary", "replica")
+	check := &recoveryCheck{inRecovery: map[string]bool{targets[0].Address: false, targets[1].Address: true}}
+	cluster := NewUpstreamCluster(targets, time.Hour, logrus.StandardLogger(), check.check)
+
+	conn, err := cluster.Connect()
+	assert.Equal(t, dialedAddress(t, conn, err), targets[0].Address)
+	assert.Assert(t, targets[0].Primary())
+	assert.Assert(t, !targets[1].Primary())
+
+	// The primary goes down and the replica gets promoted
+	check.remove(targets[0].Address)
+	check.set(targets[1].Address, false)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	listener.Close()
+	targets[0].Address = listener.Addr().String()
+
+	conn, err = cluster.Connect()
+	assert.Equal(t, dialedAddress(t, conn, err), targets[1].Address)
+	assert.Assert(t, !targets[0].Healthy())
+	assert.Assert(t, targets[1].Primary())
+
+	// Nothing is left
+	check.remove(targets[1].Address)
+	cluster.CheckTargets()
+	_, err = cluster.Connect()
+	assert.Error(t, err, "no primary destination is available")
+}
+
+func TestUpstreamClusterReadOnly(t *testing.T) {
+	targets := startTestTargets(t, "primary", "replica", "replica")
+	check := &recoveryCheck{inRecovery: map[string]bool{targets[0].Address: false, targets[1].Address: true, targets[2].Address: true}}
+	cluster := NewUpstreamCluster(targets, time.Hour, logrus.StandardLogger(), check.check)
+	cluster.CheckTargets()
+
+	// The replicas take turns
+	dialed := map[string]int{}
+	for range 4 {
+		conn, err := cluster.ConnectReadOnly()
+		dialed[dialedAddress(t, conn, err)]++
+	}
+	assert.DeepEqual(t, dialed, map[string]int{targets[1].Address: 2, targets[2].Address: 2})
+
+	// The primary serves the reads once the replicas are down
+	check.remove(targets[1].Address)
+	check.remove(targets[2].Address)
+	cluster.CheckTargets()
+	conn, err := cluster.ConnectReadOnly()
+	assert.Equal(t, dialedAddress(t, conn, err), targets[0].Address)
+}
+
+func TestUpstreamClusterBackgroundChecks(t *testing.T) {
+	targets := startTestTargets(t, "primary", "replica")
+	check := &recoveryCheck{inRecovery: map[string]bool{targets[0].Address: true, targets[1].Address: false}}
+	cluster := NewUpstreamCluster(targets, 10*time.Millisecond, logrus.StandardLogger(), check.check)
+
+	// The first check runs before the start returns
+	cluster.Start()
+	defer cluster.Close()
+	assert.Assert(t, !targets[0].Primary())
+	assert.Assert(t, targets[1].Primary())
+
+	check.set(targets[0].Address, false)
+	check.set(targets[1].Address, true)
+	deadline := time.Now().Add(time.Second)
+	for !targets[0].Primary() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Assert(t, targets[0].Primary())
+
+	assert.NilError(t, cluster.Close())
+}